@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// activationListeners returns the sockets passed by systemd socket
+// activation (sd_listen_fds), or nil when not started that way. The
+// variables are cleared so child processes don't claim the sockets too.
+func activationListeners() ([]net.Listener, error) {
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return nil, nil
+    }
+
+    count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || count <= 0 {
+        return nil, nil
+    }
+
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+
+    listeners := make([]net.Listener, 0, count)
+    for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+        file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+        listener, err := net.FileListener(file)
+        file.Close()
+        if err != nil {
+            return nil, fmt.Errorf("inherited fd %d is not a listening socket: %w", fd, err)
+        }
+        listeners = append(listeners, listener)
+    }
+
+    return listeners, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// maxBatchSize bounds how many requests one batch may carry
+const maxBatchSize = 1000
+
+// batch runs the requests of a batch envelope, one after another or at once
+// when parallel is set, and answers with their responses in order. A
+// failing request doesn't stop the rest; each response reports its own.
+// Each request counts against its client's rate as if sent alone. One at a
+// time runs under the batch's own in-flight slot and any others take slots
+// of their own, so a parallel batch runs no more at once than the client's
+// in-flight limit.
+func (s *server) batch(ctx context.Context, req protocol.Request) protocol.Response {
+    var p struct {
+        Requests []protocol.Request `json:"requests"`
+        Parallel bool               `json:"parallel"`
+    }
+
+    if err := json.Unmarshal(req.Params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if len(p.Requests) > maxBatchSize {
+        return protocol.ErrorResponse(fmt.Errorf("batch of %d requests exceeds the limit of %d", len(p.Requests), maxBatchSize))
+    }
+
+    // The batch already holds one of the client's in-flight slots, which
+    // its requests take turns to run under
+    own := make(chan struct{}, 1)
+    own <- struct{}{}
+
+    responses := make([]protocol.Response, len(p.Requests))
+    runOne := func(i int) {
+        sub := p.Requests[i]
+        if sub.TraceID == "" {
+            sub.TraceID = req.TraceID
+        }
+        if sub.Priority == "" {
+            sub.Priority = req.Priority
+        }
+
+        var resp protocol.Response
+        if sub.Module == "" {
+            // Session actions and nested batches belong on the connection
+            resp = protocol.ErrorResponse(fmt.Errorf("action not allowed in a batch: %s", sub.Action))
+        } else if limited, err := s.acquireFor(ctx, own); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else {
+            var wait func()
+            resp, wait = s.run(ctx, sub)
+            wait()
+            limited()
+        }
+
+        resp.ID = sub.ID
+        resp.TraceID = sub.TraceID
+        responses[i] = resp
+    }
+
+    if p.Parallel {
+        // The batch's own slot counts towards the client's limit
+        width := len(p.Requests)
+        if max := s.limits.MaxInFlight; max > 0 && max < width {
+            width = max
+        }
+        slots := make(chan struct{}, width)
+
+        var wg sync.WaitGroup
+        for i := range p.Requests {
+            wg.Add(1)
+            slots <- struct{}{}
+            go func(i int) {
+                defer wg.Done()
+                defer func() { <-slots }()
+                runOne(i)
+            }(i)
+        }
+        wg.Wait()
+    } else {
+        for i := range p.Requests {
+            runOne(i)
+        }
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "responses": responses,
+    })
+}
+
+// acquireFor counts a batched request against its client's limiter, if the
+// client has one. It runs under the batch's own slot when that is free, so
+// a client allowed one request at a time can still send batches.
+func (s *server) acquireFor(ctx context.Context, own chan struct{}) (func(), error) {
+    limiter := limiterOf(ctx)
+    if limiter == nil {
+        return func() {}, nil
+    }
+
+    select {
+    case <-own:
+        if err := limiter.Charge(); err != nil {
+            own <- struct{}{}
+            return nil, err
+        }
+        return func() { own <- struct{}{} }, nil
+    default:
+        return limiter.Acquire()
+    }
+}
@@ -0,0 +1,224 @@
+// Command pygen writes the typed Python client for the native actions. It
+// reads the same action tables and params structs describe does, so a
+// renamed field changes the generated signatures instead of going unseen.
+//
+// Run it with go generate from native/go.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/rdawebb/kernel/native/email/imap"
+	"github.com/rdawebb/kernel/native/email/smtp"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// module is one handler's actions with their params schemas
+type module struct {
+    name    string
+    class   string
+    actions []string
+    schemas map[string]any
+}
+
+// pythonKeywords can't be used as argument names, so they get a trailing
+// underscore
+var pythonKeywords = map[string]bool{
+    "False": true, "None": true, "True": true, "and": true, "as": true,
+    "assert": true, "async": true, "await": true, "break": true, "class": true,
+    "continue": true, "def": true, "del": true, "elif": true, "else": true,
+    "except": true, "finally": true, "for": true, "from": true, "global": true,
+    "if": true, "import": true, "in": true, "is": true, "lambda": true,
+    "nonlocal": true, "not": true, "or": true, "pass": true, "raise": true,
+    "return": true, "try": true, "while": true, "with": true, "yield": true,
+}
+
+func main() {
+    out := flag.String("o", "", "file to write (default stdout)")
+    flag.Parse()
+
+    imapHandler := imap.NewHandler()
+    smtpHandler := smtp.NewHandler()
+    modules := []module{
+        {name: "imap", class: "ImapClient", actions: imapHandler.Actions(), schemas: imapHandler.Describe()},
+        {name: "smtp", class: "SmtpClient", actions: smtpHandler.Actions(), schemas: smtpHandler.Describe()},
+    }
+
+    source := generate(modules, protocol.Codes)
+    if *out == "" {
+        os.Stdout.Write(source)
+        return
+    }
+    if err := os.WriteFile(*out, source, 0644); err != nil {
+        log.Fatalf("Failed to write %s: %v", *out, err)
+    }
+}
+
+// generate writes the Python module
+func generate(modules []module, codes map[string]string) []byte {
+    var b bytes.Buffer
+    b.WriteString(`# Code generated by native/go/cmd/pygen; DO NOT EDIT.
+"""Typed client for the native actions, generated from the Go handlers.
+
+Regenerate with ` + "`go generate`" + ` in native/go after changing an action's
+params. Optional params left as None are omitted, so the server applies
+its default.
+"""
+
+from typing import Any, Dict, List, Optional
+
+from src.native_bridge import NativeBridge
+`)
+
+    names := make([]string, 0, len(codes))
+    for code := range codes {
+        names = append(names, code)
+    }
+    sort.Strings(names)
+
+    b.WriteString("\n# What each NativeError.code means\n")
+    b.WriteString("ERROR_CODES: Dict[str, str] = {\n")
+    for _, code := range names {
+        fmt.Fprintf(&b, "    %q: %q,\n", code, codes[code])
+    }
+    b.WriteString("}\n")
+
+    for _, m := range modules {
+        fmt.Fprintf(&b, "\n\nclass %s:\n", m.class)
+        fmt.Fprintf(&b, "    \"\"\"Calls to the native %s module.\"\"\"\n\n", m.name)
+        b.WriteString("    def __init__(self, bridge: NativeBridge):\n")
+        b.WriteString("        self._bridge = bridge\n")
+
+        for _, action := range m.actions {
+            schema, _ := m.schemas[action].(map[string]any)
+            writeMethod(&b, m.name, action, schema)
+        }
+    }
+
+    b.WriteString("\n\nclass NativeClient:\n")
+    b.WriteString("    \"\"\"Typed calls to every native module.\"\"\"\n\n")
+    b.WriteString("    def __init__(self, bridge: NativeBridge):\n")
+    for _, m := range modules {
+        fmt.Fprintf(&b, "        self.%s = %s(bridge)\n", m.name, m.class)
+    }
+
+    return b.Bytes()
+}
+
+// param is one argument of a generated method
+type param struct {
+    field    string // JSON name
+    name     string // Python name
+    typ      string
+    required bool
+}
+
+// writeMethod writes the method for one action
+func writeMethod(b *bytes.Buffer, module, action string, schema map[string]any) {
+    params := paramsOf(schema)
+
+    b.WriteString("\n")
+    if len(params) == 0 {
+        fmt.Fprintf(b, "    async def %s(self) -> Dict[str, Any]:\n", action)
+    } else {
+        fmt.Fprintf(b, "    async def %s(\n        self,\n        *,\n", action)
+        for _, p := range params {
+            if p.required {
+                fmt.Fprintf(b, "        %s: %s,\n", p.name, p.typ)
+            } else {
+                fmt.Fprintf(b, "        %s: Optional[%s] = None,\n", p.name, p.typ)
+            }
+        }
+        b.WriteString("    ) -> Dict[str, Any]:\n")
+    }
+    fmt.Fprintf(b, "        \"\"\"Call %s.%s.\"\"\"\n", module, action)
+
+    b.WriteString("        params: Dict[str, Any] = {")
+    first := true
+    for _, p := range params {
+        if !p.required {
+            continue
+        }
+        if first {
+            b.WriteString("\n")
+            first = false
+        }
+        fmt.Fprintf(b, "            %q: %s,\n", p.field, p.name)
+    }
+    if !first {
+        b.WriteString("        ")
+    }
+    b.WriteString("}\n")
+    for _, p := range params {
+        if p.required {
+            continue
+        }
+        fmt.Fprintf(b, "        if %s is not None:\n", p.name)
+        fmt.Fprintf(b, "            params[%q] = %s\n", p.field, p.name)
+    }
+    fmt.Fprintf(b, "        return await self._bridge.call(%q, %q, params)\n", module, action)
+}
+
+// paramsOf lists an action's params, required ones first, each group in
+// name order
+func paramsOf(schema map[string]any) []param {
+    properties, _ := schema["properties"].(map[string]any)
+    required := map[string]bool{}
+    if names, ok := schema["required"].([]string); ok {
+        for _, name := range names {
+            required[name] = true
+        }
+    }
+
+    params := make([]param, 0, len(properties))
+    for field, prop := range properties {
+        name := field
+        if pythonKeywords[name] {
+            name += "_"
+        }
+        propSchema, _ := prop.(map[string]any)
+        params = append(params, param{
+            field:    field,
+            name:     name,
+            typ:      pythonType(propSchema),
+            required: required[field],
+        })
+    }
+
+    sort.Slice(params, func(i, j int) bool {
+        if params[i].required != params[j].required {
+            return params[i].required
+        }
+        return params[i].field < params[j].field
+    })
+    return params
+}
+
+// pythonType maps a JSON schema to a type annotation
+func pythonType(schema map[string]any) string {
+    switch schema["type"] {
+    case "boolean":
+        return "bool"
+    case "integer":
+        return "int"
+    case "number":
+        return "float"
+    case "string":
+        return "str"
+    case "array":
+        items, _ := schema["items"].(map[string]any)
+        return "List[" + pythonType(items) + "]"
+    case "object":
+        if values, ok := schema["additionalProperties"].(map[string]any); ok {
+            return "Dict[str, " + pythonType(values) + "]"
+        }
+        return "Dict[str, Any]"
+    default:
+        return "Any"
+    }
+}
@@ -0,0 +1,206 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// defaultBadgeInterval is how often registered INBOX counts are refreshed
+const defaultBadgeInterval = time.Minute
+
+// Badge is the INBOX count of one account
+type Badge struct {
+    Unseen    uint32    `json:"unseen"`
+    Messages  uint32    `json:"messages"`
+    UpdatedAt time.Time `json:"updated_at"`
+    Error     string    `json:"error,omitempty"`
+}
+
+// badges keeps INBOX counts of registered handles fresh with STATUS, which
+// is cheap enough to poll and works without selecting the folder
+type badges struct {
+    mu     sync.Mutex
+    counts map[int]*Badge
+    stops  map[int]chan struct{}
+}
+
+// Status issues STATUS for a folder
+func (c *Connection) Status(folder string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    status, err := client.Status(folder, items)
+    if err != nil {
+        return nil, fmt.Errorf("status failed: %w", err)
+    }
+
+    return status, nil
+}
+
+// refreshBadge updates the INBOX count of a registered handle, publishing an
+// event when it changed
+func (h *Handler) refreshBadge(handle int) {
+    h.badges.mu.Lock()
+    _, registered := h.badges.counts[handle]
+    h.badges.mu.Unlock()
+    if !registered {
+        return
+    }
+
+    badge := &Badge{UpdatedAt: time.Now().UTC()}
+
+    conn, err := h.getConnection(handle)
+    if err == nil {
+        var status *imap.MailboxStatus
+        status, err = conn.Status("INBOX", []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+        if err == nil {
+            badge.Unseen = status.Unseen
+            badge.Messages = status.Messages
+        }
+    }
+
+    h.badges.mu.Lock()
+    prev, registered := h.badges.counts[handle]
+    if !registered {
+        h.badges.mu.Unlock()
+        return
+    }
+    if err != nil {
+        // Keep the last known counts so the badge doesn't flicker to zero
+        badge.Unseen = prev.Unseen
+        badge.Messages = prev.Messages
+        badge.Error = err.Error()
+    }
+    h.badges.counts[handle] = badge
+    total := h.totalUnseenLocked()
+    h.badges.mu.Unlock()
+
+    if err == nil && (prev.UpdatedAt.IsZero() || prev.Unseen != badge.Unseen || prev.Messages != badge.Messages) {
+        h.publish("badge.changed", handle, map[string]any{
+            "unseen":       badge.Unseen,
+            "messages":     badge.Messages,
+            "total_unseen": total,
+        })
+    }
+}
+
+func (h *Handler) totalUnseenLocked() uint32 {
+    var total uint32
+    for _, badge := range h.badges.counts {
+        total += badge.Unseen
+    }
+    return total
+}
+
+// stopBadge unregisters a handle from the badge service
+func (h *Handler) stopBadge(handle int) {
+    h.badges.mu.Lock()
+    defer h.badges.mu.Unlock()
+
+    if stop, ok := h.badges.stops[handle]; ok {
+        close(stop)
+    }
+    delete(h.badges.stops, handle)
+    delete(h.badges.counts, handle)
+}
+
+// pollBadge refreshes a handle's badge every interval until stop closes
+func (h *Handler) pollBadge(handle int, interval time.Duration, stop chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            h.refreshBadge(handle)
+        }
+    }
+}
+
+func (h *Handler) handleBadgeRegister(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle          int `json:"handle" validate:"required"`
+        IntervalSeconds int `json:"interval_seconds"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if _, err := h.getConnection(p.Handle); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    interval := defaultBadgeInterval
+    if p.IntervalSeconds > 0 {
+        interval = time.Duration(p.IntervalSeconds) * time.Second
+    }
+
+    // Replacing a registration and starting its ticker happen together, so
+    // concurrent registers can't each leave a ticker running
+    stop := make(chan struct{})
+    h.badges.mu.Lock()
+    if prev, ok := h.badges.stops[p.Handle]; ok {
+        close(prev)
+    }
+    h.badges.counts[p.Handle] = &Badge{}
+    h.badges.stops[p.Handle] = stop
+    go h.pollBadge(p.Handle, interval, stop)
+    h.badges.mu.Unlock()
+
+    h.refreshBadge(p.Handle)
+
+    // Unregistered or closed while the first count was taken
+    h.badges.mu.Lock()
+    current, ok := h.badges.counts[p.Handle]
+    var badge Badge
+    if ok {
+        badge = *current
+    }
+    h.badges.mu.Unlock()
+    if !ok {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidHandle, errors.New("badge unregistered while registering")))
+    }
+
+    return protocol.SuccessResponse(badge)
+}
+
+func (h *Handler) handleBadgeUnregister(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    h.stopBadge(p.Handle)
+    return protocol.SuccessResponse(nil)
+}
+
+func (h *Handler) handleBadgeCounts(ctx context.Context, params json.RawMessage) protocol.Response {
+    h.badges.mu.Lock()
+    defer h.badges.mu.Unlock()
+
+    counts := make(map[int]Badge, len(h.badges.counts))
+    for handle, badge := range h.badges.counts {
+        counts[handle] = *badge
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "handles":      counts,
+        "total_unseen": h.totalUnseenLocked(),
+    })
+}
@@ -0,0 +1,135 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// MIMEPart is a node of a message's MIME tree as BODYSTRUCTURE describes
+// it. Part is the section specifier that fetches the node: "1" or "2.1"
+// for leaf parts, "TEXT" for a multipart message's body and "3.TEXT" for
+// that of an attached message.
+type MIMEPart struct {
+    Part        string     `json:"part"`
+    Type        string     `json:"type"`
+    Size        uint32     `json:"size,omitempty"`     // Encoded size in bytes; not reported for multiparts
+    Lines       uint32     `json:"lines,omitempty"`    // For text parts
+    Encoding    string     `json:"encoding,omitempty"` // Content-Transfer-Encoding, lowercased
+    Charset     string     `json:"charset,omitempty"`
+    Filename    string     `json:"filename,omitempty"`
+    Disposition string     `json:"disposition,omitempty"`
+    ContentID   string     `json:"content_id,omitempty"` // For inline images referenced by cid:
+    Parts       []MIMEPart `json:"parts,omitempty"`
+}
+
+// MessageStructure is a message's MIME tree
+type MessageStructure struct {
+    UID       uint32   `json:"uid"`
+    Size      uint32   `json:"size"`
+    Structure MIMEPart `json:"structure"`
+}
+
+// mimeTree converts a BODYSTRUCTURE into a MIMEPart tree
+func mimeTree(bs *imap.BodyStructure) MIMEPart {
+    if strings.EqualFold(bs.MIMEType, "multipart") {
+        return mimeNode(bs, "TEXT", "")
+    }
+    // A single part message's body is part 1
+    return mimeNode(bs, "1", "")
+}
+
+// mimeNode converts one part. Children of a multipart are numbered after
+// prefix, which for the body of a message is that of the part holding it.
+func mimeNode(bs *imap.BodyStructure, part, prefix string) MIMEPart {
+    node := MIMEPart{
+        Part:        part,
+        Type:        strings.ToLower(bs.MIMEType + "/" + bs.MIMESubType),
+        Disposition: strings.ToLower(bs.Disposition),
+    }
+
+    if strings.EqualFold(bs.MIMEType, "multipart") {
+        for i, child := range bs.Parts {
+            number := strconv.Itoa(i + 1)
+            if prefix != "" {
+                number = prefix + "." + number
+            }
+            node.Parts = append(node.Parts, mimeNode(child, number, number))
+        }
+        return node
+    }
+
+    node.Size = bs.Size
+    node.Lines = bs.Lines
+    node.Encoding = strings.ToLower(bs.Encoding)
+    node.Charset = bs.Params["charset"]
+    node.Filename, _ = bs.Filename()
+    node.ContentID = strings.Trim(bs.Id, "<>")
+
+    // An attached message's body is numbered within its part
+    if inner := bs.BodyStructure; inner != nil && strings.EqualFold(bs.MIMEType, "message") {
+        if strings.EqualFold(inner.MIMEType, "multipart") {
+            node.Parts = []MIMEPart{mimeNode(inner, part+".TEXT", part)}
+        } else {
+            node.Parts = []MIMEPart{mimeNode(inner, part+".1", part)}
+        }
+    }
+
+    return node
+}
+
+// FetchBodyStructure fetches the MIME trees of messages in a folder
+func (c *Connection) FetchBodyStructure(ctx context.Context, folder string, uids []uint32) ([]MessageStructure, error) {
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchBodyStructure}
+    result := make([]MessageStructure, 0, len(uids))
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return fetchWith(client, uids, items, func(msg *imap.Message) {
+            if msg.BodyStructure == nil {
+                return
+            }
+            result = append(result, MessageStructure{
+                UID:       msg.Uid,
+                Size:      msg.Size,
+                Structure: mimeTree(msg.BodyStructure),
+            })
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func (h *Handler) handleFetchBodyStructure(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder" validate:"required"`
+        UIDs   []uint32 `json:"uids" validate:"required,max=500"` // Fetched with a single FETCH
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    messages, err := conn.FetchBodyStructure(ctx, p.Folder, p.UIDs)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "messages": messages,
+    })
+}
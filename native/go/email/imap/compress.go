@@ -0,0 +1,125 @@
+package imap
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+)
+
+// compressConn is the connection a client talks over, which can switch to
+// raw deflate both ways for COMPRESS=DEFLATE (RFC 4978). go-imap's upgrade
+// hook can't be used: its reader goroutine is already waiting on the plain
+// connection when the server's OK arrives, and would be handed the first
+// compressed bytes. Read instead decides once bytes arrive whether to
+// inflate them.
+type compressConn struct {
+    net.Conn
+    on      atomic.Bool
+    inflate io.ReadCloser // Only touched by the client's reader goroutine
+
+    wmu     sync.Mutex
+    deflate *flate.Writer
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+    if c.inflate != nil {
+        return c.inflate.Read(b)
+    }
+    if c.on.Load() {
+        c.inflate = flate.NewReader(c.Conn)
+        return c.inflate.Read(b)
+    }
+
+    n, err := c.Conn.Read(b)
+    if n == 0 || !c.on.Load() {
+        return n, err
+    }
+
+    // Compression began while this read waited, so these bytes are the
+    // start of the compressed stream
+    pending := bytes.NewReader(append([]byte(nil), b[:n]...))
+    c.inflate = flate.NewReader(io.MultiReader(pending, c.Conn))
+    return c.inflate.Read(b)
+}
+
+// Write compresses once compression is on, flushing every write so
+// commands aren't held back
+func (c *compressConn) Write(b []byte) (int, error) {
+    c.wmu.Lock()
+    defer c.wmu.Unlock()
+
+    if c.deflate == nil {
+        return c.Conn.Write(b)
+    }
+    n, err := c.deflate.Write(b)
+    if err != nil {
+        return n, err
+    }
+    return n, c.deflate.Flush()
+}
+
+// start switches both directions to deflate. It must be called after the
+// server's OK and before the next command.
+func (c *compressConn) start() error {
+    w, err := flate.NewWriter(c.Conn, flate.DefaultCompression)
+    if err != nil {
+        return err
+    }
+
+    c.wmu.Lock()
+    c.deflate = w
+    c.wmu.Unlock()
+    c.on.Store(true)
+    return nil
+}
+
+// EnableCompression turns on COMPRESS=DEFLATE if the server supports it,
+// reporting whether the connection is compressed. It is turned on again
+// after a reconnect.
+func (c *Connection) EnableCompression() (bool, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return false, err
+    }
+    defer release()
+
+    c.mu.Lock()
+    c.compress = true
+    wire := c.wire
+    c.mu.Unlock()
+
+    if wire.on.Load() {
+        return true, nil
+    }
+    if ok, _ := client.Support("COMPRESS=DEFLATE"); !ok {
+        return false, nil
+    }
+
+    cmd := &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+    status, err := client.Execute(cmd, nil)
+    if err != nil {
+        return false, fmt.Errorf("compression failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return false, fmt.Errorf("compression failed: %w", err)
+    }
+
+    if err := wire.start(); err != nil {
+        return false, fmt.Errorf("compression failed: %w", err)
+    }
+    return true, nil
+}
+
+// Compressed reports whether the connection is compressed
+func (c *Connection) Compressed() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    return c.wire != nil && c.wire.on.Load()
+}
@@ -1,41 +1,120 @@
 package imap
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/rdawebb/kernel/native/internal/authfail"
+	"github.com/rdawebb/kernel/native/internal/breaker"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/provider"
+	"github.com/rdawebb/kernel/native/internal/trust"
 )
 
 // Connection wraps an IMAP client connection
 type Connection struct {
     mu          sync.RWMutex
+    cmdMu       sync.Mutex // Serialises command sequences on client
     client      *client.Client
     host        string
     port        int
     username    string
+    password    string // The access token for XOAUTH2
+    authType    string
     connectedAt time.Time
+    tlsState    tls.ConnectionState
     closed      bool
+    roles       map[string]string // Detected folder per role
+    roleMoved   func(RoleChange) // Told when a role folder moves
+    selected    string
+    wire        *compressConn // The client's connection
+    compress    bool          // COMPRESS=DEFLATE was asked for
+    hosts       *breaker.Breaker // Backoff state Reconnect goes through
 }
 
-// Connect establishes an IMAP connection
-func Connect(host string, port int, username, password string) (*Connection, error) {
+// logins remembers rejected credentials so they are never retried blindly
+var logins = authfail.NewGuard()
+
+// Connect establishes an IMAP connection, backing off from servers that keep
+// failing according to hosts, which tracks them across connects and
+// reconnects. ctx bounds only the wait for a backoff delay.
+func Connect(ctx context.Context, hosts *breaker.Breaker, host string, port int, username, password, authType string) (*Connection, error) {
+    key := fmt.Sprintf("%s:%d", host, port)
+    account := username + "@" + key
+
+    if prev := logins.Check(account, password); prev != nil {
+        return nil, fmt.Errorf("credentials previously rejected, not retrying: %w", prev)
+    }
+    if err := hosts.Acquire(ctx, key); err != nil {
+        return nil, err
+    }
+
+    conn, err := connect(host, port, username, password, authType)
+
+    var authErr *authfail.Error
+    if errors.As(err, &authErr) {
+        logins.Record(account, password, authErr)
+        // A credential rejection proves the server is up
+        if authErr.Credential() {
+            hosts.Success(key)
+        } else {
+            hosts.Failure(key)
+        }
+        return nil, err
+    }
+
+    if err == nil {
+        logins.Record(account, password, nil)
+    }
+    hosts.Report(key, err)
+    if conn != nil {
+        conn.hosts = hosts
+    }
+    return conn, err
+}
+
+func connect(host string, port int, username, password, authType string) (*Connection, error) {
     addr := fmt.Sprintf("%s:%d", host, port)
     
-    // Connect with TLS
-    c, err := client.DialTLS(addr, &tls.Config{
-        ServerName: host,
-    })
+    // Connect with TLS, dialling directly so the session can be reported
+    tlsConn, err := tls.Dial("tcp", addr, trust.Config(host))
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect: %w", err)
+    }
+    wire := &compressConn{Conn: tlsConn}
+    c, err := client.New(wire)
     if err != nil {
+        tlsConn.Close()
         return nil, fmt.Errorf("failed to connect: %w", err)
     }
 
     // Login
-    if err := c.Login(username, password); err != nil {
+    if authType == AuthXOAuth2 {
+        err = authenticate(c, username, password)
+    } else {
+        err = login(c, username, password)
+    }
+    if err != nil {
         c.Logout()
-        return nil, fmt.Errorf("login failed: %w", err)
+
+        var authErr *authfail.Error
+        if errors.As(err, &authErr) {
+            // A rejected access token says nothing about which kind of
+            // password the provider wants
+            if authType == AuthXOAuth2 {
+                return nil, authErr
+            }
+            return nil, provider.Advise(host, authErr)
+        }
+        return nil, err
     }
 
     return &Connection{
@@ -44,11 +123,149 @@ func Connect(host string, port int, username, password string) (*Connection, err
         host:        host,
         port:        port,
         username:    username,
+        password:    password,
+        authType:    authType,
         connectedAt: time.Now(),
+        tlsState:    tlsConn.ConnectionState(),
+        wire:        wire,
         closed:      false,
+        roles:       make(map[string]string),
     }, nil
 }
 
+// errBusy is returned by Check when another command held the connection
+// for the whole timeout; a connection in use is not known to be dead
+var errBusy = errors.New("connection busy")
+
+// Check sends a NOOP and fails if no reply arrives within timeout. The
+// timeout starts again once the connection is free, and if it never is,
+// Check returns errBusy.
+func (c *Connection) Check(timeout time.Duration) error {
+    acquired := make(chan struct{})
+    done := make(chan error, 1)
+    go func() {
+        client, release, err := c.acquire()
+        close(acquired)
+        if err != nil {
+            done <- err
+            return
+        }
+        defer release()
+        done <- client.Noop()
+    }()
+
+    select {
+    case <-acquired:
+    case <-time.After(timeout):
+        return errBusy
+    }
+
+    select {
+    case err := <-done:
+        return err
+    case <-time.After(timeout):
+        return fmt.Errorf("no response within %s", timeout)
+    }
+}
+
+// Reconnect replaces the underlying client with a fresh login, restoring the
+// previously selected folder
+func (c *Connection) Reconnect() error {
+    fresh, err := Connect(context.Background(), c.hosts, c.host, c.port, c.username, c.password, c.authType)
+    if err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        fresh.Close()
+        return fmt.Errorf("connection closed")
+    }
+    old := c.client
+    c.client = fresh.client
+    c.connectedAt = fresh.connectedAt
+    c.tlsState = fresh.tlsState
+    c.wire = fresh.wire
+    folder := c.selected
+    compress := c.compress
+    c.mu.Unlock()
+
+    // The old connection is presumed dead, so skip the LOGOUT round trip
+    if old != nil {
+        old.Terminate()
+    }
+
+    if compress {
+        if _, err := c.EnableCompression(); err != nil {
+            return err
+        }
+    }
+
+    if folder != "" {
+        if err := c.SelectFolder(folder); err != nil {
+            return fmt.Errorf("failed to reselect %s: %w", folder, err)
+        }
+    }
+
+    return nil
+}
+
+// TLSState returns the TLS session of the current connection
+func (c *Connection) TLSState() tls.ConnectionState {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    return c.tlsState
+}
+
+// login authenticates with LOGIN. It runs the command directly rather than
+// through client.Login so a rejection keeps its response code for
+// classification.
+func login(c *client.Client, username, password string) error {
+    if disabled, _ := c.Support("LOGINDISABLED"); disabled {
+        return fmt.Errorf("login failed: server disallows LOGIN on this connection")
+    }
+
+    status, err := c.Execute(&commands.Login{Username: username, Password: password}, nil)
+    if err != nil {
+        return fmt.Errorf("login failed: %w", err)
+    }
+    if status.Type != imap.StatusRespOk {
+        return authfail.ClassifyIMAP(string(status.Code), status.Info)
+    }
+
+    c.SetState(imap.AuthenticatedState, nil)
+    return refreshCapabilities(c)
+}
+
+// refreshCapabilities asks again after login, as servers usually advertise
+// more capabilities once logged in
+func refreshCapabilities(c *client.Client) error {
+    if _, err := c.Capability(); err != nil {
+        return fmt.Errorf("failed to refresh capabilities: %w", err)
+    }
+    return nil
+}
+
+// acquire reserves the connection for one command sequence. The underlying
+// client is not safe for concurrent use, so callers keep it until release.
+func (c *Connection) acquire() (*client.Client, func(), error) {
+    c.cmdMu.Lock()
+
+    c.mu.RLock()
+    client := c.client
+    closed := c.closed
+    c.mu.RUnlock()
+
+    if closed || client == nil {
+        c.cmdMu.Unlock()
+        return nil, nil, protocol.WithCode(protocol.CodeNotConnected, errors.New("client not connected"))
+    }
+
+    return client, c.cmdMu.Unlock, nil
+}
+
 // Close closes the connection
 func (c *Connection) Close() error {
     c.mu.Lock()
@@ -66,13 +283,11 @@ func (c *Connection) Close() error {
 
 // Noop sends a NOOP to keep connection alive
 func (c *Connection) Noop() error {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return fmt.Errorf("client not connected")
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
     }
-    client := c.client
-    c.mu.RUnlock()
+    defer release()
     return client.Noop()
 }
 
@@ -80,3 +295,48 @@ func (c *Connection) Noop() error {
 func (c *Connection) GetClient() *client.Client {
     return c.client
 }
+
+// Host returns the server host name
+func (c *Connection) Host() string {
+    return c.host
+}
+
+// Username returns the authenticated user name
+func (c *Connection) Username() string {
+    return c.username
+}
+
+// Supports reports whether the server advertises a capability
+func (c *Connection) Supports(capability string) bool {
+    client, release, err := c.acquire()
+    if err != nil {
+        return false
+    }
+    defer release()
+
+    ok, err := client.Support(capability)
+    return err == nil && ok
+}
+
+// Capabilities asks the server for its capabilities, returned sorted
+func (c *Connection) Capabilities() ([]string, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    caps, err := client.Capability()
+    if err != nil {
+        return nil, fmt.Errorf("capability failed: %w", err)
+    }
+
+    names := make([]string, 0, len(caps))
+    for name, ok := range caps {
+        if ok {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
@@ -0,0 +1,265 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// StoreFlags adds or removes flags on several messages in the selected folder
+func (c *Connection) StoreFlags(uids []uint32, flags []string, add bool) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    return storeFlagsWith(client, uids, flags, add)
+}
+
+// storeFlagsWith stores flags over a client the caller already holds
+func storeFlagsWith(client *client.Client, uids []uint32, flags []string, add bool) error {
+    var operation imap.FlagsOp
+    if add {
+        operation = imap.AddFlags
+    } else {
+        operation = imap.RemoveFlags
+    }
+
+    // The writer only formats lists of interface{}, not []string
+    values := make([]interface{}, len(flags))
+    for i, flag := range flags {
+        values[i] = flag
+    }
+
+    item := imap.FormatFlagsOp(operation, true)
+    return client.UidStore(uidSet(uids), item, values, nil)
+}
+
+// moveWith moves messages from the selected folder with MOVE, or with COPY
+// and a UID-scoped expunge where MOVE isn't supported, so other \Deleted
+// messages are left alone
+func moveWith(client *client.Client, uids []uint32, destFolder string) error {
+    if ok, _ := client.Support("MOVE"); ok {
+        return client.UidMove(uidSet(uids), destFolder)
+    }
+    if err := client.UidCopy(uidSet(uids), destFolder); err != nil {
+        return err
+    }
+    return expungeUIDsWith(client, uids)
+}
+
+// isGmail reports whether the server speaks Gmail's IMAP extensions
+func (c *Connection) isGmail() bool {
+    return c.Supports("X-GM-EXT-1")
+}
+
+// ResolveThread finds the UIDs of a conversation's messages per folder. On
+// Gmail a numeric thread ID is matched with X-GM-THRID; otherwise the ID is
+// the root Message-ID and members are found through Message-ID, References
+// and In-Reply-To.
+func (c *Connection) ResolveThread(ctx context.Context, threadID string, folders []string) (map[string][]uint32, error) {
+    gmailThread := c.isGmail() && isDigits(threadID)
+
+    messageID := threadID
+    if !gmailThread && !strings.HasPrefix(messageID, "<") {
+        messageID = "<" + messageID + ">"
+    }
+
+    members := make(map[string][]uint32)
+    for _, folder := range folders {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+
+        var uids []uint32
+        err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+            var err error
+            if gmailThread {
+                uids, err = uidSearchRaw(client, imap.RawString("X-GM-THRID"), imap.RawString(threadID))
+            } else {
+                uids, err = searchThreadHeaders(client, messageID)
+            }
+            return err
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        if len(uids) > 0 {
+            members[folder] = uids
+        }
+    }
+
+    return members, nil
+}
+
+// searchThreadHeaders finds the messages of the selected folder that are,
+// reply to or reference messageID
+func searchThreadHeaders(client *client.Client, messageID string) ([]uint32, error) {
+    header := func(name string) *imap.SearchCriteria {
+        criteria := imap.NewSearchCriteria()
+        criteria.Header = textproto.MIMEHeader{name: {messageID}}
+        return criteria
+    }
+
+    references := imap.NewSearchCriteria()
+    references.Or = [][2]*imap.SearchCriteria{{header("References"), header("In-Reply-To")}}
+
+    criteria := imap.NewSearchCriteria()
+    criteria.Or = [][2]*imap.SearchCriteria{{header("Message-ID"), references}}
+
+    return searchWith(client, criteria)
+}
+
+// conversationFolders picks the folders to resolve a conversation in when
+// the caller doesn't name them
+func (c *Connection) conversationFolders(operation string) ([]string, error) {
+    if c.isGmail() {
+        // Every Gmail message is in All Mail; archiving removes the INBOX label
+        if operation == "archive" {
+            return []string{"INBOX"}, nil
+        }
+        allMail, err := c.RoleFolder("all")
+        if err != nil {
+            return nil, err
+        }
+        return []string{allMail}, nil
+    }
+
+    mailboxes, err := c.ListMailboxes()
+    if err != nil {
+        return nil, err
+    }
+
+    var folders []string
+    for _, mbox := range mailboxes {
+        if hasAttribute(mbox, imap.NoSelectAttr) || hasAttribute(mbox, `\All`) {
+            continue
+        }
+        folders = append(folders, mbox.Name)
+    }
+    return folders, nil
+}
+
+// applyConversationOp runs one operation on a conversation's messages in a
+// single folder
+func (c *Connection) applyConversationOp(folder string, uids []uint32, operation, destFolder string) error {
+    if (operation == "archive" || operation == "move") && folder == destFolder {
+        return nil
+    }
+
+    return c.withFolder(folder, false, func(client *client.Client, _ *imap.MailboxStatus) error {
+        switch operation {
+        case "mark_read", "mark_unread":
+            return storeFlagsWith(client, uids, []string{imap.SeenFlag}, operation == "mark_read")
+
+        case "archive", "move":
+            return moveWith(client, uids, destFolder)
+
+        case "delete":
+            if destFolder != "" && folder != destFolder {
+                return moveWith(client, uids, destFolder)
+            }
+            // Already in Trash, or deleting outright: expunge only these
+            return expungeUIDsWith(client, uids)
+
+        default:
+            return fmt.Errorf("unknown conversation operation: %s", operation)
+        }
+    })
+}
+
+func isDigits(s string) bool {
+    if s == "" {
+        return false
+    }
+    for _, r := range s {
+        if r < '0' || r > '9' {
+            return false
+        }
+    }
+    return true
+}
+
+func (h *Handler) handleConversationAction(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int      `json:"handle" validate:"required"`
+        ThreadID   string   `json:"thread_id" validate:"required"`
+        Operation  string   `json:"operation"` // mark_read, mark_unread, archive, delete, move
+        DestFolder string   `json:"dest_folder"`
+        Folders    []string `json:"folders"`
+        Permanent  bool     `json:"permanent"` // delete: expunge rather than move to Trash
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    destFolder := p.DestFolder
+    switch p.Operation {
+    case "move":
+        if destFolder == "" {
+            return protocol.ErrorResponse(fmt.Errorf("dest_folder is required for move"))
+        }
+    case "archive":
+        if destFolder == "" {
+            role := "archive"
+            if conn.isGmail() {
+                role = "all"
+            }
+            if destFolder, err = conn.RoleFolder(role); err != nil {
+                return protocol.ErrorResponse(err)
+            }
+        }
+    case "delete":
+        // Without Trash the thread could only be lost for good, which the
+        // caller must ask for
+        if p.Permanent {
+            destFolder = ""
+        } else if destFolder == "" {
+            if destFolder, err = conn.RoleFolder("trash"); err != nil {
+                return protocol.ErrorResponse(fmt.Errorf("%w; set permanent to delete outright", err))
+            }
+        }
+    case "mark_read", "mark_unread":
+    default:
+        return protocol.ErrorResponse(fmt.Errorf("unknown conversation operation: %s", p.Operation))
+    }
+
+    folders := p.Folders
+    if len(folders) == 0 {
+        if folders, err = conn.conversationFolders(p.Operation); err != nil {
+            return protocol.ErrorResponse(err)
+        }
+    }
+
+    members, err := conn.ResolveThread(ctx, p.ThreadID, folders)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    affected := 0
+    for folder, uids := range members {
+        if err := conn.applyConversationOp(folder, uids, p.Operation, destFolder); err != nil {
+            return protocol.ErrorResponse(fmt.Errorf("%s failed in %s: %w", p.Operation, folder, err))
+        }
+        affected += len(uids)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "members":  members,
+        "affected": affected,
+    })
+}
@@ -0,0 +1,293 @@
+package imap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Keywords clients set when the user marks a message, which override the
+// folder it's in
+const (
+    keywordJunk    = "$Junk"
+    keywordNotJunk = "$NotJunk"
+)
+
+// CorpusSource says where an export's junk and ham come from. Junk is the
+// junk folder less anything marked $NotJunk; ham is the ham folder less
+// anything marked $Junk or deleted.
+type CorpusSource struct {
+    JunkFolder string `json:"junk_folder"`           // Defaults to the detected junk folder
+    HamFolder  string `json:"ham_folder"`            // Defaults to INBOX
+    Limit      int    `json:"limit" validate:"min=0"` // Newest messages per label; 0 for all
+}
+
+// CorpusCounts are how many messages each label has
+type CorpusCounts struct {
+    JunkFolder string `json:"junk_folder"`
+    HamFolder  string `json:"ham_folder"`
+    Junk       int    `json:"junk"`
+    Ham        int    `json:"ham"`
+}
+
+// CorpusEntry is one exported message, as listed in index.json
+type CorpusEntry struct {
+    File   string `json:"file"`  // Relative to the export directory
+    Label  string `json:"label"` // "junk" or "ham"
+    Folder string `json:"folder"`
+    Size   int    `json:"size"`
+}
+
+// corpusSet is the UIDs of one label
+type corpusSet struct {
+    label  string
+    folder string
+    uids   []uint32
+}
+
+// resolve fills in the default folders
+func (s *CorpusSource) resolve(c *Connection) error {
+    if s.JunkFolder == "" {
+        folder, err := c.RoleFolder("junk")
+        if err != nil {
+            return err
+        }
+        s.JunkFolder = folder
+    }
+    if s.HamFolder == "" {
+        s.HamFolder = "INBOX"
+    }
+    return nil
+}
+
+// corpusUIDs finds the UIDs of each label, newest first and limited
+func (c *Connection) corpusUIDs(source CorpusSource) ([]corpusSet, error) {
+    sets := []corpusSet{
+        {label: "junk", folder: source.JunkFolder},
+        {label: "ham", folder: source.HamFolder},
+    }
+
+    for i := range sets {
+        criteria := imap.NewSearchCriteria()
+        if sets[i].label == "junk" {
+            criteria.WithoutFlags = []string{keywordNotJunk}
+        } else {
+            criteria.WithoutFlags = []string{keywordJunk, imap.DeletedFlag}
+        }
+
+        var uids []uint32
+        err := c.withFolder(sets[i].folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+            var err error
+            uids, err = searchWith(client, criteria)
+            return err
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        sort.Slice(uids, func(a, b int) bool { return uids[a] > uids[b] })
+        if source.Limit > 0 && len(uids) > source.Limit {
+            uids = uids[:source.Limit]
+        }
+        sets[i].uids = uids
+    }
+
+    return sets, nil
+}
+
+// CorpusCounts counts what an export of source would contain
+func (c *Connection) CorpusCounts(source CorpusSource) (*CorpusCounts, error) {
+    if err := source.resolve(c); err != nil {
+        return nil, err
+    }
+    sets, err := c.corpusUIDs(source)
+    if err != nil {
+        return nil, err
+    }
+
+    return &CorpusCounts{
+        JunkFolder: source.JunkFolder,
+        HamFolder:  source.HamFolder,
+        Junk:       len(sets[0].uids),
+        Ham:        len(sets[1].uids),
+    }, nil
+}
+
+// ExportCorpus writes labelled messages to dir, one file per message under
+// junk/ and ham/ with an index.json, for training a spam filter. dir must
+// be new or empty so exports never mix.
+func (c *Connection) ExportCorpus(ctx context.Context, source CorpusSource, dir string, headersOnly bool, redaction mime.Redaction) ([]CorpusEntry, error) {
+    if err := source.resolve(c); err != nil {
+        return nil, err
+    }
+    if err := prepareExportDir(dir); err != nil {
+        return nil, err
+    }
+
+    // A fresh key per export, so pseudonyms can't be linked across exports
+    salt := make([]byte, 32)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, fmt.Errorf("failed to generate pseudonym key: %w", err)
+    }
+
+    sets, err := c.corpusUIDs(source)
+    if err != nil {
+        return nil, err
+    }
+
+    section := &imap.BodySectionName{Peek: true}
+    if headersOnly {
+        section.Specifier = imap.HeaderSpecifier
+    }
+    items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+
+    entries := []CorpusEntry{}
+    for _, set := range sets {
+        if err := os.MkdirAll(filepath.Join(dir, set.label), 0700); err != nil {
+            return nil, fmt.Errorf("failed to create export directory: %w", err)
+        }
+
+        err := c.withFolder(set.folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+            for start := 0; start < len(set.uids); start += fetchBatchSize {
+                if err := lanes.Yield(ctx); err != nil {
+                    return err
+                }
+
+                end := start + fetchBatchSize
+                if end > len(set.uids) {
+                    end = len(set.uids)
+                }
+
+                var writeErr error
+                err := fetchWith(client, set.uids[start:end], items, func(msg *imap.Message) {
+                    literal := msg.GetBody(section)
+                    if literal == nil || writeErr != nil {
+                        return
+                    }
+                    raw, err := io.ReadAll(literal)
+                    if err != nil {
+                        return
+                    }
+                    raw = mime.Redact(raw, redaction, salt)
+
+                    // Numbered rather than named by UID, which would identify
+                    // the messages in the account
+                    name := filepath.Join(set.label, fmt.Sprintf("%06d.eml", len(entries)+1))
+                    if err := os.WriteFile(filepath.Join(dir, name), raw, 0600); err != nil {
+                        writeErr = fmt.Errorf("failed to write %s: %w", name, err)
+                        return
+                    }
+                    entries = append(entries, CorpusEntry{File: name, Label: set.label, Folder: set.folder, Size: len(raw)})
+                })
+                if err != nil {
+                    return err
+                }
+                if writeErr != nil {
+                    return writeErr
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    index, err := json.MarshalIndent(entries, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    if err := os.WriteFile(filepath.Join(dir, "index.json"), index, 0600); err != nil {
+        return nil, fmt.Errorf("failed to write index: %w", err)
+    }
+
+    return entries, nil
+}
+
+// prepareExportDir creates dir, refusing one that already has files
+func prepareExportDir(dir string) error {
+    if !filepath.IsAbs(dir) {
+        return protocol.WithCode(protocol.CodeInvalidRequest, errors.New("dir must be an absolute path"))
+    }
+
+    existing, err := os.ReadDir(dir)
+    if err == nil && len(existing) > 0 {
+        return protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("%s is not empty", dir))
+    }
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create export directory: %w", err)
+    }
+    return nil
+}
+
+func (h *Handler) handleCorpusCounts(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+        CorpusSource
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    counts, err := conn.CorpusCounts(p.CorpusSource)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(counts)
+}
+
+func (h *Handler) handleExportCorpus(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Dir    string `json:"dir" validate:"required"` // Absolute path of a new or empty directory
+        CorpusSource
+
+        // HeadersOnly leaves out bodies, for sharing less
+        HeadersOnly bool           `json:"headers_only"`
+        Redact      mime.Redaction `json:"redact"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    entries, err := conn.ExportCorpus(ctx, p.CorpusSource, p.Dir, p.HeadersOnly, p.Redact)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    counts := map[string]int{"junk": 0, "ham": 0}
+    for _, entry := range entries {
+        counts[entry.Label]++
+    }
+    return protocol.SuccessResponse(map[string]any{
+        "dir":   p.Dir,
+        "junk":  counts["junk"],
+        "ham":   counts["ham"],
+        "index": "index.json",
+    })
+}
@@ -0,0 +1,106 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// envelopeItems are the FETCH items for a message list row
+var envelopeItems = []imap.FetchItem{
+    imap.FetchUid, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size,
+}
+
+// MessageEnvelope is a message's ENVELOPE with its flags, arrival time and
+// size: enough for a message list row without the body
+type MessageEnvelope struct {
+    UID          uint32           `json:"uid"`
+    Flags        []string         `json:"flags"`
+    InternalDate time.Time        `json:"internal_date"`
+    Size         uint32           `json:"size"`
+    Date         time.Time        `json:"date"`
+    Subject      string           `json:"subject"`
+    From         []MessageAddress `json:"from"`
+    Sender       []MessageAddress `json:"sender,omitempty"`
+    ReplyTo      []MessageAddress `json:"reply_to,omitempty"`
+    To           []MessageAddress `json:"to"`
+    Cc           []MessageAddress `json:"cc,omitempty"`
+    Bcc          []MessageAddress `json:"bcc,omitempty"`
+    InReplyTo    string           `json:"in_reply_to,omitempty"`
+    MessageID    string           `json:"message_id"`
+}
+
+// FetchEnvelopes fetches the envelopes of messages in a folder with one
+// UID FETCH
+func (c *Connection) FetchEnvelopes(ctx context.Context, folder string, uids []uint32) ([]MessageEnvelope, error) {
+    result := make([]MessageEnvelope, 0, len(uids))
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return fetchWith(client, uids, envelopeItems, func(msg *imap.Message) {
+            result = append(result, messageEnvelope(msg))
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func messageEnvelope(msg *imap.Message) MessageEnvelope {
+    envelope := MessageEnvelope{
+        UID:          msg.Uid,
+        Flags:        msg.Flags,
+        InternalDate: msg.InternalDate,
+        Size:         msg.Size,
+    }
+
+    if env := msg.Envelope; env != nil {
+        envelope.Date = env.Date
+        envelope.Subject = env.Subject
+        envelope.From = messageAddresses(env.From)
+        envelope.Sender = messageAddresses(env.Sender)
+        envelope.ReplyTo = messageAddresses(env.ReplyTo)
+        envelope.To = messageAddresses(env.To)
+        envelope.Cc = messageAddresses(env.Cc)
+        envelope.Bcc = messageAddresses(env.Bcc)
+        envelope.InReplyTo = env.InReplyTo
+        envelope.MessageID = env.MessageId
+    }
+
+    return envelope
+}
+
+func (h *Handler) handleFetchEnvelopes(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+
+        // UIDs are fetched with a single FETCH, so they are bounded; larger
+        // lists belong in fetch_metadata's batches
+        UIDs []uint32 `json:"uids" validate:"required,max=500"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    messages, err := conn.FetchEnvelopes(ctx, p.Folder, p.UIDs)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "messages": messages,
+    })
+}
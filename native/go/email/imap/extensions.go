@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// uidSearchRaw runs UID SEARCH with pre-formatted criteria, for search keys
+// go-imap doesn't model such as X-GM-THRID
+func uidSearchRaw(c *client.Client, criteria ...interface{}) ([]uint32, error) {
+    cmd := &commands.Uid{
+        Cmd: &imap.Command{Name: "SEARCH", Arguments: criteria},
+    }
+    res := &responses.Search{}
+
+    status, err := c.Execute(cmd, res)
+    if err != nil {
+        return nil, fmt.Errorf("search failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("search failed: %w", err)
+    }
+
+    return res.Ids, nil
+}
+
+// uidSet builds a sequence set from UIDs
+func uidSet(uids []uint32) *imap.SeqSet {
+    seqSet := new(imap.SeqSet)
+    for _, uid := range uids {
+        seqSet.AddNum(uid)
+    }
+    return seqSet
+}
+
+// checkUIDs rejects a UID of 0 in the uids param, which uidSet would turn
+// into * and so act on the last message in the folder
+func checkUIDs(uids []uint32) error {
+    for i, uid := range uids {
+        if uid == 0 {
+            return &protocol.ValidationError{Field: fmt.Sprintf("params.uids[%d]", i), Reason: "must be a UID, not 0"}
+        }
+    }
+    return nil
+}
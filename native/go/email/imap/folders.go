@@ -0,0 +1,548 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// roleAttributes maps folder roles to their SPECIAL-USE attribute (RFC 6154)
+var roleAttributes = map[string]string{
+    "sent":    `\Sent`,
+    "drafts":  `\Drafts`,
+    "trash":   `\Trash`,
+    "junk":    `\Junk`,
+    "archive": `\Archive`,
+    "all":     `\All`,
+}
+
+// specialUseAttributes are the SPECIAL-USE attributes reported separately in
+// folder listings: RFC 6154's, and \Important from RFC 8457
+var specialUseAttributes = []string{
+    `\All`, `\Archive`, `\Drafts`, `\Flagged`, `\Junk`, `\Sent`, `\Trash`, `\Important`,
+}
+
+// roleNames are common folder names per role, tried when the server does
+// not advertise SPECIAL-USE or XLIST attributes
+var roleNames = map[string][]string{
+    "sent": {
+        "Sent", "Sent Items", "Sent Messages", "Sent Mail", "[Gmail]/Sent Mail",
+        "INBOX.Sent", "INBOX/Sent", "Gesendet", "Gesendete Elemente",
+        "Envoyés", "Enviados", "Inviata",
+    },
+    "drafts": {
+        "Drafts", "[Gmail]/Drafts", "INBOX.Drafts", "INBOX/Drafts", "Entwürfe",
+        "Brouillons", "Borradores", "Bozze",
+    },
+    "trash": {
+        "Trash", "Deleted Items", "Deleted Messages", "[Gmail]/Trash", "[Gmail]/Bin",
+        "INBOX.Trash", "INBOX/Trash", "Papierkorb", "Corbeille", "Papelera", "Cestino",
+    },
+    "junk": {
+        "Junk", "Spam", "Junk E-mail", "Junk Email", "Bulk Mail", "[Gmail]/Spam",
+        "INBOX.Junk", "INBOX.Spam", "INBOX/Junk", "Courrier indésirable",
+    },
+    "archive": {
+        "Archive", "Archives", "INBOX.Archive", "INBOX/Archive", "Archiv",
+    },
+    "all": {
+        "[Gmail]/All Mail", "All Mail",
+    },
+}
+
+// ListMailboxes lists all mailboxes visible to the user
+func (c *Connection) ListMailboxes() ([]*imap.MailboxInfo, error) {
+    return c.listMailboxes(false)
+}
+
+// listMailboxes lists all mailboxes, or with subscribed only those the user
+// subscribed to (LSUB). Servers with XLIST but not SPECIAL-USE are listed
+// with XLIST for its folder attributes. Only full listings are used to
+// recheck role folders, since an unsubscribed folder hasn't gone anywhere.
+func (c *Connection) listMailboxes(subscribed bool) ([]*imap.MailboxInfo, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    if !subscribed && usesXList(client) {
+        result, err := xlistMailboxes(client)
+        if err != nil {
+            return nil, fmt.Errorf("list failed: %w", err)
+        }
+        c.checkRoles(result)
+        return result, nil
+    }
+
+    mailboxes := make(chan *imap.MailboxInfo, 32)
+    done := make(chan error, 1)
+
+    go func() {
+        if subscribed {
+            done <- client.Lsub("", "*", mailboxes)
+        } else {
+            done <- client.List("", "*", mailboxes)
+        }
+    }()
+
+    var result []*imap.MailboxInfo
+    for mbox := range mailboxes {
+        result = append(result, mbox)
+    }
+
+    if err := <-done; err != nil {
+        return nil, fmt.Errorf("list failed: %w", err)
+    }
+
+    if !subscribed {
+        c.checkRoles(result)
+    }
+    return result, nil
+}
+
+// FolderInfo is a folder in the tree with its message counts. Counts are
+// omitted for folders that can't be selected. SpecialUse repeats the
+// attributes that name the folder's purpose, when the server advertises them.
+type FolderInfo struct {
+    Name       string   `json:"name"`
+    Delimiter  string   `json:"delimiter"`
+    Attributes []string `json:"attributes"`
+    SpecialUse []string `json:"special_use,omitempty"`
+    Messages   *uint32  `json:"messages,omitempty"`
+    Unseen     *uint32  `json:"unseen,omitempty"`
+}
+
+// folderStatusItems are the counts returned for each folder
+var folderStatusItems = []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen}
+
+// listStatus collects the LIST and STATUS replies of LIST ... RETURN
+// (STATUS ...) (RFC 5819)
+type listStatus struct {
+    mailboxes []*imap.MailboxInfo
+    statuses  map[string]*imap.MailboxStatus
+}
+
+func (r *listStatus) Handle(resp imap.Resp) error {
+    name, fields, ok := imap.ParseNamedResp(resp)
+    if !ok {
+        return responses.ErrUnhandled
+    }
+
+    switch name {
+    case "LIST":
+        mbox := &imap.MailboxInfo{}
+        if err := mbox.Parse(fields); err != nil {
+            return err
+        }
+        r.mailboxes = append(r.mailboxes, mbox)
+    case "STATUS":
+        status := &responses.Status{}
+        if err := status.Handle(resp); err != nil {
+            return err
+        }
+        r.statuses[status.Mailbox.Name] = status.Mailbox
+    default:
+        return responses.ErrUnhandled
+    }
+    return nil
+}
+
+// ListFolders lists the folder tree with message and unseen counts, or with
+// subscribed only the folders the user subscribed to. Servers with
+// LIST-STATUS answer in one round trip; others get a STATUS per folder.
+func (c *Connection) ListFolders(ctx context.Context, subscribed bool) ([]FolderInfo, error) {
+    var mailboxes []*imap.MailboxInfo
+    statuses := make(map[string]*imap.MailboxStatus)
+
+    if c.Supports("LIST-STATUS") {
+        res, err := c.listWithStatus(subscribed)
+        if err != nil {
+            return nil, err
+        }
+        mailboxes, statuses = res.mailboxes, res.statuses
+    } else {
+        var err error
+        mailboxes, err = c.listMailboxes(subscribed)
+        if err != nil {
+            return nil, err
+        }
+
+        for _, mbox := range mailboxes {
+            if err := ctx.Err(); err != nil {
+                return nil, err
+            }
+            if hasAttribute(mbox, imap.NoSelectAttr) || hasAttribute(mbox, `\NonExistent`) {
+                continue
+            }
+
+            status, err := c.Status(mbox.Name, folderStatusItems)
+            if err != nil {
+                return nil, err
+            }
+            statuses[mbox.Name] = status
+        }
+    }
+
+    folders := make([]FolderInfo, 0, len(mailboxes))
+    for _, mbox := range mailboxes {
+        folder := FolderInfo{
+            Name:       mbox.Name,
+            Delimiter:  mbox.Delimiter,
+            Attributes: childAttributes(mbox, mailboxes, subscribed),
+        }
+        for _, attr := range specialUseAttributes {
+            if hasAttribute(mbox, attr) {
+                folder.SpecialUse = append(folder.SpecialUse, attr)
+            }
+        }
+        if status, ok := statuses[mbox.Name]; ok {
+            messages, unseen := status.Messages, status.Unseen
+            folder.Messages = &messages
+            folder.Unseen = &unseen
+        }
+        folders = append(folders, folder)
+    }
+
+    return folders, nil
+}
+
+// childAttributes returns a mailbox's attributes, adding \HasChildren or
+// \HasNoChildren from the rest of the tree when a server without CHILDREN
+// (RFC 3348) leaves them out. A subscribed listing can't tell, as children
+// may be unsubscribed.
+func childAttributes(mbox *imap.MailboxInfo, mailboxes []*imap.MailboxInfo, subscribed bool) []string {
+    attrs := mbox.Attributes
+    if attrs == nil {
+        attrs = []string{}
+    }
+    if subscribed || mbox.Delimiter == "" || hasAttribute(mbox, imap.HasChildrenAttr) || hasAttribute(mbox, imap.HasNoChildrenAttr) {
+        return attrs
+    }
+
+    prefix := mbox.Name + mbox.Delimiter
+    for _, other := range mailboxes {
+        if strings.HasPrefix(other.Name, prefix) {
+            return append(attrs[:len(attrs):len(attrs)], imap.HasChildrenAttr)
+        }
+    }
+    return append(attrs[:len(attrs):len(attrs)], imap.HasNoChildrenAttr)
+}
+
+// listWithStatus issues LIST "" "*" RETURN (STATUS (MESSAGES UNSEEN)),
+// asking for SPECIAL-USE attributes too when the server supports them.
+// LIST-STATUS implies LIST-EXTENDED (RFC 5258), so subscribed folders are
+// selected with the SUBSCRIBED option.
+func (c *Connection) listWithStatus(subscribed bool) (*listStatus, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    items := make([]interface{}, len(folderStatusItems))
+    for i, item := range folderStatusItems {
+        items[i] = imap.RawString(item)
+    }
+
+    options := []interface{}{imap.RawString("STATUS"), items}
+    if ok, _ := client.Support("SPECIAL-USE"); ok {
+        options = append([]interface{}{imap.RawString("SPECIAL-USE")}, options...)
+    }
+
+    args := []interface{}{"", "*", imap.RawString("RETURN"), options}
+    if subscribed {
+        args = append([]interface{}{[]interface{}{imap.RawString("SUBSCRIBED")}}, args...)
+    }
+
+    cmd := &imap.Command{Name: "LIST", Arguments: args}
+    res := &listStatus{statuses: make(map[string]*imap.MailboxStatus)}
+
+    status, err := client.Execute(cmd, res)
+    if err != nil {
+        return nil, fmt.Errorf("list failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("list failed: %w", err)
+    }
+
+    if !subscribed {
+        c.checkRoles(res.mailboxes)
+    }
+    return res, nil
+}
+
+func (h *Handler) handleListFolders(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int  `json:"handle" validate:"required"`
+        Subscribed bool `json:"subscribed"` // Only folders the user subscribed to
+        protocol.Page
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    folders, err := conn.ListFolders(ctx, p.Subscribed)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    start, end, next, err := p.Slice(len(folders), func(i int) string { return folders[i].Name })
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "folders":     folders[start:end],
+        "total":       len(folders),
+        "next_cursor": next,
+    })
+}
+
+// DeleteMailbox deletes a mailbox. Its children are left in place, as IMAP
+// requires; a selected mailbox is no longer reselected on reconnect.
+func (c *Connection) DeleteMailbox(name string) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    err = client.Delete(name)
+    release()
+    if err != nil {
+        return fmt.Errorf("delete failed: %w", err)
+    }
+
+    c.mu.Lock()
+    if c.selected == name {
+        c.selected = ""
+    }
+    c.mu.Unlock()
+
+    c.forgetRole(name)
+    return nil
+}
+
+// RenameMailbox renames a mailbox, moving its children with it
+func (c *Connection) RenameMailbox(from, to string) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    err = client.Rename(from, to)
+    release()
+    if err != nil {
+        return fmt.Errorf("rename failed: %w", err)
+    }
+
+    c.mu.Lock()
+    if c.selected == from {
+        c.selected = to
+    }
+    c.mu.Unlock()
+
+    c.forgetRole(from)
+    return nil
+}
+
+// SetSubscribed subscribes to a mailbox, or unsubscribes from it
+func (c *Connection) SetSubscribed(name string, subscribed bool) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    if subscribed {
+        err = client.Subscribe(name)
+    } else {
+        err = client.Unsubscribe(name)
+    }
+    if err != nil {
+        return fmt.Errorf("subscription change failed: %w", err)
+    }
+    return nil
+}
+
+// forgetRole rechecks the role folders after one was renamed or deleted, so
+// the change is announced rather than found by the next failing append
+func (c *Connection) forgetRole(folder string) {
+    if c.roleOf(folder) != "" {
+        c.ListMailboxes()
+    }
+}
+
+func (h *Handler) handleCreateFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"` // Full name; servers create missing parents
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if err := conn.CreateMailbox(p.Folder); err != nil {
+        return protocol.ErrorResponse(fmt.Errorf("create failed: %w", err))
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "folder": p.Folder,
+    })
+}
+
+func (h *Handler) handleDeleteFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if strings.EqualFold(p.Folder, "INBOX") {
+        return protocol.ErrorResponse(&protocol.ValidationError{Field: "params.folder", Reason: "INBOX can't be deleted"})
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if err := conn.DeleteMailbox(p.Folder); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(nil)
+}
+
+func (h *Handler) handleRenameFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        From   string `json:"from" validate:"required"`
+        To     string `json:"to" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if err := conn.RenameMailbox(p.From, p.To); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "folder": p.To,
+    })
+}
+
+func (h *Handler) handleSubscribeFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    return h.setSubscribed(ctx, params, true)
+}
+
+func (h *Handler) handleUnsubscribeFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    return h.setSubscribed(ctx, params, false)
+}
+
+// setSubscribed serves subscribe_folder and unsubscribe_folder
+func (h *Handler) setSubscribed(ctx context.Context, params json.RawMessage, subscribed bool) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if err := conn.SetSubscribed(p.Folder, subscribed); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(nil)
+}
+
+// RoleFolder detects the folder serving a role ("sent", "drafts", "trash",
+// "junk", "archive" or "all"), preferring SPECIAL-USE or XLIST attributes
+// and falling back to well-known names
+func (c *Connection) RoleFolder(role string) (string, error) {
+    if _, ok := roleAttributes[role]; !ok {
+        return "", fmt.Errorf("unknown folder role: %s", role)
+    }
+
+    c.mu.RLock()
+    cached := c.roles[role]
+    c.mu.RUnlock()
+    if cached != "" {
+        return cached, nil
+    }
+
+    mailboxes, err := c.ListMailboxes()
+    if err != nil {
+        return "", err
+    }
+
+    folder := detectRole(mailboxes, role)
+    if folder == "" {
+        return "", fmt.Errorf("no %s folder found", role)
+    }
+
+    c.mu.Lock()
+    c.roles[role] = folder
+    c.mu.Unlock()
+
+    return folder, nil
+}
+
+// SentFolder detects the account's Sent folder
+func (c *Connection) SentFolder() (string, error) {
+    return c.RoleFolder("sent")
+}
+
+// hasAttribute reports whether a mailbox carries an attribute
+func hasAttribute(mbox *imap.MailboxInfo, attr string) bool {
+    for _, a := range mbox.Attributes {
+        if strings.EqualFold(a, attr) {
+            return true
+        }
+    }
+    return false
+}
+
+// matchFolderName returns the first mailbox whose name matches one of the
+// candidates, in candidate order
+func matchFolderName(mailboxes []*imap.MailboxInfo, candidates []string) string {
+    for _, candidate := range candidates {
+        for _, mbox := range mailboxes {
+            if strings.EqualFold(mbox.Name, candidate) {
+                return mbox.Name
+            }
+        }
+    }
+    return ""
+}
@@ -1,84 +1,420 @@
 package imap
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
+	"github.com/rdawebb/kernel/native/internal/breaker"
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/history"
+	"github.com/rdawebb/kernel/native/internal/notify"
 	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/priority"
 	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/stats"
+	"github.com/rdawebb/kernel/native/internal/tags"
 )
 
 // Handler handles IMAP requests from Python
 type Handler struct {
-    pool *pool.ConnectionPool
+    pool     *pool.ConnectionPool
+    stats    *stats.Recorder
+    history  *history.Recorder
+    events   *events.Bus
+    watchers watchers
+    badges   badges
+    tags     *tags.Store
+    notifier *notify.Notifier
+    priority *priority.Classifier
+    hosts    *breaker.Breaker // Failing servers, kept apart per tenant
+
+    migrations  string // Directory of migration checkpoints
+    rawCommands bool   // Whether raw_command may be used
+    readOnly    bool   // Whether mutating actions are refused
 }
 
 // NewHandler creates a new IMAP handler
 func NewHandler() *Handler {
     return &Handler{
-        pool: pool.NewConnectionPool(),
+        pool:     pool.NewConnectionPool(),
+        stats:    stats.NewRecorder(),
+        history:  history.New(history.DefaultSize),
+        hosts:    breaker.New(breaker.DefaultConfig),
+        watchers: watchers{
+            byID: make(map[int]*watcher),
+        },
+        badges: badges{
+            counts: make(map[int]*Badge),
+            stops:  make(map[int]chan struct{}),
+        },
     }
 }
 
-// Handle processes an IMAP request
-func (h *Handler) Handle(req protocol.Request) protocol.Response {
+// Handle processes an IMAP request, recording its latency. Long-running
+// actions stop early when ctx is cancelled.
+func (h *Handler) Handle(ctx context.Context, req protocol.Request) protocol.Response {
+    // Refused here rather than in dispatch, which describe also runs
+    if h.readOnly && mutations[req.Action] {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeReadOnly, fmt.Errorf("%s is disabled in read-only mode", req.Action)))
+    }
+
+    start := time.Now()
+    resp := h.dispatch(ctx, req)
+    elapsed := time.Since(start)
+
+    // Only handles still in the pool get stats and a timeline, so a bogus
+    // or just closed handle leaves nothing behind
+    handle := protocol.HandleParam(req.Params)
+    if _, err := h.pool.Get(handle); err != nil {
+        handle = 0
+    }
+    h.stats.Record(req.Action, handle, elapsed, !resp.Success)
+    h.recordCommand(handle, req.Action, elapsed, resp)
+    return resp
+}
+
+// actions lists the actions dispatch understands, for the hello handshake
+var actions = []string{
+    "connect",
+    "close",
+    "select_folder",
+    "search_uids",
+    "sort_uids",
+    "fetch_messages",
+    "set_flags",
+    "copy_message",
+    "append_message",
+    "append_messages",
+    "expunge",
+    "noop",
+    "capabilities",
+    "stats",
+    "watch_folders",
+    "badge_register",
+    "badge_unregister",
+    "badge_counts",
+    "conversation_action",
+    "add_label",
+    "remove_label",
+    "search_by_label",
+    "set_color",
+    "message_markers",
+    "replay_journal",
+    "recover_folder",
+    "transfer_message",
+    "migrate_account",
+    "migration_status",
+    "list_folders",
+    "create_folder",
+    "delete_folder",
+    "rename_folder",
+    "subscribe_folder",
+    "unsubscribe_folder",
+    "folder_roles",
+    "folder_status",
+    "object_ids",
+    "fetch_metadata",
+    "fetch_envelopes",
+    "fetch_bodystructure",
+    "fetch_part",
+    "fetch_headers",
+    "warm_up",
+    "raw_command",
+    "verify_cache",
+    "mailing_lists",
+    "find_messages_with_attachments",
+    "find_messages_larger_than",
+    "handle_history",
+    "tls_info",
+    "get_quota",
+    "delivery_route",
+    "corpus_counts",
+    "export_corpus",
+}
+
+// Actions returns the actions this handler supports
+func (h *Handler) Actions() []string {
+    return actions
+}
+
+// Connections returns how many IMAP connections are pooled
+func (h *Handler) Connections() int {
+    return h.pool.Count()
+}
+
+// reads are the actions that only read state, so repeating them is safe
+var reads = map[string]bool{
+    "select_folder": true,
+    "search_uids": true,
+    "sort_uids": true,
+    "fetch_messages": true,
+    "noop": true,
+    "capabilities": true,
+    "stats": true,
+    "badge_counts": true,
+    "search_by_label": true,
+    "message_markers": true,
+    "migration_status": true,
+    "list_folders": true,
+    "folder_roles": true,
+    "folder_status": true,
+    "object_ids": true,
+    "fetch_metadata": true,
+    "fetch_envelopes": true,
+    "fetch_bodystructure": true,
+    "fetch_part": true,
+    "fetch_headers": true,
+    "verify_cache": true,
+    "mailing_lists": true,
+    "find_messages_with_attachments": true,
+    "find_messages_larger_than": true,
+    "handle_history": true,
+    "tls_info": true,
+    "get_quota": true,
+    "delivery_route": true,
+    "corpus_counts": true,
+}
+
+// Idempotent reports whether an action can be retried without effect
+func (h *Handler) Idempotent(action string) bool {
+    return reads[action]
+}
+
+// mutations are the actions that change the mailbox on the server
+var mutations = map[string]bool{
+    "set_flags": true,
+    "copy_message": true,
+    "append_message": true,
+    "append_messages": true,
+    "expunge": true,
+    "conversation_action": true,
+    "add_label": true,
+    "remove_label": true,
+    "set_color": true,
+    "replay_journal": true,
+    "transfer_message": true,
+    "migrate_account": true,
+    "raw_command": true,
+    "create_folder": true,
+    "delete_folder": true,
+    "rename_folder": true,
+    "subscribe_folder": true,
+    "unsubscribe_folder": true,
+}
+
+// SetReadOnly makes the handler refuse mutating actions with READ_ONLY, so
+// a mailbox can be browsed without risk while testing a client
+func (h *Handler) SetReadOnly(enabled bool) {
+    h.readOnly = enabled
+}
+
+// ReadOnly reports whether mutating actions are refused
+func (h *Handler) ReadOnly() bool {
+    return h.readOnly
+}
+
+// Describe returns the JSON schema of each action's params, read from the
+// structs the handlers decode into
+func (h *Handler) Describe() map[string]any {
+    schemas := make(map[string]any, len(actions))
+    for _, action := range actions {
+        schemas[action] = protocol.DescribeParams(func(ctx context.Context) {
+            h.dispatch(ctx, protocol.Request{Module: "imap", Action: action})
+        })
+    }
+    return schemas
+}
+
+func (h *Handler) dispatch(ctx context.Context, req protocol.Request) protocol.Response {
     switch req.Action {
     case "connect":
-        return h.handleConnect(req.Params)
+        return h.handleConnect(ctx, req.Params)
     case "close":
-        return h.handleClose(req.Params)
+        return h.handleClose(ctx, req.Params)
     case "select_folder":
-        return h.handleSelectFolder(req.Params)
+        return h.handleSelectFolder(ctx, req.Params)
     case "search_uids":
-        return h.handleSearchUIDs(req.Params)
+        return h.handleSearchUIDs(ctx, req.Params)
+    case "sort_uids":
+        return h.handleSortUIDs(ctx, req.Params)
     case "fetch_messages":
-        return h.handleFetchMessages(req.Params)
+        return h.handleFetchMessages(ctx, req.Params, req.Partial)
     case "set_flags":
-        return h.handleSetFlags(req.Params)
+        return h.handleSetFlags(ctx, req.Params)
     case "copy_message":
-        return h.handleCopyMessage(req.Params)
+        return h.handleCopyMessage(ctx, req.Params)
+    case "append_message":
+        return h.handleAppendMessage(ctx, req.Params)
+    case "append_messages":
+        return h.handleAppendMessages(ctx, req.Params)
     case "expunge":
-        return h.handleExpunge(req.Params)
+        return h.handleExpunge(ctx, req.Params)
     case "noop":
-        return h.handleNoop(req.Params)
+        return h.handleNoop(ctx, req.Params)
+    case "capabilities":
+        return h.handleCapabilities(ctx, req.Params)
+    case "stats":
+        return h.handleStats(ctx, req.Params)
+    case "watch_folders":
+        return h.handleWatchFolders(ctx, req.Params)
+    case "badge_register":
+        return h.handleBadgeRegister(ctx, req.Params)
+    case "badge_unregister":
+        return h.handleBadgeUnregister(ctx, req.Params)
+    case "badge_counts":
+        return h.handleBadgeCounts(ctx, req.Params)
+    case "conversation_action":
+        return h.handleConversationAction(ctx, req.Params)
+    case "add_label":
+        return h.handleAddLabel(ctx, req.Params)
+    case "remove_label":
+        return h.handleRemoveLabel(ctx, req.Params)
+    case "search_by_label":
+        return h.handleSearchByLabel(ctx, req.Params)
+    case "set_color":
+        return h.handleSetColor(ctx, req.Params)
+    case "message_markers":
+        return h.handleMessageMarkers(ctx, req.Params)
+    case "replay_journal":
+        return h.handleReplayJournal(ctx, req.Params)
+    case "recover_folder":
+        return h.handleRecoverFolder(ctx, req.Params)
+    case "transfer_message":
+        return h.handleTransferMessage(ctx, req.Params)
+    case "migrate_account":
+        return h.handleMigrateAccount(ctx, req.Params)
+    case "migration_status":
+        return h.handleMigrationStatus(ctx, req.Params)
+    case "list_folders":
+        return h.handleListFolders(ctx, req.Params)
+    case "create_folder":
+        return h.handleCreateFolder(ctx, req.Params)
+    case "delete_folder":
+        return h.handleDeleteFolder(ctx, req.Params)
+    case "rename_folder":
+        return h.handleRenameFolder(ctx, req.Params)
+    case "subscribe_folder":
+        return h.handleSubscribeFolder(ctx, req.Params)
+    case "unsubscribe_folder":
+        return h.handleUnsubscribeFolder(ctx, req.Params)
+    case "folder_roles":
+        return h.handleFolderRoles(ctx, req.Params)
+    case "folder_status":
+        return h.handleFolderStatus(ctx, req.Params)
+    case "object_ids":
+        return h.handleObjectIDs(ctx, req.Params)
+    case "fetch_metadata":
+        return h.handleFetchMetadata(ctx, req.Params)
+    case "fetch_envelopes":
+        return h.handleFetchEnvelopes(ctx, req.Params)
+    case "fetch_bodystructure":
+        return h.handleFetchBodyStructure(ctx, req.Params)
+    case "fetch_part":
+        return h.handleFetchPart(ctx, req.Params)
+    case "fetch_headers":
+        return h.handleFetchHeaders(ctx, req.Params)
+    case "warm_up":
+        return h.handleWarmUp(ctx, req.Params)
+    case "raw_command":
+        return h.handleRawCommand(ctx, req.Params)
+    case "mailing_lists":
+        return h.handleMailingLists(ctx, req.Params)
+    case "find_messages_with_attachments":
+        return h.handleFindAttachments(ctx, req.Params)
+    case "find_messages_larger_than":
+        return h.handleFindLarger(ctx, req.Params)
+    case "handle_history":
+        return h.handleHandleHistory(ctx, req.Params)
+    case "tls_info":
+        return h.handleTLSInfo(ctx, req.Params)
+    case "get_quota":
+        return h.handleGetQuota(ctx, req.Params)
+    case "verify_cache":
+        return h.handleVerifyCache(ctx, req.Params)
+    case "delivery_route":
+        return h.handleDeliveryRoute(ctx, req.Params)
+    case "corpus_counts":
+        return h.handleCorpusCounts(ctx, req.Params)
+    case "export_corpus":
+        return h.handleExportCorpus(ctx, req.Params)
     default:
-        return protocol.ErrorResponse(fmt.Errorf("unknown action: %s", req.Action))
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("unknown action: %s", req.Action)))
     }
 }
 
-func (h *Handler) handleConnect(params json.RawMessage) protocol.Response {
+func (h *Handler) handleConnect(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
+        Host     string `json:"host" validate:"required"`
+        Port     int    `json:"port" validate:"required,min=1,max=65535"`
         Username string `json:"username"`
         Password string `json:"password"`
+
+        // AuthType "xoauth2" logs in with an OAuth2 access token, for
+        // providers that no longer accept passwords
+        AuthType    string `json:"auth_type" validate:"oneof=login xoauth2"`
+        AccessToken string `json:"access_token"`
+
+        // Compress turns on COMPRESS=DEFLATE where the server supports it,
+        // which shrinks large fetches at some CPU cost
+        Compress bool `json:"compress"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
-    conn, err := Connect(p.Host, p.Port, p.Username, p.Password)
+    secret := p.Password
+    if p.AuthType == AuthXOAuth2 {
+        if p.AccessToken == "" {
+            return protocol.ErrorResponse(&protocol.ValidationError{Field: "params.access_token", Reason: "required for xoauth2"})
+        }
+        secret = p.AccessToken
+    }
+
+    conn, err := Connect(ctx, h.hosts, p.Host, p.Port, p.Username, secret, p.AuthType)
     if err != nil {
         return protocol.ErrorResponse(err)
     }
 
-    handle, err := h.pool.Add(conn)
+    if p.Compress {
+        if _, err := conn.EnableCompression(); err != nil {
+            conn.Close()
+            return protocol.ErrorResponse(err)
+        }
+    }
+
+    handle, err := h.pool.Add(ctx, conn)
     if err != nil {
         return protocol.ErrorResponse(err)
     }
+    h.recordConnect(handle, conn)
+    conn.OnRoleChange(func(change RoleChange) {
+        h.publish("folder.role_changed", handle, change)
+    })
+
+    // Capabilities let the client feature-detect IDLE, MOVE, QRESYNC and
+    // the like without asking again
+    caps, err := conn.Capabilities()
+    if err != nil {
+        caps = []string{}
+    }
 
     return protocol.SuccessResponse(map[string]any{
-        "handle": handle,
+        "handle":       handle,
+        "compressed":   conn.Compressed(),
+        "capabilities": caps,
     })
 }
 
-func (h *Handler) handleClose(params json.RawMessage) protocol.Response {
+func (h *Handler) handleClose(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int `json:"handle"`
+        Handle int `json:"handle" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -87,22 +423,27 @@ func (h *Handler) handleClose(params json.RawMessage) protocol.Response {
         return protocol.ErrorResponse(err)
     }
 
+    h.stopWatcher(p.Handle)
+    h.stopBadge(p.Handle)
+
     conn := connInterface.(*Connection)
     if err := conn.Close(); err != nil {
         return protocol.ErrorResponse(err)
     }
 
     h.pool.Remove(p.Handle)
+    h.stats.Forget(p.Handle)
+    h.history.Closed(p.Handle)
     return protocol.SuccessResponse(nil)
 }
 
-func (h *Handler) handleSelectFolder(params json.RawMessage) protocol.Response {
+func (h *Handler) handleSelectFolder(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int    `json:"handle"`
-        Folder string `json:"folder"`
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -119,15 +460,26 @@ func (h *Handler) handleSelectFolder(params json.RawMessage) protocol.Response {
     return protocol.SuccessResponse(nil)
 }
 
-func (h *Handler) handleSearchUIDs(params json.RawMessage) protocol.Response {
+func (h *Handler) handleSearchUIDs(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle    int    `json:"handle"`
+        Handle    int    `json:"handle" validate:"required"`
         HighestUID uint32 `json:"highest_uid"`
+        Unseen    bool   `json:"unseen"` // Only messages without \Seen
+
+        // Return asks for "min", "max" and/or "count" of the matching
+        // UIDs instead of the UIDs, with ESEARCH where the server has it
+        Return []string `json:"return"`
+        protocol.Page
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
+    for i, option := range p.Return {
+        if !searchReturnOptions[option] {
+            return protocol.ErrorResponse(&protocol.ValidationError{Field: fmt.Sprintf("params.return[%d]", i), Reason: "must be one of min, max, count"})
+        }
+    }
 
     connInterface, err := h.pool.Get(p.Handle)
     if err != nil {
@@ -135,25 +487,49 @@ func (h *Handler) handleSearchUIDs(params json.RawMessage) protocol.Response {
     }
 
     conn := connInterface.(*Connection)
-    uids, err := conn.SearchUIDs(p.HighestUID)
+    criteria := uidCriteria(p.HighestUID, p.Unseen)
+    if len(p.Return) > 0 {
+        summary, err := conn.SearchReturn(criteria, p.Return)
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+        return protocol.SuccessResponse(summary)
+    }
+
+    uids, err := conn.Search(criteria)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    start, end, next, err := p.Slice(len(uids), func(i int) string {
+        return strconv.FormatUint(uint64(uids[i]), 10)
+    })
     if err != nil {
         return protocol.ErrorResponse(err)
     }
 
     return protocol.SuccessResponse(map[string]any{
-        "uids": uids,
+        "uids":        uids[start:end],
+        "total":       len(uids),
+        "next_cursor": next,
     })
 }
 
-func (h *Handler) handleFetchMessages(params json.RawMessage) protocol.Response {
+func (h *Handler) handleFetchMessages(ctx context.Context, params json.RawMessage, partial func(any) error) protocol.Response {
     var p struct {
-        Handle int      `json:"handle"`
+        Handle int      `json:"handle" validate:"required"`
         UIDs   []uint32 `json:"uids"`
+
+        // Peek fetches with BODY.PEEK so messages stay unread, unless set
+        // to false
+        Peek *bool `json:"peek"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
+    // Setting \Seen changes the mailbox, which read-only mode forbids
+    peek := p.Peek == nil || *p.Peek || h.readOnly
 
     connInterface, err := h.pool.Get(p.Handle)
     if err != nil {
@@ -161,25 +537,51 @@ func (h *Handler) handleFetchMessages(params json.RawMessage) protocol.Response
     }
 
     conn := connInterface.(*Connection)
-    messages, err := conn.FetchMessages(p.UIDs)
+
+    // Streaming: one partial response per message, then a final count
+    if partial != nil {
+        count := 0
+        err := conn.FetchEach(ctx, p.UIDs, peek, func(uid uint32, body []byte) error {
+            count++
+            return partial(map[string]any{
+                "uid":     uid,
+                "message": body, // base64 in JSON, raw bytes in msgpack
+            })
+        })
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+
+        return protocol.SuccessResponse(map[string]any{
+            "count": count,
+        })
+    }
+
+    messages, err := conn.FetchMessages(ctx, p.UIDs, peek)
     if err != nil {
         return protocol.ErrorResponse(err)
     }
 
+    // Key by decimal UID in every encoding, as JSON objects must be
+    keyed := make(map[string][]byte, len(messages))
+    for uid, body := range messages {
+        keyed[strconv.FormatUint(uint64(uid), 10)] = body
+    }
+
     return protocol.SuccessResponse(map[string]any{
-        "messages": messages,
+        "messages": keyed,
     })
 }
 
-func (h *Handler) handleSetFlags(params json.RawMessage) protocol.Response {
+func (h *Handler) handleSetFlags(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int      `json:"handle"`
-        UID    uint32   `json:"uid"`
+        Handle int      `json:"handle" validate:"required"`
+        UID    uint32   `json:"uid" validate:"required"`
         Flags  []string `json:"flags"`
         Add    bool     `json:"add"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -196,14 +598,14 @@ func (h *Handler) handleSetFlags(params json.RawMessage) protocol.Response {
     return protocol.SuccessResponse(nil)
 }
 
-func (h *Handler) handleCopyMessage(params json.RawMessage) protocol.Response {
+func (h *Handler) handleCopyMessage(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle     int    `json:"handle"`
-        UID        uint32 `json:"uid"`
-        DestFolder string `json:"dest_folder"`
+        Handle     int    `json:"handle" validate:"required"`
+        UID        uint32 `json:"uid" validate:"required"`
+        DestFolder string `json:"dest_folder" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -213,19 +615,20 @@ func (h *Handler) handleCopyMessage(params json.RawMessage) protocol.Response {
     }
 
     conn := connInterface.(*Connection)
-    if err := conn.CopyMessage(p.UID, p.DestFolder); err != nil {
+    result, err := conn.CopyMessage(p.UID, p.DestFolder)
+    if err != nil {
         return protocol.ErrorResponse(err)
     }
 
-    return protocol.SuccessResponse(nil)
+    return protocol.SuccessResponse(result)
 }
 
-func (h *Handler) handleExpunge(params json.RawMessage) protocol.Response {
+func (h *Handler) handleExpunge(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int `json:"handle"`
+        Handle int `json:"handle" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -242,12 +645,12 @@ func (h *Handler) handleExpunge(params json.RawMessage) protocol.Response {
     return protocol.SuccessResponse(nil)
 }
 
-func (h *Handler) handleNoop(params json.RawMessage) protocol.Response {
+func (h *Handler) handleNoop(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int `json:"handle"`
+        Handle int `json:"handle" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -263,3 +666,46 @@ func (h *Handler) handleNoop(params json.RawMessage) protocol.Response {
 
     return protocol.SuccessResponse(nil)
 }
+
+func (h *Handler) handleCapabilities(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    caps, err := conn.Capabilities()
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "capabilities": caps,
+    })
+}
+
+func (h *Handler) handleStats(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    result := map[string]any{
+        "global": h.stats.Global(),
+    }
+    if p.Handle != 0 {
+        result["handle"] = h.stats.Handle(p.Handle)
+    }
+
+    return protocol.SuccessResponse(result)
+}
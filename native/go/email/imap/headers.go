@@ -0,0 +1,124 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	stdmime "mime"
+	"net/textproto"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// MessageHeaders is the header of a message, by canonical field name.
+// Values keep their order, with folding undone and encoded words decoded.
+type MessageHeaders struct {
+    UID     uint32              `json:"uid"`
+    Headers map[string][]string `json:"headers"`
+}
+
+// headerSection is the section fetch_headers reads: the whole header, or
+// only the given fields
+func headerSection(fields []string) *imap.BodySectionName {
+    return &imap.BodySectionName{
+        BodyPartName: imap.BodyPartName{
+            Specifier: imap.HeaderSpecifier,
+            Fields:    fields,
+        },
+        Peek: true,
+    }
+}
+
+// decodedHeader decodes RFC 2047 encoded words in every value, keeping a
+// value as sent when it can't be decoded
+func decodedHeader(header textproto.MIMEHeader) map[string][]string {
+    decoder := new(stdmime.WordDecoder)
+    result := make(map[string][]string, len(header))
+    for name, values := range header {
+        decoded := make([]string, len(values))
+        for i, value := range values {
+            if d, err := decoder.DecodeHeader(value); err == nil {
+                value = d
+            }
+            decoded[i] = value
+        }
+        result[name] = decoded
+    }
+    return result
+}
+
+// FetchHeaders fetches the headers of messages in a folder, limited to
+// fields when given, with one UID FETCH
+func (c *Connection) FetchHeaders(ctx context.Context, folder string, uids []uint32, fields []string) ([]MessageHeaders, error) {
+    section := headerSection(fields)
+    items := []imap.FetchItem{imap.FetchUid, section.FetchItem()}
+    result := make([]MessageHeaders, 0, len(uids))
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return fetchWith(client, uids, items, func(msg *imap.Message) {
+            headers := map[string][]string{}
+            if header := fetchedHeader(msg, section); header != nil {
+                headers = decodedHeader(header)
+            }
+            result = append(result, MessageHeaders{UID: msg.Uid, Headers: headers})
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func (h *Handler) handleFetchHeaders(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder" validate:"required"`
+        UIDs   []uint32 `json:"uids" validate:"required,max=500"` // Fetched with a single FETCH
+
+        // Fields limits the headers to those named, such as Message-ID,
+        // References and List-Unsubscribe; empty fetches them all
+        Fields []string `json:"fields"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    for i, field := range p.Fields {
+        if !validFieldName(field) {
+            return protocol.ErrorResponse(&protocol.ValidationError{Field: fmt.Sprintf("params.fields[%d]", i), Reason: "not a header field name"})
+        }
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    messages, err := conn.FetchHeaders(ctx, p.Folder, p.UIDs, p.Fields)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "messages": messages,
+    })
+}
+
+// validFieldName reports whether name is a header field name (RFC 5322
+// printable ASCII except colon) that is also an IMAP atom, so it can go
+// into HEADER.FIELDS as is
+func validFieldName(name string) bool {
+    if name == "" {
+        return false
+    }
+    for _, r := range name {
+        if r <= ' ' || r > '~' || r == ':' || r == '(' || r == ')' || r == '"' || r == '\\' {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,318 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Conflict resolution policies for replaying offline changes
+const (
+    PolicyServerWins    = "server_wins"        // Drop the local change
+    PolicyLocalWins     = "local_wins"         // Force the local change onto the server
+    PolicyDuplicateFlag = "duplicate_and_flag" // Keep both sides and mark the message for review
+)
+
+// conflictFlag marks messages kept by duplicate_and_flag
+const conflictFlag = "$Conflict"
+
+// JournalEntry is one change made offline. BaseFlags are the flags the
+// client saw when it made the change, used to tell whether the server
+// changed the message meanwhile. Message optionally carries the body, and
+// InternalDate its original arrival time, so a message deleted on the
+// server can be restored.
+type JournalEntry struct {
+    Folder      string   `json:"folder"`
+    UIDValidity uint32   `json:"uid_validity"`
+    UID         uint32   `json:"uid"`
+    Op          string   `json:"op"` // "flags" or "delete"
+    BaseFlags   []string `json:"base_flags"`
+    Add         []string `json:"add,omitempty"`
+    Remove      []string `json:"remove,omitempty"`
+    Message     []byte   `json:"message_b64,omitempty"`
+
+    InternalDate time.Time `json:"internal_date,omitempty"`
+}
+
+// Conflict reports how one disagreement was resolved
+type Conflict struct {
+    Folder     string `json:"folder"`
+    UID        uint32 `json:"uid"`
+    Kind       string `json:"kind"` // deleted_on_server, changed_on_server, uidvalidity
+    Resolution string `json:"resolution"`
+    NewUID     uint32 `json:"new_uid,omitempty"` // Of a restored copy
+}
+
+// JournalReport summarises a journal replay
+type JournalReport struct {
+    Applied   int        `json:"applied"`
+    Conflicts []Conflict `json:"conflicts"`
+}
+
+// FetchFlags fetches the flags of messages in the selected folder; UIDs
+// missing from the result no longer exist
+func (c *Connection) FetchFlags(uids []uint32) (map[uint32][]string, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return flagsWith(client, uids)
+}
+
+// flagsWith fetches flags over a client the caller already holds
+func flagsWith(client *client.Client, uids []uint32) (map[uint32][]string, error) {
+    result := make(map[uint32][]string)
+    if len(uids) == 0 {
+        return result, nil
+    }
+
+    messages := make(chan *imap.Message, 64)
+    done := make(chan error, 1)
+
+    go func() {
+        done <- client.UidFetch(uidSet(uids), []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+    }()
+
+    for msg := range messages {
+        result[msg.Uid] = msg.Flags
+    }
+
+    if err := <-done; err != nil {
+        return nil, fmt.Errorf("fetch failed: %w", err)
+    }
+
+    return result, nil
+}
+
+// ReplayJournal applies offline changes, resolving disagreements with the
+// server by policy
+func (c *Connection) ReplayJournal(ctx context.Context, entries []JournalEntry, policy string) (*JournalReport, error) {
+    report := &JournalReport{Conflicts: []Conflict{}}
+
+    // Group by folder, keeping the journal's order within each
+    var folders []string
+    byFolder := make(map[string][]JournalEntry)
+    for _, entry := range entries {
+        if _, ok := byFolder[entry.Folder]; !ok {
+            folders = append(folders, entry.Folder)
+        }
+        byFolder[entry.Folder] = append(byFolder[entry.Folder], entry)
+    }
+
+    for _, folder := range folders {
+        if err := ctx.Err(); err != nil {
+            return report, err
+        }
+        if err := c.replayFolder(folder, byFolder[folder], policy, report); err != nil {
+            return report, fmt.Errorf("replay in %s: %w", folder, err)
+        }
+    }
+
+    return report, nil
+}
+
+func (c *Connection) replayFolder(folder string, entries []JournalEntry, policy string, report *JournalReport) error {
+    return c.withFolder(folder, false, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        uids := make([]uint32, 0, len(entries))
+        for _, entry := range entries {
+            uids = append(uids, entry.UID)
+        }
+        current, err := flagsWith(client, uids)
+        if err != nil {
+            return err
+        }
+
+        // current follows the entries as they are applied, and restored maps
+        // a message restored from the journal to its copy's UID, so later
+        // entries for the same message build on earlier ones
+        restored := make(map[uint32]uint32)
+        var deleted []uint32
+        for _, entry := range entries {
+            conflict := Conflict{Folder: folder, UID: entry.UID, Resolution: policy}
+
+            serverFlags, exists := current[entry.UID]
+            target := entry.UID
+            if uid, ok := restored[entry.UID]; ok {
+                target = uid
+            }
+            switch {
+            case entry.UIDValidity != mbox.UidValidity:
+                // UIDs no longer name the same messages; nothing can be matched
+                conflict.Kind = "uidvalidity"
+                conflict.Resolution = "dropped"
+                report.Conflicts = append(report.Conflicts, conflict)
+                continue
+
+            case !exists:
+                conflict.Kind = "deleted_on_server"
+                if entry.Op == "delete" {
+                    // Both sides agree
+                    report.Applied++
+                    continue
+                }
+                if policy == PolicyServerWins || len(entry.Message) == 0 {
+                    conflict.Resolution = PolicyServerWins
+                    report.Conflicts = append(report.Conflicts, conflict)
+                    continue
+                }
+
+                // Restore the message with the local flags applied
+                flags := applyFlagChange(entry.BaseFlags, entry.Add, entry.Remove)
+                if policy == PolicyDuplicateFlag {
+                    flags = append(flags, conflictFlag)
+                }
+                result, err := appendWith(client, folder, withoutRecent(flags), entry.InternalDate, entry.Message)
+                if err != nil {
+                    return err
+                }
+                conflict.NewUID = result.UID
+                report.Conflicts = append(report.Conflicts, conflict)
+
+                current[entry.UID] = flags
+                restored[entry.UID] = result.UID
+                continue
+
+            case target == 0:
+                // Restored without UIDPLUS, so the copy can't be found again
+                conflict.Kind = "deleted_on_server"
+                conflict.Resolution = "dropped"
+                report.Conflicts = append(report.Conflicts, conflict)
+                continue
+
+            case changedSince(entry, serverFlags):
+                conflict.Kind = "changed_on_server"
+                report.Conflicts = append(report.Conflicts, conflict)
+
+                switch policy {
+                case PolicyServerWins:
+                    continue
+                case PolicyDuplicateFlag:
+                    // Keep the server's state and the message, flagged for review
+                    if err := storeFlagsWith(client, []uint32{target}, []string{conflictFlag}, true); err != nil {
+                        return err
+                    }
+                    current[entry.UID] = applyFlagChange(serverFlags, []string{conflictFlag}, nil)
+                    continue
+                }
+            }
+
+            // No conflict, or local wins
+            if entry.Op == "delete" {
+                deleted = append(deleted, target)
+                delete(current, entry.UID)
+                delete(restored, entry.UID)
+            } else {
+                if len(entry.Add) > 0 {
+                    if err := storeFlagsWith(client, []uint32{target}, entry.Add, true); err != nil {
+                        return err
+                    }
+                }
+                if len(entry.Remove) > 0 {
+                    if err := storeFlagsWith(client, []uint32{target}, entry.Remove, false); err != nil {
+                        return err
+                    }
+                }
+                current[entry.UID] = applyFlagChange(serverFlags, entry.Add, entry.Remove)
+            }
+            report.Applied++
+        }
+
+        // Only the journal's own deletions are expunged
+        if len(deleted) > 0 {
+            return expungeUIDsWith(client, deleted)
+        }
+        return nil
+    })
+}
+
+// changedSince reports whether the server changed any flag the entry
+// touches (or, for a delete, any flag at all) since the client's snapshot
+func changedSince(entry JournalEntry, serverFlags []string) bool {
+    if entry.Op == "delete" {
+        return flagKey(withoutRecent(entry.BaseFlags)) != flagKey(withoutRecent(serverFlags))
+    }
+
+    base := flagSet(entry.BaseFlags)
+    server := flagSet(serverFlags)
+
+    for _, flag := range append(append([]string{}, entry.Add...), entry.Remove...) {
+        if base[flag] != server[flag] {
+            return true
+        }
+    }
+    return false
+}
+
+func applyFlagChange(base, add, remove []string) []string {
+    set := flagSet(base)
+    for _, flag := range add {
+        set[flag] = true
+    }
+    for _, flag := range remove {
+        delete(set, flag)
+    }
+
+    flags := make([]string, 0, len(set))
+    for flag := range set {
+        flags = append(flags, flag)
+    }
+    return flags
+}
+
+func flagSet(flags []string) map[string]bool {
+    set := make(map[string]bool, len(flags))
+    for _, flag := range flags {
+        set[flag] = true
+    }
+    return set
+}
+
+// withoutRecent drops \Recent, which clients may not set
+func withoutRecent(flags []string) []string {
+    kept := make([]string, 0, len(flags))
+    for _, flag := range flags {
+        if flag != imap.RecentFlag {
+            kept = append(kept, flag)
+        }
+    }
+    return kept
+}
+
+func (h *Handler) handleReplayJournal(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle  int            `json:"handle" validate:"required"`
+        Entries []JournalEntry `json:"entries"`
+        Policy  string         `json:"policy"` // Default server_wins
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    switch p.Policy {
+    case "":
+        p.Policy = PolicyServerWins
+    case PolicyServerWins, PolicyLocalWins, PolicyDuplicateFlag:
+    default:
+        return protocol.ErrorResponse(fmt.Errorf("unknown conflict policy: %s", p.Policy))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    report, err := conn.ReplayJournal(ctx, p.Entries, p.Policy)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(report)
+}
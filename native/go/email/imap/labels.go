@@ -0,0 +1,208 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/tags"
+)
+
+// Label backends, in order of preference
+const (
+    labelsGmail   = "gmail"   // X-GM-LABELS
+    labelsKeyword = "keyword" // IMAP keywords (custom flags)
+    labelsLocal   = "local"   // Native tag store, never synced to the server
+)
+
+// labelTarget is a selected folder and the backend its labels live in
+type labelTarget struct {
+    backend     string
+    uidValidity uint32
+}
+
+// withLabels selects folder, picks the label backend for it and calls fn,
+// putting back the previous selection afterwards. Keywords need the server
+// to accept new flags (\* in PERMANENTFLAGS) and the label to be a valid
+// flag atom; servers only report those to a read-write SELECT.
+func (c *Connection) withLabels(folder, label string, fn func(*client.Client, *labelTarget) error) (*labelTarget, error) {
+    gmail := c.isGmail()
+
+    target := &labelTarget{backend: labelsLocal}
+    err := c.withFolder(folder, false, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        target.uidValidity = mbox.UidValidity
+        switch {
+        case gmail:
+            target.backend = labelsGmail
+        case validKeyword(label) && acceptsKeywords(mbox):
+            target.backend = labelsKeyword
+        }
+        return fn(client, target)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return target, nil
+}
+
+// storeLabels adds or removes a Gmail label on messages in the selected folder
+func storeLabels(client *client.Client, uids []uint32, label string, add bool) error {
+    item := imap.StoreItem("-X-GM-LABELS.SILENT")
+    if add {
+        item = imap.StoreItem("+X-GM-LABELS.SILENT")
+    }
+
+    return client.UidStore(uidSet(uids), item, []interface{}{label}, nil)
+}
+
+// searchKeyword finds messages in the selected folder carrying a keyword
+func searchKeyword(client *client.Client, keyword string) ([]uint32, error) {
+    criteria := imap.NewSearchCriteria()
+    criteria.WithFlags = []string{keyword}
+
+    return searchWith(client, criteria)
+}
+
+// account identifies the connection's mailbox for the local tag store
+func (c *Connection) account() string {
+    return c.username + "@" + c.host
+}
+
+func acceptsKeywords(mbox *imap.MailboxStatus) bool {
+    for _, flag := range mbox.PermanentFlags {
+        if flag == imap.TryCreateFlag {
+            return true
+        }
+    }
+    return false
+}
+
+// validKeyword reports whether label can be sent as an IMAP flag atom
+func validKeyword(label string) bool {
+    if label == "" || strings.HasPrefix(label, `\`) {
+        return false
+    }
+    for _, r := range label {
+        if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+            return false
+        }
+    }
+    return true
+}
+
+// SetTagStore sets the local store used when a server can't hold labels
+func (h *Handler) SetTagStore(store *tags.Store) {
+    h.tags = store
+}
+
+func (h *Handler) handleAddLabel(ctx context.Context, params json.RawMessage) protocol.Response {
+    return h.changeLabel(ctx, params, true)
+}
+
+func (h *Handler) handleRemoveLabel(ctx context.Context, params json.RawMessage) protocol.Response {
+    return h.changeLabel(ctx, params, false)
+}
+
+func (h *Handler) changeLabel(ctx context.Context, params json.RawMessage, add bool) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder" validate:"required"`
+        UIDs   []uint32 `json:"uids" validate:"required"`
+        Label  string   `json:"label" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if err := checkUIDs(p.UIDs); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    target, err := conn.withLabels(p.Folder, p.Label, func(client *client.Client, target *labelTarget) error {
+        switch target.backend {
+        case labelsGmail:
+            return storeLabels(client, p.UIDs, p.Label, add)
+        case labelsKeyword:
+            return storeFlagsWith(client, p.UIDs, []string{p.Label}, add)
+        }
+        return nil
+    })
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if target.backend == labelsLocal {
+        if h.tags == nil {
+            return protocol.ErrorResponse(fmt.Errorf("server does not support labels and no local tag store is configured"))
+        }
+        if add {
+            err = h.tags.Add(conn.account(), p.Folder, target.uidValidity, p.UIDs, p.Label)
+        } else {
+            err = h.tags.Remove(conn.account(), p.Folder, target.uidValidity, p.UIDs, p.Label)
+        }
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "backend": target.backend,
+        "count":   len(p.UIDs),
+    })
+}
+
+func (h *Handler) handleSearchByLabel(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+        Label  string `json:"label" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    var uids []uint32
+    target, err := conn.withLabels(p.Folder, p.Label, func(client *client.Client, target *labelTarget) error {
+        var err error
+        switch target.backend {
+        case labelsGmail:
+            uids, err = uidSearchRaw(client, imap.RawString("X-GM-LABELS"), p.Label)
+        case labelsKeyword:
+            uids, err = searchKeyword(client, p.Label)
+        }
+        return err
+    })
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if target.backend == labelsLocal {
+        if h.tags == nil {
+            return protocol.ErrorResponse(fmt.Errorf("server does not support labels and no local tag store is configured"))
+        }
+        uids, err = h.tags.Search(conn.account(), p.Folder, target.uidValidity, p.Label)
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "backend": target.backend,
+        "uids":    uids,
+    })
+}
@@ -0,0 +1,204 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// listFields is the header section mailing lists are detected from
+var listFields = &imap.BodySectionName{
+    BodyPartName: imap.BodyPartName{
+        Specifier: imap.HeaderSpecifier,
+        Fields:    mime.ListHeaders,
+    },
+    Peek: true,
+}
+
+// MailingListGroup is the messages of one list in a folder
+type MailingListGroup struct {
+    mime.MailingList
+    Count  int       `json:"count"`
+    UIDs   []uint32  `json:"uids"`
+    Latest time.Time `json:"latest"`
+}
+
+// messageList returns the mailing list of a message fetched with
+// listFields, or nil for personal mail
+func messageList(msg *imap.Message) *mime.MailingList {
+    header := fetchedHeader(msg, listFields)
+    if header == nil {
+        return nil
+    }
+    return mime.ListOf(header)
+}
+
+// fetchedHeader parses a header section fetched with msg, returning nil if
+// it wasn't fetched or can't be read
+func fetchedHeader(msg *imap.Message, section *imap.BodySectionName) textproto.MIMEHeader {
+    literal := msg.GetBody(section)
+    if literal == nil {
+        return nil
+    }
+
+    raw, err := io.ReadAll(literal)
+    if err != nil {
+        return nil
+    }
+    header, err := mime.ReadHeader(raw)
+    if err != nil {
+        return nil
+    }
+    return header
+}
+
+// filterLists keeps either the list mail or the personal mail
+func filterLists(messages []MessageMetadata, lists bool) []MessageMetadata {
+    kept := messages[:0:0]
+    for _, msg := range messages {
+        if (msg.List != nil) == lists {
+            kept = append(kept, msg)
+        }
+    }
+    return kept
+}
+
+// searchBulk finds messages in the selected folder with any of the headers
+// list and bulk mail is recognised by. Precedence is matched as a
+// substring, so "bulk" and "list" are checked again by mime.ListOf.
+func searchBulk(client *client.Client) ([]uint32, error) {
+    header := func(name, value string) *imap.SearchCriteria {
+        criteria := imap.NewSearchCriteria()
+        criteria.Header = textproto.MIMEHeader{name: {value}}
+        return criteria
+    }
+    or := func(a, b *imap.SearchCriteria) *imap.SearchCriteria {
+        criteria := imap.NewSearchCriteria()
+        criteria.Or = [][2]*imap.SearchCriteria{{a, b}}
+        return criteria
+    }
+
+    criteria := or(
+        or(header("List-Id", ""), header("List-Unsubscribe", "")),
+        or(or(header("Precedence", "bulk"), header("Precedence", "list")), header("Feedback-ID", "")),
+    )
+
+    uids, err := client.UidSearch(criteria)
+    if err != nil {
+        return nil, fmt.Errorf("search failed: %w", err)
+    }
+    return uids, nil
+}
+
+// MailingLists groups the list and bulk mail in a folder by list
+func (c *Connection) MailingLists(ctx context.Context, folder string) ([]*MailingListGroup, error) {
+    groups := make(map[string]*MailingListGroup)
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, listFields.FetchItem()}
+
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        uids, err := searchBulk(client)
+        if err != nil {
+            return err
+        }
+
+        for start := 0; start < len(uids); start += fetchBatchSize {
+            if err := lanes.Yield(ctx); err != nil {
+                return err
+            }
+
+            end := start + fetchBatchSize
+            if end > len(uids) {
+                end = len(uids)
+            }
+
+            err := fetchWith(client, uids[start:end], items, func(msg *imap.Message) {
+                list := messageList(msg)
+                if list == nil {
+                    return
+                }
+
+                group, ok := groups[list.ID]
+                if !ok {
+                    group = &MailingListGroup{MailingList: *list}
+                    groups[list.ID] = group
+                }
+                group.Count++
+                group.UIDs = append(group.UIDs, msg.Uid)
+
+                // The newest message names and unsubscribes for the list
+                if msg.InternalDate.After(group.Latest) {
+                    group.Latest = msg.InternalDate
+                    if list.Name != "" {
+                        group.Name = list.Name
+                    }
+                    if list.Unsubscribe != "" {
+                        group.Unsubscribe = list.Unsubscribe
+                    }
+                }
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    result := make([]*MailingListGroup, 0, len(groups))
+    for _, group := range groups {
+        sort.Slice(group.UIDs, func(i, j int) bool { return group.UIDs[i] < group.UIDs[j] })
+        result = append(result, group)
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].Latest.After(result[j].Latest) })
+
+    return result, nil
+}
+
+func (h *Handler) handleMailingLists(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder"`
+        List   string `json:"list"` // Optional: only this list's messages
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    groups, err := conn.MailingLists(ctx, p.Folder)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if p.List != "" {
+        filtered := groups[:0]
+        for _, group := range groups {
+            if group.ID == strings.ToLower(p.List) {
+                filtered = append(filtered, group)
+            }
+        }
+        groups = filtered
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "lists": groups,
+    })
+}
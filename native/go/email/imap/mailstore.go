@@ -0,0 +1,146 @@
+package imap
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/provider"
+)
+
+// getConnection looks up the connection behind a handle
+func (h *Handler) getConnection(handle int) (*Connection, error) {
+    connInterface, err := h.pool.Get(handle)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, ok := connInterface.(*Connection)
+    if !ok {
+        return nil, protocol.WithCode(protocol.CodeInvalidHandle, fmt.Errorf("handle %d is not an IMAP connection", handle))
+    }
+
+    return conn, nil
+}
+
+// Append stores a message in folder on the connection identified by handle,
+// returning the folder used with UIDVALIDITY and UID when the server reports
+// them (UIDPLUS). A role folder the server reports missing is looked for
+// again, and the message appended where it went.
+func (h *Handler) Append(handle int, folder string, flags []string, message []byte) (string, uint32, uint32, error) {
+    conn, err := h.getConnection(handle)
+    if err != nil {
+        return "", 0, 0, err
+    }
+
+    result, err := appendFollowing(conn, folder, flags, time.Now(), message)
+    if err != nil {
+        return "", 0, 0, err
+    }
+
+    return result.Folder, result.UIDValidity, result.UID, nil
+}
+
+// appendFollowing appends a message, following a role folder the server
+// reports missing to where it went
+func appendFollowing(conn *Connection, folder string, flags []string, date time.Time, message []byte) (*AppendResult, error) {
+    result, err := conn.AppendMessage(folder, flags, date, message)
+    if errors.Is(err, errFolderMissing) {
+        if moved := conn.relocate(folder); moved != "" {
+            result, err = conn.AppendMessage(moved, flags, date, message)
+        }
+    }
+    return result, err
+}
+
+func (h *Handler) handleAppendMessage(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int      `json:"handle" validate:"required"`
+        Folder     string   `json:"folder" validate:"required"`
+        Flags      []string `json:"flags"`
+        MessageB64 string   `json:"message_b64" validate:"required"` // The RFC 822 message
+
+        // InternalDate is stored as the message's arrival time; the server
+        // uses the current time when it's omitted
+        InternalDate time.Time `json:"internal_date"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    message, err := base64.StdEncoding.DecodeString(p.MessageB64)
+    if err != nil {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("invalid base64 message: %w", err)))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    result, err := appendFollowing(conn, p.Folder, p.Flags, p.InternalDate, message)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(result)
+}
+
+// Delete removes a message Append stored, unless its folder was renumbered
+// since
+func (h *Handler) Delete(handle int, folder string, uidValidity, uid uint32) error {
+    conn, err := h.getConnection(handle)
+    if err != nil {
+        return err
+    }
+
+    return conn.withFolder(folder, false, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        if mbox.UidValidity != uidValidity {
+            return fmt.Errorf("UIDVALIDITY of %s changed", folder)
+        }
+        return expungeUIDsWith(client, []uint32{uid})
+    })
+}
+
+// URLAuth returns a URLAUTH-authorised URL that lets submitter fetch a stored
+// message, or an empty string when the server does not support URLAUTH
+func (h *Handler) URLAuth(handle int, folder string, uidValidity, uid uint32, submitter string) (string, error) {
+    conn, err := h.getConnection(handle)
+    if err != nil {
+        return "", err
+    }
+
+    if !conn.Supports("URLAUTH") {
+        return "", nil
+    }
+
+    return conn.GenURLAuth(folder, uidValidity, uid, submitter)
+}
+
+// SentFolder returns the Sent folder of the account behind handle, and
+// whether the provider already files submitted messages there by itself
+func (h *Handler) SentFolder(handle int) (string, bool, error) {
+    conn, err := h.getConnection(handle)
+    if err != nil {
+        return "", false, err
+    }
+
+    folder, err := conn.SentFolder()
+    if err != nil {
+        return "", false, err
+    }
+
+    if p := provider.Lookup(conn.Host()); p != nil && p.SavesSent {
+        return folder, true, nil
+    }
+
+    // Gmail-compatible servers advertise their extensions
+    return folder, conn.Supports("X-GM-EXT-1"), nil
+}
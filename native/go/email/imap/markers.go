@@ -0,0 +1,161 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Markers are the colour flag and priority of a message
+type Markers struct {
+    Color    string `json:"color,omitempty"`
+    Priority string `json:"priority"`
+}
+
+// priorityFields is the header section holding a message's priority
+var priorityFields = &imap.BodySectionName{
+    BodyPartName: imap.BodyPartName{
+        Specifier: imap.HeaderSpecifier,
+        Fields:    []string{"X-Priority", "X-MSMail-Priority", "Importance"},
+    },
+    Peek: true,
+}
+
+// FetchMarkers fetches the colour flag and priority of messages in folder
+func (c *Connection) FetchMarkers(folder string, uids []uint32) (map[uint32]Markers, error) {
+    result := make(map[uint32]Markers)
+    if len(uids) == 0 {
+        return result, nil
+    }
+
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        return fetchMarkersWith(client, uids, result)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// fetchMarkersWith fetches markers into result over a client the caller
+// already holds
+func fetchMarkersWith(client *client.Client, uids []uint32, result map[uint32]Markers) error {
+    messages := make(chan *imap.Message, 16)
+    done := make(chan error, 1)
+
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, priorityFields.FetchItem()}
+    go func() {
+        done <- client.UidFetch(uidSet(uids), items, messages)
+    }()
+
+    for msg := range messages {
+        if msg == nil {
+            continue
+        }
+
+        markers := Markers{
+            Color:    mime.ColorFromFlags(msg.Flags),
+            Priority: mime.PriorityNormal,
+        }
+
+        if literal := msg.GetBody(priorityFields); literal != nil {
+            if raw, err := io.ReadAll(literal); err == nil {
+                if header, err := mime.ReadHeader(raw); err == nil {
+                    markers.Priority = mime.Priority(header)
+                }
+            }
+        }
+
+        result[msg.Uid] = markers
+    }
+
+    if err := <-done; err != nil {
+        return fmt.Errorf("fetch failed: %w", err)
+    }
+    return nil
+}
+
+// SetColor sets the colour flag of messages in folder, in the $MailFlagBit
+// encoding Apple Mail and other clients understand
+func (c *Connection) SetColor(folder string, uids []uint32, color string) error {
+    add, remove, err := mime.ColorFlags(color)
+    if err != nil {
+        return err
+    }
+
+    return c.withFolder(folder, false, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if len(remove) > 0 {
+            if err := storeFlagsWith(client, uids, remove, false); err != nil {
+                return err
+            }
+        }
+        if len(add) > 0 {
+            if err := storeFlagsWith(client, uids, add, true); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func (h *Handler) handleSetColor(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder" validate:"required"`
+        UIDs   []uint32 `json:"uids" validate:"required"`
+        Color  string   `json:"color"` // red, orange, yellow, green, blue, purple, gray or none
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if err := checkUIDs(p.UIDs); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if err := conn.SetColor(p.Folder, p.UIDs, p.Color); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(nil)
+}
+
+func (h *Handler) handleMessageMarkers(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder" validate:"required"`
+        UIDs   []uint32 `json:"uids" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if err := checkUIDs(p.UIDs); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    markers, err := conn.FetchMarkers(p.Folder, p.UIDs)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "markers": markers,
+    })
+}
@@ -0,0 +1,275 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Optional FETCH items, requested only when the server advertises them
+const (
+    fetchSaveDate = imap.FetchItem("SAVEDATE") // RFC 8514
+    fetchModSeq   = imap.FetchItem("MODSEQ")   // RFC 7162
+)
+
+// dateFields is the header section dates are normalized from
+var dateFields = &imap.BodySectionName{
+    BodyPartName: imap.BodyPartName{
+        Specifier: imap.HeaderSpecifier,
+        Fields:    mime.DateHeaders,
+    },
+    Peek: true,
+}
+
+// MessageAddress is one envelope address
+type MessageAddress struct {
+    Name    string `json:"name,omitempty"`
+    Address string `json:"address"`
+}
+
+// MessageMetadata is a message's envelope with the dates and identifiers
+// the frontend ages and tracks messages by
+type MessageMetadata struct {
+    UID          uint32           `json:"uid"`
+    Subject      string           `json:"subject"`
+    From         []MessageAddress `json:"from"`
+    To           []MessageAddress `json:"to"`
+    Cc           []MessageAddress `json:"cc,omitempty"`
+    Date         time.Time        `json:"date"`
+    MessageID    string           `json:"message_id"`
+    InReplyTo    string           `json:"in_reply_to,omitempty"`
+    Flags        []string         `json:"flags"`
+    Size         uint32           `json:"size"`
+    InternalDate time.Time        `json:"internal_date"`
+
+    // SaveDate is when the message was stored in this folder, which unlike
+    // INTERNALDATE changes on move; nil where SAVEDATE is unsupported
+    SaveDate *time.Time `json:"save_date,omitempty"`
+    ModSeq   uint64     `json:"modseq,omitempty"`
+    EmailID  string     `json:"email_id,omitempty"`
+    ThreadID string     `json:"thread_id,omitempty"`
+
+    // List is the mailing list or bulk sender the message came from; nil
+    // for personal mail
+    List *mime.MailingList `json:"list,omitempty"`
+
+    // Priority is a virtual label from the sender: "vip", "important" or
+    // unset. It lives only in the classifier, never on the server.
+    Priority string `json:"priority,omitempty"`
+
+    // Dates are the Date header and Received chain normalized to UTC,
+    // fetched only on request
+    Dates *mime.MessageDates `json:"dates,omitempty"`
+}
+
+// metadataItems lists the FETCH items for metadata, adding the optional
+// ones the server supports and the date headers if asked
+func (c *Connection) metadataItems(dates bool) []imap.FetchItem {
+    items := []imap.FetchItem{
+        imap.FetchUid, imap.FetchEnvelope, imap.FetchFlags,
+        imap.FetchRFC822Size, imap.FetchInternalDate, listFields.FetchItem(),
+    }
+    if c.Supports("SAVEDATE") {
+        items = append(items, fetchSaveDate)
+    }
+    if c.Supports("CONDSTORE") {
+        items = append(items, fetchModSeq)
+    }
+    if c.Supports("OBJECTID") {
+        items = append(items, imap.FetchItem("EMAILID"), imap.FetchItem("THREADID"))
+    }
+    if dates {
+        items = append(items, dateFields.FetchItem())
+    }
+    return items
+}
+
+// FetchMetadata fetches envelope metadata for messages in a folder, with
+// normalized dates if dates is set
+func (c *Connection) FetchMetadata(ctx context.Context, folder string, uids []uint32, dates bool) ([]MessageMetadata, error) {
+    items := c.metadataItems(dates)
+    result := make([]MessageMetadata, 0, len(uids))
+
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        for start := 0; start < len(uids); start += fetchBatchSize {
+            if err := lanes.Yield(ctx); err != nil {
+                return err
+            }
+
+            end := start + fetchBatchSize
+            if end > len(uids) {
+                end = len(uids)
+            }
+
+            err := fetchWith(client, uids[start:end], items, func(msg *imap.Message) {
+                result = append(result, messageMetadata(msg))
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return result, nil
+}
+
+func messageMetadata(msg *imap.Message) MessageMetadata {
+    meta := MessageMetadata{
+        UID:          msg.Uid,
+        Flags:        msg.Flags,
+        Size:         msg.Size,
+        InternalDate: msg.InternalDate,
+        EmailID:      objectIDValue(msg.Items["EMAILID"]),
+        ThreadID:     objectIDValue(msg.Items["THREADID"]),
+        List:         messageList(msg),
+    }
+
+    if env := msg.Envelope; env != nil {
+        meta.Subject = env.Subject
+        meta.From = messageAddresses(env.From)
+        meta.To = messageAddresses(env.To)
+        meta.Cc = messageAddresses(env.Cc)
+        meta.Date = env.Date
+        meta.MessageID = env.MessageId
+        meta.InReplyTo = env.InReplyTo
+    }
+
+    // SAVEDATE is NIL where the server can't tell
+    if s, ok := msg.Items[fetchSaveDate].(string); ok {
+        if saved, err := time.Parse(imap.DateTimeLayout, s); err == nil {
+            meta.SaveDate = &saved
+        }
+    }
+
+    // MODSEQ comes as a one-element list
+    if list, ok := msg.Items[fetchModSeq].([]interface{}); ok && len(list) > 0 {
+        meta.ModSeq, _ = strconv.ParseUint(objectIDValue(list[0]), 10, 64)
+    }
+
+    if dates := messageDates(msg); dates != nil {
+        meta.Dates = dates
+        // go-imap leaves the envelope date zero when it can't parse it
+        if meta.Date.IsZero() && dates.Date != nil && dates.Date.Time != nil {
+            meta.Date = *dates.Date.Time
+        }
+    }
+
+    return meta
+}
+
+// messageDates normalizes the dates of a message fetched with dateFields,
+// or returns nil if they weren't fetched
+func messageDates(msg *imap.Message) *mime.MessageDates {
+    header := fetchedHeader(msg, dateFields)
+    if header == nil {
+        return nil
+    }
+    dates := mime.Dates(header)
+    return &dates
+}
+
+// dedupeSent drops the second copy of messages sharing a Message-ID. On
+// Gmail a client that appends to Sent as well as submitting leaves two
+// messages in All Mail, so the lowest UID is kept as the original. The
+// dropped UIDs are returned mapped to the UID kept in their place.
+func dedupeSent(messages []MessageMetadata) ([]MessageMetadata, map[uint32]uint32) {
+    first := make(map[string]int, len(messages))
+    for i, msg := range messages {
+        if msg.MessageID == "" {
+            continue
+        }
+        if j, ok := first[msg.MessageID]; !ok || msg.UID < messages[j].UID {
+            first[msg.MessageID] = i
+        }
+    }
+
+    kept := messages[:0:0]
+    duplicates := map[uint32]uint32{}
+    for i, msg := range messages {
+        if j, ok := first[msg.MessageID]; ok && j != i {
+            duplicates[msg.UID] = messages[j].UID
+            continue
+        }
+        kept = append(kept, msg)
+    }
+
+    return kept, duplicates
+}
+
+func messageAddresses(addrs []*imap.Address) []MessageAddress {
+    result := make([]MessageAddress, 0, len(addrs))
+    for _, addr := range addrs {
+        result = append(result, MessageAddress{Name: addr.PersonalName, Address: addr.Address()})
+    }
+    return result
+}
+
+func (h *Handler) handleFetchMetadata(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder"`
+        UIDs   []uint32 `json:"uids"`
+
+        // Gmail copies of a sent message are collapsed unless this is set
+        KeepDuplicates bool `json:"keep_duplicates"`
+
+        // Order VIP then important mail ahead of the rest
+        PriorityFirst bool `json:"priority_first"`
+
+        // Lists is "only" for list and bulk mail, "exclude" for personal
+        // mail, or empty for both
+        Lists string `json:"lists" validate:"oneof=only exclude"`
+
+        // Dates adds the Date header and Received timestamps, normalized
+        // to UTC beside their original text
+        Dates bool `json:"dates"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    messages, err := conn.FetchMetadata(ctx, p.Folder, p.UIDs, p.Dates)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    result := map[string]any{
+        "savedate": conn.Supports("SAVEDATE"),
+    }
+    if conn.isGmail() && !p.KeepDuplicates {
+        var duplicates map[uint32]uint32
+        messages, duplicates = dedupeSent(messages)
+        if len(duplicates) > 0 {
+            result["duplicates"] = duplicates
+        }
+    }
+
+    if p.Lists != "" {
+        messages = filterLists(messages, p.Lists == "only")
+    }
+
+    h.classify(messages)
+    if p.PriorityFirst {
+        priorityFirst(messages)
+    }
+    result["messages"] = messages
+
+    return protocol.SuccessResponse(result)
+}
@@ -0,0 +1,394 @@
+package imap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// migrationProgressInterval bounds how often migration progress is published
+const migrationProgressInterval = time.Second
+
+// migrationBatch and migrationBatchBytes bound the messages a migration
+// fetches per visit to a folder. A batch is held in memory until appended,
+// and the checkpoint is saved after each.
+const (
+    migrationBatch      = 100
+    migrationBatchBytes = 32 << 20
+)
+
+// folderCheckpoint records how far a folder's migration got. Messages are
+// copied in ascending UID order, so everything up to LastUID is done.
+type folderCheckpoint struct {
+    Dest        string `json:"dest"`
+    UIDValidity uint32 `json:"uid_validity"`
+    LastUID     uint32 `json:"last_uid"`
+    Copied      int    `json:"copied"`
+    Done        bool   `json:"done"`
+}
+
+// MigrationCheckpoint is the resumable state of an account migration
+type MigrationCheckpoint struct {
+    Started  time.Time                    `json:"started"`
+    Updated  time.Time                    `json:"updated"`
+    Finished bool                         `json:"finished"`
+    Folders  map[string]*folderCheckpoint `json:"folders"` // Keyed by source folder
+}
+
+// MigrationProgress is the payload of migration.progress events
+type MigrationProgress struct {
+    Folder     string `json:"folder"`
+    Copied     int    `json:"copied"` // Messages copied, across all runs
+    Total      int    `json:"total"`
+    ETASeconds int    `json:"eta_seconds,omitempty"`
+}
+
+// loadCheckpoint reads a migration checkpoint, or starts a new one
+func loadCheckpoint(path string) (*MigrationCheckpoint, error) {
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return &MigrationCheckpoint{Started: time.Now(), Folders: map[string]*folderCheckpoint{}}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var cp MigrationCheckpoint
+    if err := json.Unmarshal(data, &cp); err != nil {
+        return nil, fmt.Errorf("corrupt migration checkpoint: %w", err)
+    }
+    if cp.Folders == nil {
+        cp.Folders = map[string]*folderCheckpoint{}
+    }
+    return &cp, nil
+}
+
+// save writes the checkpoint atomically
+func (cp *MigrationCheckpoint) save(path string) error {
+    cp.Updated = time.Now()
+    data, err := json.Marshal(cp)
+    if err != nil {
+        return err
+    }
+
+    if err := atomicfile.Write(path, data); err != nil {
+        return fmt.Errorf("failed to write checkpoint: %w", err)
+    }
+    return nil
+}
+
+// copied counts the messages copied so far across all folders
+func (cp *MigrationCheckpoint) copied() int {
+    n := 0
+    for _, f := range cp.Folders {
+        n += f.Copied
+    }
+    return n
+}
+
+// migrationFolder pairs a source folder with where its messages go
+type migrationFolder struct {
+    source   string
+    dest     string
+    messages int
+}
+
+// planMigration lists the source folders to copy and their destinations.
+// Special-use folders map onto the destination's folder of the same role,
+// and hierarchy delimiters are translated. Gmail's All Mail is skipped, as
+// it only repeats messages from the other folders.
+func planMigration(src, dst *Connection) ([]migrationFolder, error) {
+    srcBoxes, err := src.ListMailboxes()
+    if err != nil {
+        return nil, err
+    }
+    dstBoxes, err := dst.ListMailboxes()
+    if err != nil {
+        return nil, err
+    }
+
+    dstDelim := "/"
+    existing := make(map[string]bool, len(dstBoxes))
+    for _, mbox := range dstBoxes {
+        existing[mbox.Name] = true
+        if mbox.Delimiter != "" {
+            dstDelim = mbox.Delimiter
+        }
+    }
+
+    var plan []migrationFolder
+    for _, mbox := range srcBoxes {
+        if hasAttribute(mbox, imap.NoSelectAttr) || hasAttribute(mbox, `\All`) {
+            continue
+        }
+
+        dest := ""
+        for role, attr := range roleAttributes {
+            if role != "all" && hasAttribute(mbox, attr) {
+                dest, _ = dst.RoleFolder(role)
+                break
+            }
+        }
+        if dest == "" {
+            dest = mbox.Name
+            if mbox.Delimiter != "" && mbox.Delimiter != dstDelim {
+                dest = strings.ReplaceAll(dest, mbox.Delimiter, dstDelim)
+            }
+        }
+
+        if !existing[dest] {
+            if err := dst.CreateMailbox(dest); err != nil {
+                return nil, fmt.Errorf("failed to create %s: %w", dest, err)
+            }
+            existing[dest] = true
+        }
+
+        plan = append(plan, migrationFolder{source: mbox.Name, dest: dest})
+    }
+
+    return plan, nil
+}
+
+// CreateMailbox creates a mailbox
+func (c *Connection) CreateMailbox(name string) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    return client.Create(name)
+}
+
+// Migrate copies every folder of an account to another server, keeping
+// flags and INTERNALDATE. Progress is saved to the checkpoint at path after
+// each batch, so an interrupted migration resumes where it stopped.
+func Migrate(ctx context.Context, src, dst *Connection, path string, progress func(MigrationProgress)) (*MigrationCheckpoint, error) {
+    cp, err := loadCheckpoint(path)
+    if err != nil {
+        return nil, err
+    }
+
+    plan, err := planMigration(src, dst)
+    if err != nil {
+        return cp, err
+    }
+
+    total := 0
+    for i := range plan {
+        err := src.withFolder(plan[i].source, true, func(_ *client.Client, mbox *imap.MailboxStatus) error {
+            plan[i].messages = int(mbox.Messages)
+            return nil
+        })
+        if err != nil {
+            return cp, err
+        }
+        total += plan[i].messages
+    }
+
+    start := time.Now()
+    startCopied := cp.copied()
+    var lastReport time.Time
+
+    report := func(folder string, force bool) {
+        if !force && time.Since(lastReport) < migrationProgressInterval {
+            return
+        }
+        lastReport = time.Now()
+
+        p := MigrationProgress{Folder: folder, Copied: cp.copied(), Total: total}
+        if done := p.Copied - startCopied; done > 0 && p.Total > p.Copied {
+            perMessage := time.Since(start) / time.Duration(done)
+            p.ETASeconds = int((perMessage * time.Duration(p.Total-p.Copied)).Seconds())
+        }
+        progress(p)
+    }
+
+    for _, folder := range plan {
+        fc := cp.Folders[folder.source]
+        if fc != nil && fc.Done {
+            continue
+        }
+
+        for {
+            if err := lanes.Yield(ctx); err != nil {
+                return cp, err
+            }
+
+            more, err := migrateBatch(src, dst, folder, cp)
+            // Saved even after a failure, for the messages the batch copied
+            if saveErr := cp.save(path); err == nil {
+                err = saveErr
+            }
+            if err != nil {
+                return cp, err
+            }
+            report(folder.source, false)
+
+            if !more {
+                break
+            }
+        }
+
+        cp.Folders[folder.source].Done = true
+        if err := cp.save(path); err != nil {
+            return cp, err
+        }
+        report(folder.source, true)
+    }
+
+    cp.Finished = true
+    return cp, cp.save(path)
+}
+
+// migrateBatch copies the next batch of a folder's messages and reports
+// whether any are left. The batch is searched and fetched with the folder
+// selected throughout, then appended with the source released, so two
+// migrations in opposite directions can't deadlock. The folder's checkpoint
+// starts over if its UIDs were renumbered.
+func migrateBatch(src, dst *Connection, folder migrationFolder, cp *MigrationCheckpoint) (more bool, err error) {
+    var fc *folderCheckpoint
+    var uids []uint32
+    var batch []*StoredMessage
+
+    err = src.withFolder(folder.source, true, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        // New UIDs mean the checkpoint no longer says what was copied
+        fc = cp.Folders[folder.source]
+        if fc == nil || fc.UIDValidity != mbox.UidValidity {
+            fc = &folderCheckpoint{Dest: folder.dest, UIDValidity: mbox.UidValidity}
+            cp.Folders[folder.source] = fc
+        }
+
+        found, err := searchWith(client, uidCriteria(fc.LastUID, false))
+        if err != nil {
+            return err
+        }
+
+        size := 0
+        for _, uid := range found {
+            // n:* always matches the last message, even below n
+            if uid <= fc.LastUID {
+                continue
+            }
+            if len(batch) == migrationBatch || size >= migrationBatchBytes {
+                more = true
+                break
+            }
+
+            msg, err := fetchStoredWith(client, uid)
+            if err != nil {
+                return fmt.Errorf("failed to fetch %s/%d: %w", folder.source, uid, err)
+            }
+            uids = append(uids, uid)
+            batch = append(batch, msg)
+            size += len(msg.Body)
+        }
+        return nil
+    })
+    if err != nil {
+        return false, err
+    }
+
+    for i, msg := range batch {
+        if _, err := dst.AppendStored(fc.Dest, msg, func(int) {}); err != nil {
+            return false, fmt.Errorf("failed to append to %s: %w", fc.Dest, err)
+        }
+
+        fc.LastUID = uids[i]
+        fc.Copied++
+    }
+    return more, nil
+}
+
+// SetMigrationDir sets where migration checkpoints are kept
+func (h *Handler) SetMigrationDir(dir string) error {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create migration directory: %w", err)
+    }
+    h.migrations = dir
+    return nil
+}
+
+// checkpointPath names a migration's checkpoint by hash, so any ID is safe
+func (h *Handler) checkpointPath(id string) (string, error) {
+    if h.migrations == "" {
+        return "", fmt.Errorf("migrations are not configured")
+    }
+    if id == "" {
+        return "", fmt.Errorf("migration id is required")
+    }
+
+    sum := sha256.Sum256([]byte(id))
+    return filepath.Join(h.migrations, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+func (h *Handler) handleMigrateAccount(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        ID           string `json:"id"` // Names the checkpoint; reuse it to resume
+        SourceHandle int    `json:"source_handle"`
+        DestHandle   int    `json:"dest_handle"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    path, err := h.checkpointPath(p.ID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    src, err := h.getConnection(p.SourceHandle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    dst, err := h.getConnection(p.DestHandle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    progress := func(data MigrationProgress) {
+        h.publishFor(ctx, "migration.progress", p.SourceHandle, data)
+    }
+
+    cp, err := Migrate(ctx, src, dst, path, progress)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(cp)
+}
+
+func (h *Handler) handleMigrationStatus(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        ID string `json:"id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    path, err := h.checkpointPath(p.ID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    cp, err := loadCheckpoint(path)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(cp)
+}
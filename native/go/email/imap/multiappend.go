@@ -0,0 +1,187 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Bulk append batches. Servers with MULTIAPPEND (RFC 3502) take a batch in
+// one command, stored all or nothing; others get an APPEND per message.
+const (
+    appendBatchMessages = 50
+    appendBatchBytes    = 16 << 20
+)
+
+// AppendItem is one message of a bulk append
+type AppendItem struct {
+    Flags []string
+    Date  time.Time // Zero lets the server use the current time
+    Body  []byte
+}
+
+// BulkAppendResult is the outcome for one message of a bulk append, by its
+// position in the request
+type BulkAppendResult struct {
+    Index int    `json:"index"`
+    UID   uint32 `json:"uid,omitempty"` // Only when the server has UIDPLUS
+    Error string `json:"error,omitempty"`
+}
+
+// AppendMany uploads messages to a folder, in MULTIAPPEND batches when the
+// server supports it. Failures are reported per message rather than ending
+// the upload; a failed batch fails every message in it. The UIDVALIDITY the
+// UIDs belong to is returned with the results.
+func (c *Connection) AppendMany(ctx context.Context, folder string, items []AppendItem) ([]BulkAppendResult, uint32) {
+    results := make([]BulkAppendResult, len(items))
+    for i := range results {
+        results[i].Index = i
+    }
+
+    multi := c.Supports("MULTIAPPEND")
+    var uidValidity uint32
+
+    for start := 0; start < len(items); {
+        end := start + 1
+        if multi {
+            end = batchEnd(items, start)
+        }
+
+        var validity uint32
+        var uids []uint32
+        err := ctx.Err()
+        if err == nil {
+            validity, uids, err = c.appendBatch(folder, items[start:end])
+        }
+
+        for i := start; i < end; i++ {
+            switch {
+            case err != nil:
+                results[i].Error = err.Error()
+            case i-start < len(uids):
+                results[i].UID = uids[i-start]
+            }
+        }
+        if validity != 0 {
+            uidValidity = validity
+        }
+        start = end
+    }
+
+    return results, uidValidity
+}
+
+// batchEnd returns where the MULTIAPPEND batch starting at start ends,
+// keeping it within the count and size limits
+func batchEnd(items []AppendItem, start int) int {
+    end, size := start, 0
+    for end < len(items) && end-start < appendBatchMessages {
+        size += len(items[end].Body)
+        if end > start && size > appendBatchBytes {
+            break
+        }
+        end++
+    }
+    return end
+}
+
+// appendBatch appends messages with one APPEND command, which for more than
+// one message is a MULTIAPPEND. The UIDs come from APPENDUID, in order.
+func (c *Connection) appendBatch(folder string, items []AppendItem) (uint32, []uint32, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return 0, nil, err
+    }
+    defer release()
+
+    mailbox, err := utf7.Encoding.NewEncoder().String(folder)
+    if err != nil {
+        return 0, nil, fmt.Errorf("append failed: %w", err)
+    }
+
+    args := []interface{}{imap.FormatMailboxName(mailbox)}
+    for _, item := range items {
+        if item.Flags != nil {
+            flags := make([]interface{}, len(item.Flags))
+            for i, flag := range item.Flags {
+                flags[i] = imap.RawString(flag)
+            }
+            args = append(args, flags)
+        }
+        if !item.Date.IsZero() {
+            args = append(args, item.Date)
+        }
+        args = append(args, bytes.NewBuffer(item.Body))
+    }
+
+    status, err := client.Execute(&imap.Command{Name: "APPEND", Arguments: args}, nil)
+    if err != nil {
+        return 0, nil, fmt.Errorf("append failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return 0, nil, fmt.Errorf("append failed: %w", err)
+    }
+
+    if status.Code != "APPENDUID" || len(status.Arguments) < 2 {
+        return 0, nil, nil
+    }
+    validity, _ := imap.ParseNumber(status.Arguments[0])
+    return validity, uidSetValues(status.Arguments[1]), nil
+}
+
+func (h *Handler) handleAppendMessages(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle   int    `json:"handle" validate:"required"`
+        Folder   string `json:"folder" validate:"required"`
+        Messages []struct {
+            MessageB64   string    `json:"message_b64" validate:"required"`
+            Flags        []string  `json:"flags"`
+            InternalDate time.Time `json:"internal_date"`
+        } `json:"messages" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    items := make([]AppendItem, len(p.Messages))
+    for i, msg := range p.Messages {
+        body, err := base64.StdEncoding.DecodeString(msg.MessageB64)
+        if err != nil {
+            return protocol.ErrorResponse(&protocol.ValidationError{
+                Field:  fmt.Sprintf("params.messages[%d].message_b64", i),
+                Reason: "invalid base64",
+            })
+        }
+        items[i] = AppendItem{Flags: msg.Flags, Date: msg.InternalDate, Body: body}
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    results, uidValidity := conn.AppendMany(ctx, p.Folder, items)
+
+    appended := 0
+    for _, result := range results {
+        if result.Error == "" {
+            appended++
+        }
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "folder":       p.Folder,
+        "uid_validity": uidValidity,
+        "multiappend":  conn.Supports("MULTIAPPEND"),
+        "appended":     appended,
+        "results":      results,
+    })
+}
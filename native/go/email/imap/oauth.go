@@ -0,0 +1,69 @@
+package imap
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/authfail"
+)
+
+// How Connect authenticates
+const (
+    AuthLogin   = "login"   // Username and password, with LOGIN
+    AuthXOAuth2 = "xoauth2" // Username and OAuth2 access token, with SASL XOAUTH2
+)
+
+// xoauth2 is the SASL client for Google's and Microsoft's XOAUTH2, which
+// go-sasl doesn't provide
+type xoauth2 struct {
+    username string
+    token    string
+}
+
+func (a *xoauth2) Start() (string, []byte, error) {
+    ir := "user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"
+    return "XOAUTH2", []byte(ir), nil
+}
+
+// Next answers the JSON error a server sends as a challenge when the token
+// is refused; the empty reply lets it finish with NO
+func (a *xoauth2) Next(challenge []byte) ([]byte, error) {
+    return []byte{}, nil
+}
+
+// authenticate logs in with an access token
+func authenticate(c *client.Client, username, token string) error {
+    if ok, _ := c.SupportAuth("XOAUTH2"); !ok {
+        return fmt.Errorf("login failed: server doesn't support XOAUTH2")
+    }
+
+    mech := &xoauth2{username: username, token: token}
+    name, ir, _ := mech.Start()
+    cmd := &commands.Authenticate{Mechanism: name}
+    res := &responses.Authenticate{
+        Mechanism:       mech,
+        InitialResponse: ir,
+        RepliesCh:       make(chan []byte, 10),
+    }
+
+    // Send the token with the command when the server allows, saving a
+    // round trip
+    if ok, _ := c.Support("SASL-IR"); ok {
+        cmd.InitialResponse = ir
+        res.InitialResponse = nil
+    }
+
+    status, err := c.Execute(cmd, res)
+    if err != nil {
+        return fmt.Errorf("login failed: %w", err)
+    }
+    if status.Type != imap.StatusRespOk {
+        return authfail.ClassifyIMAP(string(status.Code), status.Info)
+    }
+
+    c.SetState(imap.AuthenticatedState, nil)
+    return refreshCapabilities(c)
+}
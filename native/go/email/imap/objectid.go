@@ -0,0 +1,190 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Identifier schemes, from most to least stable
+const (
+    IDSchemeObjectID = "objectid" // RFC 8474 EMAILID/THREADID/MAILBOXID
+    IDSchemeGmail    = "gmail"    // X-GM-MSGID/X-GM-THRID
+    IDSchemeUID      = "uid"      // UIDVALIDITY and UID; lost on moves and resets
+)
+
+// ObjectID identifies a message independently of its folder and UID where
+// the server allows it
+type ObjectID struct {
+    EmailID  string `json:"email_id"`
+    ThreadID string `json:"thread_id,omitempty"`
+}
+
+// FolderObjectIDs are the identifiers of messages in one folder
+type FolderObjectIDs struct {
+    Scheme      string              `json:"scheme"`
+    MailboxID   string              `json:"mailbox_id,omitempty"`
+    UIDValidity uint32              `json:"uid_validity"`
+    IDs         map[string]ObjectID `json:"ids"` // Keyed by decimal UID
+}
+
+// idScheme picks the most stable identifiers the server offers
+func (c *Connection) idScheme() string {
+    switch {
+    case c.Supports("OBJECTID"):
+        return IDSchemeObjectID
+    case c.isGmail():
+        return IDSchemeGmail
+    default:
+        return IDSchemeUID
+    }
+}
+
+// FetchObjectIDs returns stable identifiers for messages in a folder
+func (c *Connection) FetchObjectIDs(ctx context.Context, folder string, uids []uint32) (*FolderObjectIDs, error) {
+    scheme := c.idScheme()
+
+    items := []imap.StatusItem{imap.StatusUidValidity}
+    if scheme == IDSchemeObjectID {
+        items = append(items, imap.StatusItem("MAILBOXID"))
+    }
+    status, err := c.Status(folder, items)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &FolderObjectIDs{
+        Scheme:      scheme,
+        MailboxID:   objectIDValue(status.Items["MAILBOXID"]),
+        UIDValidity: status.UidValidity,
+        IDs:         make(map[string]ObjectID, len(uids)),
+    }
+
+    if scheme == IDSchemeUID {
+        for _, uid := range uids {
+            result.IDs[strconv.FormatUint(uint64(uid), 10)] = ObjectID{
+                EmailID: fmt.Sprintf("%d:%d", status.UidValidity, uid),
+            }
+        }
+        return result, nil
+    }
+
+    emailItem, threadItem := imap.FetchItem("EMAILID"), imap.FetchItem("THREADID")
+    if scheme == IDSchemeGmail {
+        emailItem, threadItem = imap.FetchItem("X-GM-MSGID"), imap.FetchItem("X-GM-THRID")
+    }
+
+    err = c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        for start := 0; start < len(uids); start += fetchBatchSize {
+            if err := lanes.Yield(ctx); err != nil {
+                return err
+            }
+
+            end := start + fetchBatchSize
+            if end > len(uids) {
+                end = len(uids)
+            }
+
+            err := fetchWith(client, uids[start:end], []imap.FetchItem{imap.FetchUid, emailItem, threadItem}, func(msg *imap.Message) {
+                result.IDs[strconv.FormatUint(uint64(msg.Uid), 10)] = ObjectID{
+                    EmailID:  objectIDValue(msg.Items[emailItem]),
+                    ThreadID: objectIDValue(msg.Items[threadItem]),
+                }
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return result, nil
+}
+
+// fetchItems fetches items of messages in the selected folder, passing
+// each message to fn
+func (c *Connection) fetchItems(uids []uint32, items []imap.FetchItem, fn func(*imap.Message)) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    return fetchWith(client, uids, items, fn)
+}
+
+// fetchWith is fetchItems on a client already acquired
+func fetchWith(client *client.Client, uids []uint32, items []imap.FetchItem, fn func(*imap.Message)) error {
+    messages := make(chan *imap.Message, 64)
+    done := make(chan error, 1)
+
+    go func() {
+        done <- client.UidFetch(uidSet(uids), items, messages)
+    }()
+
+    for msg := range messages {
+        if msg != nil {
+            fn(msg)
+        }
+    }
+
+    if err := <-done; err != nil {
+        return fmt.Errorf("fetch failed: %w", err)
+    }
+    return nil
+}
+
+// objectIDValue reads an identifier, which RFC 8474 wraps in parentheses
+// and Gmail sends as a bare number
+func objectIDValue(v interface{}) string {
+    if list, ok := v.([]interface{}); ok {
+        if len(list) == 0 {
+            return ""
+        }
+        v = list[0]
+    }
+
+    switch v := v.(type) {
+    case string:
+        return v
+    case imap.RawString:
+        return string(v)
+    case uint32:
+        return strconv.FormatUint(uint64(v), 10)
+    default:
+        return ""
+    }
+}
+
+func (h *Handler) handleObjectIDs(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int      `json:"handle" validate:"required"`
+        Folder string   `json:"folder"`
+        UIDs   []uint32 `json:"uids"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    ids, err := conn.FetchObjectIDs(ctx, p.Folder, p.UIDs)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(ids)
+}
@@ -0,0 +1,168 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// partSpecifier matches the section specifiers fetch_part accepts: a part
+// number, optionally followed by HEADER, TEXT or MIME, or HEADER or TEXT of
+// the message itself
+var partSpecifier = regexp.MustCompile(`^(?:[1-9][0-9]*(?:\.[1-9][0-9]*)*(?:\.(?:HEADER|TEXT|MIME))?|HEADER|TEXT)$`)
+
+// FetchedPart is one body section of a message
+type FetchedPart struct {
+    UID      uint32 `json:"uid"`
+    Part     string `json:"part"`
+    Type     string `json:"type,omitempty"`
+    Filename string `json:"filename,omitempty"`
+    Size     uint32 `json:"size,omitempty"`     // Encoded size of the whole part
+    Encoding string `json:"encoding,omitempty"` // Transfer encoding still applied to Data
+    Data     []byte `json:"data_b64"`
+}
+
+// findPart finds the node of a MIME tree with the given specifier
+func findPart(node MIMEPart, part string) (MIMEPart, bool) {
+    if node.Part == part {
+        return node, true
+    }
+    for _, child := range node.Parts {
+        if found, ok := findPart(child, part); ok {
+            return found, true
+        }
+    }
+    return MIMEPart{}, false
+}
+
+// partBody finds a fetched section. Some servers answer a byte range
+// without its origin, so the section is matched by name alone, and trimmed
+// here if the server sent more than was asked for.
+func partBody(msg *imap.Message, section *imap.BodySectionName) io.Reader {
+    for name, body := range msg.Body {
+        if !name.BodyPartName.Equal(&section.BodyPartName) {
+            continue
+        }
+        if body == nil {
+            return bytes.NewReader(nil)
+        }
+        if len(section.Partial) == 2 && body.Len() > section.Partial[1] {
+            data, _ := io.ReadAll(body)
+            return bytes.NewReader(section.ExtractPartial(data))
+        }
+        return body
+    }
+    return nil
+}
+
+// FetchPart fetches one body section of a message in a folder, or length
+// bytes of it from offset when length is set. With decode the part's
+// transfer encoding is undone, which needs the whole part.
+func (c *Connection) FetchPart(ctx context.Context, folder string, uid uint32, part string, offset, length int, decode bool) (*FetchedPart, error) {
+    section, err := imap.ParseBodySectionName(imap.FetchItem("BODY[" + part + "]"))
+    if err != nil {
+        return nil, fmt.Errorf("invalid part %q: %w", part, err)
+    }
+    section.Peek = true
+    if length > 0 {
+        section.Partial = []int{offset, length}
+    }
+
+    var fetched *FetchedPart
+    var readErr error
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure, section.FetchItem()}
+    err = c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return fetchWith(client, []uint32{uid}, items, func(msg *imap.Message) {
+            literal := partBody(msg, section)
+            if literal == nil || fetched != nil {
+                return
+            }
+
+            fetched = &FetchedPart{UID: msg.Uid, Part: part}
+            if msg.BodyStructure != nil {
+                if node, ok := findPart(mimeTree(msg.BodyStructure), part); ok {
+                    fetched.Type = node.Type
+                    fetched.Filename = node.Filename
+                    fetched.Size = node.Size
+                    fetched.Encoding = node.Encoding
+                }
+            }
+
+            var r io.Reader = literal
+            if decode {
+                r = mime.DecodeTransfer(fetched.Encoding, literal)
+                fetched.Encoding = ""
+            }
+            fetched.Data, readErr = io.ReadAll(r)
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    if readErr != nil {
+        return nil, fmt.Errorf("failed to read part %s: %w", part, readErr)
+    }
+    if fetched == nil {
+        return nil, fmt.Errorf("message not found")
+    }
+
+    // Encodings that leave the bytes as they are need no mention
+    switch fetched.Encoding {
+    case "7bit", "8bit", "binary":
+        fetched.Encoding = ""
+    }
+    return fetched, nil
+}
+
+func (h *Handler) handleFetchPart(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+        UID    uint32 `json:"uid" validate:"required"`
+        Part   string `json:"part" validate:"required"` // Section specifier, as in fetch_bodystructure
+
+        // Offset and Length fetch a byte range of the encoded part, so a
+        // large attachment can be loaded in pieces
+        Offset int `json:"offset" validate:"min=0"`
+        Length int `json:"length" validate:"min=0"`
+
+        // Decode undoes base64 or quoted-printable; it needs the whole part
+        Decode bool `json:"decode"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    part := strings.ToUpper(p.Part)
+    if !partSpecifier.MatchString(part) {
+        return protocol.ErrorResponse(&protocol.ValidationError{Field: "params.part", Reason: "must be a part number such as 2.1, optionally with .HEADER, .TEXT or .MIME"})
+    }
+    if p.Decode && p.Length > 0 {
+        return protocol.ErrorResponse(&protocol.ValidationError{Field: "params.decode", Reason: "can't be combined with a byte range"})
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    fetched, err := conn.FetchPart(ctx, p.Folder, p.UID, part, p.Offset, p.Length, p.Decode)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(fetched)
+}
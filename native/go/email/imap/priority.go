@@ -0,0 +1,66 @@
+package imap
+
+import (
+	"log"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/rdawebb/kernel/native/internal/priority"
+)
+
+// SetClassifier sets how fetched messages are ranked by sender
+func (h *Handler) SetClassifier(c *priority.Classifier) {
+    h.priority = c
+}
+
+// classify sets the priority of each message from its sender, first
+// learning the senders of messages the user has answered
+func (h *Handler) classify(messages []MessageMetadata) {
+    if h.priority == nil {
+        return
+    }
+
+    var answered []string
+    for _, msg := range messages {
+        if len(msg.From) > 0 && hasFlag(msg.Flags, imap.AnsweredFlag) {
+            answered = append(answered, msg.From[0].Address)
+        }
+    }
+    if err := h.priority.Learn(answered); err != nil {
+        log.Printf("Failed to save learned senders: %v", err)
+    }
+
+    for i := range messages {
+        if len(messages[i].From) > 0 {
+            messages[i].Priority = h.priority.Classify(messages[i].From[0].Address)
+        }
+    }
+}
+
+// priorityFirst orders VIP mail first, then important mail, keeping the
+// order within each
+func priorityFirst(messages []MessageMetadata) {
+    rank := func(p string) int {
+        switch p {
+        case priority.VIP:
+            return 0
+        case priority.Important:
+            return 1
+        default:
+            return 2
+        }
+    }
+
+    sort.SliceStable(messages, func(i, j int) bool {
+        return rank(messages[i].Priority) < rank(messages[j].Priority)
+    })
+}
+
+func hasFlag(flags []string, flag string) bool {
+    for _, f := range flags {
+        if f == flag {
+            return true
+        }
+    }
+    return false
+}
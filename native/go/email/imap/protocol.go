@@ -1,37 +1,108 @@
 package imap
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/rdawebb/kernel/native/internal/lanes"
 )
 
 // SelectFolder selects an IMAP folder
 func (c *Connection) SelectFolder(folder string) error {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return fmt.Errorf("client not connected")
+    _, err := c.selectMailbox(folder)
+    return err
+}
+
+// selectMailbox selects an IMAP folder and returns its status
+func (c *Connection) selectMailbox(folder string) (*imap.MailboxStatus, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
     }
-    client := c.client
-    c.mu.RUnlock()
+    defer release()
 
-    _, err := client.Select(folder, false)
+    mbox, err := client.Select(folder, false)
+    if err != nil {
+        return nil, err
+    }
+
+    c.mu.Lock()
+    c.selected = folder
+    c.mu.Unlock()
+    return mbox, nil
+}
+
+// withFolder runs fn with folder selected, read-only with EXAMINE when
+// readOnly is set. The connection is held for the whole sequence, so no
+// other request on the handle runs against the borrowed folder, and the
+// folder chosen with select_folder is selected again afterwards, or none
+// when nothing was.
+func (c *Connection) withFolder(folder string, readOnly bool, fn func(client *client.Client, mbox *imap.MailboxStatus) error) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    mbox, err := client.Select(folder, readOnly)
+    if err != nil {
+        c.restoreSelection(client, folder, readOnly)
+        return fmt.Errorf("failed to open %s: %w", folder, err)
+    }
+
+    err = fn(client, mbox)
+    if restoreErr := c.restoreSelection(client, folder, readOnly); err == nil {
+        err = restoreErr
+    }
     return err
 }
 
-// SearchUIDs searches for message UIDs
-func (c *Connection) SearchUIDs(highestUID uint32) ([]uint32, error) {
+// restoreSelection puts back the folder chosen with select_folder after
+// withFolder borrowed the connection, or leaves none selected
+func (c *Connection) restoreSelection(client *client.Client, borrowed string, readOnly bool) error {
     c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return nil, fmt.Errorf("client not connected")
-    }
-    client := c.client
+    previous := c.selected
     c.mu.RUnlock()
 
+    if previous != "" {
+        if previous == borrowed && !readOnly {
+            return nil
+        }
+        if _, err := client.Select(previous, false); err != nil {
+            return fmt.Errorf("failed to reselect %s: %w", previous, err)
+        }
+        return nil
+    }
+
+    if client.State() != imap.SelectedState {
+        return nil
+    }
+    if ok, _ := client.Support("UNSELECT"); ok {
+        return client.Unselect()
+    }
+    // CLOSE expunges a folder opened read-write, so reopen it read-only first
+    if !readOnly {
+        if _, err := client.Select(borrowed, true); err != nil {
+            return err
+        }
+    }
+    return client.Close()
+}
+
+// SearchUIDs searches for message UIDs
+func (c *Connection) SearchUIDs(highestUID uint32) ([]uint32, error) {
+    return c.Search(uidCriteria(highestUID, false))
+}
+
+// uidCriteria matches the messages above highestUID, or all if it is 0,
+// with unseen only those without \Seen
+func uidCriteria(highestUID uint32, unseen bool) *imap.SearchCriteria {
     // Parse criteria, all if no highestUID
     searchCriteria := imap.NewSearchCriteria()
     if highestUID > 0 {
@@ -41,7 +112,25 @@ func (c *Connection) SearchUIDs(highestUID uint32) ([]uint32, error) {
         searchCriteria.Uid = new(imap.SeqSet)
         searchCriteria.Uid.AddRange(1, 0)
     }
+    if unseen {
+        searchCriteria.WithoutFlags = []string{imap.SeenFlag}
+    }
+    return searchCriteria
+}
+
+// Search returns the UIDs of the messages matching criteria
+func (c *Connection) Search(searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return searchWith(client, searchCriteria)
+}
 
+// searchWith is Search on a client already acquired
+func searchWith(client *client.Client, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
     uids, err := client.UidSearch(searchCriteria)
     if err != nil {
         return nil, fmt.Errorf("search failed: %w", err)
@@ -50,15 +139,28 @@ func (c *Connection) SearchUIDs(highestUID uint32) ([]uint32, error) {
     return uids, nil
 }
 
-// FetchMessage fetches a single message by UID
-func (c *Connection) FetchMessage(uid uint32) ([]byte, error) {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return nil, fmt.Errorf("client not connected")
+// messageSection returns the section for a whole message. A peek leaves
+// \Seen alone; RFC822 sets it on most servers.
+func messageSection(peek bool) *imap.BodySectionName {
+    return &imap.BodySectionName{Peek: peek}
+}
+
+// messageItem is the FETCH item for a whole message
+func messageItem(peek bool) imap.FetchItem {
+    if peek {
+        return messageSection(true).FetchItem()
     }
-    client := c.client
-    c.mu.RUnlock()
+    return imap.FetchRFC822
+}
+
+// FetchMessage fetches a single message by UID, with BODY.PEEK if peek is
+// set
+func (c *Connection) FetchMessage(uid uint32, peek bool) ([]byte, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
 
     seqSet := new(imap.SeqSet)
     seqSet.AddNum(uid)
@@ -67,7 +169,7 @@ func (c *Connection) FetchMessage(uid uint32) ([]byte, error) {
     done := make(chan error, 1)
 
     go func() {
-        done <- client.UidFetch(seqSet, []imap.FetchItem{imap.FetchRFC822}, messages)
+        done <- client.UidFetch(seqSet, []imap.FetchItem{messageItem(peek)}, messages)
     }()
 
     msg := <-messages
@@ -79,7 +181,7 @@ func (c *Connection) FetchMessage(uid uint32) ([]byte, error) {
         return nil, fmt.Errorf("fetch failed: %w", err)
     }
 
-    literal := msg.GetBody(&imap.BodySectionName{})
+    literal := msg.GetBody(messageSection(peek))
     if literal == nil {
         return nil, fmt.Errorf("no message body")
     }
@@ -92,40 +194,76 @@ func (c *Connection) FetchMessage(uid uint32) ([]byte, error) {
     return body, nil
 }
 
-// FetchMessages fetches multiple messages by UID
-func (c *Connection) FetchMessages(uids []uint32) (map[uint32]string, error) {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return nil, fmt.Errorf("client not connected")
+// FetchMessages fetches multiple messages by UID, with BODY.PEEK if peek
+// is set
+func (c *Connection) FetchMessages(ctx context.Context, uids []uint32, peek bool) (map[uint32][]byte, error) {
+    result := make(map[uint32][]byte)
+
+    err := c.FetchEach(ctx, uids, peek, func(uid uint32, body []byte) error {
+        result[uid] = body
+        return nil
+    })
+    if err != nil {
+        return nil, err
     }
-    client := c.client
-    c.mu.RUnlock()
 
-    if len(uids) == 0 {
-        return make(map[uint32]string), nil
+    return result, nil
+}
+
+// fetchBatchSize bounds how many messages one FETCH asks for, which is also
+// how long a cancelled fetch can take to stop and how long an interactive
+// request can wait behind a bulk one
+const fetchBatchSize = 50
+
+// FetchEach fetches messages by UID, passing each to fn as it arrives so
+// large fetches need not be held in memory. If fn fails or ctx is cancelled
+// the remaining messages are discarded and the error returned. With peek
+// the messages are fetched with BODY.PEEK, leaving them unread.
+func (c *Connection) FetchEach(ctx context.Context, uids []uint32, peek bool, fn func(uid uint32, body []byte) error) error {
+    for start := 0; start < len(uids); start += fetchBatchSize {
+        if err := lanes.Yield(ctx); err != nil {
+            return err
+        }
+
+        end := start + fetchBatchSize
+        if end > len(uids) {
+            end = len(uids)
+        }
+
+        if err := c.fetchBatch(ctx, uids[start:end], peek, fn); err != nil {
+            return err
+        }
     }
 
-    seqSet := new(imap.SeqSet)
-    for _, uid := range uids {
-        seqSet.AddNum(uid)
+    return nil
+}
+
+func (c *Connection) fetchBatch(ctx context.Context, uids []uint32, peek bool, fn func(uid uint32, body []byte) error) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
     }
+    defer release()
 
-    messages := make(chan *imap.Message, len(uids))
+    messages := make(chan *imap.Message, 16)
     done := make(chan error, 1)
 
     go func() {
-        done <- client.UidFetch(seqSet, []imap.FetchItem{imap.FetchRFC822}, messages)
+        done <- client.UidFetch(uidSet(uids), []imap.FetchItem{messageItem(peek)}, messages)
     }()
 
-    result := make(map[uint32]string)
-
+    var fnErr error
     for msg := range messages {
-        if msg == nil {
+        if fnErr == nil {
+            fnErr = ctx.Err()
+        }
+
+        // Keep draining after a failure so the fetch can complete
+        if msg == nil || fnErr != nil {
             continue
         }
 
-        literal := msg.GetBody(&imap.BodySectionName{})
+        literal := msg.GetBody(messageSection(peek))
         if literal == nil {
             continue
         }
@@ -135,26 +273,23 @@ func (c *Connection) FetchMessages(uids []uint32) (map[uint32]string, error) {
             continue
         }
 
-        // Encode as base64 for JSON transport
-        result[msg.Uid] = base64.StdEncoding.EncodeToString(body)
+        fnErr = fn(msg.Uid, body)
     }
 
     if err := <-done; err != nil {
-        return nil, fmt.Errorf("fetch failed: %w", err)
+        return fmt.Errorf("fetch failed: %w", err)
     }
 
-    return result, nil
+    return fnErr
 }
 
 // SetFlags sets flags on a message
 func (c *Connection) SetFlags(uid uint32, flags []string, add bool) error {
-    c.mu.Lock()
-    if c.closed || c.client == nil {
-        c.mu.Unlock()
-        return fmt.Errorf("client not connected")
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
     }
-    client := c.client
-    c.mu.Unlock()
+    defer release()
 
     seqSet := new(imap.SeqSet)
     seqSet.AddNum(uid)
@@ -170,31 +305,111 @@ func (c *Connection) SetFlags(uid uint32, flags []string, add bool) error {
     return client.UidStore(seqSet, item, flags, nil)
 }
 
-// CopyMessage copies a message to another folder
-func (c *Connection) CopyMessage(uid uint32, destFolder string) error {
-    c.mu.Lock()
-    if c.closed || c.client == nil {
-        c.mu.Unlock()
-        return fmt.Errorf("client not connected")
+// CopyMessage copies a message to another folder, returning its UID there
+// from COPYUID when the server supports UIDPLUS
+func (c *Connection) CopyMessage(uid uint32, destFolder string) (*AppendResult, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
     }
-    client := c.client
-    c.mu.Unlock()
+    defer release()
 
     seqSet := new(imap.SeqSet)
     seqSet.AddNum(uid)
 
-    return client.UidCopy(seqSet, destFolder)
+    cmd := &commands.Uid{Cmd: &commands.Copy{SeqSet: seqSet, Mailbox: destFolder}}
+    status, err := client.Execute(cmd, nil)
+    if err != nil {
+        return nil, fmt.Errorf("copy failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("copy failed: %w", err)
+    }
+
+    result := &AppendResult{Folder: destFolder}
+    if status.Code == "COPYUID" && len(status.Arguments) >= 3 {
+        result.UIDValidity, _ = imap.ParseNumber(status.Arguments[0])
+        if uids := uidSetValues(status.Arguments[2]); len(uids) > 0 {
+            result.UID = uids[0]
+        }
+    }
+
+    return result, nil
+}
+
+// uidSetValues expands a uid-set from an APPENDUID or COPYUID code, in
+// order, or returns nil if it can't be read
+func uidSetValues(arg interface{}) []uint32 {
+    set, err := imap.ParseSeqSet(fmt.Sprint(arg))
+    if err != nil {
+        return nil
+    }
+
+    var uids []uint32
+    for _, seq := range set.Set {
+        for uid := seq.Start; uid <= seq.Stop; uid++ {
+            uids = append(uids, uid)
+        }
+    }
+    return uids
 }
 
 // Expunge permanently removes deleted messages
 func (c *Connection) Expunge() error {
-    c.mu.Lock()
-    if c.closed || c.client == nil {
-        c.mu.Unlock()
-        return fmt.Errorf("client not connected")
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
     }
-    client := c.client
-    c.mu.Unlock()
+    defer release()
 
     return client.Expunge(nil)
 }
+
+
+// AppendResult describes where an appended or copied message was stored
+type AppendResult struct {
+    Folder      string `json:"folder"`
+    UIDValidity uint32 `json:"uid_validity,omitempty"`
+    UID         uint32 `json:"uid,omitempty"`
+}
+
+// AppendMessage uploads a message to a folder, returning the APPENDUID when
+// the server supports UIDPLUS
+func (c *Connection) AppendMessage(folder string, flags []string, date time.Time, message []byte) (*AppendResult, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return appendWith(client, folder, flags, date, message)
+}
+
+// appendWith uploads a message over a client the caller already holds
+func appendWith(client *client.Client, folder string, flags []string, date time.Time, message []byte) (*AppendResult, error) {
+    cmd := &commands.Append{
+        Mailbox: folder,
+        Flags:   flags,
+        Date:    date,
+        Message: bytes.NewBuffer(message),
+    }
+
+    status, err := client.Execute(cmd, nil)
+    if err != nil {
+        return nil, fmt.Errorf("append failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        if folderMissing(status) {
+            return nil, fmt.Errorf("append failed: %w: %w", errFolderMissing, err)
+        }
+        return nil, fmt.Errorf("append failed: %w", err)
+    }
+
+    result := &AppendResult{Folder: folder}
+    if status.Code == "APPENDUID" && len(status.Arguments) >= 2 {
+        result.UIDValidity, _ = imap.ParseNumber(status.Arguments[0])
+        result.UID, _ = imap.ParseNumber(status.Arguments[1])
+    }
+
+    return result, nil
+}
\ No newline at end of file
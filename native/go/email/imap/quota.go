@@ -0,0 +1,164 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// QuotaResource is one limited resource of a quota root (RFC 9208).
+// STORAGE is counted in units of 1024 octets, MESSAGE in messages.
+type QuotaResource struct {
+    Name    string  `json:"name"`
+    Usage   uint64  `json:"usage"`
+    Limit   uint64  `json:"limit"`
+    Percent float64 `json:"percent"`
+}
+
+// QuotaRoot is a quota shared by the folders under it
+type QuotaRoot struct {
+    Root      string          `json:"root"`
+    Resources []QuotaResource `json:"resources"`
+}
+
+// quotaRecorder collects the QUOTAROOT and QUOTA replies to GETQUOTAROOT
+type quotaRecorder struct {
+    roots  []string
+    quotas map[string][]QuotaResource
+}
+
+func (r *quotaRecorder) Handle(resp imap.Resp) error {
+    name, fields, ok := imap.ParseNamedResp(resp)
+    if !ok {
+        return responses.ErrUnhandled
+    }
+
+    switch name {
+    case "QUOTAROOT":
+        // The mailbox name, then its roots
+        for _, field := range fields[1:] {
+            root, err := imap.ParseString(field)
+            if err != nil {
+                return err
+            }
+            r.roots = append(r.roots, root)
+        }
+    case "QUOTA":
+        if len(fields) < 2 {
+            return fmt.Errorf("malformed QUOTA response")
+        }
+        root, err := imap.ParseString(fields[0])
+        if err != nil {
+            return err
+        }
+        list, ok := fields[1].([]interface{})
+        if !ok {
+            return fmt.Errorf("malformed QUOTA response")
+        }
+        r.quotas[root] = quotaResources(list)
+    default:
+        return responses.ErrUnhandled
+    }
+    return nil
+}
+
+// quotaResources reads the (name usage limit ...) triples of a QUOTA reply
+func quotaResources(list []interface{}) []QuotaResource {
+    resources := []QuotaResource{}
+    for i := 0; i+2 < len(list); i += 3 {
+        name, err := imap.ParseString(list[i])
+        if err != nil {
+            continue
+        }
+        usage, _ := imap.ParseNumber(list[i+1])
+        limit, _ := imap.ParseNumber(list[i+2])
+
+        resource := QuotaResource{Name: strings.ToUpper(name), Usage: uint64(usage), Limit: uint64(limit)}
+        if limit > 0 {
+            resource.Percent = float64(usage) / float64(limit) * 100
+        }
+        resources = append(resources, resource)
+    }
+    return resources
+}
+
+// Quota returns the quota roots of a folder with their usage and limits,
+// or nil when the server has no QUOTA support
+func (c *Connection) Quota(folder string) ([]QuotaRoot, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    if ok, _ := client.Support("QUOTA"); !ok {
+        return nil, nil
+    }
+
+    mailbox, err := utf7.Encoding.NewEncoder().String(folder)
+    if err != nil {
+        return nil, fmt.Errorf("quota failed: %w", err)
+    }
+
+    cmd := &imap.Command{Name: "GETQUOTAROOT", Arguments: []interface{}{imap.FormatMailboxName(mailbox)}}
+    res := &quotaRecorder{quotas: make(map[string][]QuotaResource)}
+
+    status, err := client.Execute(cmd, res)
+    if err != nil {
+        return nil, fmt.Errorf("quota failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("quota failed: %w", err)
+    }
+
+    roots := make([]QuotaRoot, 0, len(res.roots))
+    for _, root := range res.roots {
+        resources, ok := res.quotas[root]
+        if !ok {
+            resources = []QuotaResource{}
+        }
+        roots = append(roots, QuotaRoot{Root: root, Resources: resources})
+    }
+    return roots, nil
+}
+
+func (h *Handler) handleGetQuota(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder"` // Defaults to INBOX
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if p.Folder == "" {
+        p.Folder = "INBOX"
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    roots, err := conn.Quota(p.Folder)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    supported := roots != nil
+    if !supported {
+        roots = []QuotaRoot{}
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "supported": supported,
+        "folder":    p.Folder,
+        "roots":     roots,
+    })
+}
@@ -0,0 +1,147 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// rawDenied are commands raw_command refuses, as they change connection
+// state the Connection tracks itself (authentication, TLS, the selected
+// folder) or never complete on their own
+var rawDenied = map[string]bool{
+    "LOGIN":        true,
+    "AUTHENTICATE": true,
+    "LOGOUT":       true,
+    "STARTTLS":     true,
+    "COMPRESS":     true,
+    "ENABLE":       true,
+    "IDLE":         true,
+    "SELECT":       true,
+    "EXAMINE":      true,
+    "UNSELECT":     true,
+    "CLOSE":        true,
+}
+
+// rawLiteral matches a synchronising literal, which would leave the server
+// waiting for data raw_command can't send
+var rawLiteral = regexp.MustCompile(`\{\d+\}$`)
+
+// rawCommand is a command sent as typed
+type rawCommand struct {
+    name string
+    args string
+}
+
+func (c *rawCommand) Command() *imap.Command {
+    cmd := &imap.Command{Name: c.name}
+    if c.args != "" {
+        cmd.Arguments = []interface{}{imap.RawString(c.args)}
+    }
+    return cmd
+}
+
+// rawRecorder collects the untagged responses to a raw command as text. It
+// passes them on too, so the client still tracks mailbox updates.
+type rawRecorder struct {
+    lines []string
+}
+
+func (r *rawRecorder) Handle(resp imap.Resp) error {
+    if w, ok := resp.(interface{ WriteTo(*imap.Writer) error }); ok {
+        var buf bytes.Buffer
+        if err := w.WriteTo(imap.NewWriter(&buf)); err == nil {
+            r.lines = append(r.lines, strings.TrimRight(buf.String(), "\r\n"))
+        }
+    }
+    return responses.ErrUnhandled
+}
+
+// RawResult is the server's answer to a raw command
+type RawResult struct {
+    Untagged []string `json:"untagged"`
+    Status   string   `json:"status"` // OK, NO or BAD
+    Code     string   `json:"code,omitempty"`
+    Info     string   `json:"info"`
+}
+
+// Raw sends a command verbatim and returns the server's responses. The
+// tagged status is returned even when it is NO or BAD.
+func (c *Connection) Raw(command string) (*RawResult, error) {
+    command = strings.TrimSpace(command)
+    if command == "" {
+        return nil, fmt.Errorf("command is required")
+    }
+    if strings.ContainsAny(command, "\r\n") {
+        return nil, fmt.Errorf("command must be a single line")
+    }
+    if rawLiteral.MatchString(command) {
+        return nil, fmt.Errorf("synchronising literals are not supported")
+    }
+
+    name, args, _ := strings.Cut(command, " ")
+    name = strings.ToUpper(name)
+    if rawDenied[name] {
+        return nil, fmt.Errorf("%s changes connection state and can't be sent raw", name)
+    }
+
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    recorder := &rawRecorder{}
+    status, err := client.Execute(&rawCommand{name: name, args: strings.TrimSpace(args)}, recorder)
+    if err != nil {
+        return nil, fmt.Errorf("command failed: %w", err)
+    }
+
+    return &RawResult{
+        Untagged: recorder.lines,
+        Status:   string(status.Type),
+        Code:     string(status.Code),
+        Info:     status.Info,
+    }, nil
+}
+
+// EnableRawCommands allows raw_command, which is off by default as it can
+// do anything the account can
+func (h *Handler) EnableRawCommands(enabled bool) {
+    h.rawCommands = enabled
+}
+
+func (h *Handler) handleRawCommand(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle  int    `json:"handle" validate:"required"`
+        Command string `json:"command"` // Without the tag, e.g. "GETQUOTAROOT INBOX"
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if !h.rawCommands {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, errors.New("raw commands are disabled")))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    result, err := conn.Raw(p.Command)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(result)
+}
@@ -0,0 +1,214 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// CachedMessage is a message the client holds from before a UIDVALIDITY
+// change, identified by its Message-ID
+type CachedMessage struct {
+    UID       uint32 `json:"uid"`
+    MessageID string `json:"message_id"`
+}
+
+// Recovery is the outcome of re-syncing a folder whose UIDVALIDITY changed.
+// Remapped cached messages keep their bodies under the new UID; Stale ones
+// are gone and Unmatched UIDs must be downloaded.
+type Recovery struct {
+    Folder      string            `json:"folder"`
+    Changed     bool              `json:"changed"`
+    UIDValidity uint32            `json:"uid_validity"`
+    Remapped    map[uint32]uint32 `json:"remapped"` // Old UID to new UID
+    Stale       []uint32          `json:"stale"`     // Old UIDs with no match
+    Unmatched   []uint32          `json:"unmatched"` // New UIDs with no cached copy
+}
+
+// RecoveryProgress is the payload of folder.recovery events
+type RecoveryProgress struct {
+    Folder string `json:"folder"`
+    Stage  string `json:"stage"` // scan, invalidate, done
+    Done   int    `json:"done"`
+    Total  int    `json:"total"`
+}
+
+// FetchMessageIDs fetches the Message-ID of messages in the selected folder
+func (c *Connection) FetchMessageIDs(uids []uint32) (map[uint32]string, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return messageIDsWith(client, uids)
+}
+
+// messageIDsWith fetches Message-IDs over a client the caller already holds
+func messageIDsWith(client *client.Client, uids []uint32) (map[uint32]string, error) {
+    result := make(map[uint32]string)
+    if len(uids) == 0 {
+        return result, nil
+    }
+
+    messages := make(chan *imap.Message, 64)
+    done := make(chan error, 1)
+
+    go func() {
+        done <- client.UidFetch(uidSet(uids), []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, messages)
+    }()
+
+    for msg := range messages {
+        if msg != nil && msg.Envelope != nil {
+            result[msg.Uid] = msg.Envelope.MessageId
+        }
+    }
+
+    if err := <-done; err != nil {
+        return nil, fmt.Errorf("fetch failed: %w", err)
+    }
+
+    return result, nil
+}
+
+// RecoverFolder re-syncs a folder after its UIDVALIDITY changed from
+// uidValidity, matching cached messages to their new UIDs by Message-ID so
+// their bodies need not be downloaded again. progress is called as the
+// folder is scanned.
+func (c *Connection) RecoverFolder(ctx context.Context, folder string, uidValidity uint32, cached []CachedMessage, progress func(RecoveryProgress)) (*Recovery, error) {
+    recovery := &Recovery{
+        Folder:    folder,
+        Remapped:  map[uint32]uint32{},
+        Stale:     []uint32{},
+        Unmatched: []uint32{},
+    }
+
+    // Message-IDs shared by several messages can't be matched reliably
+    var uids []uint32
+    byID := make(map[string]uint32)
+    ambiguous := make(map[string]bool)
+    err := c.withFolder(folder, true, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        recovery.Changed = mbox.UidValidity != uidValidity
+        recovery.UIDValidity = mbox.UidValidity
+        if !recovery.Changed {
+            return nil
+        }
+
+        var err error
+        uids, err = searchWith(client, uidCriteria(0, false))
+        if err != nil {
+            return err
+        }
+
+        for start := 0; start < len(uids); start += fetchBatchSize {
+            if err := lanes.Yield(ctx); err != nil {
+                return err
+            }
+
+            end := start + fetchBatchSize
+            if end > len(uids) {
+                end = len(uids)
+            }
+
+            ids, err := messageIDsWith(client, uids[start:end])
+            if err != nil {
+                return err
+            }
+            for _, uid := range uids[start:end] {
+                id := normalizeMessageID(ids[uid])
+                if id == "" {
+                    continue
+                }
+                if _, ok := byID[id]; ok {
+                    ambiguous[id] = true
+                }
+                byID[id] = uid
+            }
+
+            progress(RecoveryProgress{Folder: folder, Stage: "scan", Done: end, Total: len(uids)})
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if !recovery.Changed {
+        return recovery, nil
+    }
+
+    matched := make(map[uint32]bool, len(cached))
+    for _, msg := range cached {
+        id := normalizeMessageID(msg.MessageID)
+        newUID, ok := byID[id]
+        if id == "" || !ok || ambiguous[id] || matched[newUID] {
+            recovery.Stale = append(recovery.Stale, msg.UID)
+            continue
+        }
+        recovery.Remapped[msg.UID] = newUID
+        matched[newUID] = true
+    }
+
+    for _, uid := range uids {
+        if !matched[uid] {
+            recovery.Unmatched = append(recovery.Unmatched, uid)
+        }
+    }
+    sort.Slice(recovery.Stale, func(i, j int) bool { return recovery.Stale[i] < recovery.Stale[j] })
+
+    return recovery, nil
+}
+
+// normalizeMessageID strips whitespace and angle brackets, which servers
+// and clients don't report consistently
+func normalizeMessageID(id string) string {
+    return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+func (h *Handler) handleRecoverFolder(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle      int             `json:"handle" validate:"required"`
+        Folder      string          `json:"folder"`
+        UIDValidity uint32          `json:"uid_validity"` // The cache's, now invalid
+        Cached      []CachedMessage `json:"cached"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    progress := func(data RecoveryProgress) {
+        h.publishFor(ctx, "folder.recovery", p.Handle, data)
+    }
+
+    recovery, err := conn.RecoverFolder(ctx, p.Folder, p.UIDValidity, p.Cached, progress)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if !recovery.Changed {
+        return protocol.SuccessResponse(recovery)
+    }
+
+    // Local labels follow their messages to the new UIDs
+    progress(RecoveryProgress{Folder: p.Folder, Stage: "invalidate"})
+    if h.tags != nil {
+        err := h.tags.Remap(conn.account(), p.Folder, p.UIDValidity, recovery.UIDValidity, recovery.Remapped)
+        if err != nil {
+            return protocol.ErrorResponse(fmt.Errorf("failed to remap labels: %w", err))
+        }
+    }
+
+    progress(RecoveryProgress{Folder: p.Folder, Stage: "done", Done: len(recovery.Remapped), Total: len(p.Cached)})
+    return protocol.SuccessResponse(recovery)
+}
@@ -0,0 +1,250 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// errFolderMissing marks a command refused because its folder doesn't
+// exist (TRYCREATE, or NONEXISTENT from RFC 5530)
+var errFolderMissing = errors.New("folder does not exist")
+
+// RoleChange reports a role folder renamed, moved or deleted on the server
+type RoleChange struct {
+    Role     string `json:"role"`
+    Previous string `json:"previous"`
+    Folder   string `json:"folder,omitempty"` // Empty when no folder serves the role now
+}
+
+// FolderRole is the folder serving a role, and whether it was found by its
+// attributes ("special_use" or "xlist") or by its name ("name")
+type FolderRole struct {
+    Role   string `json:"role"`
+    Folder string `json:"folder,omitempty"` // Empty when no folder serves the role
+    Source string `json:"source,omitempty"`
+}
+
+// xlistAttributes maps the attributes of Gmail's XLIST, which predates
+// SPECIAL-USE, to their RFC 6154 names. \Sent, \Drafts, \Trash and
+// \Important are spelled the same.
+var xlistAttributes = map[string]string{
+    `\spam`:    `\Junk`,
+    `\allmail`: `\All`,
+    `\starred`: `\Flagged`,
+}
+
+// xlistReply collects the replies to XLIST, which are LIST replies by
+// another name
+type xlistReply struct {
+    mailboxes []*imap.MailboxInfo
+}
+
+func (r *xlistReply) Handle(resp imap.Resp) error {
+    name, fields, ok := imap.ParseNamedResp(resp)
+    if !ok || name != "XLIST" {
+        return responses.ErrUnhandled
+    }
+
+    mbox := &imap.MailboxInfo{}
+    if err := mbox.Parse(fields); err != nil {
+        return err
+    }
+    for i, attr := range mbox.Attributes {
+        if special, ok := xlistAttributes[strings.ToLower(attr)]; ok {
+            mbox.Attributes[i] = special
+        }
+    }
+    r.mailboxes = append(r.mailboxes, mbox)
+    return nil
+}
+
+// usesXList reports whether folder roles come from XLIST: only on servers
+// that offer it without SPECIAL-USE
+func usesXList(client *client.Client) bool {
+    if ok, _ := client.Support("SPECIAL-USE"); ok {
+        return false
+    }
+    ok, _ := client.Support("XLIST")
+    return ok
+}
+
+// xlistMailboxes lists all mailboxes with XLIST, with its attributes given
+// their SPECIAL-USE names
+func xlistMailboxes(client *client.Client) ([]*imap.MailboxInfo, error) {
+    cmd := &imap.Command{Name: "XLIST", Arguments: []interface{}{"", "*"}}
+    res := &xlistReply{}
+
+    status, err := client.Execute(cmd, res)
+    if err != nil {
+        return nil, err
+    }
+    if err := status.Err(); err != nil {
+        return nil, err
+    }
+    return res.mailboxes, nil
+}
+
+// folderMissing reports whether a tagged reply says the folder is missing
+func folderMissing(status *imap.StatusResp) bool {
+    code := strings.ToUpper(string(status.Code))
+    return code == "TRYCREATE" || code == "NONEXISTENT"
+}
+
+// detectRole finds the folder serving a role in a LIST reply, preferring
+// SPECIAL-USE attributes over well-known names
+func detectRole(mailboxes []*imap.MailboxInfo, role string) string {
+    attr := roleAttributes[role]
+    for _, mbox := range mailboxes {
+        if hasAttribute(mbox, attr) {
+            return mbox.Name
+        }
+    }
+    return matchFolderName(mailboxes, roleNames[role])
+}
+
+// OnRoleChange sets what is told when a detected role folder turns out to
+// have moved
+func (c *Connection) OnRoleChange(fn func(RoleChange)) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.roleMoved = fn
+}
+
+// checkRoles compares the detected role folders with a fresh LIST reply,
+// so a folder renamed or given a role elsewhere is followed rather than
+// failing the next append to it
+func (c *Connection) checkRoles(mailboxes []*imap.MailboxInfo) {
+    c.mu.Lock()
+    var changes []RoleChange
+    for role, cached := range c.roles {
+        current := detectRole(mailboxes, role)
+        if current == cached {
+            continue
+        }
+
+        if current == "" {
+            delete(c.roles, role)
+        } else {
+            c.roles[role] = current
+        }
+        changes = append(changes, RoleChange{Role: role, Previous: cached, Folder: current})
+    }
+    notify := c.roleMoved
+    c.mu.Unlock()
+
+    if notify == nil {
+        return
+    }
+    for _, change := range changes {
+        notify(change)
+    }
+}
+
+// roleOf returns the role a folder was detected for, or ""
+func (c *Connection) roleOf(folder string) string {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    for role, cached := range c.roles {
+        if cached == folder {
+            return role
+        }
+    }
+    return ""
+}
+
+// relocate finds where a role folder went after the server reported it
+// missing, returning "" if it wasn't a role folder or is gone for good
+func (c *Connection) relocate(folder string) string {
+    role := c.roleOf(folder)
+    if role == "" {
+        return ""
+    }
+
+    // Listing rechecks every role, announcing what moved
+    if _, err := c.ListMailboxes(); err != nil {
+        return ""
+    }
+
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    if moved := c.roles[role]; moved != folder {
+        return moved
+    }
+    return ""
+}
+
+// FolderRoles detects the folder of every role from one listing, caching
+// them for RoleFolder. Roles without a folder are included, empty.
+func (c *Connection) FolderRoles() ([]FolderRole, error) {
+    mailboxes, err := c.ListMailboxes()
+    if err != nil {
+        return nil, err
+    }
+
+    byAttribute := "special_use"
+    if c.Supports("XLIST") && !c.Supports("SPECIAL-USE") {
+        byAttribute = "xlist"
+    }
+
+    roles := make([]string, 0, len(roleAttributes))
+    for role := range roleAttributes {
+        roles = append(roles, role)
+    }
+    sort.Strings(roles)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    result := make([]FolderRole, 0, len(roles))
+    for _, role := range roles {
+        found := FolderRole{Role: role}
+        if folder := detectRole(mailboxes, role); folder != "" {
+            found.Folder = folder
+            found.Source = "name"
+            for _, mbox := range mailboxes {
+                if mbox.Name == folder && hasAttribute(mbox, roleAttributes[role]) {
+                    found.Source = byAttribute
+                    break
+                }
+            }
+            c.roles[role] = folder
+        }
+        result = append(result, found)
+    }
+    return result, nil
+}
+
+func (h *Handler) handleFolderRoles(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    roles, err := conn.FolderRoles()
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "roles": roles,
+    })
+}
@@ -0,0 +1,59 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// DeliveryRoute fetches the Received chain of a message and reads it into
+// the hops the message took
+func (c *Connection) DeliveryRoute(folder string, uid uint32) (*mime.DeliveryRoute, error) {
+    var route *mime.DeliveryRoute
+    items := []imap.FetchItem{imap.FetchUid, dateFields.FetchItem()}
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        return fetchWith(client, []uint32{uid}, items, func(msg *imap.Message) {
+            if header := fetchedHeader(msg, dateFields); header != nil && msg.Uid == uid {
+                r := mime.Route(header)
+                route = &r
+            }
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    if route == nil {
+        return nil, fmt.Errorf("message not found")
+    }
+
+    return route, nil
+}
+
+func (h *Handler) handleDeliveryRoute(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder" validate:"required"`
+        UID    uint32 `json:"uid" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    route, err := conn.DeliveryRoute(p.Folder, p.UID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(route)
+}
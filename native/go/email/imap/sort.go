@@ -0,0 +1,221 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// sortKeys maps sort_uids keys to their SORT criteria (RFC 5256)
+var sortKeys = map[string]string{
+    "date":    "DATE",
+    "size":    "SIZE",
+    "from":    "FROM",
+    "subject": "SUBJECT",
+}
+
+// sortReply collects the UIDs of a SORT reply, in order
+type sortReply struct {
+    uids []uint32
+}
+
+func (r *sortReply) Handle(resp imap.Resp) error {
+    name, fields, ok := imap.ParseNamedResp(resp)
+    if !ok || name != "SORT" {
+        return responses.ErrUnhandled
+    }
+
+    for _, field := range fields {
+        uid, err := imap.ParseNumber(field)
+        if err != nil {
+            return err
+        }
+        r.uids = append(r.uids, uid)
+    }
+    return nil
+}
+
+// sortable is what the client-side sort compares for one message
+type sortable struct {
+    uid     uint32
+    date    time.Time
+    size    uint32
+    from    string
+    subject string
+}
+
+// SortUIDs returns the UIDs of a folder in the order of a key, with SORT
+// when the server supports it. Others get the envelopes of every message
+// fetched and sorted here, which costs a pass over the folder. Ties keep
+// UID order either way. It reports whether the server sorted.
+func (c *Connection) SortUIDs(ctx context.Context, folder, key string, reverse bool) ([]uint32, bool, error) {
+    var sorted []uint32
+    var serverSide bool
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+
+        if ok, _ := client.Support("SORT"); ok {
+            uids, err := serverSort(client, key, reverse)
+            sorted, serverSide = uids, true
+            return err
+        }
+
+        uids, err := searchWith(client, uidCriteria(0, false))
+        if err != nil {
+            return err
+        }
+        if len(uids) == 0 {
+            return nil
+        }
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+
+        messages := make([]sortable, 0, len(uids))
+        items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchInternalDate}
+        err = fetchWith(client, uids, items, func(msg *imap.Message) {
+            m := sortable{uid: msg.Uid, date: msg.InternalDate, size: msg.Size}
+            if env := msg.Envelope; env != nil {
+                if !env.Date.IsZero() {
+                    m.date = env.Date
+                }
+                if len(env.From) > 0 {
+                    m.from = strings.ToLower(env.From[0].MailboxName)
+                }
+                m.subject = baseSubject(env.Subject)
+            }
+            messages = append(messages, m)
+        })
+        if err != nil {
+            return err
+        }
+
+        sorted = sortLocally(messages, key, reverse)
+        return nil
+    })
+    if err != nil {
+        return nil, false, err
+    }
+    return sorted, serverSide, nil
+}
+
+// sortLocally orders messages by key as SORT would, ties in UID order
+func sortLocally(messages []sortable, key string, reverse bool) []uint32 {
+    sort.Slice(messages, func(i, j int) bool {
+        return messages[i].uid < messages[j].uid
+    })
+    sort.SliceStable(messages, func(i, j int) bool {
+        if reverse {
+            i, j = j, i
+        }
+        a, b := messages[i], messages[j]
+        switch key {
+        case "size":
+            return a.size < b.size
+        case "from":
+            return a.from < b.from
+        case "subject":
+            return a.subject < b.subject
+        default:
+            return a.date.Before(b.date)
+        }
+    })
+
+    sorted := make([]uint32, len(messages))
+    for i, m := range messages {
+        sorted[i] = m.uid
+    }
+    return sorted
+}
+
+// serverSort issues UID SORT for every message of the selected folder
+func serverSort(client *client.Client, key string, reverse bool) ([]uint32, error) {
+    criteria := []interface{}{imap.RawString(sortKeys[key])}
+    if reverse {
+        criteria = append([]interface{}{imap.RawString("REVERSE")}, criteria...)
+    }
+
+    cmd := &commands.Uid{Cmd: &imap.Command{
+        Name:      "SORT",
+        Arguments: []interface{}{criteria, imap.RawString("UTF-8"), imap.RawString("ALL")},
+    }}
+    res := &sortReply{}
+
+    status, err := client.Execute(cmd, res)
+    if err != nil {
+        return nil, fmt.Errorf("sort failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("sort failed: %w", err)
+    }
+    return res.uids, nil
+}
+
+// baseSubject approximates the base subject SORT compares (RFC 5256):
+// lowercased, without reply and forward prefixes or a "(fwd)" trailer
+func baseSubject(subject string) string {
+    s := strings.ToLower(strings.TrimSpace(subject))
+    for {
+        trimmed := strings.TrimSpace(strings.TrimSuffix(s, "(fwd)"))
+        for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+            trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+        }
+        if trimmed == s {
+            return s
+        }
+        s = trimmed
+    }
+}
+
+func (h *Handler) handleSortUIDs(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle  int    `json:"handle" validate:"required"`
+        Folder  string `json:"folder" validate:"required"`
+        Sort    string `json:"sort" validate:"oneof=date size from subject"` // Defaults to date
+        Reverse bool   `json:"reverse"`
+        protocol.Page
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if p.Sort == "" {
+        p.Sort = "date"
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    uids, serverSide, err := conn.SortUIDs(ctx, p.Folder, p.Sort, p.Reverse)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    start, end, next, err := p.Slice(len(uids), func(i int) string {
+        return strconv.FormatUint(uint64(uids[i]), 10)
+    })
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "uids":        uids[start:end],
+        "total":       len(uids),
+        "next_cursor": next,
+        "server_sort": serverSide,
+    })
+}
@@ -0,0 +1,76 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/emersion/go-imap"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// folderStatusCounts are the items folder_status asks each folder for
+var folderStatusCounts = []imap.StatusItem{
+    imap.StatusMessages, imap.StatusUnseen, imap.StatusRecent, imap.StatusUidNext, imap.StatusUidValidity,
+}
+
+// FolderStatus is the STATUS reply for one folder. A folder that couldn't
+// be read carries an error instead of counts.
+type FolderStatus struct {
+    Folder      string `json:"folder"`
+    Messages    uint32 `json:"messages"`
+    Unseen      uint32 `json:"unseen"`
+    Recent      uint32 `json:"recent"`
+    UIDNext     uint32 `json:"uid_next"`
+    UIDValidity uint32 `json:"uid_validity"`
+    Error       string `json:"error,omitempty"`
+}
+
+// FolderStatuses issues STATUS for each folder without selecting it.
+// Failures are reported per folder rather than ending the run.
+func (c *Connection) FolderStatuses(ctx context.Context, folders []string) ([]FolderStatus, error) {
+    result := make([]FolderStatus, 0, len(folders))
+    for _, folder := range folders {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+
+        entry := FolderStatus{Folder: folder}
+        status, err := c.Status(folder, folderStatusCounts)
+        if err != nil {
+            entry.Error = err.Error()
+        } else {
+            entry.Messages = status.Messages
+            entry.Unseen = status.Unseen
+            entry.Recent = status.Recent
+            entry.UIDNext = status.UidNext
+            entry.UIDValidity = status.UidValidity
+        }
+        result = append(result, entry)
+    }
+    return result, nil
+}
+
+func (h *Handler) handleFolderStatus(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle  int      `json:"handle" validate:"required"`
+        Folders []string `json:"folders" validate:"required,max=500"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    folders, err := conn.FolderStatuses(ctx, p.Folders)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "folders": folders,
+    })
+}
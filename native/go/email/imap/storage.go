@@ -0,0 +1,248 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Ways of finding messages with attachments, best first
+const (
+    attachmentsGmail     = "gmail"         // X-GM-RAW "has:attachment"
+    attachmentsKeyword   = "keyword"       // $HasAttachment, RFC 8457
+    attachmentsStructure = "bodystructure" // Every message's BODYSTRUCTURE
+)
+
+// hasAttachmentKeyword is set by servers that detect attachments on delivery
+const hasAttachmentKeyword = "$HasAttachment"
+
+// AttachmentInfo is one attachment as BODYSTRUCTURE describes it
+type AttachmentInfo struct {
+    Filename string `json:"filename,omitempty"`
+    Type     string `json:"type"`
+    Size     uint32 `json:"size"` // Encoded size, about 4/3 of the decoded size for base64
+}
+
+// StorageItem is a message as the storage cleanup view lists it
+type StorageItem struct {
+    UID         uint32           `json:"uid"`
+    Size        uint32           `json:"size"`
+    Subject     string           `json:"subject"`
+    From        []MessageAddress `json:"from"`
+    Date        time.Time        `json:"date"`
+    Attachments []AttachmentInfo `json:"attachments"`
+}
+
+// attachments lists the attachment parts of a message: those marked as
+// attachments, and named parts not marked inline
+func attachments(bs *imap.BodyStructure) []AttachmentInfo {
+    result := []AttachmentInfo{}
+    if bs == nil {
+        return result
+    }
+
+    bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+        if strings.EqualFold(part.MIMEType, "multipart") {
+            return true
+        }
+
+        filename, _ := part.Filename()
+        disposition := strings.ToLower(part.Disposition)
+        if disposition == "attachment" || (filename != "" && disposition != "inline") {
+            result = append(result, AttachmentInfo{
+                Filename: filename,
+                Type:     strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
+                Size:     part.Size,
+            })
+        }
+
+        // An attached message's own parts belong to it
+        return !strings.EqualFold(part.MIMEType, "message")
+    })
+    return result
+}
+
+// storageItems fetches the size, envelope and attachments of messages in
+// the selected folder, largest first
+func storageItems(ctx context.Context, client *client.Client, uids []uint32) ([]StorageItem, error) {
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchBodyStructure}
+    result := make([]StorageItem, 0, len(uids))
+
+    for start := 0; start < len(uids); start += fetchBatchSize {
+        if err := lanes.Yield(ctx); err != nil {
+            return nil, err
+        }
+
+        end := start + fetchBatchSize
+        if end > len(uids) {
+            end = len(uids)
+        }
+
+        err := fetchWith(client, uids[start:end], items, func(msg *imap.Message) {
+            item := StorageItem{
+                UID:         msg.Uid,
+                Size:        msg.Size,
+                Attachments: attachments(msg.BodyStructure),
+            }
+            if env := msg.Envelope; env != nil {
+                item.Subject = env.Subject
+                item.From = messageAddresses(env.From)
+                item.Date = env.Date
+            }
+            result = append(result, item)
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    sort.SliceStable(result, func(i, j int) bool { return result[i].Size > result[j].Size })
+    return result, nil
+}
+
+// FindLarger lists messages in a folder larger than size bytes with SEARCH
+// LARGER, which every server supports
+func (c *Connection) FindLarger(ctx context.Context, folder string, size uint32) ([]StorageItem, error) {
+    criteria := imap.NewSearchCriteria()
+    criteria.Larger = size
+
+    var found []StorageItem
+    err := c.withFolder(folder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        uids, err := searchWith(client, criteria)
+        if err != nil {
+            return err
+        }
+        found, err = storageItems(ctx, client, uids)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return found, nil
+}
+
+// FindWithAttachments lists messages in a folder with attachments. SEARCH
+// can only find them on Gmail and on servers that set $HasAttachment;
+// elsewhere every message's BODYSTRUCTURE is checked, which is slower but
+// still leaves the bodies on the server.
+func (c *Connection) FindWithAttachments(ctx context.Context, folder string) ([]StorageItem, string, error) {
+    gmail := c.isGmail()
+
+    method := attachmentsStructure
+    var found []StorageItem
+    err := c.withFolder(folder, true, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        var uids []uint32
+        var err error
+        switch {
+        case gmail:
+            method = attachmentsGmail
+            uids, err = uidSearchRaw(client, imap.RawString("X-GM-RAW"), "has:attachment")
+        case hasFlag(mbox.Flags, hasAttachmentKeyword):
+            method = attachmentsKeyword
+            uids, err = searchKeyword(client, hasAttachmentKeyword)
+        default:
+            uids, err = searchWith(client, uidCriteria(0, false))
+        }
+        if err != nil {
+            return err
+        }
+
+        found, err = storageItems(ctx, client, uids)
+        return err
+    })
+    if err != nil {
+        return nil, "", err
+    }
+
+    // Searches can match attachments BODYSTRUCTURE doesn't show, such as
+    // Gmail counting inline images, so every method is filtered the same
+    kept := found[:0]
+    for _, item := range found {
+        if len(item.Attachments) > 0 {
+            kept = append(kept, item)
+        }
+    }
+    return kept, method, nil
+}
+
+// limitItems keeps the first limit items; zero keeps them all
+func limitItems(items []StorageItem, limit int) []StorageItem {
+    if limit > 0 && len(items) > limit {
+        return items[:limit]
+    }
+    return items
+}
+
+// storageTotal adds up the size of messages
+func storageTotal(items []StorageItem) uint64 {
+    var total uint64
+    for _, item := range items {
+        total += uint64(item.Size)
+    }
+    return total
+}
+
+func (h *Handler) handleFindLarger(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder"`
+        Size   uint32 `json:"size"`  // In bytes
+        Limit  int    `json:"limit"` // Largest messages to return; 0 for all
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    found, err := conn.FindLarger(ctx, p.Folder, p.Size)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "count":      len(found),
+        "total_size": storageTotal(found),
+        "messages":   limitItems(found, p.Limit),
+    })
+}
+
+func (h *Handler) handleFindAttachments(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int    `json:"handle" validate:"required"`
+        Folder string `json:"folder"`
+        Limit  int    `json:"limit"` // Largest messages to return; 0 for all
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    found, method, err := conn.FindWithAttachments(ctx, p.Folder)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "method":     method,
+        "count":      len(found),
+        "total_size": storageTotal(found),
+        "messages":   limitItems(found, p.Limit),
+    })
+}
@@ -0,0 +1,295 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// transferProgressStep is how many bytes pass between progress events while
+// a message is uploaded
+const transferProgressStep = 1 << 20
+
+// StoredMessage is a message with the metadata needed to recreate it
+// elsewhere
+type StoredMessage struct {
+    Flags []string
+    Date  time.Time
+    Body  []byte
+}
+
+// TransferProgress is the payload of message.transfer events
+type TransferProgress struct {
+    UID   uint32 `json:"uid"`
+    Stage string `json:"stage"` // fetch, append, delete, done
+    Bytes int    `json:"bytes"`
+    Total int    `json:"total"`
+}
+
+// FetchStored fetches a message from the selected folder with its flags and
+// INTERNALDATE
+func (c *Connection) FetchStored(uid uint32) (*StoredMessage, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return fetchStoredWith(client, uid)
+}
+
+// fetchStoredWith fetches a message over a client the caller already holds
+func fetchStoredWith(client *client.Client, uid uint32) (*StoredMessage, error) {
+    seqSet := new(imap.SeqSet)
+    seqSet.AddNum(uid)
+
+    messages := make(chan *imap.Message, 1)
+    done := make(chan error, 1)
+
+    section := &imap.BodySectionName{Peek: true}
+    items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+    go func() {
+        done <- client.UidFetch(seqSet, items, messages)
+    }()
+
+    var stored *StoredMessage
+    for msg := range messages {
+        if msg == nil || stored != nil {
+            continue
+        }
+
+        literal := msg.GetBody(section)
+        if literal == nil {
+            continue
+        }
+        body, err := io.ReadAll(literal)
+        if err != nil {
+            continue
+        }
+
+        stored = &StoredMessage{Flags: withoutRecent(msg.Flags), Date: msg.InternalDate, Body: body}
+    }
+
+    if err := <-done; err != nil {
+        return nil, fmt.Errorf("fetch failed: %w", err)
+    }
+    if stored == nil {
+        return nil, fmt.Errorf("message not found")
+    }
+
+    return stored, nil
+}
+
+// progressLiteral is a message literal that reports how much of it has been
+// read, so uploads of large messages can show progress
+type progressLiteral struct {
+    *bytes.Reader
+    total    int
+    reported int
+    progress func(read int)
+}
+
+func (l *progressLiteral) Len() int {
+    return l.total
+}
+
+func (l *progressLiteral) Read(p []byte) (int, error) {
+    n, err := l.Reader.Read(p)
+    read := l.total - l.Reader.Len()
+    if read-l.reported >= transferProgressStep || (read == l.total && read != l.reported) {
+        l.reported = read
+        l.progress(read)
+    }
+    return n, err
+}
+
+// AppendStored uploads a message keeping its flags and INTERNALDATE,
+// reporting upload progress
+func (c *Connection) AppendStored(folder string, msg *StoredMessage, progress func(read int)) (*AppendResult, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    cmd := &commands.Append{
+        Mailbox: folder,
+        Flags:   msg.Flags,
+        Date:    msg.Date,
+        Message: &progressLiteral{Reader: bytes.NewReader(msg.Body), total: len(msg.Body), progress: progress},
+    }
+
+    status, err := client.Execute(cmd, nil)
+    if err != nil {
+        return nil, fmt.Errorf("append failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return nil, fmt.Errorf("append failed: %w", err)
+    }
+
+    result := &AppendResult{Folder: folder}
+    if status.Code == "APPENDUID" && len(status.Arguments) >= 2 {
+        result.UIDValidity, _ = imap.ParseNumber(status.Arguments[0])
+        result.UID, _ = imap.ParseNumber(status.Arguments[1])
+    }
+
+    return result, nil
+}
+
+// ExpungeUIDs permanently removes messages from the selected folder, leaving
+// other \Deleted messages alone where the server supports UIDPLUS
+func (c *Connection) ExpungeUIDs(uids []uint32) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    return expungeUIDsWith(client, uids)
+}
+
+// expungeUIDsWith expunges over a client the caller already holds
+func expungeUIDsWith(client *client.Client, uids []uint32) error {
+    if ok, _ := client.Support("UIDPLUS"); !ok {
+        return expungeOnlyWith(client, uids)
+    }
+    if err := storeFlagsWith(client, uids, []string{imap.DeletedFlag}, true); err != nil {
+        return err
+    }
+
+    cmd := &commands.Uid{
+        Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{uidSet(uids)}},
+    }
+    status, err := client.Execute(cmd, nil)
+    if err != nil {
+        return fmt.Errorf("expunge failed: %w", err)
+    }
+    return status.Err()
+}
+
+// expungeOnlyWith expunges uids without UIDPLUS. A plain EXPUNGE removes
+// every \Deleted message in the folder, so the others are unmarked for it
+// and marked again afterwards.
+func expungeOnlyWith(client *client.Client, uids []uint32) error {
+    criteria := imap.NewSearchCriteria()
+    criteria.WithFlags = []string{imap.DeletedFlag}
+    marked, err := searchWith(client, criteria)
+    if err != nil {
+        return err
+    }
+
+    expunged := make(map[uint32]bool, len(uids))
+    for _, uid := range uids {
+        expunged[uid] = true
+    }
+    var others []uint32
+    for _, uid := range marked {
+        if !expunged[uid] {
+            others = append(others, uid)
+        }
+    }
+
+    if len(others) > 0 {
+        if err := storeFlagsWith(client, others, []string{imap.DeletedFlag}, false); err != nil {
+            return fmt.Errorf("failed to spare other deleted messages: %w", err)
+        }
+    }
+
+    err = storeFlagsWith(client, uids, []string{imap.DeletedFlag}, true)
+    if err == nil {
+        err = client.Expunge(nil)
+    }
+
+    if len(others) > 0 {
+        if restoreErr := storeFlagsWith(client, others, []string{imap.DeletedFlag}, true); err == nil && restoreErr != nil {
+            err = fmt.Errorf("failed to mark other messages deleted again: %w", restoreErr)
+        }
+    }
+    return err
+}
+
+// Transfer copies a message to a folder of another account, or moves it
+// when move is set. The source is only deleted once the destination has
+// stored the copy.
+func Transfer(ctx context.Context, src *Connection, srcFolder string, uid uint32, dst *Connection, dstFolder string, move bool, progress func(TransferProgress)) (*AppendResult, error) {
+    progress(TransferProgress{UID: uid, Stage: "fetch"})
+    var msg *StoredMessage
+    err := src.withFolder(srcFolder, true, func(client *client.Client, _ *imap.MailboxStatus) error {
+        var err error
+        msg, err = fetchStoredWith(client, uid)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    total := len(msg.Body)
+    progress(TransferProgress{UID: uid, Stage: "append", Total: total})
+    result, err := dst.AppendStored(dstFolder, msg, func(read int) {
+        progress(TransferProgress{UID: uid, Stage: "append", Bytes: read, Total: total})
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if move {
+        // The copy exists now, so the move completes even if ctx ends
+        progress(TransferProgress{UID: uid, Stage: "delete", Bytes: total, Total: total})
+        err := src.withFolder(srcFolder, false, func(client *client.Client, _ *imap.MailboxStatus) error {
+            return expungeUIDsWith(client, []uint32{uid})
+        })
+        if err != nil {
+            return result, fmt.Errorf("copied but failed to delete source: %w", err)
+        }
+    }
+
+    progress(TransferProgress{UID: uid, Stage: "done", Bytes: total, Total: total})
+    return result, nil
+}
+
+func (h *Handler) handleTransferMessage(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        SourceHandle int    `json:"source_handle"`
+        SourceFolder string `json:"source_folder"`
+        UID          uint32 `json:"uid"`
+        DestHandle   int    `json:"dest_handle"`
+        DestFolder   string `json:"dest_folder"`
+        Move         bool   `json:"move"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    src, err := h.getConnection(p.SourceHandle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    dst, err := h.getConnection(p.DestHandle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    progress := func(data TransferProgress) {
+        h.publishFor(ctx, "message.transfer", p.SourceHandle, data)
+    }
+
+    result, err := Transfer(ctx, src, p.SourceFolder, p.UID, dst, p.DestFolder, p.Move, progress)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(result)
+}
@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+)
+
+// MessageURL builds the RFC 5092 IMAP URL of a stored message
+func (c *Connection) MessageURL(folder string, uidValidity, uid uint32) string {
+    return fmt.Sprintf(
+        "imap://%s@%s/%s;UIDVALIDITY=%d/;UID=%d",
+        url.PathEscape(c.username),
+        c.host,
+        url.PathEscape(folder),
+        uidValidity,
+        uid,
+    )
+}
+
+// GenURLAuth issues a GENURLAUTH (RFC 4467) for a stored message, returning
+// a URL the submission server can fetch on behalf of submitter
+func (c *Connection) GenURLAuth(folder string, uidValidity, uid uint32, submitter string) (string, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return "", err
+    }
+    defer release()
+
+    if ok, err := client.Support("URLAUTH"); err != nil || !ok {
+        return "", fmt.Errorf("server does not support URLAUTH")
+    }
+
+    rump := c.MessageURL(folder, uidValidity, uid) + ";urlauth=submit+" + url.PathEscape(submitter)
+    cmd := &imap.Command{
+        Name:      "GENURLAUTH",
+        Arguments: []interface{}{rump, imap.RawString("INTERNAL")},
+    }
+
+    var authURL string
+    handler := responses.HandlerFunc(func(resp imap.Resp) error {
+        name, fields, ok := imap.ParseNamedResp(resp)
+        if !ok || name != "GENURLAUTH" || len(fields) == 0 {
+            return responses.ErrUnhandled
+        }
+        authURL, _ = imap.ParseString(fields[0])
+        return nil
+    })
+
+    status, err := client.Execute(cmd, handler)
+    if err != nil {
+        return "", fmt.Errorf("GENURLAUTH failed: %w", err)
+    }
+    if err := status.Err(); err != nil {
+        return "", fmt.Errorf("GENURLAUTH failed: %w", err)
+    }
+    if authURL == "" {
+        return "", fmt.Errorf("GENURLAUTH returned no URL")
+    }
+
+    return authURL, nil
+}
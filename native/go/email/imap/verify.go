@@ -0,0 +1,182 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// CachedFlags is a message as the client's cache holds it
+type CachedFlags struct {
+    UID   uint32   `json:"uid"`
+    Flags []string `json:"flags"`
+}
+
+// FlagDrift is a message whose cached flags differ from the server's
+type FlagDrift struct {
+    UID    uint32   `json:"uid"`
+    Cached []string `json:"cached"`
+    Server []string `json:"server"`
+}
+
+// Repair is a suggested fix for drift, named after the action that applies
+// it: remove drops UIDs from the cache, fetch downloads them, update_flags
+// takes the server's flags, and recover_folder re-maps a folder whose
+// UIDVALIDITY changed
+type Repair struct {
+    Action string   `json:"action"`
+    UIDs   []uint32 `json:"uids,omitempty"`
+}
+
+// CacheReport compares a folder's cache with the server
+type CacheReport struct {
+    Folder             string      `json:"folder"`
+    InSync             bool        `json:"in_sync"`
+    UIDValidityChanged bool        `json:"uid_validity_changed"`
+    MissingOnServer    []uint32    `json:"missing_on_server"` // Cached, but expunged
+    MissingInCache     []uint32    `json:"missing_in_cache"`  // On the server, not cached
+    FlagDrift          []FlagDrift `json:"flag_drift"`
+    CachedUnseen       int         `json:"cached_unseen"`
+    ServerUnseen       int         `json:"server_unseen"`
+    Repairs            []Repair    `json:"repairs"`
+}
+
+// VerifyCache cross-checks a folder's cached UIDs and flags against the
+// server with UID SEARCH and FETCH FLAGS, selecting it read-only. Server
+// UIDs below minUID count as deliberately uncached. Nothing is changed; the
+// report says what to repair.
+func (c *Connection) VerifyCache(ctx context.Context, folder string, uidValidity uint32, cached []CachedFlags, minUID uint32) (*CacheReport, error) {
+    report := &CacheReport{
+        Folder:          folder,
+        MissingOnServer: []uint32{},
+        MissingInCache:  []uint32{},
+        FlagDrift:       []FlagDrift{},
+        Repairs:         []Repair{},
+    }
+
+    err := c.withFolder(folder, true, func(client *client.Client, mbox *imap.MailboxStatus) error {
+        // Cached UIDs mean nothing under a new UIDVALIDITY
+        if mbox.UidValidity != uidValidity {
+            report.UIDValidityChanged = true
+            return nil
+        }
+
+        serverUIDs, err := searchWith(client, uidCriteria(0, false))
+        if err != nil {
+            return err
+        }
+        onServer := make(map[uint32]bool, len(serverUIDs))
+        for _, uid := range serverUIDs {
+            onServer[uid] = true
+        }
+
+        byUID := make(map[uint32]CachedFlags, len(cached))
+        var present []uint32
+        for _, msg := range cached {
+            byUID[msg.UID] = msg
+            if !flagSet(msg.Flags)[imap.SeenFlag] {
+                report.CachedUnseen++
+            }
+            if onServer[msg.UID] {
+                present = append(present, msg.UID)
+            } else {
+                report.MissingOnServer = append(report.MissingOnServer, msg.UID)
+            }
+        }
+        for _, uid := range serverUIDs {
+            if _, ok := byUID[uid]; !ok && uid >= minUID {
+                report.MissingInCache = append(report.MissingInCache, uid)
+            }
+        }
+
+        for start := 0; start < len(present); start += fetchBatchSize {
+            if err := lanes.Yield(ctx); err != nil {
+                return err
+            }
+
+            end := start + fetchBatchSize
+            if end > len(present) {
+                end = len(present)
+            }
+
+            flags, err := flagsWith(client, present[start:end])
+            if err != nil {
+                return err
+            }
+            for _, uid := range present[start:end] {
+                server, ok := flags[uid]
+                if !ok {
+                    // Expunged between the search and the fetch
+                    report.MissingOnServer = append(report.MissingOnServer, uid)
+                    continue
+                }
+
+                server = withoutRecent(server)
+                if cachedFlags := withoutRecent(byUID[uid].Flags); flagKey(cachedFlags) != flagKey(server) {
+                    report.FlagDrift = append(report.FlagDrift, FlagDrift{UID: uid, Cached: cachedFlags, Server: server})
+                }
+            }
+        }
+
+        unseen, err := uidSearchRaw(client, imap.RawString("UNSEEN"))
+        if err != nil {
+            return err
+        }
+        report.ServerUnseen = len(unseen)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if report.UIDValidityChanged {
+        report.Repairs = append(report.Repairs, Repair{Action: "recover_folder"})
+        return report, nil
+    }
+
+    if len(report.MissingOnServer) > 0 {
+        report.Repairs = append(report.Repairs, Repair{Action: "remove", UIDs: report.MissingOnServer})
+    }
+    if len(report.MissingInCache) > 0 {
+        report.Repairs = append(report.Repairs, Repair{Action: "fetch", UIDs: report.MissingInCache})
+    }
+    if len(report.FlagDrift) > 0 {
+        uids := make([]uint32, 0, len(report.FlagDrift))
+        for _, drift := range report.FlagDrift {
+            uids = append(uids, drift.UID)
+        }
+        report.Repairs = append(report.Repairs, Repair{Action: "update_flags", UIDs: uids})
+    }
+    report.InSync = len(report.Repairs) == 0 && report.CachedUnseen == report.ServerUnseen
+
+    return report, nil
+}
+
+func (h *Handler) handleVerifyCache(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle      int           `json:"handle" validate:"required"`
+        Folder      string        `json:"folder"`
+        UIDValidity uint32        `json:"uid_validity"`
+        Messages    []CachedFlags `json:"messages"`
+        MinUID      uint32        `json:"min_uid"` // Oldest UID the cache keeps, if it keeps a window
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    report, err := conn.VerifyCache(ctx, p.Folder, p.UIDValidity, p.Messages, p.MinUID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(report)
+}
@@ -0,0 +1,166 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// defaultWarmUpDeadline bounds warm-up when the client gives no deadline
+const defaultWarmUpDeadline = 5 * time.Second
+
+// WarmUpAccount is an account to connect at launch
+type WarmUpAccount struct {
+    ID       string `json:"id"` // Client's account ID, echoed in results
+    Host     string `json:"host" validate:"required"`
+    Port     int    `json:"port" validate:"required,min=1,max=65535"`
+    Username string `json:"username"`
+    Password string `json:"password"`
+    Folder   string `json:"folder,omitempty"` // Defaults to INBOX
+
+    // AuthType "xoauth2" logs in with AccessToken instead of Password
+    AuthType    string `json:"auth_type" validate:"oneof=login xoauth2"`
+    AccessToken string `json:"access_token"`
+}
+
+// secret is the password or token the account logs in with
+func (a WarmUpAccount) secret() string {
+    if a.AuthType == AuthXOAuth2 {
+        return a.AccessToken
+    }
+    return a.Password
+}
+
+// warmedUp is a finished warm-up and the account's position in the request
+type warmedUp struct {
+    index  int
+    result WarmUpResult
+}
+
+// WarmUpResult is the state of one account when warm-up returns
+type WarmUpResult struct {
+    ID          string `json:"id"`
+    Ready       bool   `json:"ready"`
+    Handle      int    `json:"handle,omitempty"`
+    Folder      string `json:"folder,omitempty"`
+    Messages    uint32 `json:"messages,omitempty"`
+    UIDValidity uint32 `json:"uid_validity,omitempty"`
+    UIDNext     uint32 `json:"uid_next,omitempty"`
+    Error       string `json:"error,omitempty"`
+    Pending     bool   `json:"pending,omitempty"` // Still connecting at the deadline
+}
+
+// warmUp connects an account and selects its folder. Only ctx's owner is
+// used, as the connection outlives a caller that stopped waiting.
+func (h *Handler) warmUp(ctx context.Context, account WarmUpAccount) WarmUpResult {
+    result := WarmUpResult{ID: account.ID, Folder: account.Folder}
+    if result.Folder == "" {
+        result.Folder = "INBOX"
+    }
+
+    conn, err := Connect(context.WithoutCancel(ctx), h.hosts, account.Host, account.Port, account.Username, account.secret(), account.AuthType)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+
+    mbox, err := conn.selectMailbox(result.Folder)
+    if err != nil {
+        conn.Close()
+        result.Error = fmt.Sprintf("failed to select %s: %v", result.Folder, err)
+        return result
+    }
+
+    handle, err := h.pool.Add(ctx, conn)
+    if err != nil {
+        conn.Close()
+        result.Error = err.Error()
+        return result
+    }
+
+    result.Ready = true
+    result.Handle = handle
+    result.Messages = mbox.Messages
+    result.UIDValidity = mbox.UidValidity
+    result.UIDNext = mbox.UidNext
+    return result
+}
+
+// WarmUp connects every account concurrently, returning what is ready by
+// the deadline. Accounts still connecting keep going and announce
+// themselves with a warmup.finished event when done.
+func (h *Handler) WarmUp(ctx context.Context, accounts []WarmUpAccount, deadline time.Duration) []WarmUpResult {
+    results := make([]WarmUpResult, len(accounts))
+    for i, account := range accounts {
+        results[i] = WarmUpResult{ID: account.ID, Pending: true}
+    }
+
+    // Buffered, so late connections never block on a returned caller
+    finished := make(chan warmedUp, len(accounts))
+    for i, account := range accounts {
+        go func(i int, account WarmUpAccount) {
+            finished <- warmedUp{i, h.warmUp(ctx, account)}
+        }(i, account)
+    }
+
+    timer := time.NewTimer(deadline)
+    defer timer.Stop()
+
+    remaining := len(accounts)
+    for remaining > 0 {
+        select {
+        case d := <-finished:
+            results[d.index] = d.result
+            remaining--
+        case <-timer.C:
+            go h.announceLate(ctx, finished, remaining)
+            return results
+        case <-ctx.Done():
+            go h.announceLate(ctx, finished, remaining)
+            return results
+        }
+    }
+
+    return results
+}
+
+// announceLate publishes the accounts that finish after warm-up returned
+func (h *Handler) announceLate(ctx context.Context, finished <-chan warmedUp, remaining int) {
+    for ; remaining > 0; remaining-- {
+        d := <-finished
+        h.publishFor(ctx, "warmup.finished", d.result.Handle, d.result)
+    }
+}
+
+func (h *Handler) handleWarmUp(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Accounts   []WarmUpAccount `json:"accounts"`
+        DeadlineMS int             `json:"deadline_ms"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    deadline := defaultWarmUpDeadline
+    if p.DeadlineMS > 0 {
+        deadline = time.Duration(p.DeadlineMS) * time.Millisecond
+    }
+
+    results := h.WarmUp(ctx, p.Accounts, deadline)
+
+    ready := 0
+    for _, r := range results {
+        if r.Ready {
+            ready++
+        }
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "accounts": results,
+        "ready":    ready,
+    })
+}
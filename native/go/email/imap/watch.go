@@ -0,0 +1,394 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// defaultWatchInterval is how often watched folders are polled, and how long
+// an IDLE runs before the other folders get their turn
+const defaultWatchInterval = 2 * time.Minute
+
+// folderSnapshot is the last seen state of a watched folder
+type folderSnapshot struct {
+    uidValidity uint32
+    flags       map[uint32][]string
+}
+
+// FolderChange is the differential event payload for a watched folder
+type FolderChange struct {
+    Folder   string              `json:"folder"`
+    Reset    bool                `json:"reset,omitempty"` // UIDVALIDITY changed, resync everything
+    Previous uint32              `json:"previous_uid_validity,omitempty"` // Set on reset, for recover_folder
+    Added    []uint32            `json:"added,omitempty"`
+    Expunged []uint32            `json:"expunged,omitempty"`
+    Flags    map[uint32][]string `json:"flags,omitempty"` // New flags of changed messages
+}
+
+// watcher follows a set of folders on a dedicated connection. The first
+// folder is followed with IDLE when the server supports it; the rest are
+// polled between IDLE periods, since one connection can only IDLE on its
+// selected mailbox.
+type watcher struct {
+    handle    int
+    conn      *Connection
+    folders   []string
+    interval  time.Duration
+    snapshots map[string]*folderSnapshot
+    changed   chan struct{}
+    stop      chan struct{}
+    done      chan struct{}
+    publish   func(eventType string, handle int, data any)
+    onChange  func(folder string)
+    onNewMail func(folder string, uids []uint32)
+    onError   func(err error)
+    onRetry   func(err error) // After each reconnect attempt
+}
+
+func newWatcher(h *Handler, handle int, conn *Connection, folders []string, interval time.Duration) *watcher {
+    w := &watcher{
+        handle:    handle,
+        conn:      conn,
+        folders:   folders,
+        interval:  interval,
+        snapshots: make(map[string]*folderSnapshot),
+        changed:   make(chan struct{}, 1),
+        stop:      make(chan struct{}),
+        done:      make(chan struct{}),
+        publish:   h.publish,
+        onNewMail: func(folder string, uids []uint32) {
+            h.newMail(handle, folder, uids)
+        },
+        onError: func(err error) {
+            h.history.Fail(handle, "watch", err)
+        },
+        onRetry: func(err error) {
+            h.recordReconnect(handle, conn, err)
+        },
+        onChange: func(folder string) {
+            // IDLE notices INBOX changes long before the next badge poll
+            if strings.EqualFold(folder, "INBOX") {
+                go h.refreshBadge(handle)
+            }
+        },
+    }
+    w.listen()
+    return w
+}
+
+// listen routes unsolicited updates into the changed signal. The client
+// blocks while its Updates channel is full, so it is always drained.
+func (w *watcher) listen() {
+    updates := make(chan client.Update, 16)
+
+    w.conn.mu.Lock()
+    if w.conn.client != nil {
+        w.conn.client.Updates = updates
+    }
+    w.conn.mu.Unlock()
+
+    go func() {
+        for range updates {
+            select {
+            case w.changed <- struct{}{}:
+            default:
+            }
+        }
+    }()
+}
+
+func (w *watcher) run() {
+    defer close(w.done)
+    defer w.conn.Close()
+
+    for {
+        err := w.cycle()
+
+        select {
+        case <-w.stop:
+            return
+        default:
+        }
+
+        if err == nil {
+            continue
+        }
+
+        w.publish("watch.error", w.handle, map[string]any{"error": err.Error()})
+        w.onError(err)
+
+        select {
+        case <-w.stop:
+            return
+        case <-time.After(w.interval):
+        }
+
+        err = w.conn.Reconnect()
+        w.onRetry(err)
+        if err == nil {
+            w.listen()
+        }
+    }
+}
+
+// cycle polls every watched folder once, then waits on the primary folder
+// until the server reports a change or the interval passes
+func (w *watcher) cycle() error {
+    for _, folder := range w.folders[1:] {
+        if err := w.poll(folder); err != nil {
+            return err
+        }
+    }
+
+    // Polled last so it stays selected for IDLE
+    primary := w.folders[0]
+    if err := w.poll(primary); err != nil {
+        return err
+    }
+
+    if !w.conn.Supports("IDLE") {
+        select {
+        case <-w.stop:
+        case <-time.After(w.interval):
+        }
+        return nil
+    }
+
+    return w.idle()
+}
+
+func (w *watcher) idle() error {
+    c, release, err := w.conn.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    stop := make(chan struct{})
+    done := make(chan error, 1)
+    go func() {
+        done <- c.Idle(stop, nil)
+    }()
+
+    timer := time.NewTimer(w.interval)
+    defer timer.Stop()
+
+    select {
+    case err := <-done:
+        return err
+    case <-w.changed:
+    case <-timer.C:
+    case <-w.stop:
+    }
+
+    close(stop)
+    return <-done
+}
+
+// poll diffs one folder against its snapshot and publishes the changes
+func (w *watcher) poll(folder string) error {
+    status, err := w.conn.Examine(folder)
+    if err != nil {
+        return fmt.Errorf("failed to examine %s: %w", folder, err)
+    }
+
+    flags := map[uint32][]string{}
+    if status.Messages > 0 {
+        flags, err = w.conn.FetchAllFlags()
+        if err != nil {
+            return fmt.Errorf("failed to fetch flags in %s: %w", folder, err)
+        }
+    }
+
+    prev := w.snapshots[folder]
+    w.snapshots[folder] = &folderSnapshot{uidValidity: status.UidValidity, flags: flags}
+
+    if prev == nil {
+        return nil
+    }
+    if prev.uidValidity != status.UidValidity {
+        w.publish("folder.changed", w.handle, FolderChange{Folder: folder, Reset: true, Previous: prev.uidValidity})
+        w.onChange(folder)
+        return nil
+    }
+
+    change := diffFlags(folder, prev.flags, flags)
+    if len(change.Added) > 0 || len(change.Expunged) > 0 || len(change.Flags) > 0 {
+        w.publish("folder.changed", w.handle, change)
+        w.onChange(folder)
+    }
+
+    // Only unread arrivals are news; a copy of one's own sent mail is not
+    var unseen []uint32
+    for _, uid := range change.Added {
+        if !flagSet(flags[uid])[imap.SeenFlag] {
+            unseen = append(unseen, uid)
+        }
+    }
+    w.onNewMail(folder, unseen)
+
+    return nil
+}
+
+// diffFlags compares two UID-to-flags maps
+func diffFlags(folder string, old, current map[uint32][]string) FolderChange {
+    change := FolderChange{Folder: folder}
+
+    for uid, flags := range current {
+        prevFlags, ok := old[uid]
+        if !ok {
+            change.Added = append(change.Added, uid)
+            continue
+        }
+        if flagKey(prevFlags) != flagKey(flags) {
+            if change.Flags == nil {
+                change.Flags = make(map[uint32][]string)
+            }
+            change.Flags[uid] = flags
+        }
+    }
+
+    for uid := range old {
+        if _, ok := current[uid]; !ok {
+            change.Expunged = append(change.Expunged, uid)
+        }
+    }
+
+    sort.Slice(change.Added, func(i, j int) bool { return change.Added[i] < change.Added[j] })
+    sort.Slice(change.Expunged, func(i, j int) bool { return change.Expunged[i] < change.Expunged[j] })
+    return change
+}
+
+func flagKey(flags []string) string {
+    sorted := append([]string(nil), flags...)
+    sort.Strings(sorted)
+    return strings.Join(sorted, " ")
+}
+
+// Examine selects a folder read-only
+func (c *Connection) Examine(folder string) (*imap.MailboxStatus, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return client.Select(folder, true)
+}
+
+// FetchAllFlags returns the flags of every message in the selected folder
+func (c *Connection) FetchAllFlags() (map[uint32][]string, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    seqSet := new(imap.SeqSet)
+    seqSet.AddRange(1, 0)
+
+    messages := make(chan *imap.Message, 64)
+    done := make(chan error, 1)
+
+    go func() {
+        done <- client.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+    }()
+
+    result := make(map[uint32][]string)
+    for msg := range messages {
+        result[msg.Uid] = msg.Flags
+    }
+
+    if err := <-done; err != nil {
+        return nil, fmt.Errorf("fetch failed: %w", err)
+    }
+
+    return result, nil
+}
+
+// watchers tracks the folder watcher of each handle
+type watchers struct {
+    mu   sync.Mutex
+    byID map[int]*watcher
+}
+
+// stopWatcher stops and removes the watcher of a handle, if any. The
+// watcher is stopped outside the lock, as it may be mid IDLE or poll.
+func (h *Handler) stopWatcher(handle int) {
+    h.watchers.mu.Lock()
+    w, ok := h.watchers.byID[handle]
+    delete(h.watchers.byID, handle)
+    h.watchers.mu.Unlock()
+
+    if ok {
+        close(w.stop)
+        <-w.done
+    }
+}
+
+func (h *Handler) handleWatchFolders(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle          int      `json:"handle" validate:"required"`
+        Folders         []string `json:"folders"`
+        IntervalSeconds int      `json:"interval_seconds"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    h.stopWatcher(p.Handle)
+    if len(p.Folders) == 0 {
+        return protocol.SuccessResponse(map[string]any{"watching": []string{}})
+    }
+
+    interval := defaultWatchInterval
+    if p.IntervalSeconds > 0 {
+        interval = time.Duration(p.IntervalSeconds) * time.Second
+    }
+
+    // Watching needs its own connection so IDLE doesn't block the handle
+    dedicated, err := Connect(ctx, h.hosts, conn.host, conn.port, conn.username, conn.password, conn.authType)
+    if err != nil {
+        return protocol.ErrorResponse(fmt.Errorf("failed to open watch connection: %w", err))
+    }
+    idle := dedicated.Supports("IDLE")
+
+    // The dial ran unlocked, so another call may have installed a watcher
+    // or the handle closed meanwhile
+    h.watchers.mu.Lock()
+    _, raced := h.watchers.byID[p.Handle]
+    _, err = h.getConnection(p.Handle)
+    if raced || err != nil {
+        h.watchers.mu.Unlock()
+        dedicated.Close()
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+        return protocol.ErrorResponse(&protocol.BusyError{Reason: "another watch_folders call for this handle finished first"})
+    }
+    w := newWatcher(h, p.Handle, dedicated, p.Folders, interval)
+    h.watchers.byID[p.Handle] = w
+    h.watchers.mu.Unlock()
+
+    go w.run()
+
+    return protocol.SuccessResponse(map[string]any{
+        "watching": p.Folders,
+        "idle":     idle,
+    })
+}
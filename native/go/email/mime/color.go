@@ -0,0 +1,73 @@
+package mime
+
+import (
+	"fmt"
+)
+
+// Apple Mail encodes a flag colour as \Flagged plus a 3-bit number spread
+// over the $MailFlagBit0-2 keywords; red is \Flagged with no bits set
+const (
+    flagged  = `\Flagged`
+    colorBit = "$MailFlagBit"
+)
+
+// colors lists flag colours by their bit value
+var colors = []string{"red", "orange", "yellow", "green", "blue", "purple", "gray"}
+
+// ColorFromFlags returns the flag colour a message's flags encode, or "" if
+// the message isn't flagged
+func ColorFromFlags(flags []string) string {
+    isFlagged := false
+    value := 0
+    for _, flag := range flags {
+        switch flag {
+        case flagged:
+            isFlagged = true
+        case colorBit + "0":
+            value |= 1
+        case colorBit + "1":
+            value |= 2
+        case colorBit + "2":
+            value |= 4
+        }
+    }
+
+    if !isFlagged {
+        return ""
+    }
+    if value >= len(colors) {
+        return colors[0]
+    }
+    return colors[value]
+}
+
+// ColorFlags returns the flags to add and remove to give a message a flag
+// colour. An empty colour (or "none") unflags the message.
+func ColorFlags(color string) (add, remove []string, err error) {
+    bits := []string{colorBit + "0", colorBit + "1", colorBit + "2"}
+
+    if color == "" || color == "none" {
+        return nil, append([]string{flagged}, bits...), nil
+    }
+
+    value := -1
+    for i, c := range colors {
+        if c == color {
+            value = i
+            break
+        }
+    }
+    if value < 0 {
+        return nil, nil, fmt.Errorf("unknown flag colour: %s", color)
+    }
+
+    add = []string{flagged}
+    for i, bit := range bits {
+        if value&(1<<i) != 0 {
+            add = append(add, bit)
+        } else {
+            remove = append(remove, bit)
+        }
+    }
+    return add, remove, nil
+}
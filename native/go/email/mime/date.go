@@ -0,0 +1,259 @@
+package mime
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateHeaders are the header fields Dates reads
+var DateHeaders = []string{"Date", "Received"}
+
+// obsoleteZones are the zone names RFC 5322 section 4.3 still allows, and
+// a few more that real mail uses. Military letters are deliberately absent:
+// RFC 5322 says to treat them as -0000, which the default already does.
+var obsoleteZones = map[string]int{
+    "UT": 0, "UTC": 0, "GMT": 0, "Z": 0,
+    "EST": -5, "EDT": -4,
+    "CST": -6, "CDT": -5,
+    "MST": -7, "MDT": -6,
+    "PST": -8, "PDT": -7,
+    "BST": 1, "CET": 1, "CEST": 2, "MET": 1, "MEST": 2, "EET": 2, "EEST": 3,
+    "IST": 5, "JST": 9, "KST": 9, "HKT": 8, "AEST": 10, "AEDT": 11,
+}
+
+// monthNames maps the first three letters of English month names
+var monthNames = map[string]time.Month{
+    "jan": time.January, "feb": time.February, "mar": time.March,
+    "apr": time.April, "may": time.May, "jun": time.June,
+    "jul": time.July, "aug": time.August, "sep": time.September,
+    "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// NormalizedDate is a header date in RFC 3339 UTC beside the text it came
+// from. Lenient is set when the text broke RFC 5322 and was read anyway.
+type NormalizedDate struct {
+    Time     *time.Time `json:"time,omitempty"` // Nil when unreadable
+    Original string     `json:"original"`
+    Lenient  bool       `json:"lenient,omitempty"`
+}
+
+// MessageDates are a message's normalized dates
+type MessageDates struct {
+    Date     *NormalizedDate `json:"date,omitempty"`
+    Received []ReceivedHop   `json:"received"` // Newest first, as in the header
+}
+
+// Dates normalizes the Date header and the Received chain
+func Dates(header textproto.MIMEHeader) MessageDates {
+    dates := MessageDates{Received: []ReceivedHop{}}
+
+    if value := header.Get("Date"); value != "" {
+        date := Normalize(value)
+        dates.Date = &date
+    }
+
+    for _, value := range header.Values("Received") {
+        if hop, ok := ParseReceived(value); ok {
+            dates.Received = append(dates.Received, hop)
+        }
+    }
+
+    return dates
+}
+
+// Normalize reads a date as leniently as mail needs
+func Normalize(value string) NormalizedDate {
+    value = strings.TrimSpace(unfold(value))
+    date := NormalizedDate{Original: value}
+
+    t, lenient, err := ParseDate(value)
+    if err != nil {
+        return date
+    }
+    utc := t.UTC()
+    date.Time = &utc
+    date.Lenient = lenient
+    return date
+}
+
+// ParseDate parses an RFC 5322 date, accepting the obsolete syntax and the
+// usual mistakes: comments, missing weekday or seconds, two-digit years,
+// zone names, dotted times and ISO 8601. lenient reports whether any of
+// the mistakes was needed.
+func ParseDate(value string) (t time.Time, lenient bool, err error) {
+    value = stripComments(value)
+    if value == "" {
+        return time.Time{}, false, errors.New("empty date")
+    }
+
+    // ISO 8601, as some scripts write
+    for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05"} {
+        if t, err := time.Parse(layout, value); err == nil {
+            return t, true, nil
+        }
+    }
+
+    fields := strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' })
+
+    // The weekday is optional and often wrong, so it is ignored
+    if len(fields) > 0 && isWeekday(fields[0]) {
+        fields = fields[1:]
+    }
+    if len(fields) < 4 {
+        return time.Time{}, false, fmt.Errorf("malformed date %q", value)
+    }
+
+    day, month, year := fields[0], fields[1], fields[2]
+    // "Jan 2 2006" ordering
+    if _, ok := monthOf(day); ok {
+        day, month = month, day
+        lenient = true
+    }
+
+    d, err := strconv.Atoi(day)
+    if err != nil || d < 1 || d > 31 {
+        return time.Time{}, false, fmt.Errorf("malformed day in %q", value)
+    }
+    m, ok := monthOf(month)
+    if !ok {
+        return time.Time{}, false, fmt.Errorf("malformed month in %q", value)
+    }
+    y, err := strconv.Atoi(year)
+    if err != nil {
+        return time.Time{}, false, fmt.Errorf("malformed year in %q", value)
+    }
+    // Two- and three-digit years (RFC 5322 section 4.3)
+    switch {
+    case len(year) == 2 && y < 50:
+        y += 2000
+        lenient = true
+    case len(year) <= 3:
+        y += 1900
+        lenient = true
+    }
+
+    hour, minute, second, timeLenient, err := parseClock(fields[3])
+    if err != nil {
+        return time.Time{}, false, fmt.Errorf("malformed time in %q: %w", value, err)
+    }
+    lenient = lenient || timeLenient
+
+    loc := time.UTC
+    if len(fields) > 4 {
+        var zoneLenient bool
+        loc, zoneLenient = parseZone(fields[4])
+        lenient = lenient || zoneLenient
+    } else {
+        // No zone at all; UTC is the least wrong guess
+        lenient = true
+    }
+
+    return time.Date(y, m, d, hour, minute, second, 0, loc), lenient, nil
+}
+
+// parseClock reads hh:mm[:ss], also with dots
+func parseClock(value string) (hour, minute, second int, lenient bool, err error) {
+    if strings.Contains(value, ".") {
+        value = strings.ReplaceAll(value, ".", ":")
+        lenient = true
+    }
+
+    parts := strings.Split(value, ":")
+    if len(parts) < 2 || len(parts) > 3 {
+        return 0, 0, 0, false, errors.New("want hh:mm:ss")
+    }
+    if len(parts) == 2 {
+        lenient = true
+        parts = append(parts, "0")
+    }
+
+    nums := make([]int, 3)
+    limits := []int{23, 59, 60} // 60 for leap seconds
+    for i, part := range parts {
+        n, err := strconv.Atoi(part)
+        if err != nil || n < 0 || n > limits[i] {
+            return 0, 0, 0, false, fmt.Errorf("bad %q", part)
+        }
+        nums[i] = n
+    }
+    if nums[2] == 60 {
+        nums[2] = 59
+    }
+    return nums[0], nums[1], nums[2], lenient, nil
+}
+
+// parseZone reads a numeric offset or a zone name. Unknown names mean
+// "-0000", no information, which is read as UTC.
+func parseZone(value string) (*time.Location, bool) {
+    if len(value) == 5 && (value[0] == '+' || value[0] == '-') {
+        if n, err := strconv.Atoi(value[1:]); err == nil {
+            offset := (n/100)*3600 + (n%100)*60
+            if value[0] == '-' {
+                offset = -offset
+            }
+            return time.FixedZone(value, offset), false
+        }
+    }
+
+    name := strings.ToUpper(value)
+    // "GMT+0100" and "UTC-5" style
+    for _, prefix := range []string{"GMT", "UTC", "UT"} {
+        if rest, ok := strings.CutPrefix(name, prefix); ok && rest != "" {
+            if loc, _ := parseZone(rest); loc != time.UTC {
+                return loc, true
+            }
+            if n, err := strconv.Atoi(rest); err == nil && n >= -14 && n <= 14 {
+                return time.FixedZone(value, n*3600), true
+            }
+        }
+    }
+
+    if hours, ok := obsoleteZones[name]; ok {
+        return time.FixedZone(name, hours*3600), name != "UT" && name != "GMT"
+    }
+    return time.UTC, true
+}
+
+// stripComments removes parenthesised comments, which may nest, and
+// collapses whitespace
+func stripComments(value string) string {
+    var b strings.Builder
+    depth := 0
+    for _, r := range value {
+        switch {
+        case r == '(':
+            depth++
+        case r == ')' && depth > 0:
+            depth--
+        case depth == 0:
+            b.WriteRune(r)
+        }
+    }
+    return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// unfold joins a folded header value onto one line
+func unfold(value string) string {
+    return strings.Join(strings.Fields(value), " ")
+}
+
+func isWeekday(field string) bool {
+    switch strings.ToLower(field) {
+    case "mon", "tue", "wed", "thu", "fri", "sat", "sun",
+        "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday":
+        return true
+    }
+    return false
+}
+
+func monthOf(field string) (time.Month, bool) {
+    if len(field) < 3 {
+        return 0, false
+    }
+    m, ok := monthNames[strings.ToLower(field[:3])]
+    return m, ok
+}
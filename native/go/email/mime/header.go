@@ -0,0 +1,25 @@
+package mime
+
+import (
+	"fmt"
+)
+
+// AddHeader prepends a header field unless the message already has it
+func AddHeader(message []byte, name, value string) ([]byte, error) {
+    header, err := ReadHeader(message)
+    if err != nil {
+        return nil, err
+    }
+    if header.Get(name) != "" {
+        return message, nil
+    }
+
+    _, sep := splitHeader(message)
+    if sep == "" {
+        return nil, fmt.Errorf("message has no header")
+    }
+
+    out := make([]byte, 0, len(message)+len(name)+len(value)+4)
+    out = append(out, name+": "+value+sep...)
+    return append(out, message...), nil
+}
@@ -0,0 +1,101 @@
+package mime
+
+import (
+	stdmime "mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ListHeaders are the header fields ListOf reads
+var ListHeaders = []string{"List-Id", "List-Unsubscribe", "List-Post", "Precedence", "Feedback-ID", "From"}
+
+// MailingList identifies the list or bulk sender a message came from
+type MailingList struct {
+    // ID groups messages of one list: the List-Id, or for bulk mail without
+    // one the sender's address
+    ID          string `json:"id"`
+    Name        string `json:"name,omitempty"`
+    Unsubscribe string `json:"unsubscribe,omitempty"`
+
+    // Discussion is set for lists members can post to, as opposed to
+    // newsletters and other one-way mail
+    Discussion bool `json:"discussion,omitempty"`
+}
+
+// ListOf returns the mailing list a message came from, or nil for personal
+// mail. Besides List-Id (RFC 2919), bulk mail is recognised by
+// List-Unsubscribe, Precedence: bulk or list, and the Feedback-ID that
+// bulk senders stamp for mailbox providers.
+func ListOf(header textproto.MIMEHeader) *MailingList {
+    list := &MailingList{
+        Unsubscribe: firstURI(header.Get("List-Unsubscribe")),
+        Discussion:  listPost(header.Get("List-Post")),
+    }
+
+    if id := header.Get("List-Id"); id != "" {
+        list.ID, list.Name = parseListID(id)
+        if list.ID != "" {
+            return list
+        }
+    }
+
+    precedence := strings.ToLower(strings.TrimSpace(header.Get("Precedence")))
+    bulk := list.Unsubscribe != "" || precedence == "bulk" || precedence == "list" || header.Get("Feedback-ID") != ""
+    if !bulk {
+        return nil
+    }
+
+    from, err := mail.ParseAddress(header.Get("From"))
+    if err != nil {
+        return nil
+    }
+    list.ID = strings.ToLower(from.Address)
+    list.Name = from.Name
+    return list
+}
+
+// parseListID splits `Name <list.example.com>` into its identifier and
+// description. The angle brackets are optional in practice.
+func parseListID(value string) (id, name string) {
+    value = strings.TrimSpace(value)
+
+    start := strings.LastIndex(value, "<")
+    end := strings.LastIndex(value, ">")
+    if start < 0 || end < start {
+        return strings.ToLower(value), ""
+    }
+
+    id = strings.ToLower(strings.TrimSpace(value[start+1 : end]))
+    name = strings.Trim(strings.TrimSpace(value[:start]), `"`)
+    if decoded, err := new(stdmime.WordDecoder).DecodeHeader(name); err == nil {
+        name = decoded
+    }
+    return id, name
+}
+
+// firstURI returns the first URI of a List-Unsubscribe style header,
+// preferring https over mailto
+func firstURI(value string) string {
+    var first string
+    for _, part := range strings.Split(value, ",") {
+        uri := strings.Trim(strings.TrimSpace(part), "<>")
+        if uri == "" {
+            continue
+        }
+        if strings.HasPrefix(strings.ToLower(uri), "https:") {
+            return uri
+        }
+        if first == "" {
+            first = uri
+        }
+    }
+    return first
+}
+
+// listPost reports whether List-Post names an address; "NO" marks an
+// announcement-only list
+func listPost(value string) bool {
+    value = strings.TrimSpace(value)
+    return value != "" && !strings.EqualFold(value, "NO")
+}
@@ -0,0 +1,142 @@
+package mime
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Priority levels, normalised across X-Priority, X-MSMail-Priority and
+// Importance
+const (
+    PriorityHigh   = "high"
+    PriorityNormal = "normal"
+    PriorityLow    = "low"
+)
+
+// priorityHeaders are written together so every client sees the same level
+var priorityHeaders = map[string][3]string{
+    //                X-Priority      X-MSMail-Priority  Importance
+    PriorityHigh:   {"1 (Highest)", "High", "high"},
+    PriorityNormal: {"3 (Normal)", "Normal", "normal"},
+    PriorityLow:    {"5 (Lowest)", "Low", "low"},
+}
+
+// ReadHeader parses the header block at the start of a raw message
+func ReadHeader(message []byte) (textproto.MIMEHeader, error) {
+    reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(message)))
+
+    header, err := reader.ReadMIMEHeader()
+    if err != nil && len(header) == 0 {
+        return nil, fmt.Errorf("failed to parse header: %w", err)
+    }
+    return header, nil
+}
+
+// Priority returns a message's priority from its headers. X-Priority wins,
+// then Importance, then X-MSMail-Priority; without any it is normal.
+func Priority(header textproto.MIMEHeader) string {
+    // "1 (Highest)" - only the leading digit matters
+    if fields := strings.Fields(header.Get("X-Priority")); len(fields) > 0 {
+        if n, err := strconv.Atoi(fields[0]); err == nil {
+            switch {
+            case n <= 2:
+                return PriorityHigh
+            case n >= 4:
+                return PriorityLow
+            default:
+                return PriorityNormal
+            }
+        }
+    }
+
+    for _, name := range []string{"Importance", "X-MSMail-Priority"} {
+        switch strings.ToLower(strings.TrimSpace(header.Get(name))) {
+        case "high":
+            return PriorityHigh
+        case "low":
+            return PriorityLow
+        case "normal", "medium":
+            return PriorityNormal
+        }
+    }
+
+    return PriorityNormal
+}
+
+// SetPriority rewrites a raw message's priority headers, replacing any
+// existing ones so the message carries a single consistent level
+func SetPriority(message []byte, priority string) ([]byte, error) {
+    values, ok := priorityHeaders[priority]
+    if !ok {
+        return nil, fmt.Errorf("unknown priority: %s", priority)
+    }
+
+    headerEnd, sep := splitHeader(message)
+    if headerEnd < 0 {
+        return nil, fmt.Errorf("message has no header")
+    }
+
+    var out bytes.Buffer
+    for _, line := range [][2]string{
+        {"X-Priority", values[0]},
+        {"X-MSMail-Priority", values[1]},
+        {"Importance", values[2]},
+    } {
+        out.WriteString(line[0] + ": " + line[1] + sep)
+    }
+
+    // Copy the original header minus old priority fields (and their
+    // continuation lines)
+    skipping := false
+    for _, line := range splitLines(message[:headerEnd]) {
+        if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+            if !skipping {
+                out.Write(line)
+            }
+            continue
+        }
+
+        name, _, _ := strings.Cut(string(line), ":")
+        switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) {
+        case "X-Priority", "X-Msmail-Priority", "Importance":
+            skipping = true
+        default:
+            skipping = false
+            out.Write(line)
+        }
+    }
+
+    out.Write(message[headerEnd:])
+    return out.Bytes(), nil
+}
+
+// splitHeader returns the offset of the blank line ending the header and
+// the line separator in use
+func splitHeader(message []byte) (int, string) {
+    if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+        return i + 2, "\r\n"
+    }
+    if i := bytes.Index(message, []byte("\n\n")); i >= 0 {
+        return i + 1, "\n"
+    }
+    return -1, ""
+}
+
+// splitLines splits b after each newline, keeping the line endings
+func splitLines(b []byte) [][]byte {
+    var lines [][]byte
+    for len(b) > 0 {
+        i := bytes.IndexByte(b, '\n')
+        if i < 0 {
+            lines = append(lines, b)
+            break
+        }
+        lines = append(lines, b[:i+1])
+        b = b[i+1:]
+    }
+    return lines
+}
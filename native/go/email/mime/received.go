@@ -0,0 +1,183 @@
+package mime
+
+import (
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ReceivedHop is one Received header: a server that accepted the message
+// on its way
+type ReceivedHop struct {
+    NormalizedDate
+    From   string `json:"from,omitempty"`    // Name the sending host gave in HELO
+    FromIP string `json:"from_ip,omitempty"` // Address the sending host connected from
+    By     string `json:"by,omitempty"`      // The host that added the header
+    With   string `json:"with,omitempty"`    // Protocol, such as ESMTPS
+    ID     string `json:"id,omitempty"`      // The receiving host's queue ID
+    For    string `json:"for,omitempty"`     // Recipient, when only one was given
+
+    // DelayMs is how long after the previous hop, or after the Date header
+    // for the first, this hop received the message. It can be negative
+    // when clocks disagree, and is nil when either time is unknown.
+    DelayMs *int64 `json:"delay_ms,omitempty"`
+}
+
+// DeliveryRoute is the path a message took, from its Received chain
+type DeliveryRoute struct {
+    Hops []ReceivedHop `json:"hops"` // Oldest first
+
+    // OriginIP is the first public address in the chain, normally the
+    // sender's mail server; relays can forge anything below their own hop
+    OriginIP string `json:"origin_ip,omitempty"`
+
+    // TotalMs is from the Date header, or the first dated hop, to the last
+    TotalMs *int64 `json:"total_ms,omitempty"`
+}
+
+// receivedClauses are the keywords opening each part of a Received header
+// (RFC 5321 section 4.4)
+var receivedClauses = map[string]bool{
+    "from": true, "by": true, "via": true, "with": true, "id": true, "for": true,
+}
+
+// bracketedIP matches an address literal, as in "[192.0.2.1]" or
+// "[IPv6:2001:db8::1]"
+var bracketedIP = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// ParseReceived reads the clauses and date of one Received header. ok is
+// false when the header has no date, which servers always add.
+func ParseReceived(value string) (hop ReceivedHop, ok bool) {
+    value = unfold(value)
+
+    // The date follows the last semicolon
+    i := strings.LastIndex(value, ";")
+    if i < 0 {
+        return hop, false
+    }
+    hop.NormalizedDate = Normalize(value[i+1:])
+
+    clauses := splitClauses(value[:i])
+    if from, ok := clauses["from"]; ok {
+        hop.From = firstWord(from)
+        hop.FromIP = findIP(from)
+    }
+    hop.By = firstWord(clauses["by"])
+    hop.With = firstWord(clauses["with"])
+    hop.ID = strings.Trim(firstWord(clauses["id"]), "<>")
+    hop.For = strings.Trim(firstWord(clauses["for"]), "<>")
+
+    return hop, true
+}
+
+// Route reads a message's Received chain into the hops it took, oldest
+// first, with the delay at each
+func Route(header textproto.MIMEHeader) DeliveryRoute {
+    values := header.Values("Received")
+    route := DeliveryRoute{Hops: make([]ReceivedHop, 0, len(values))}
+
+    // Each server prepends its header, so the oldest is last
+    for i := len(values) - 1; i >= 0; i-- {
+        if hop, ok := ParseReceived(values[i]); ok {
+            route.Hops = append(route.Hops, hop)
+        }
+    }
+
+    var first, previous *time.Time
+    if date := header.Get("Date"); date != "" {
+        first = Normalize(date).Time
+        previous = first
+    }
+    for i := range route.Hops {
+        hop := &route.Hops[i]
+        if hop.Time == nil {
+            continue
+        }
+        if previous != nil {
+            delay := hop.Time.Sub(*previous).Milliseconds()
+            hop.DelayMs = &delay
+        }
+        if first == nil {
+            first = hop.Time
+        }
+        previous = hop.Time
+
+        if route.OriginIP == "" && isPublic(hop.FromIP) {
+            route.OriginIP = hop.FromIP
+        }
+    }
+    if first != nil && previous != nil && previous != first {
+        total := previous.Sub(*first).Milliseconds()
+        route.TotalMs = &total
+    }
+
+    return route
+}
+
+// splitClauses splits the part of a Received header before the date at
+// each keyword outside a comment
+func splitClauses(value string) map[string]string {
+    clauses := map[string]string{}
+    current := ""
+    var text strings.Builder
+    depth := 0
+
+    flush := func() {
+        if current != "" {
+            if _, seen := clauses[current]; !seen {
+                clauses[current] = strings.TrimSpace(text.String())
+            }
+        }
+        text.Reset()
+    }
+
+    for _, word := range strings.Fields(value) {
+        if depth == 0 && receivedClauses[strings.ToLower(word)] {
+            flush()
+            current = strings.ToLower(word)
+            continue
+        }
+        depth += strings.Count(word, "(") - strings.Count(word, ")")
+        if depth < 0 {
+            depth = 0
+        }
+        text.WriteString(word)
+        text.WriteByte(' ')
+    }
+    flush()
+
+    return clauses
+}
+
+// firstWord returns a clause's value, without the comments that follow it
+func firstWord(clause string) string {
+    if fields := strings.Fields(stripComments(clause)); len(fields) > 0 {
+        return fields[0]
+    }
+    return ""
+}
+
+// findIP returns the address in a from clause. Servers write it in the
+// comment, usually bracketed as in "(mx.example.com [192.0.2.1])", and
+// sometimes bare.
+func findIP(clause string) string {
+    for _, match := range bracketedIP.FindAllStringSubmatch(clause, -1) {
+        if ip := net.ParseIP(match[1]); ip != nil {
+            return ip.String()
+        }
+    }
+    for _, word := range strings.FieldsFunc(clause, func(r rune) bool { return strings.ContainsRune(" ()[]=,;", r) }) {
+        if ip := net.ParseIP(strings.TrimPrefix(word, "IPv6:")); ip != nil {
+            return ip.String()
+        }
+    }
+    return ""
+}
+
+// isPublic reports whether an address is routable on the internet
+func isPublic(addr string) bool {
+    ip := net.ParseIP(addr)
+    return ip != nil && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
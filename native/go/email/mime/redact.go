@@ -0,0 +1,114 @@
+package mime
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Redaction is what to remove from a message before it leaves the machine
+type Redaction struct {
+    // Addresses replaces the local part of every address with a pseudonym,
+    // the same one each time within an export, and drops display names
+    // from address headers. Domains are kept, as they carry most of the
+    // signal a spam filter learns from. Text inside base64 or
+    // quoted-printable parts isn't decoded, so may keep addresses.
+    Addresses bool `json:"addresses"`
+
+    // Headers are removed entirely, such as X-Originating-IP
+    Headers []string `json:"headers"`
+}
+
+// addressPattern finds addresses in raw text; the local part is group 1
+var addressPattern = regexp.MustCompile(`([A-Za-z0-9._%+=-]+)@((?:[A-Za-z0-9-]+\.)+[A-Za-z]{2,})`)
+
+// addressHeaders are the fields whose display names are dropped
+var addressHeaders = map[string]bool{
+    "From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true,
+    "Sender": true, "Resent-From": true, "Resent-To": true, "Resent-Cc": true,
+    "Delivered-To": true, "Return-Path": true,
+}
+
+// Redact applies a redaction to a raw message. salt keys the pseudonyms,
+// so two exports with different salts can't be matched up.
+func Redact(raw []byte, r Redaction, salt []byte) []byte {
+    header, body := splitMessage(raw)
+    eol := "\r\n"
+    if !bytes.HasSuffix(header, []byte(eol)) {
+        eol = "\n"
+    }
+
+    drop := make(map[string]bool, len(r.Headers))
+    for _, name := range r.Headers {
+        drop[textproto.CanonicalMIMEHeaderKey(name)] = true
+    }
+
+    var out bytes.Buffer
+    for _, field := range splitFields(header) {
+        name, value, ok := strings.Cut(field, ":")
+        key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+        if ok && drop[key] {
+            continue
+        }
+        if ok && r.Addresses && addressHeaders[key] {
+            if list, err := mail.ParseAddressList(unfold(value)); err == nil {
+                addresses := make([]string, 0, len(list))
+                for _, addr := range list {
+                    addresses = append(addresses, "<"+addr.Address+">")
+                }
+                field = name + ": " + strings.Join(addresses, ", ") + eol
+            }
+        }
+        out.WriteString(field)
+    }
+    out.WriteString(eol)
+    out.Write(body)
+
+    if !r.Addresses {
+        return out.Bytes()
+    }
+    return addressPattern.ReplaceAllFunc(out.Bytes(), func(match []byte) []byte {
+        at := bytes.LastIndexByte(match, '@')
+        return append([]byte(pseudonym(match, salt)), match[at:]...)
+    })
+}
+
+// pseudonym is the stable stand-in for an address's local part
+func pseudonym(address, salt []byte) string {
+    mac := hmac.New(sha256.New, salt)
+    mac.Write(bytes.ToLower(address))
+    return "anon-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// splitMessage separates the header section, without its blank line, from
+// the body
+func splitMessage(raw []byte) (header, body []byte) {
+    for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+        if i := bytes.Index(raw, sep); i >= 0 {
+            return raw[:i+len(sep)/2], raw[i+len(sep):]
+        }
+    }
+    return raw, nil
+}
+
+// splitFields splits a header section into fields, each with its
+// continuation lines and line endings
+func splitFields(header []byte) []string {
+    var fields []string
+    for _, line := range strings.SplitAfter(string(header), "\n") {
+        if line == "" {
+            continue
+        }
+        if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+            fields[len(fields)-1] += line
+            continue
+        }
+        fields = append(fields, line)
+    }
+    return fields
+}
@@ -0,0 +1,182 @@
+package mime
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	stdmime "mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// attachmentPhrases are words suggesting the writer meant to attach
+// something, across the languages users commonly write in. They are matched
+// as lowercase substrings, so stems cover inflections.
+var attachmentPhrases = []string{
+    // English
+    "attached", "attachment", "attaching", "enclosed", "i attach", "please find",
+    // German
+    "anhang", "angehängt", "anbei", "beigefügt",
+    // French
+    "pièce jointe", "pièces jointes", "ci-joint", "en pj",
+    // Spanish / Portuguese
+    "adjunto", "adjunta", "em anexo", "segue anexo", "anexado",
+    // Italian
+    "allegato", "allegata", "in allegato",
+    // Dutch
+    "bijlage", "bijgevoegd",
+    // Scandinavian
+    "bifogad", "bilaga", "vedhæftet", "vedlagt",
+    // Polish
+    "załącznik", "w załączeniu",
+    // Russian
+    "вложени", "во вложении", "прикреп",
+    // Japanese / Chinese / Korean
+    "添付", "附件", "첨부",
+}
+
+// htmlTag strips markup from HTML bodies before matching
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// AttachmentReminder is the result of checking a draft for a missing
+// attachment
+type AttachmentReminder struct {
+    Warn        bool     `json:"warn"`
+    Matches     []string `json:"matches,omitempty"`
+    Attachments int      `json:"attachments"`
+}
+
+// CheckAttachments warns when a message's own text mentions an attachment
+// but it has none. Quoted replies and signatures are ignored, since they
+// often talk about someone else's attachments.
+func CheckAttachments(message []byte) (*AttachmentReminder, error) {
+    msg, err := mail.ReadMessage(bytes.NewReader(message))
+    if err != nil {
+        return nil, err
+    }
+
+    var text strings.Builder
+    attachments := 0
+
+    // The subject counts as the writer's own text
+    text.WriteString(msg.Header.Get("Subject"))
+    text.WriteString("\n")
+
+    err = walkParts(msg.Header, msg.Body, func(contentType, disposition string, body []byte) {
+        if disposition == "attachment" {
+            attachments++
+            return
+        }
+        switch contentType {
+        case "text/plain":
+            text.WriteString(ownText(string(body)))
+        case "text/html":
+            text.WriteString(ownText(htmlTag.ReplaceAllString(string(body), " ")))
+        default:
+            // Inline non-text parts (images pasted in) count as attached
+            if !strings.HasPrefix(contentType, "multipart/") {
+                attachments++
+            }
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return CheckText(text.String(), attachments), nil
+}
+
+// CheckText warns when text mentions an attachment and attachments is zero
+func CheckText(text string, attachments int) *AttachmentReminder {
+    reminder := &AttachmentReminder{Attachments: attachments}
+
+    lower := strings.ToLower(text)
+    for _, phrase := range attachmentPhrases {
+        if strings.Contains(lower, phrase) {
+            reminder.Matches = append(reminder.Matches, phrase)
+        }
+    }
+
+    reminder.Warn = attachments == 0 && len(reminder.Matches) > 0
+    return reminder
+}
+
+// ownText drops quoted lines and everything after the signature separator
+func ownText(body string) string {
+    var out strings.Builder
+
+    scanner := bufio.NewScanner(strings.NewReader(body))
+    scanner.Buffer(nil, len(body)+1)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if line == "-- " || line == "--" {
+            break
+        }
+        if strings.HasPrefix(strings.TrimSpace(line), ">") {
+            continue
+        }
+        out.WriteString(line)
+        out.WriteString("\n")
+    }
+
+    return out.String()
+}
+
+// partHeader is implemented by both message and part headers
+type partHeader interface {
+    Get(key string) string
+}
+
+// walkParts calls fn with each leaf part's media type, disposition and
+// decoded body, descending into multiparts
+func walkParts(header partHeader, body io.Reader, fn func(contentType, disposition string, body []byte)) error {
+    contentType, params, err := stdmime.ParseMediaType(header.Get("Content-Type"))
+    if err != nil {
+        contentType = "text/plain"
+    }
+
+    if strings.HasPrefix(contentType, "multipart/") {
+        reader := multipart.NewReader(body, params["boundary"])
+        for {
+            part, err := reader.NextRawPart()
+            if err == io.EOF {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            if err := walkParts(part.Header, part, fn); err != nil {
+                return err
+            }
+        }
+    }
+
+    disposition, dispParams, _ := stdmime.ParseMediaType(header.Get("Content-Disposition"))
+    if disposition == "" && (dispParams["filename"] != "" || params["name"] != "") {
+        disposition = "attachment"
+    }
+
+    data, err := io.ReadAll(DecodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+    if err != nil {
+        return err
+    }
+
+    fn(contentType, disposition, data)
+    return nil
+}
+
+// DecodeTransfer undoes a Content-Transfer-Encoding
+func DecodeTransfer(encoding string, r io.Reader) io.Reader {
+    switch strings.ToLower(strings.TrimSpace(encoding)) {
+    case "base64":
+        return base64.NewDecoder(base64.StdEncoding, r)
+    case "quoted-printable":
+        return quotedprintable.NewReader(r)
+    default:
+        return r
+    }
+}
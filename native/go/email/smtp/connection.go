@@ -1,34 +1,88 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/rdawebb/kernel/native/internal/authfail"
+	"github.com/rdawebb/kernel/native/internal/breaker"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/provider"
+	"github.com/rdawebb/kernel/native/internal/trust"
 )
 
 // Connection wraps an SMTP client connection
 type Connection struct {
     mu          sync.RWMutex
+    cmdMu       sync.Mutex // Serialises command sequences on client
     client      *smtp.Client
     host        string
     port        int
     username    string
+    password    string
     connectedAt time.Time
     closed      bool
+    maxRcpt     int // Recipients per transaction; 0 for the server's limit
+    hosts       *breaker.Breaker // Backoff state Reconnect goes through
+}
+
+// logins remembers rejected credentials so they are never retried blindly
+var logins = authfail.NewGuard()
+
+// Connect establishes an SMTP connection, backing off from servers that keep
+// failing according to hosts, which tracks them across connects and
+// reconnects. ctx bounds only the wait for a backoff delay.
+func Connect(ctx context.Context, hosts *breaker.Breaker, host string, port int, username, password string) (*Connection, error) {
+    key := fmt.Sprintf("%s:%d", host, port)
+    account := username + "@" + key
+
+    if prev := logins.Check(account, password); prev != nil {
+        return nil, fmt.Errorf("credentials previously rejected, not retrying: %w", prev)
+    }
+    if err := hosts.Acquire(ctx, key); err != nil {
+        return nil, err
+    }
+
+    conn, err := connect(host, port, username, password)
+
+    var authErr *authfail.Error
+    if errors.As(err, &authErr) {
+        logins.Record(account, password, authErr)
+        // A credential rejection proves the server is up
+        if authErr.Credential() {
+            hosts.Success(key)
+        } else {
+            hosts.Failure(key)
+        }
+        return nil, err
+    }
+
+    if err == nil {
+        logins.Record(account, password, nil)
+    }
+    hosts.Report(key, err)
+    if conn != nil {
+        conn.hosts = hosts
+    }
+    return conn, err
 }
 
-// Connect establishes an SMTP connection
-func Connect(host string, port int, username, password string) (*Connection, error) {
+func connect(host string, port int, username, password string) (*Connection, error) {
     addr := fmt.Sprintf("[%s]:%d", host, port)
     var conn net.Conn
     var err error
 
     if port == 465 {
         // Implicit TLS
-        conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: host})
+        conn, err = tls.Dial("tcp", addr, trust.Config(host))
         if err != nil {
             return nil, fmt.Errorf("failed to connect (TLS): %w", err)
         }
@@ -48,7 +102,7 @@ func Connect(host string, port int, username, password string) (*Connection, err
     // Upgrade to TLS if not already using it
     if port != 465 {
         if ok, _ := c.Extension("STARTTLS"); ok {
-            if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+            if err = c.StartTLS(trust.Config(host)); err != nil {
                 c.Quit()
                 return nil, fmt.Errorf("STARTTLS failed: %w", err)
             }
@@ -59,6 +113,11 @@ func Connect(host string, port int, username, password string) (*Connection, err
     auth := smtp.PlainAuth("", username, password, host)
     if err = c.Auth(auth); err != nil {
         c.Quit()
+
+        var reply *textproto.Error
+        if errors.As(err, &reply) {
+            return nil, provider.Advise(host, authfail.ClassifySMTP(reply.Code, reply.Msg))
+        }
         return nil, fmt.Errorf("authentication failed: %w", err)
     }
 
@@ -67,10 +126,102 @@ func Connect(host string, port int, username, password string) (*Connection, err
         host:        host,
         port:        port,
         username:    username,
+        password:    password,
         connectedAt: time.Now(),
     }, nil
 }
 
+// errBusy is returned by Check when another command held the connection
+// for the whole timeout; a connection in use is not known to be dead
+var errBusy = errors.New("connection busy")
+
+// Check sends a NOOP and fails if no reply arrives within timeout. The
+// timeout starts again once the connection is free, and if it never is,
+// Check returns errBusy.
+func (c *Connection) Check(timeout time.Duration) error {
+    acquired := make(chan struct{})
+    done := make(chan error, 1)
+    go func() {
+        client, release, err := c.acquire()
+        close(acquired)
+        if err != nil {
+            done <- err
+            return
+        }
+        defer release()
+        done <- client.Noop()
+    }()
+
+    select {
+    case <-acquired:
+    case <-time.After(timeout):
+        return errBusy
+    }
+
+    select {
+    case err := <-done:
+        return err
+    case <-time.After(timeout):
+        return fmt.Errorf("no response within %s", timeout)
+    }
+}
+
+// Reconnect replaces the underlying client with a freshly authenticated one
+func (c *Connection) Reconnect() error {
+    fresh, err := Connect(context.Background(), c.hosts, c.host, c.port, c.username, c.password)
+    if err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        fresh.Close()
+        return fmt.Errorf("connection closed")
+    }
+    old := c.client
+    c.client = fresh.client
+    c.connectedAt = fresh.connectedAt
+    c.mu.Unlock()
+
+    // The old connection is presumed dead, so skip the QUIT round trip
+    if old != nil {
+        old.Close()
+    }
+
+    return nil
+}
+
+// TLSState returns the TLS session of the current connection, if any; ok
+// is false when the server offered no STARTTLS
+func (c *Connection) TLSState() (tls.ConnectionState, bool) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return tls.ConnectionState{}, false
+    }
+    defer release()
+
+    return client.TLSConnectionState()
+}
+
+// acquire reserves the connection for one command sequence. The underlying
+// client is not safe for concurrent use, so callers keep it until release.
+func (c *Connection) acquire() (*smtp.Client, func(), error) {
+    c.cmdMu.Lock()
+
+    c.mu.RLock()
+    client := c.client
+    closed := c.closed
+    c.mu.RUnlock()
+
+    if closed || client == nil {
+        c.cmdMu.Unlock()
+        return nil, nil, protocol.WithCode(protocol.CodeNotConnected, errors.New("client not connected"))
+    }
+
+    return client, c.cmdMu.Unlock, nil
+}
+
 // Close closes the connection
 func (c *Connection) Close() error {
     c.mu.Lock()
@@ -94,13 +245,11 @@ func (c *Connection) IsClosed() bool {
 
 // Noop sends a NOOP to keep connection alive
 func (c *Connection) Noop() error {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return fmt.Errorf("client not connected")
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
     }
-    client := c.client
-    c.mu.RUnlock()
+    defer release()
     return client.Noop()
 }
 
@@ -108,3 +257,35 @@ func (c *Connection) Noop() error {
 func (c *Connection) GetClient() *smtp.Client {
     return c.client
 }
+
+// Username returns the authenticated user name
+func (c *Connection) Username() string {
+    return c.username
+}
+
+// account identifies the connection's login, for per-account settings
+func (c *Connection) account() string {
+    return c.username + "@" + c.host
+}
+
+// SupportsBURL reports whether the server accepts BURL with IMAP URLs (RFC 4468)
+func (c *Connection) SupportsBURL() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    if c.closed || c.client == nil {
+        return false
+    }
+
+    ok, params := c.client.Extension("BURL")
+    if !ok {
+        return false
+    }
+
+    for _, scheme := range strings.Fields(params) {
+        if strings.EqualFold(scheme, "imap") {
+            return true
+        }
+    }
+    return false
+}
@@ -1,75 +1,257 @@
 package smtp
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/breaker"
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/history"
+	"github.com/rdawebb/kernel/native/internal/identity"
+	"github.com/rdawebb/kernel/native/internal/outbox"
 	"github.com/rdawebb/kernel/native/internal/pool"
 	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/stats"
 )
 
 // Handler handles SMTP requests from Python
 type Handler struct {
-    pool *pool.ConnectionPool
+    pool       *pool.ConnectionPool
+    stats      *stats.Recorder
+    history    *history.Recorder
+    events     *events.Bus
+    mailstore  Mailstore
+    outbox     *outbox.Outbox
+    scheduled  scheduled
+    sending    claims
+    routes     routes
+    identities *identity.Store
+    hosts      *breaker.Breaker // Failing servers, kept apart per tenant
+
+    rawCommands bool // Whether raw_smtp may be used
+    readOnly    bool // Whether mutating actions are refused
 }
 
 // NewHandler creates a new SMTP handler
 func NewHandler() *Handler {
     return &Handler{
-        pool: pool.NewConnectionPool(),
+        pool:      pool.NewConnectionPool(),
+        stats:     stats.NewRecorder(),
+        history:   history.New(history.DefaultSize),
+        hosts:     breaker.New(breaker.DefaultConfig),
+        scheduled: scheduled{
+            timers: make(map[string]*time.Timer),
+        },
+        sending:   claims{
+            ids: make(map[string]bool),
+        },
+    }
+}
+
+// Handle processes an SMTP request, recording its latency. Long-running
+// actions stop early when ctx is cancelled.
+func (h *Handler) Handle(ctx context.Context, req protocol.Request) protocol.Response {
+    // Refused here rather than in dispatch, which describe also runs
+    if h.readOnly && mutations[req.Action] {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeReadOnly, fmt.Errorf("%s is disabled in read-only mode", req.Action)))
+    }
+
+    start := time.Now()
+    resp := h.dispatch(ctx, req)
+    elapsed := time.Since(start)
+
+    // Only handles still in the pool get stats and a timeline, so a bogus
+    // or just closed handle leaves nothing behind
+    handle := protocol.HandleParam(req.Params)
+    if _, err := h.pool.Get(handle); err != nil {
+        handle = 0
     }
+    h.stats.Record(req.Action, handle, elapsed, !resp.Success)
+    h.recordCommand(handle, req.Action, elapsed, resp)
+    return resp
+}
+
+// actions lists the actions dispatch understands, for the hello handshake
+var actions = []string{
+    "connect",
+    "close",
+    "send",
+    "noop",
+    "stats",
+    "outbox_list",
+    "outbox_flush",
+    "outbox_get",
+    "outbox_retry",
+    "outbox_resend",
+    "outbox_abandon",
+    "cancel_send",
+    "check_attachments",
+    "set_routes",
+    "list_routes",
+    "list_identities",
+    "set_identity",
+    "remove_identity",
+    "generate_alias",
+    "raw_smtp",
+    "handle_history",
+    "tls_info",
+}
+
+// Actions returns the actions this handler supports
+func (h *Handler) Actions() []string {
+    return actions
+}
+
+// Connections returns how many SMTP connections are pooled
+func (h *Handler) Connections() int {
+    return h.pool.Count()
+}
+
+// reads are the actions that only read state, so repeating them is safe
+var reads = map[string]bool{
+    "noop": true,
+    "stats": true,
+    "outbox_list": true,
+    "outbox_get": true,
+    "check_attachments": true,
+    "list_routes": true,
+    "list_identities": true,
+    "handle_history": true,
+    "tls_info": true,
+}
+
+// Idempotent reports whether an action can be retried without effect
+func (h *Handler) Idempotent(action string) bool {
+    return reads[action]
+}
+
+// mutations are the actions that transmit mail or change the outbox,
+// identities or routes
+var mutations = map[string]bool{
+    "send": true,
+    "outbox_flush": true,
+    "outbox_retry": true,
+    "outbox_resend": true,
+    "outbox_abandon": true,
+    "cancel_send": true,
+    "raw_smtp": true,
+    "set_routes": true,
+    "set_identity": true,
+    "remove_identity": true,
+    "generate_alias": true,
 }
 
-// Handle processes an SMTP request
-func (h *Handler) Handle(req protocol.Request) protocol.Response {
+// SetReadOnly makes the handler refuse to send or change anything, with
+// READ_ONLY
+func (h *Handler) SetReadOnly(enabled bool) {
+    h.readOnly = enabled
+}
+
+// Describe returns the JSON schema of each action's params, read from the
+// structs the handlers decode into
+func (h *Handler) Describe() map[string]any {
+    schemas := make(map[string]any, len(actions))
+    for _, action := range actions {
+        schemas[action] = protocol.DescribeParams(func(ctx context.Context) {
+            h.dispatch(ctx, protocol.Request{Module: "smtp", Action: action})
+        })
+    }
+    return schemas
+}
+
+func (h *Handler) dispatch(ctx context.Context, req protocol.Request) protocol.Response {
     switch req.Action {
     case "connect":
-        return h.handleConnect(req.Params)
+        return h.handleConnect(ctx, req.Params)
     case "close":
-        return h.handleClose(req.Params)
+        return h.handleClose(ctx, req.Params)
     case "send":
-        return h.handleSend(req.Params)
+        return h.handleSend(ctx, req.Params)
     case "noop":
-        return h.handleNoop(req.Params)
+        return h.handleNoop(ctx, req.Params)
+    case "stats":
+        return h.handleStats(ctx, req.Params)
+    case "outbox_list":
+        return h.handleOutboxList(ctx, req.Params)
+    case "outbox_flush":
+        return h.handleOutboxFlush(ctx, req.Params)
+    case "outbox_get":
+        return h.handleOutboxGet(ctx, req.Params)
+    case "outbox_retry":
+        return h.handleOutboxRetry(ctx, req.Params)
+    case "outbox_resend":
+        return h.handleOutboxResend(ctx, req.Params)
+    case "outbox_abandon":
+        return h.handleOutboxAbandon(ctx, req.Params)
+    case "cancel_send":
+        return h.handleCancelSend(ctx, req.Params)
+    case "check_attachments":
+        return h.handleCheckAttachments(ctx, req.Params)
+    case "set_routes":
+        return h.handleSetRoutes(ctx, req.Params)
+    case "list_routes":
+        return h.handleListRoutes(ctx, req.Params)
+    case "list_identities":
+        return h.handleListIdentities(ctx, req.Params)
+    case "set_identity":
+        return h.handleSetIdentity(ctx, req.Params)
+    case "remove_identity":
+        return h.handleRemoveIdentity(ctx, req.Params)
+    case "generate_alias":
+        return h.handleGenerateAlias(ctx, req.Params)
+    case "raw_smtp":
+        return h.handleRawSMTP(ctx, req.Params)
+    case "handle_history":
+        return h.handleHandleHistory(ctx, req.Params)
+    case "tls_info":
+        return h.handleTLSInfo(ctx, req.Params)
     default:
-        return protocol.ErrorResponse(fmt.Errorf("unknown action: %s", req.Action))
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("unknown action: %s", req.Action)))
     }
 }
 
-func (h *Handler) handleConnect(params json.RawMessage) protocol.Response {
+func (h *Handler) handleConnect(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Host     string `json:"host"`
-        Port     int    `json:"port"`
+        Host     string `json:"host" validate:"required"`
+        Port     int    `json:"port" validate:"required,min=1,max=65535"`
         Username string `json:"username"`
         Password string `json:"password"`
+
+        // MaxRecipients caps recipients per transaction (0: server limit)
+        MaxRecipients int `json:"max_recipients"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
-    conn, err := Connect(p.Host, p.Port, p.Username, p.Password)
+    conn, err := Connect(ctx, h.hosts, p.Host, p.Port, p.Username, p.Password)
     if err != nil {
         return protocol.ErrorResponse(err)
     }
+    conn.SetMaxRecipients(p.MaxRecipients)
 
-    handle, err := h.pool.Add(conn)
+    handle, err := h.pool.Add(ctx, conn)
     if err != nil {
         return protocol.ErrorResponse(err)
     }
+    h.recordConnect(handle, conn)
 
     return protocol.SuccessResponse(map[string]any{
         "handle": handle,
     })
 }
 
-func (h *Handler) handleClose(params json.RawMessage) protocol.Response {
+func (h *Handler) handleClose(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int `json:"handle"`
+        Handle int `json:"handle" validate:"required"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -78,24 +260,39 @@ func (h *Handler) handleClose(params json.RawMessage) protocol.Response {
         return protocol.ErrorResponse(err)
     }
 
+    h.routes.forget(p.Handle)
+
     conn := connInterface.(*Connection)
     if err := conn.Close(); err != nil {
         return protocol.ErrorResponse(err)
     }
 
     h.pool.Remove(p.Handle)
+    h.stats.Forget(p.Handle)
+    h.history.Closed(p.Handle)
     return protocol.SuccessResponse(nil)
 }
 
-func (h *Handler) handleSend(params json.RawMessage) protocol.Response {
+func (h *Handler) handleSend(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle     int      `json:"handle"`
-        From       string   `json:"from"`
-        To         []string `json:"to"`
-        MessageB64 string   `json:"message_b64"`
+        Handle     int      `json:"handle" validate:"required"`
+        From       string   `json:"from" validate:"required"`
+        To         []string `json:"to" validate:"required"`
+        MessageB64 string   `json:"message_b64" validate:"required"`
+        IMAPHandle int      `json:"imap_handle"`
+        SentFolder string   `json:"sent_folder"`
+        SaveSent   bool     `json:"save_sent"`
+        Outbox     bool     `json:"outbox"`
+        Priority   string   `json:"priority"` // Optional: high, normal or low
+
+        // Hold the message before sending: for UndoSeconds (an undo
+        // window), or until SendAt. Either returns at once with an outbox ID
+        // that cancel_send accepts.
+        UndoSeconds int       `json:"undo_seconds"`
+        SendAt      time.Time `json:"send_at"`
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -107,23 +304,102 @@ func (h *Handler) handleSend(params json.RawMessage) protocol.Response {
     // Decode base64 message
     message, err := base64.StdEncoding.DecodeString(p.MessageB64)
     if err != nil {
-        return protocol.ErrorResponse(fmt.Errorf("invalid base64 message: %w", err))
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("invalid base64 message: %w", err)))
+    }
+
+    if p.Priority != "" {
+        if message, err = mime.SetPriority(message, p.Priority); err != nil {
+            return protocol.ErrorResponse(err)
+        }
     }
 
     conn := connInterface.(*Connection)
-    if err := conn.SendMessage(p.From, p.To, message); err != nil {
+
+    if message, err = h.checkIdentity(conn, p.From, message); err != nil {
         return protocol.ErrorResponse(err)
     }
 
-    return protocol.SuccessResponse(nil)
+    sendAt := p.SendAt
+    if p.UndoSeconds > 0 {
+        sendAt = time.Now().Add(time.Duration(p.UndoSeconds) * time.Second)
+    }
+    if !sendAt.IsZero() {
+        entry := &outbox.Entry{
+            From:       p.From,
+            To:         p.To,
+            Message:    message,
+            SentFolder: p.SentFolder,
+            SaveSent:   p.SaveSent,
+            SendAt:     sendAt.UTC(),
+        }
+        if err := h.sendLater(ctx, conn, p.Handle, p.IMAPHandle, entry); err != nil {
+            return protocol.ErrorResponse(err)
+        }
+        return protocol.SuccessResponse(map[string]any{
+            "outbox_id": entry.ID,
+            "send_at":   entry.SendAt,
+        })
+    }
+
+    if p.Outbox {
+        delivery, err := h.sendViaOutbox(conn, p.Handle, p.IMAPHandle, &outbox.Entry{
+            From:       p.From,
+            To:         p.To,
+            Message:    message,
+            SentFolder: p.SentFolder,
+            SaveSent:   p.SaveSent,
+        })
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+        return protocol.SuccessResponse(delivery)
+    }
+
+    delivery, err := h.send(conn, p.Handle, p.IMAPHandle, p.From, p.To, message, p.SentFolder, p.SaveSent)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(delivery)
 }
 
-func (h *Handler) handleNoop(params json.RawMessage) protocol.Response {
+func (h *Handler) handleCheckAttachments(ctx context.Context, params json.RawMessage) protocol.Response {
     var p struct {
-        Handle int `json:"handle"`
+        // Either a full draft...
+        MessageB64 string `json:"message_b64"`
+
+        // ...or its body text and attachment count
+        Body        string `json:"body"`
+        Attachments int    `json:"attachments"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if p.MessageB64 == "" {
+        return protocol.SuccessResponse(mime.CheckText(p.Body, p.Attachments))
+    }
+
+    message, err := base64.StdEncoding.DecodeString(p.MessageB64)
+    if err != nil {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("invalid base64 message: %w", err)))
+    }
+
+    reminder, err := mime.CheckAttachments(message)
+    if err != nil {
+        return protocol.ErrorResponse(err)
     }
 
-    if err := json.Unmarshal(params, &p); err != nil {
+    return protocol.SuccessResponse(reminder)
+}
+
+func (h *Handler) handleNoop(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
         return protocol.ErrorResponse(err)
     }
 
@@ -139,3 +415,22 @@ func (h *Handler) handleNoop(params json.RawMessage) protocol.Response {
 
     return protocol.SuccessResponse(nil)
 }
+
+func (h *Handler) handleStats(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    result := map[string]any{
+        "global": h.stats.Global(),
+    }
+    if p.Handle != 0 {
+        result["handle"] = h.stats.Handle(p.Handle)
+    }
+
+    return protocol.SuccessResponse(result)
+}
@@ -0,0 +1,138 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// checkTimeout bounds how long a connection may take to answer a NOOP
+// before it is considered dead
+const checkTimeout = 5 * time.Second
+
+// SetEventBus sets where connection events are published
+func (h *Handler) SetEventBus(bus *events.Bus) {
+    h.events = bus
+}
+
+func (h *Handler) publish(eventType string, handle int, data any) {
+    h.publishFor(context.Background(), eventType, handle, data)
+}
+
+// publishFor publishes an event raised by the request ctx serves, tagged
+// with its trace ID
+func (h *Handler) publishFor(ctx context.Context, eventType string, handle int, data any) {
+    h.events.Publish(events.Event{
+        Type:    eventType,
+        Module:  "smtp",
+        Handle:  handle,
+        Data:    data,
+        TraceID: protocol.TraceID(ctx),
+    })
+}
+
+// Revalidate checks every pooled connection, typically after a network
+// change, and re-establishes those that no longer answer
+func (h *Handler) Revalidate() {
+    var wg sync.WaitGroup
+
+    h.pool.Range(func(handle int, c any) {
+        conn, ok := c.(*Connection)
+        if !ok {
+            return
+        }
+
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            h.revalidate(handle, conn)
+        }()
+    })
+
+    wg.Wait()
+}
+
+// CloseAll quits every pooled connection, for shutdown
+func (h *Handler) CloseAll() {
+    var handles []int
+    h.pool.Range(func(handle int, _ any) {
+        handles = append(handles, handle)
+    })
+    h.closeHandles(handles)
+}
+
+// Owner returns the client that opened a handle, "" for none, and whether
+// the handle is open
+func (h *Handler) Owner(handle int) (string, bool) {
+    return h.pool.Owner(handle)
+}
+
+// CloseOwned closes the connections a client opened, once it disconnects,
+// returning how many there were
+func (h *Handler) CloseOwned(owner string) int {
+    handles := h.pool.Owned(owner)
+    h.closeHandles(handles)
+    return len(handles)
+}
+
+// Park leaves a disconnected client's connections open for it to resume,
+// returning how many there were. Nothing runs on an idle SMTP connection,
+// so there is nothing to stop.
+func (h *Handler) Park(owner string) int {
+    return len(h.pool.Owned(owner))
+}
+
+// Transfer gives a client's connections to another, returning how many
+// there were
+func (h *Handler) Transfer(from, to string) int {
+    return len(h.pool.Transfer(from, to))
+}
+
+// closeHandles closes and forgets connections concurrently
+func (h *Handler) closeHandles(handles []int) {
+    var wg sync.WaitGroup
+
+    for _, handle := range handles {
+        conn, err := h.getConnection(handle)
+        if err != nil {
+            continue
+        }
+
+        wg.Add(1)
+        go func(handle int) {
+            defer wg.Done()
+            h.routes.forget(handle)
+            conn.Close()
+            h.pool.Remove(handle)
+            h.stats.Forget(handle)
+            h.history.Closed(handle)
+        }(handle)
+    }
+
+    wg.Wait()
+}
+
+func (h *Handler) revalidate(handle int, conn *Connection) {
+    // Only a failed NOOP means the connection is gone; one busy with a long
+    // command is left alone
+    err := conn.Check(checkTimeout)
+    if err == nil || errors.Is(err, errBusy) {
+        return
+    }
+
+    h.publish("connection.lost", handle, map[string]any{"error": err.Error()})
+    h.history.Fail(handle, "connection lost", err)
+
+    err = conn.Reconnect()
+    h.recordReconnect(handle, conn, err)
+    if err != nil {
+        h.publish("connection.failed", handle, map[string]any{"error": err.Error()})
+        return
+    }
+
+    h.publish("connection.restored", handle, nil)
+}
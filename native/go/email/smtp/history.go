@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/history"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// recordCommand adds a finished request to its handle's timeline. Connect
+// and close have events of their own, and reading the timeline isn't worth
+// recording in it.
+func (h *Handler) recordCommand(handle int, action string, elapsed time.Duration, resp protocol.Response) {
+    switch action {
+    case "connect", "close", "handle_history":
+        return
+    }
+
+    h.history.Record(handle, history.Event{
+        Kind:       history.Command,
+        Detail:     action,
+        Error:      resp.Error,
+        DurationMs: float64(elapsed.Microseconds()) / 1000,
+    })
+}
+
+// recordConnect starts a handle's timeline with the login and TLS session
+func (h *Handler) recordConnect(handle int, conn *Connection) {
+    h.history.Record(handle, history.Event{
+        Kind:   history.Connect,
+        Detail: fmt.Sprintf("%s@%s:%d", conn.username, conn.host, conn.port),
+    })
+    h.recordTLS(handle, conn)
+}
+
+// recordReconnect notes a reconnect attempt and, when it worked, the new
+// TLS session
+func (h *Handler) recordReconnect(handle int, conn *Connection, err error) {
+    if err != nil {
+        h.history.Record(handle, history.Event{Kind: history.Reconnect, Error: err.Error()})
+        return
+    }
+
+    h.history.Record(handle, history.Event{Kind: history.Reconnect})
+    h.recordTLS(handle, conn)
+}
+
+// recordTLS notes the TLS session, or its absence when the server offered
+// no STARTTLS
+func (h *Handler) recordTLS(handle int, conn *Connection) {
+    state, ok := conn.TLSState()
+    if !ok {
+        h.history.Record(handle, history.Event{Kind: history.TLS, Detail: "none: server offered no STARTTLS"})
+        return
+    }
+    h.history.Record(handle, history.TLSEvent(state))
+}
+
+func (h *Handler) handleHandleHistory(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle" validate:"required"`
+        Limit  int `json:"limit"` // Most recent events to return; 0 for all
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    // Closed handles keep their history for a while, so no pool lookup
+    events, dropped, closed, ok := h.history.Events(p.Handle)
+    if !ok {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidHandle, fmt.Errorf("no history for handle %d", p.Handle)))
+    }
+    if p.Limit > 0 && len(events) > p.Limit {
+        dropped += len(events) - p.Limit
+        events = events[len(events)-p.Limit:]
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "handle":  p.Handle,
+        "closed":  closed,
+        "dropped": dropped,
+        "events":  events,
+    })
+}
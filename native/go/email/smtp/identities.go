@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rdawebb/kernel/native/email/mime"
+	"github.com/rdawebb/kernel/native/internal/alias"
+	"github.com/rdawebb/kernel/native/internal/identity"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// SetIdentities enables sender identity checks at send time
+func (h *Handler) SetIdentities(store *identity.Store) {
+    h.identities = store
+}
+
+// checkIdentity rejects a send whose sender the connection's account has no
+// identity for, then applies the identity's default Reply-To
+func (h *Handler) checkIdentity(conn *Connection, from string, message []byte) ([]byte, error) {
+    if h.identities == nil {
+        return message, nil
+    }
+
+    // The raw value, so Check can refuse one it can't parse
+    var headerFrom string
+    if header, err := mime.ReadHeader(message); err == nil {
+        headerFrom = header.Get("From")
+    }
+
+    id, err := h.identities.Check(conn.account(), from, headerFrom)
+    if err != nil {
+        return nil, err
+    }
+
+    if id != nil && id.ReplyTo != "" {
+        return mime.AddHeader(message, "Reply-To", id.ReplyTo)
+    }
+    return message, nil
+}
+
+func (h *Handler) handleListIdentities(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int `json:"handle"` // Optional: only identities of this connection's account
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.identities == nil {
+        return protocol.ErrorResponse(fmt.Errorf("identities not configured"))
+    }
+
+    ids, err := h.identities.List()
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if p.Handle != 0 {
+        conn, err := h.getConnection(p.Handle)
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+
+        kept := ids[:0]
+        for _, id := range ids {
+            if strings.EqualFold(id.Account, conn.account()) {
+                kept = append(kept, id)
+            }
+        }
+        ids = kept
+    }
+
+    if ids == nil {
+        ids = []identity.Identity{}
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "identities": ids,
+    })
+}
+
+func (h *Handler) handleSetIdentity(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p identity.Identity
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.identities == nil {
+        return protocol.ErrorResponse(fmt.Errorf("identities not configured"))
+    }
+
+    if err := h.identities.Put(p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(nil)
+}
+
+func (h *Handler) handleRemoveIdentity(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        ID string `json:"id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.identities == nil {
+        return protocol.ErrorResponse(fmt.Errorf("identities not configured"))
+    }
+
+    if err := h.identities.Remove(p.ID); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(nil)
+}
+
+func (h *Handler) handleGenerateAlias(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Kind    string `json:"kind"`    // plus, fastmail or simplelogin
+        Address string `json:"address"` // Base address for plus
+        Tag     string `json:"tag"`     // Plus tag; random if empty
+        Token   string `json:"token"`   // Fastmail API token or SimpleLogin API key
+        Domain  string `json:"domain"`  // Site the alias is for
+        Note    string `json:"note"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    var address string
+    var err error
+    switch p.Kind {
+    case "plus", "":
+        address, err = alias.Plus(p.Address, p.Tag)
+    case "fastmail":
+        address, err = alias.Fastmail(ctx, p.Token, p.Domain, p.Note)
+    case "simplelogin":
+        address, err = alias.SimpleLogin(ctx, p.Token, p.Domain, p.Note)
+    default:
+        err = fmt.Errorf("unknown alias kind: %s", p.Kind)
+    }
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "address": address,
+    })
+}
@@ -0,0 +1,217 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/outbox"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// SetOutbox enables crash-safe sending through a persistent outbox
+func (h *Handler) SetOutbox(ob *outbox.Outbox) {
+    h.outbox = ob
+}
+
+// sendViaOutbox persists a message before attempting it, so it survives a
+// crash until both transmission and the Sent-folder append have succeeded
+func (h *Handler) sendViaOutbox(conn *Connection, handle, imapHandle int, entry *outbox.Entry) (*Delivery, error) {
+    if h.outbox == nil {
+        return nil, fmt.Errorf("outbox not configured")
+    }
+
+    if err := h.outbox.Add(entry); err != nil {
+        return nil, fmt.Errorf("failed to queue message: %w", err)
+    }
+
+    return h.processEntry(conn, handle, imapHandle, entry)
+}
+
+// processEntry advances an outbox entry: a pending entry is transmitted to
+// the recipients that have not accepted it yet and filed, a transmitted one
+// only needs its Sent copy. The entry is removed once nothing is left to do.
+func (h *Handler) processEntry(conn *Connection, handle, imapHandle int, entry *outbox.Entry) (*Delivery, error) {
+    entry.Attempts++
+
+    if entry.State == outbox.StateTransmitted {
+        if h.mailstore == nil {
+            return nil, h.entryFailed(entry, fmt.Errorf("no IMAP mailstore available to save sent message"))
+        }
+
+        folder, uidValidity, uid, err := h.mailstore.Append(imapHandle, entry.SentFolder, []string{`\Seen`}, entry.Message)
+        if err != nil {
+            return nil, h.entryFailed(entry, fmt.Errorf("failed to append to %s: %w", entry.SentFolder, err))
+        }
+
+        if err := h.outbox.Remove(entry.ID); err != nil {
+            return nil, err
+        }
+
+        return &Delivery{
+            Method:   "data",
+            SentCopy: &SentCopy{Folder: folder, UIDValidity: uidValidity, UID: uid},
+        }, nil
+    }
+
+    to := entry.Remaining()
+    delivery, err := h.send(conn, handle, imapHandle, entry.From, to, entry.Message, entry.SentFolder, entry.SaveSent)
+    if err != nil {
+        return nil, h.entryFailed(entry, err)
+    }
+
+    var refused []string
+    for _, result := range recipientResults(delivery, to) {
+        if result.Accepted {
+            entry.Delivered = append(entry.Delivered, result.Address)
+        } else {
+            refused = append(refused, result.Address)
+        }
+    }
+
+    // Recipients that did not accept the message keep the entry pending, and
+    // only they are sent to on the next attempt
+    if len(entry.Remaining()) > 0 {
+        entry.LastError = fmt.Sprintf("not accepted by %s", strings.Join(refused, ", "))
+        if delivery.SentCopyError != "" {
+            entry.SentFolder = delivery.SentCopy.Folder
+            entry.LastError += "; " + delivery.SentCopyError
+        } else {
+            // Filed already (or nothing to file): the retry must not file again
+            entry.SentFolder, entry.SaveSent = "", false
+        }
+        if err := h.outbox.Update(entry); err != nil {
+            return nil, err
+        }
+
+        delivery.OutboxID = entry.ID
+        return delivery, nil
+    }
+
+    if delivery.SentCopyError != "" {
+        entry.State = outbox.StateTransmitted
+        entry.SentFolder = delivery.SentCopy.Folder
+        entry.LastError = delivery.SentCopyError
+        if err := h.outbox.Update(entry); err != nil {
+            return nil, err
+        }
+
+        delivery.OutboxID = entry.ID
+        return delivery, nil
+    }
+
+    if err := h.outbox.Remove(entry.ID); err != nil {
+        return nil, err
+    }
+
+    return delivery, nil
+}
+
+// entryFailed records a failed attempt and wraps the error with the entry ID
+func (h *Handler) entryFailed(entry *outbox.Entry, err error) error {
+    entry.LastError = err.Error()
+    if updateErr := h.outbox.Update(entry); updateErr != nil {
+        return fmt.Errorf("%w (and failed to update outbox: %v)", err, updateErr)
+    }
+
+    return fmt.Errorf("message kept in outbox as %s: %w", entry.ID, err)
+}
+
+func (h *Handler) handleOutboxList(ctx context.Context, params json.RawMessage) protocol.Response {
+    if h.outbox == nil {
+        return protocol.ErrorResponse(fmt.Errorf("outbox not configured"))
+    }
+
+    entries, err := h.outbox.List()
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    // Message bodies stay on disk; the list is for display
+    for _, entry := range entries {
+        entry.Message = nil
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "entries": entries,
+    })
+}
+
+func (h *Handler) handleOutboxFlush(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int `json:"handle" validate:"required"`
+        IMAPHandle int `json:"imap_handle"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.outbox == nil {
+        return protocol.ErrorResponse(fmt.Errorf("outbox not configured"))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    entries, err := h.outbox.List()
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    type flushResult struct {
+        ID       string    `json:"id"`
+        Delivery *Delivery `json:"delivery,omitempty"`
+        Error    string    `json:"error,omitempty"`
+    }
+
+    results := make([]flushResult, 0, len(entries))
+    now := time.Now()
+    for _, entry := range entries {
+        // Entries left over stay queued for the next flush
+        if ctx.Err() != nil {
+            break
+        }
+
+        // Held messages go out on their own timer, or once due after a restart
+        if h.scheduled.has(entry.ID) || !entry.Due(now) {
+            continue
+        }
+
+        // One being retried from the Outbox screen is left to that request,
+        // and one it finished meanwhile is gone
+        release, ok := h.sending.claim(entry.ID)
+        if !ok {
+            continue
+        }
+        entry, err := h.outbox.Get(entry.ID)
+        if err != nil {
+            release()
+            continue
+        }
+
+        // Entries queued on other accounts may not be this one's to send
+        if entry.State == outbox.StatePending {
+            err = h.checkEntryIdentity(conn, entry)
+        }
+        var delivery *Delivery
+        if err == nil {
+            delivery, err = h.processEntry(conn, p.Handle, p.IMAPHandle, entry)
+        }
+        release()
+
+        result := flushResult{ID: entry.ID, Delivery: delivery}
+        if err != nil {
+            result.Error = err.Error()
+        }
+        results = append(results, result)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "results": results,
+    })
+}
@@ -0,0 +1,179 @@
+package smtp
+
+import (
+	"fmt"
+
+	"github.com/rdawebb/kernel/native/internal/provider"
+)
+
+// Mailstore is the IMAP side of the send pipeline, used to file a copy of
+// each transmitted message
+type Mailstore interface {
+    // Append stores a message and returns the folder it went to, which
+    // differs from folder when a role folder moved on the server, and its
+    // UIDVALIDITY and UID when known
+    Append(handle int, folder string, flags []string, message []byte) (string, uint32, uint32, error)
+    // URLAuth returns a URL the submission server may fetch the stored message
+    // from on behalf of submitter, or "" when URLAUTH is unavailable
+    URLAuth(handle int, folder string, uidValidity, uid uint32, submitter string) (string, error)
+    // Delete removes a message Append stored
+    Delete(handle int, folder string, uidValidity, uid uint32) error
+    // SentFolder detects the Sent folder and whether the provider already
+    // saves submitted messages there itself
+    SentFolder(handle int) (string, bool, error)
+}
+
+// SentCopy records where the copy of a transmitted message was filed
+type SentCopy struct {
+    Folder      string `json:"folder"`
+    UIDValidity uint32 `json:"uid_validity,omitempty"`
+    UID         uint32 `json:"uid,omitempty"`
+    ServerSaved bool   `json:"server_saved,omitempty"` // Filed by the provider, not appended
+}
+
+// Delivery describes how a message was transmitted
+type Delivery struct {
+    Method        string    `json:"method"` // "data" or "burl"
+    SentCopy      *SentCopy `json:"sent_copy,omitempty"`
+    SentCopyError string    `json:"sent_copy_error,omitempty"`
+    OutboxID      string    `json:"outbox_id,omitempty"` // Set while the entry awaits its Sent copy or some recipients
+
+    // Recipients reports each recipient's outcome when sent with DATA
+    Recipients []RecipientResult `json:"recipients,omitempty"`
+
+    // Routes breaks down a delivery split across connections by routing rules
+    Routes []RoutedDelivery `json:"routes,omitempty"`
+}
+
+// resolveSentFolder picks the folder to file a sent copy in. An explicit
+// folder is used as given; with saveSent the folder is detected. skip is set
+// when the provider saves sent messages by itself, even when the explicit
+// folder is its Sent folder, as appending there too is what leaves Gmail
+// users with every sent message twice.
+func (h *Handler) resolveSentFolder(conn *Connection, imapHandle int, sentFolder string, saveSent bool) (folder string, skip bool, err error) {
+    if sentFolder == "" && !saveSent {
+        return "", false, nil
+    }
+    if h.mailstore == nil {
+        if sentFolder != "" {
+            return sentFolder, false, nil
+        }
+        return "", false, fmt.Errorf("no IMAP mailstore available to save sent message")
+    }
+
+    if sentFolder != "" {
+        detected, serverSaved, err := h.mailstore.SentFolder(imapHandle)
+        if err == nil && serverSaved && detected == sentFolder {
+            return sentFolder, true, nil
+        }
+        return sentFolder, false, nil
+    }
+
+    if p := provider.Lookup(conn.host); p != nil && p.SavesSent {
+        return "", true, nil
+    }
+
+    folder, serverSaved, err := h.mailstore.SentFolder(imapHandle)
+    if err != nil {
+        return "", false, fmt.Errorf("failed to detect Sent folder: %w", err)
+    }
+
+    return folder, serverSaved, nil
+}
+
+// sendDirect runs the full pipeline for one message on one connection:
+// resolve the Sent folder, transmit, and file a copy unless the provider
+// does so itself
+func (h *Handler) sendDirect(conn *Connection, imapHandle int, from string, to []string, message []byte, sentFolder string, saveSent bool) (*Delivery, error) {
+    folder, serverSaved, err := h.resolveSentFolder(conn, imapHandle, sentFolder, saveSent)
+    if err != nil {
+        return nil, err
+    }
+
+    appendFolder := folder
+    if serverSaved {
+        appendFolder = ""
+    }
+
+    delivery, err := h.deliver(conn, from, to, message, imapHandle, appendFolder)
+    if err != nil {
+        return nil, err
+    }
+    if serverSaved {
+        delivery.SentCopy = &SentCopy{Folder: folder, ServerSaved: true}
+    }
+
+    return delivery, nil
+}
+
+// SetMailstore wires the IMAP side of the send pipeline
+func (h *Handler) SetMailstore(store Mailstore) {
+    h.mailstore = store
+}
+
+// deliver transmits a message and, when a Sent folder is given, files a copy
+// of it. If both servers support BURL/URLAUTH the message is appended first
+// and submitted by reference so it is only uploaded once; otherwise it is
+// sent with DATA and appended afterwards.
+func (h *Handler) deliver(conn *Connection, from string, to []string, message []byte, imapHandle int, sentFolder string) (*Delivery, error) {
+    if h.mailstore == nil || sentFolder == "" {
+        recipients, err := conn.SendMessage(from, to, message)
+        if err != nil {
+            return nil, err
+        }
+        return &Delivery{Method: "data", Recipients: recipients}, nil
+    }
+
+    var stored *SentCopy
+    if conn.SupportsBURL() {
+        folder, uidValidity, uid, err := h.mailstore.Append(imapHandle, sentFolder, []string{`\Seen`}, message)
+        if err == nil {
+            stored = &SentCopy{Folder: folder, UIDValidity: uidValidity, UID: uid}
+        }
+
+        if stored != nil && uid != 0 {
+            url, err := h.mailstore.URLAuth(imapHandle, folder, uidValidity, uid, conn.Username())
+            if err == nil && url != "" {
+                if err := conn.SendMessageBURL(from, to, url); err == nil {
+                    return &Delivery{Method: "burl", SentCopy: stored}, nil
+                }
+            }
+        }
+    }
+
+    recipients, err := conn.SendMessage(from, to, message)
+    if err != nil {
+        // The copy stored for BURL would pass for a sent message
+        if stored != nil {
+            if removeErr := h.removeStored(imapHandle, stored); removeErr != nil {
+                return nil, fmt.Errorf("%w (and failed to remove the copy in %s: %v)", err, stored.Folder, removeErr)
+            }
+        }
+        return nil, err
+    }
+
+    delivery := &Delivery{Method: "data", SentCopy: stored, Recipients: recipients}
+    if stored != nil {
+        return delivery, nil
+    }
+
+    // The message is already on its way, so a failed append is reported
+    // alongside the successful send rather than as an error
+    folder, uidValidity, uid, err := h.mailstore.Append(imapHandle, sentFolder, []string{`\Seen`}, message)
+    if err != nil {
+        delivery.SentCopy = &SentCopy{Folder: sentFolder}
+        delivery.SentCopyError = fmt.Sprintf("failed to append to %s: %v", sentFolder, err)
+        return delivery, nil
+    }
+
+    delivery.SentCopy = &SentCopy{Folder: folder, UIDValidity: uidValidity, UID: uid}
+    return delivery, nil
+}
+
+// removeStored deletes a copy deliver stored before a send that then failed
+func (h *Handler) removeStored(imapHandle int, stored *SentCopy) error {
+    if stored.UID == 0 {
+        return fmt.Errorf("the server did not report its UID")
+    }
+    return h.mailstore.Delete(imapHandle, stored.Folder, stored.UIDValidity, stored.UID)
+}
@@ -2,17 +2,51 @@ package smtp
 
 import (
 	"fmt"
+	"net/smtp"
 )
 
-// SendMessage sends an email message
-func (c *Connection) SendMessage(from string, to []string, message []byte) error {
-    c.mu.RLock()
-    if c.closed || c.client == nil {
-        c.mu.RUnlock()
-        return fmt.Errorf("client not connected")
+// SendMessage sends an email message, over several transactions if it has
+// more recipients than the server takes at once
+func (c *Connection) SendMessage(from string, to []string, message []byte) ([]RecipientResult, error) {
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    return c.transmit(client, from, to, func(client *smtp.Client) error {
+        // Send message data
+        w, err := client.Data()
+        if err != nil {
+            return fmt.Errorf("DATA command failed: %w", err)
+        }
+        defer w.Close()
+
+        if _, err := w.Write(message); err != nil {
+            return fmt.Errorf("failed to write message: %w", err)
+        }
+
+        if err := w.Close(); err != nil {
+            return fmt.Errorf("failed to close DATA: %w", err)
+        }
+
+        return nil
+    })
+}
+
+// SendMessageBURL sends a message by reference, letting the server fetch the
+// body from an authorised IMAP URL instead of uploading it again (RFC 4468)
+func (c *Connection) SendMessageBURL(from string, to []string, messageURL string) error {
+    client, release, err := c.acquire()
+    if err != nil {
+        return err
+    }
+    defer release()
+
+    // Split deliveries go through DATA so partial failures are tracked
+    if limit := c.recipientLimit(client); limit > 0 && len(to) > limit {
+        return fmt.Errorf("%d recipients exceed the per-transaction limit of %d", len(to), limit)
     }
-    client := c.client
-    c.mu.RUnlock()
 
     // Set sender
     if err := client.Mail(from); err != nil {
@@ -22,24 +56,23 @@ func (c *Connection) SendMessage(from string, to []string, message []byte) error
     // Set recipients
     for _, recipient := range to {
         if err := client.Rcpt(recipient); err != nil {
+            client.Reset()
             return fmt.Errorf("RCPT TO failed for %s: %w", recipient, err)
         }
     }
 
-    // Send message data
-    w, err := client.Data()
+    id, err := client.Text.Cmd("BURL %s LAST", messageURL)
     if err != nil {
-        return fmt.Errorf("DATA command failed: %w", err)
+        client.Reset()
+        return fmt.Errorf("BURL command failed: %w", err)
     }
-    defer w.Close()
-
-    if _, err := w.Write(message); err != nil {
-        return fmt.Errorf("failed to write message: %w", err)
-    }
-
-    if err := w.Close(); err != nil {
-        return fmt.Errorf("failed to close DATA: %w", err)
+    client.Text.StartResponse(id)
+    _, _, err = client.Text.ReadResponse(250)
+    client.Text.EndResponse(id)
+    if err != nil {
+        client.Reset()
+        return fmt.Errorf("BURL command failed: %w", err)
     }
 
     return nil
-}
+}
\ No newline at end of file
@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// rawDenied are commands raw_smtp refuses, as they change the session
+// state the Connection relies on or expect data raw_smtp doesn't send
+var rawDenied = map[string]bool{
+    "AUTH":     true,
+    "STARTTLS": true,
+    "QUIT":     true,
+    "DATA":     true,
+    "BDAT":     true,
+    "BURL":     true,
+}
+
+// RawReply is the server's reply to one raw command
+type RawReply struct {
+    Command string `json:"command"`
+    Code    int    `json:"code"`
+    Message string `json:"message"` // Lines of a multiline reply joined by \n
+}
+
+// Raw sends commands one at a time and collects each reply, whatever its
+// code. The session is reset afterwards so a MAIL or RCPT sent raw can't
+// leak into the next real send.
+func (c *Connection) Raw(commands []string) ([]RawReply, error) {
+    for _, command := range commands {
+        if strings.ContainsAny(command, "\r\n") {
+            return nil, fmt.Errorf("commands must be single lines")
+        }
+        verb, _, _ := strings.Cut(strings.TrimSpace(command), " ")
+        if verb == "" {
+            return nil, fmt.Errorf("empty command")
+        }
+        if rawDenied[strings.ToUpper(verb)] {
+            return nil, fmt.Errorf("%s can't be sent raw", strings.ToUpper(verb))
+        }
+    }
+
+    client, release, err := c.acquire()
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    replies := make([]RawReply, 0, len(commands))
+    for _, command := range commands {
+        command = strings.TrimSpace(command)
+        id, err := client.Text.Cmd("%s", command)
+        if err != nil {
+            return replies, fmt.Errorf("failed to send %q: %w", command, err)
+        }
+
+        client.Text.StartResponse(id)
+        code, message, err := client.Text.ReadResponse(0)
+        client.Text.EndResponse(id)
+        if err != nil {
+            return replies, fmt.Errorf("failed to read reply to %q: %w", command, err)
+        }
+
+        replies = append(replies, RawReply{Command: command, Code: code, Message: message})
+    }
+
+    if err := client.Reset(); err != nil {
+        return replies, fmt.Errorf("failed to reset session: %w", err)
+    }
+
+    return replies, nil
+}
+
+// EnableRawCommands allows raw_smtp, which is off by default as it can send
+// as the account
+func (h *Handler) EnableRawCommands(enabled bool) {
+    h.rawCommands = enabled
+}
+
+func (h *Handler) handleRawSMTP(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle   int      `json:"handle" validate:"required"`
+        Commands []string `json:"commands"` // e.g. ["MAIL FROM:<a@example.com>", "RCPT TO:<b@example.org>"]
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if !h.rawCommands {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, errors.New("raw commands are disabled")))
+    }
+    if len(p.Commands) == 0 {
+        return protocol.ErrorResponse(fmt.Errorf("commands are required"))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    replies, err := conn.Raw(p.Commands)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "replies": replies,
+    })
+}
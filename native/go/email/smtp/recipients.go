@@ -0,0 +1,163 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/rdawebb/kernel/native/internal/provider"
+)
+
+// RecipientResult is the outcome of a send for one recipient
+type RecipientResult struct {
+    Address  string `json:"address"`
+    Accepted bool   `json:"accepted"`
+    Code     int    `json:"code,omitempty"` // SMTP reply code of a rejection
+    Error    string `json:"error,omitempty"`
+}
+
+// SetMaxRecipients caps how many recipients one transaction carries; 0
+// leaves it to the server's advertised or known limit
+func (c *Connection) SetMaxRecipients(n int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.maxRcpt = n
+}
+
+// recipientLimit returns the per-transaction recipient cap: configured,
+// advertised (LIMITS RCPTMAX, RFC 9422), known for the provider, or 0
+func (c *Connection) recipientLimit(client *smtp.Client) int {
+    c.mu.RLock()
+    limit := c.maxRcpt
+    c.mu.RUnlock()
+    if limit > 0 {
+        return limit
+    }
+
+    if ok, params := client.Extension("LIMITS"); ok {
+        for _, field := range strings.Fields(params) {
+            name, value, _ := strings.Cut(field, "=")
+            if strings.EqualFold(name, "RCPTMAX") {
+                if n, err := strconv.Atoi(value); err == nil && n > 0 {
+                    return n
+                }
+            }
+        }
+    }
+
+    if p := provider.Lookup(c.host); p != nil {
+        return p.MaxRecipients
+    }
+    return 0
+}
+
+// transmit sends one message to many recipients, splitting it over as many
+// transactions as the recipient limit requires. A 452 reply to RCPT TO
+// ("too many recipients") ends the current batch early and defers the rest
+// to the next transaction; other rejections are recorded per recipient.
+// It fails only if no recipient accepted the message, so the results of a
+// partial delivery are never lost to an error.
+func (c *Connection) transmit(client *smtp.Client, from string, to []string, payload func(*smtp.Client) error) ([]RecipientResult, error) {
+    limit := c.recipientLimit(client)
+
+    results := make([]RecipientResult, 0, len(to))
+    delivered := 0
+    var lastErr error
+
+    remaining := to
+    for len(remaining) > 0 {
+        if err := client.Mail(from); err != nil {
+            // Earlier transactions may already have delivered, so the rest
+            // is reported as not accepted rather than failing the whole send
+            lastErr = fmt.Errorf("MAIL FROM failed: %w", err)
+            for _, recipient := range remaining {
+                results = append(results, rejected(recipient, lastErr))
+            }
+            break
+        }
+
+        var accepted []string
+        next := len(remaining)
+
+        for i, recipient := range remaining {
+            if limit > 0 && len(accepted) == limit {
+                next = i
+                break
+            }
+
+            err := client.Rcpt(recipient)
+            if err == nil {
+                accepted = append(accepted, recipient)
+                continue
+            }
+
+            var tpErr *textproto.Error
+            if errors.As(err, &tpErr) && tpErr.Code == 452 && len(accepted) > 0 {
+                next = i
+                break
+            }
+
+            results = append(results, rejected(recipient, err))
+        }
+        remaining = remaining[next:]
+
+        if len(accepted) == 0 {
+            client.Reset()
+            continue
+        }
+
+        if err := payload(client); err != nil {
+            client.Reset()
+            lastErr = err
+            for _, recipient := range accepted {
+                results = append(results, rejected(recipient, err))
+            }
+            continue
+        }
+
+        for _, recipient := range accepted {
+            results = append(results, RecipientResult{Address: recipient, Accepted: true})
+        }
+        delivered += len(accepted)
+    }
+
+    if delivered == 0 {
+        if lastErr != nil {
+            return results, lastErr
+        }
+        if len(results) > 0 {
+            return results, fmt.Errorf("RCPT TO failed for %s: %s", results[0].Address, results[0].Error)
+        }
+        return results, fmt.Errorf("no recipients")
+    }
+
+    return results, nil
+}
+
+// recipientResults returns a delivery's per-recipient outcomes; a BURL
+// submission reports none, as it succeeds for all of to or fails outright
+func recipientResults(delivery *Delivery, to []string) []RecipientResult {
+    if len(delivery.Recipients) > 0 {
+        return delivery.Recipients
+    }
+
+    results := make([]RecipientResult, 0, len(to))
+    for _, recipient := range to {
+        results = append(results, RecipientResult{Address: recipient, Accepted: true})
+    }
+    return results
+}
+
+func rejected(recipient string, err error) RecipientResult {
+    result := RecipientResult{Address: recipient, Error: err.Error()}
+
+    var tpErr *textproto.Error
+    if errors.As(err, &tpErr) {
+        result.Code = tpErr.Code
+    }
+    return result
+}
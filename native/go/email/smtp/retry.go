@@ -0,0 +1,242 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/outbox"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// claims tracks outbox entries being sent, so the Outbox screen, a flush and
+// a send-later timer never transmit the same entry twice
+type claims struct {
+    mu  sync.Mutex
+    ids map[string]bool
+}
+
+// claim marks an entry as being sent, reporting false if it already is.
+// release must be called once the attempt is over.
+func (c *claims) claim(id string) (release func(), ok bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.ids[id] {
+        return nil, false
+    }
+    c.ids[id] = true
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            c.mu.Lock()
+            delete(c.ids, id)
+            c.mu.Unlock()
+        })
+    }, true
+}
+
+// claimEntry claims an entry the Outbox screen acts on and loads it. Held
+// entries belong to their timer until cancel_send takes them back.
+func (h *Handler) claimEntry(id string) (*outbox.Entry, func(), error) {
+    if h.outbox == nil {
+        return nil, nil, fmt.Errorf("outbox not configured")
+    }
+
+    if h.scheduled.has(id) {
+        return nil, nil, protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("message %s is held for sending; use cancel_send", id))
+    }
+
+    release, ok := h.sending.claim(id)
+    if !ok {
+        return nil, nil, fmt.Errorf("message %s is already being sent", id)
+    }
+
+    entry, err := h.outbox.Get(id)
+    if err != nil {
+        release()
+        if errors.Is(err, outbox.ErrNotFound) {
+            err = protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("message %s is not in the outbox (already sent or abandoned)", id))
+        }
+        return nil, nil, err
+    }
+
+    return entry, release, nil
+}
+
+// checkEntryIdentity re-checks an entry's sender against the connection it
+// is about to go out on, which need not be the one it was queued on
+func (h *Handler) checkEntryIdentity(conn *Connection, entry *outbox.Entry) error {
+    message, err := h.checkIdentity(conn, entry.From, entry.Message)
+    if err != nil {
+        return err
+    }
+
+    entry.Message = message
+    return nil
+}
+
+// retryResult reports a retry, keeping a failed one in the outbox
+func retryResult(entry *outbox.Entry, delivery *Delivery, err error) protocol.Response {
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "outbox_id": entry.ID,
+        "delivery":  delivery,
+    })
+}
+
+func (h *Handler) handleOutboxGet(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        OutboxID string `json:"outbox_id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.outbox == nil {
+        return protocol.ErrorResponse(fmt.Errorf("outbox not configured"))
+    }
+
+    entry, err := h.outbox.Get(p.OutboxID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    // The composed source, for reopening a failed message in the composer
+    message := entry.Message
+    entry.Message = nil
+
+    return protocol.SuccessResponse(map[string]any{
+        "entry":       entry,
+        "held":        h.scheduled.has(entry.ID),
+        "message_b64": message, // []byte marshals as base64
+    })
+}
+
+func (h *Handler) handleOutboxRetry(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int    `json:"handle" validate:"required"`
+        IMAPHandle int    `json:"imap_handle"`
+        OutboxID   string `json:"outbox_id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    entry, release, err := h.claimEntry(p.OutboxID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    defer release()
+
+    if entry.State == outbox.StatePending {
+        if err := h.checkEntryIdentity(conn, entry); err != nil {
+            return protocol.ErrorResponse(err)
+        }
+    }
+
+    // Sends now even if the entry was due later; a transmitted entry only
+    // retries its Sent copy
+    delivery, err := h.processEntry(conn, p.Handle, p.IMAPHandle, entry)
+    return retryResult(entry, delivery, err)
+}
+
+func (h *Handler) handleOutboxResend(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle     int      `json:"handle" validate:"required"`
+        IMAPHandle int      `json:"imap_handle"`
+        OutboxID   string   `json:"outbox_id"`
+        MessageB64 string   `json:"message_b64"` // The edited message
+        From       string   `json:"from"`        // Optional: keeps the original sender
+        To         []string `json:"to"`          // Optional: keeps the original recipients
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    message, err := base64.StdEncoding.DecodeString(p.MessageB64)
+    if err != nil {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("invalid base64 message: %w", err)))
+    }
+    if len(message) == 0 {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, errors.New("message_b64 is required")))
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    entry, release, err := h.claimEntry(p.OutboxID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    defer release()
+
+    if entry.State == outbox.StateTransmitted {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("message %s was already sent; only its Sent copy can be retried", entry.ID)))
+    }
+
+    if p.From != "" {
+        entry.From = p.From
+    }
+    if len(p.To) > 0 {
+        entry.To = p.To
+    }
+    if message, err = h.checkIdentity(conn, entry.From, message); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    // Save the edit first, so a failed resend leaves the new version queued
+    entry.Message = message
+    entry.LastError = ""
+    if err := h.outbox.Update(entry); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    delivery, err := h.processEntry(conn, p.Handle, p.IMAPHandle, entry)
+    return retryResult(entry, delivery, err)
+}
+
+func (h *Handler) handleOutboxAbandon(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        OutboxID string `json:"outbox_id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    entry, release, err := h.claimEntry(p.OutboxID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    defer release()
+
+    if err := h.outbox.Remove(entry.ID); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    // Like cancel_send, hand the message back so it can become a draft
+    return protocol.SuccessResponse(map[string]any{
+        "outbox_id":   entry.ID,
+        "from":        entry.From,
+        "to":          entry.To,
+        "message_b64": entry.Message,
+    })
+}
@@ -0,0 +1,266 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Route sends mail through a specific SMTP connection. A route matches on
+// the sender, taking the whole message, or on recipient domains, taking
+// just those recipients.
+type Route struct {
+    Sender  string   `json:"sender,omitempty"`           // From address, or "@domain" for any address there
+    Domains []string `json:"domains,omitempty"`          // Recipient domains, subdomains included
+    Handle  int      `json:"handle" validate:"required"` // SMTP connection to send through
+}
+
+// RoutedDelivery is the part of a routed send that went through one
+// connection
+type RoutedDelivery struct {
+    Handle     int      `json:"handle"`
+    Recipients []string `json:"recipients"`
+    Method     string   `json:"method,omitempty"`
+    Error      string   `json:"error,omitempty"`
+}
+
+// routes holds the routing rules, tried in order
+type routes struct {
+    mu    sync.RWMutex
+    rules []Route
+}
+
+// forget drops the rules sending through a closed connection, so later
+// sends fall back to their own connection instead of failing
+func (r *routes) forget(handle int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    kept := r.rules[:0:0]
+    for _, rule := range r.rules {
+        if rule.Handle != handle {
+            kept = append(kept, rule)
+        }
+    }
+    r.rules = kept
+}
+
+// routeBatch is a set of recipients bound for one connection; handle 0 is
+// the connection the send was made on. err is set when the route's
+// connection can't be used, and the batch is then not sent.
+type routeBatch struct {
+    handle int
+    conn   *Connection
+    to     []string
+    err    error
+}
+
+// matchesSender reports whether from is covered by a route's sender
+func (r Route) matchesSender(from string) bool {
+    if r.Sender == "" {
+        return false
+    }
+    if strings.HasPrefix(r.Sender, "@") {
+        return strings.HasSuffix(strings.ToLower(from), strings.ToLower(r.Sender))
+    }
+    return strings.EqualFold(r.Sender, from)
+}
+
+// matchesRecipient reports whether a recipient is in one of a route's domains
+func (r Route) matchesRecipient(recipient string) bool {
+    at := strings.LastIndex(recipient, "@")
+    if at < 0 {
+        return false
+    }
+    domain := strings.ToLower(recipient[at+1:])
+
+    for _, d := range r.Domains {
+        d = strings.ToLower(strings.TrimPrefix(d, "@"))
+        if domain == d || strings.HasSuffix(domain, "."+d) {
+            return true
+        }
+    }
+    return false
+}
+
+// route splits recipients into per-connection batches by the routing rules.
+// The first matching rule wins; unmatched recipients stay on conn, which
+// is the connection behind handle. A rule only sends through a connection
+// of the client that owns handle, as rules are shared by every client.
+func (h *Handler) route(conn *Connection, handle int, from string, to []string) []routeBatch {
+    h.routes.mu.RLock()
+    rules := h.routes.rules
+    h.routes.mu.RUnlock()
+
+    handles := make(map[string]int, len(to))
+    for _, recipient := range to {
+        for _, rule := range rules {
+            if rule.matchesSender(from) || rule.matchesRecipient(recipient) {
+                handles[recipient] = rule.Handle
+                break
+            }
+        }
+    }
+
+    var batches []routeBatch
+    index := make(map[int]int)
+    for _, recipient := range to {
+        routeHandle := handles[recipient]
+
+        i, ok := index[routeHandle]
+        if !ok {
+            batch := routeBatch{handle: routeHandle, conn: conn}
+            if routeHandle != 0 {
+                batch.conn, batch.err = h.routeConnection(handle, routeHandle)
+            }
+
+            i = len(batches)
+            index[routeHandle] = i
+            batches = append(batches, batch)
+        }
+        batches[i].to = append(batches[i].to, recipient)
+    }
+
+    return batches
+}
+
+// routeConnection looks up a route's connection, refusing one that another
+// client owns as if it didn't exist
+func (h *Handler) routeConnection(handle, routeHandle int) (*Connection, error) {
+    owner, _ := h.pool.Owner(handle)
+    if routeOwner, ok := h.pool.Owner(routeHandle); ok && routeOwner != owner {
+        return nil, fmt.Errorf("route to handle %d: %w", routeHandle, protocol.WithCode(protocol.CodeInvalidHandle, errors.New("invalid connection handle")))
+    }
+
+    conn, err := h.getConnection(routeHandle)
+    if err != nil {
+        return nil, fmt.Errorf("route to handle %d: %w", routeHandle, err)
+    }
+    return conn, nil
+}
+
+// send delivers a message, through several connections if routing rules
+// split its recipients. Only the first successful route files a Sent copy.
+// Recipients of failed routes are reported as rejected rather than failing
+// the whole send, since other routes may already have delivered; an outbox
+// entry stays pending for them.
+func (h *Handler) send(conn *Connection, handle, imapHandle int, from string, to []string, message []byte, sentFolder string, saveSent bool) (*Delivery, error) {
+    batches := h.route(conn, handle, from, to)
+
+    if len(batches) <= 1 {
+        if len(batches) == 1 {
+            if batches[0].err != nil {
+                return nil, batches[0].err
+            }
+            conn = batches[0].conn
+        }
+        return h.sendDirect(conn, imapHandle, from, to, message, sentFolder, saveSent)
+    }
+
+    delivery := &Delivery{Method: "routed"}
+    filed := false
+    var firstErr error
+
+    for _, batch := range batches {
+        routed := RoutedDelivery{Handle: batch.handle, Recipients: batch.to}
+
+        folder, save := sentFolder, saveSent
+        if filed {
+            folder, save = "", false
+        }
+
+        var d *Delivery
+        err := batch.err
+        if err == nil {
+            d, err = h.sendDirect(batch.conn, imapHandle, from, batch.to, message, folder, save)
+        }
+        if err != nil {
+            if firstErr == nil {
+                firstErr = err
+            }
+            routed.Error = err.Error()
+            for _, recipient := range batch.to {
+                delivery.Recipients = append(delivery.Recipients, rejected(recipient, err))
+            }
+            delivery.Routes = append(delivery.Routes, routed)
+            continue
+        }
+
+        routed.Method = d.Method
+        delivery.Routes = append(delivery.Routes, routed)
+        delivery.Recipients = append(delivery.Recipients, recipientResults(d, batch.to)...)
+
+        if !filed {
+            delivery.SentCopy = d.SentCopy
+            delivery.SentCopyError = d.SentCopyError
+            filed = true
+        }
+    }
+
+    if !filed {
+        return nil, fmt.Errorf("every route failed: %w", firstErr)
+    }
+
+    return delivery, nil
+}
+
+// getConnection looks up the SMTP connection behind a handle
+func (h *Handler) getConnection(handle int) (*Connection, error) {
+    connInterface, err := h.pool.Get(handle)
+    if err != nil {
+        return nil, err
+    }
+
+    conn, ok := connInterface.(*Connection)
+    if !ok {
+        return nil, protocol.WithCode(protocol.CodeInvalidHandle, fmt.Errorf("handle %d is not an SMTP connection", handle))
+    }
+
+    return conn, nil
+}
+
+func (h *Handler) handleSetRoutes(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Routes []Route `json:"routes"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    for i, rule := range p.Routes {
+        if rule.Sender == "" && len(rule.Domains) == 0 {
+            return protocol.ErrorResponse(fmt.Errorf("route %d matches nothing: set sender or domains", i))
+        }
+        if _, err := h.getConnection(rule.Handle); err != nil {
+            return protocol.ErrorResponse(fmt.Errorf("route %d: %w", i, err))
+        }
+    }
+
+    h.routes.mu.Lock()
+    h.routes.rules = p.Routes
+    h.routes.mu.Unlock()
+
+    return protocol.SuccessResponse(map[string]any{
+        "count": len(p.Routes),
+    })
+}
+
+func (h *Handler) handleListRoutes(ctx context.Context, params json.RawMessage) protocol.Response {
+    h.routes.mu.RLock()
+    defer h.routes.mu.RUnlock()
+
+    rules := h.routes.rules
+    if rules == nil {
+        rules = []Route{}
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "routes": rules,
+    })
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/outbox"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// scheduled tracks outbox entries held for an undo window or a send-later
+// time, keyed by entry ID
+type scheduled struct {
+    mu     sync.Mutex
+    timers map[string]*time.Timer
+}
+
+// take removes an entry from the schedule, reporting whether it was there.
+// Whoever takes an entry owns it: the timer sends it, cancel_send drops it.
+func (s *scheduled) take(id string) (*time.Timer, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    timer, ok := s.timers[id]
+    delete(s.timers, id)
+    return timer, ok
+}
+
+// has reports whether an entry is still waiting for its timer
+func (s *scheduled) has(id string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    _, ok := s.timers[id]
+    return ok
+}
+
+// sendLater persists a message and returns immediately; it is transmitted
+// when entry.SendAt arrives unless cancelled first with cancel_send. The
+// outcome is published as send.completed or send.failed, tagged with the
+// trace ID of the request ctx serves.
+func (h *Handler) sendLater(ctx context.Context, conn *Connection, handle, imapHandle int, entry *outbox.Entry) error {
+    if h.outbox == nil {
+        return fmt.Errorf("outbox not configured")
+    }
+
+    if err := h.outbox.Add(entry); err != nil {
+        return fmt.Errorf("failed to queue message: %w", err)
+    }
+
+    h.scheduled.mu.Lock()
+    defer h.scheduled.mu.Unlock()
+
+    h.scheduled.timers[entry.ID] = time.AfterFunc(time.Until(entry.SendAt), func() {
+        if _, ok := h.scheduled.take(entry.ID); !ok {
+            return
+        }
+        release, ok := h.sending.claim(entry.ID)
+        if !ok {
+            return
+        }
+        defer release()
+
+        delivery, err := h.processEntry(conn, handle, imapHandle, entry)
+        if err != nil {
+            h.publishFor(ctx, "send.failed", handle, map[string]any{
+                "outbox_id": entry.ID,
+                "error":     err.Error(),
+            })
+            return
+        }
+
+        h.publishFor(ctx, "send.completed", handle, map[string]any{
+            "outbox_id": entry.ID,
+            "delivery":  delivery,
+        })
+    })
+
+    return nil
+}
+
+func (h *Handler) handleCancelSend(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        OutboxID string `json:"outbox_id"`
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    if h.outbox == nil {
+        return protocol.ErrorResponse(fmt.Errorf("outbox not configured"))
+    }
+
+    timer, ok := h.scheduled.take(p.OutboxID)
+    if !ok {
+        return protocol.ErrorResponse(fmt.Errorf("message %s is not awaiting send (already sent or unknown)", p.OutboxID))
+    }
+    timer.Stop()
+
+    // Hand the message back so the UI can reopen the draft
+    entry, err := h.outbox.Get(p.OutboxID)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+    if err := h.outbox.Remove(p.OutboxID); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    return protocol.SuccessResponse(map[string]any{
+        "outbox_id":   entry.ID,
+        "from":        entry.From,
+        "to":          entry.To,
+        "message_b64": entry.Message, // []byte marshals as base64
+    })
+}
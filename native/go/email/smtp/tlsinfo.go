@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rdawebb/kernel/native/internal/history"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/tlscheck"
+)
+
+func (h *Handler) handleTLSInfo(ctx context.Context, params json.RawMessage) protocol.Response {
+    var p struct {
+        Handle int  `json:"handle" validate:"required"`
+        OCSP   bool `json:"ocsp"` // Ask the CA when the server stapled no OCSP response
+    }
+
+    if err := protocol.DecodeParams(ctx, params, &p); err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    conn, err := h.getConnection(p.Handle)
+    if err != nil {
+        return protocol.ErrorResponse(err)
+    }
+
+    report := tlscheck.Unencrypted()
+    if state, ok := conn.TLSState(); ok {
+        report = tlscheck.Inspect(ctx, state, tlscheck.Options{OCSP: p.OCSP})
+    }
+    h.tlsWarnings(p.Handle, report)
+
+    return protocol.SuccessResponse(report)
+}
+
+// tlsWarnings announces what a TLS check found wrong and keeps it in the
+// handle's history
+func (h *Handler) tlsWarnings(handle int, report *tlscheck.Report) {
+    if len(report.Warnings) == 0 {
+        return
+    }
+
+    for _, warning := range report.Warnings {
+        h.history.Record(handle, history.Event{Kind: history.TLS, Error: warning})
+    }
+    h.publish("tls.warning", handle, map[string]any{
+        "warnings": report.Warnings,
+        "ocsp":     report.OCSP,
+    })
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Framing modes. Sessions start in line mode (newline-delimited JSON); a
+// client may switch to length-prefixed frames with a set_framing request.
+const (
+    framingLine   = "line"
+    framingLength = "length"
+)
+
+// defaultMaxRequestSize bounds a single request unless overridden with
+// NATIVE_MAX_REQUEST_SIZE. Large enough for a send with base64 attachments
+// at the usual provider limits.
+const defaultMaxRequestSize = 64 << 20
+
+// maxRequestSize returns the largest request a client may send, in bytes
+func maxRequestSize() int {
+    value := os.Getenv("NATIVE_MAX_REQUEST_SIZE")
+    if value == "" {
+        return defaultMaxRequestSize
+    }
+
+    size, err := strconv.Atoi(value)
+    if err != nil || size <= 0 {
+        log.Printf("Invalid NATIVE_MAX_REQUEST_SIZE %q, using %d", value, defaultMaxRequestSize)
+        return defaultMaxRequestSize
+    }
+    return size
+}
+
+// tooLargeError is an oversized request. The request has been read past, so
+// the session can answer it and carry on.
+type tooLargeError struct {
+    size  int // Zero when the transport doesn't report it
+    limit int
+}
+
+func (e *tooLargeError) Error() string {
+    if e.size == 0 {
+        return fmt.Sprintf("request exceeds the %d byte limit", e.limit)
+    }
+    return fmt.Sprintf("request of %d bytes exceeds the %d byte limit", e.size, e.limit)
+}
+
+func (e *tooLargeError) ErrorCode() string {
+    return protocol.CodeRequestTooLarge
+}
+
+// readMessage reads one message of at most limit bytes in the given
+// framing mode
+func readMessage(r *bufio.Reader, mode string, limit int) ([]byte, error) {
+    if mode == framingLength {
+        var header [4]byte
+        if _, err := io.ReadFull(r, header[:]); err != nil {
+            return nil, err
+        }
+
+        size := binary.BigEndian.Uint32(header[:])
+        if int64(size) > int64(limit) {
+            if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+                return nil, err
+            }
+            return nil, &tooLargeError{size: int(size), limit: limit}
+        }
+
+        payload := make([]byte, size)
+        if _, err := io.ReadFull(r, payload); err != nil {
+            return nil, err
+        }
+        return payload, nil
+    }
+
+    for {
+        line, err := readLine(r, limit)
+        if err != nil && (err != io.EOF || len(line) == 0) {
+            return nil, err
+        }
+
+        // Skip blank lines between requests
+        if line = bytes.TrimSpace(line); len(line) > 0 {
+            return line, nil
+        }
+        if err == io.EOF {
+            return nil, err
+        }
+    }
+}
+
+// readLine reads up to and including the next newline. A line over limit is
+// consumed but not kept, so an oversized request can't exhaust memory.
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+    var line []byte
+    size := 0
+
+    for {
+        chunk, err := r.ReadSlice('\n')
+        size += len(chunk)
+        if size <= limit+1 { // The newline doesn't count
+            line = append(line, chunk...)
+        }
+
+        switch {
+        case err == bufio.ErrBufferFull:
+            continue
+        case err != nil && (err != io.EOF || size == 0):
+            return nil, err
+        case size > limit+1:
+            return nil, &tooLargeError{size: size, limit: limit}
+        }
+        return line, err
+    }
+}
+
+// writeMessage writes one message in the given framing mode
+func writeMessage(w io.Writer, mode string, payload []byte) error {
+    if mode == framingLength {
+        var header [4]byte
+        binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+        if _, err := w.Write(header[:]); err != nil {
+            return err
+        }
+        _, err := w.Write(payload)
+        return err
+    }
+
+    _, err := w.Write(append(payload, '\n'))
+    return err
+}
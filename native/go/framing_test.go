@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// lengthFrame prefixes payload with its big-endian length
+func lengthFrame(payload string) string {
+    var header [4]byte
+    binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+    return string(header[:]) + payload
+}
+
+func TestReadMessage(t *testing.T) {
+    tests := []struct {
+        name     string
+        mode     string
+        input    string
+        limit    int
+        want     []string // Messages read before the error
+        tooLarge bool     // Whether the next read is refused as too large
+    }{
+        {"line", framingLine, "{\"a\":1}\n{\"b\":2}\n", 100, []string{`{"a":1}`, `{"b":2}`}, false},
+        {"line without newline", framingLine, `{"a":1}`, 100, []string{`{"a":1}`}, false},
+        {"blank lines skipped", framingLine, "\n  \n{\"a\":1}\r\n\n", 100, []string{`{"a":1}`}, false},
+        {"line at limit", framingLine, "12345\n", 5, []string{"12345"}, false},
+        {"line over limit", framingLine, "123456\n", 5, nil, true},
+        {"line over buffer", framingLine, strings.Repeat("x", 10000) + "\n", 100, nil, true},
+        {"length", framingLength, lengthFrame(`{"a":1}`) + lengthFrame(`{"b":2}`), 100, []string{`{"a":1}`, `{"b":2}`}, false},
+        {"length at limit", framingLength, lengthFrame("12345"), 5, []string{"12345"}, false},
+        {"length over limit", framingLength, lengthFrame("123456"), 5, nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+            for _, want := range tt.want {
+                got, err := readMessage(r, tt.mode, tt.limit)
+                if err != nil {
+                    t.Fatalf("readMessage: %v", err)
+                }
+                if string(got) != want {
+                    t.Errorf("readMessage gave %q, want %q", got, want)
+                }
+            }
+
+            _, err := readMessage(r, tt.mode, tt.limit)
+            var tooLarge *tooLargeError
+            if got := errors.As(err, &tooLarge); got != tt.tooLarge {
+                t.Fatalf("readMessage error %v, want too large %v", err, tt.tooLarge)
+            }
+            if !tt.tooLarge && err != io.EOF {
+                t.Errorf("readMessage error %v, want EOF", err)
+            }
+        })
+    }
+}
+
+// An oversized request is read past, so the one after it still arrives
+func TestReadMessageAfterTooLarge(t *testing.T) {
+    tests := []struct {
+        name  string
+        mode  string
+        input string
+    }{
+        {"line", framingLine, strings.Repeat("x", 200) + "\n{\"a\":1}\n"},
+        {"length", framingLength, lengthFrame(strings.Repeat("x", 200)) + lengthFrame(`{"a":1}`)},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+
+            _, err := readMessage(r, tt.mode, 100)
+            var tooLarge *tooLargeError
+            if !errors.As(err, &tooLarge) {
+                t.Fatalf("readMessage error %v, want too large", err)
+            }
+            if tooLarge.limit != 100 || tooLarge.size <= 100 {
+                t.Errorf("too large error %+v, want size over the limit of 100", tooLarge)
+            }
+
+            got, err := readMessage(r, tt.mode, 100)
+            if err != nil {
+                t.Fatalf("readMessage: %v", err)
+            }
+            if string(got) != `{"a":1}` {
+                t.Errorf("readMessage gave %q, want the next request", got)
+            }
+        })
+    }
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+    tests := []struct {
+        name  string
+        input string
+    }{
+        {"short header", "\x00\x00"},
+        {"short payload", lengthFrame("12345")[:7]},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := readMessage(bufio.NewReader(strings.NewReader(tt.input)), framingLength, 100)
+            if !errors.Is(err, io.ErrUnexpectedEOF) {
+                t.Errorf("readMessage error %v, want unexpected EOF", err)
+            }
+        })
+    }
+}
+
+func TestWriteMessage(t *testing.T) {
+    tests := []struct {
+        name string
+        mode string
+        want string
+    }{
+        {"line", framingLine, "{\"a\":1}\n"},
+        {"length", framingLength, lengthFrame(`{"a":1}`)},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var buf bytes.Buffer
+            if err := writeMessage(&buf, tt.mode, []byte(`{"a":1}`)); err != nil {
+                t.Fatalf("writeMessage: %v", err)
+            }
+            if buf.String() != tt.want {
+                t.Errorf("writeMessage wrote %q, want %q", buf.String(), tt.want)
+            }
+
+            got, err := readMessage(bufio.NewReader(&buf), tt.mode, 100)
+            if err != nil || string(got) != `{"a":1}` {
+                t.Errorf("readMessage gave %q, %v, want the message back", got, err)
+            }
+        })
+    }
+}
+
+func TestMaxRequestSize(t *testing.T) {
+    tests := []struct {
+        value string
+        want  int
+    }{
+        {"", defaultMaxRequestSize},
+        {"1024", 1024},
+        {"0", defaultMaxRequestSize},
+        {"-5", defaultMaxRequestSize},
+        {"lots", defaultMaxRequestSize},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.value, func(t *testing.T) {
+            t.Setenv("NATIVE_MAX_REQUEST_SIZE", tt.value)
+            if got := maxRequestSize(); got != tt.want {
+                t.Errorf("maxRequestSize() = %d, want %d", got, tt.want)
+            }
+        })
+    }
+}
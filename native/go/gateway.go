@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/ratelimit"
+)
+
+// gateway serves module actions over plain HTTP as
+// POST /v1/{module}/{action}, with the params as the JSON body and the
+// protocol response as the reply. Meant for curl and frontends that can't
+// hold a socket open.
+type gateway struct {
+    srv    *server
+    secret string // Required as a bearer token
+
+    // limiter applies the client limits to the gateway as a whole, as its
+    // requests are each on their own
+    limiter *ratelimit.Limiter
+}
+
+// serveHTTP listens on addr until shutdown
+func (s *server) serveHTTP(ctx context.Context, addr, secret string) error {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+
+    hs := &http.Server{
+        Handler:     &gateway{srv: s, secret: secret, limiter: ratelimit.New(s.limits)},
+        BaseContext: func(net.Listener) context.Context { return ctx },
+    }
+
+    // Like the other listeners, stop taking requests once shutdown begins
+    // and let the drain wait for those already admitted
+    go func() {
+        <-s.closing
+        hs.Close()
+    }()
+
+    log.Printf("Native HTTP gateway listening on %s", listener.Addr())
+    if err := hs.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    route, ok := strings.CutPrefix(r.URL.Path, "/v1/")
+    module, action, found := strings.Cut(route, "/")
+    if !ok || !found || module == "" || action == "" || strings.Contains(action, "/") {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if subtle.ConstantTimeCompare([]byte(token), []byte(g.secret)) != 1 {
+        writeHTTP(w, protocol.ErrorResponse(&authError{reason: "invalid secret"}))
+        return
+    }
+
+    req := protocol.Request{
+        ID:             r.Header.Get("X-Request-ID"),
+        Module:         module,
+        Action:         action,
+        TraceID:        r.Header.Get("X-Trace-ID"),
+        IdempotencyKey: r.Header.Get("Idempotency-Key"),
+        Priority:       r.Header.Get("X-Priority"),
+    }
+    if timeout := r.Header.Get("X-Timeout-Ms"); timeout != "" {
+        ms, err := strconv.Atoi(timeout)
+        if err != nil || ms < 0 {
+            writeHTTP(w, protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, errors.New("invalid X-Timeout-Ms"))))
+            return
+        }
+        req.TimeoutMS = ms
+    }
+
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(g.srv.maxRequest)))
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        writeHTTP(w, protocol.ErrorResponse(&tooLargeError{limit: g.srv.maxRequest}))
+        return
+    }
+    if err != nil {
+        return
+    }
+    if len(strings.TrimSpace(string(body))) == 0 {
+        body = []byte("{}")
+    }
+    if !json.Valid(body) {
+        writeHTTP(w, protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, errors.New("request body is not valid JSON"))))
+        return
+    }
+    req.Params = body
+
+    finish, err := g.srv.admit(g.limiter)
+    if err != nil {
+        writeHTTP(w, protocol.ErrorResponse(err))
+        return
+    }
+
+    // The response is flushed when the handler returns, so the slot is
+    // given back in the background once the request's handler is done
+    resp, wait := g.srv.run(withLimiter(pool.WithOwner(r.Context(), httpClient), g.limiter), req)
+    go func() {
+        wait()
+        finish()
+    }()
+    resp.ID = req.ID
+    resp.TraceID = req.TraceID
+    if !resp.Success {
+        req.Logf("%s.%s failed: %s", req.Module, req.Action, resp.Error)
+    }
+    writeHTTP(w, resp)
+}
+
+// httpStatus maps an error code onto the nearest HTTP status, so callers
+// that only look at the status still see failures
+func httpStatus(resp protocol.Response) int {
+    if resp.Success {
+        return http.StatusOK
+    }
+
+    switch resp.ErrorCode {
+    case protocol.CodeBusy:
+        return http.StatusTooManyRequests
+    case "UNAUTHENTICATED":
+        return http.StatusUnauthorized
+    case protocol.CodeInvalidRequest:
+        return http.StatusBadRequest
+    case protocol.CodeInvalidHandle:
+        return http.StatusNotFound
+    case protocol.CodeRequestTooLarge:
+        return http.StatusRequestEntityTooLarge
+    case protocol.CodeTimeout:
+        return http.StatusGatewayTimeout
+    case protocol.CodeNetwork, protocol.CodeNotConnected, protocol.CodeAuthFailed:
+        return http.StatusBadGateway
+    default:
+        return http.StatusInternalServerError
+    }
+}
+
+// writeHTTP sends a protocol response as the JSON body
+func writeHTTP(w http.ResponseWriter, resp protocol.Response) {
+    w.Header().Set("Content-Type", "application/json")
+    if after := retryAfter(resp); after > 0 {
+        w.Header().Set("Retry-After", strconv.Itoa(after))
+    }
+    w.WriteHeader(httpStatus(resp))
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        log.Printf("Failed to write HTTP response: %v", err)
+    }
+}
+
+// retryAfter returns the whole seconds a BUSY response asks the client to
+// wait, rounded up, or 0
+func retryAfter(resp protocol.Response) int {
+    if resp.ErrorCode != protocol.CodeBusy {
+        return 0
+    }
+
+    details, _ := resp.ErrorDetails.(map[string]any)
+    ms, _ := details["retry_after_ms"].(int64)
+    if ms <= 0 {
+        return 1
+    }
+    return int((ms + 999) / 1000)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/ratelimit"
+	"github.com/rdawebb/kernel/native/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService serves the handlers over gRPC, alongside the socket protocol
+type grpcService struct {
+    srv    *server
+    secret string // Required in x-native-secret metadata
+
+    // limiter applies the client limits to the gRPC listener as a whole,
+    // which has no per-client session
+    limiter *ratelimit.Limiter
+}
+
+// serveGRPC listens on addr ("unix:/path" or "host:port") until ctx ends
+func (s *server) serveGRPC(ctx context.Context, addr, secret string) error {
+    network := "tcp"
+    if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+        network, addr = "unix", path
+        os.Remove(path)
+    }
+    if secret == "" {
+        return fmt.Errorf("gRPC requires NATIVE_TCP_SECRET")
+    }
+
+    listener, err := net.Listen(network, addr)
+    if err != nil {
+        return err
+    }
+
+    gs := grpc.NewServer(grpc.ForceServerCodec(rpc.Codec{}), grpc.MaxRecvMsgSize(s.maxRequest))
+    rpc.Register(gs, &grpcService{srv: s, secret: secret, limiter: ratelimit.New(s.limits)})
+
+    // Finish running calls on shutdown, cutting them off if ctx ends first
+    go func() {
+        select {
+        case <-s.closing:
+            go func() {
+                <-ctx.Done()
+                gs.Stop()
+            }()
+            gs.GracefulStop()
+        case <-ctx.Done():
+            gs.Stop()
+        }
+    }()
+
+    log.Printf("Native gRPC server listening on %s %s", network, listener.Addr())
+    return gs.Serve(listener)
+}
+
+func (g *grpcService) authorize(ctx context.Context) error {
+    md, _ := metadata.FromIncomingContext(ctx)
+    for _, secret := range md.Get("x-native-secret") {
+        if subtle.ConstantTimeCompare([]byte(secret), []byte(g.secret)) == 1 {
+            return nil
+        }
+    }
+    return status.Error(codes.Unauthenticated, "invalid secret")
+}
+
+// request converts a gRPC request to the socket protocol's form
+func (g *grpcService) request(req *rpc.Request) (protocol.Request, error) {
+    if req.Module == "" {
+        return protocol.Request{}, status.Error(codes.InvalidArgument, "module is required")
+    }
+
+    params := json.RawMessage(req.Params)
+    if len(params) == 0 {
+        params = json.RawMessage("{}")
+    }
+
+    return protocol.Request{
+        ID:        req.ID,
+        Module:    req.Module,
+        Action:    req.Action,
+        Params:    params,
+        TraceID:   req.TraceID,
+        TimeoutMS: int(req.TimeoutMS),
+        Priority:  req.Priority,
+    }, nil
+}
+
+// response converts a socket protocol response to its gRPC form
+func response(req protocol.Request, resp protocol.Response) (*rpc.Response, error) {
+    out := &rpc.Response{
+        ID:        req.ID,
+        Success:   resp.Success,
+        Error:     resp.Error,
+        ErrorCode: resp.ErrorCode,
+        TraceID:   req.TraceID,
+        Partial:   resp.Partial,
+    }
+
+    var err error
+    if resp.Data != nil {
+        if out.Data, err = json.Marshal(resp.Data); err != nil {
+            return nil, status.Error(codes.Internal, err.Error())
+        }
+    }
+    if resp.ErrorDetails != nil {
+        if out.ErrorDetails, err = json.Marshal(resp.ErrorDetails); err != nil {
+            return nil, status.Error(codes.Internal, err.Error())
+        }
+    }
+    return out, nil
+}
+
+func (g *grpcService) Call(ctx context.Context, in *rpc.Request) (*rpc.Response, error) {
+    if err := g.authorize(ctx); err != nil {
+        return nil, err
+    }
+
+    req, err := g.request(in)
+    if err != nil {
+        return nil, err
+    }
+
+    finish, err := g.srv.admit(g.limiter)
+    if err != nil {
+        return response(req, protocol.ErrorResponse(err))
+    }
+
+    // The response goes out when Call returns, so the slot is given back
+    // in the background once the handler is done
+    resp, wait := g.srv.run(withLimiter(pool.WithOwner(ctx, grpcClient), g.limiter), req)
+    go func() {
+        wait()
+        finish()
+    }()
+    return response(req, resp)
+}
+
+func (g *grpcService) CallStream(ctx context.Context, in *rpc.Request, send func(*rpc.Response) error) error {
+    if err := g.authorize(ctx); err != nil {
+        return err
+    }
+
+    req, err := g.request(in)
+    if err != nil {
+        return err
+    }
+
+    finish, err := g.srv.admit(g.limiter)
+    if err != nil {
+        out, err := response(req, protocol.ErrorResponse(err))
+        if err != nil {
+            return err
+        }
+        return send(out)
+    }
+    defer finish()
+
+    // A gRPC stream takes one send at a time, and nothing may follow the
+    // final response, so a late handler's partials are dropped
+    var sendMu sync.Mutex
+    finished := false
+
+    req.Stream = true
+    req.Partial = func(data any) error {
+        partial := protocol.SuccessResponse(data)
+        partial.Partial = true
+
+        out, err := response(req, partial)
+        if err != nil {
+            return err
+        }
+
+        sendMu.Lock()
+        defer sendMu.Unlock()
+        if finished {
+            return nil
+        }
+        return send(out)
+    }
+
+    resp, wait := g.srv.run(withLimiter(pool.WithOwner(ctx, grpcClient), g.limiter), req)
+    defer wait()
+
+    out, err := response(req, resp)
+    if err != nil {
+        return err
+    }
+
+    sendMu.Lock()
+    defer sendMu.Unlock()
+    finished = true
+    return send(out)
+}
+
+func (g *grpcService) Events(ctx context.Context, sub *rpc.Subscription, send func(*rpc.Event) error) error {
+    if err := g.authorize(ctx); err != nil {
+        return err
+    }
+
+    ch, cancel := g.srv.tenant.events.Subscribe(256)
+    defer cancel()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case <-g.srv.closing:
+            return nil
+        case e := <-ch:
+            if !matchPrefix(e.Type, sub.Types) {
+                continue
+            }
+
+            out := &rpc.Event{
+                Event:      e.Type,
+                Module:     e.Module,
+                Handle:     int32(e.Handle),
+                TimeUnixMS: e.Time.UnixMilli(),
+                TraceID:    e.TraceID,
+            }
+            if e.Data != nil {
+                data, err := json.Marshal(e.Data)
+                if err != nil {
+                    continue
+                }
+                out.Data = data
+            }
+
+            if err := send(out); err != nil {
+                return err
+            }
+        }
+    }
+}
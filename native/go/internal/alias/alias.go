@@ -0,0 +1,179 @@
+package alias
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// API endpoints, overridable for self-hosted SimpleLogin
+var (
+    FastmailSession = "https://api.fastmail.com/jmap/session"
+    SimpleLoginURL  = "https://app.simplelogin.io"
+)
+
+const maskedEmailCapability = "https://www.fastmail.com/dev/maskedemail"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Plus returns address with a +tag subaddress, replacing any existing one.
+// An empty tag gets a random one, for a unique throwaway address.
+func Plus(address, tag string) (string, error) {
+    at := strings.LastIndex(address, "@")
+    if at <= 0 {
+        return "", fmt.Errorf("invalid address: %s", address)
+    }
+    local, domain := address[:at], address[at+1:]
+
+    if plus := strings.Index(local, "+"); plus >= 0 {
+        local = local[:plus]
+    }
+
+    if tag == "" {
+        buf := make([]byte, 4)
+        if _, err := rand.Read(buf); err != nil {
+            return "", fmt.Errorf("failed to generate tag: %w", err)
+        }
+        tag = hex.EncodeToString(buf)
+    }
+    if strings.ContainsAny(tag, "@+ \t\"") {
+        return "", fmt.Errorf("invalid tag: %s", tag)
+    }
+
+    return local + "+" + tag + "@" + domain, nil
+}
+
+// Fastmail creates a masked email address through Fastmail's JMAP API
+func Fastmail(ctx context.Context, token, forDomain, description string) (string, error) {
+    var session struct {
+        APIURL          string            `json:"apiUrl"`
+        PrimaryAccounts map[string]string `json:"primaryAccounts"`
+    }
+    if err := call(ctx, http.MethodGet, FastmailSession, "Bearer "+token, nil, &session); err != nil {
+        return "", fmt.Errorf("fastmail session: %w", err)
+    }
+
+    accountID := session.PrimaryAccounts[maskedEmailCapability]
+    if accountID == "" {
+        return "", fmt.Errorf("fastmail account has no masked email access")
+    }
+
+    request := map[string]any{
+        "using": []string{"urn:ietf:params:jmap:core", maskedEmailCapability},
+        "methodCalls": []any{
+            []any{"MaskedEmail/set", map[string]any{
+                "accountId": accountID,
+                "create": map[string]any{
+                    "new": map[string]any{
+                        "state":       "enabled",
+                        "forDomain":   forDomain,
+                        "description": description,
+                    },
+                },
+            }, "0"},
+        },
+    }
+
+    var response struct {
+        MethodResponses [][]json.RawMessage `json:"methodResponses"`
+    }
+    if err := call(ctx, http.MethodPost, session.APIURL, "Bearer "+token, request, &response); err != nil {
+        return "", fmt.Errorf("fastmail masked email: %w", err)
+    }
+
+    if len(response.MethodResponses) == 0 || len(response.MethodResponses[0]) < 2 {
+        return "", fmt.Errorf("fastmail masked email: empty response")
+    }
+
+    var result struct {
+        Created    map[string]struct{ Email string } `json:"created"`
+        NotCreated map[string]struct {
+            Type        string `json:"type"`
+            Description string `json:"description"`
+        } `json:"notCreated"`
+    }
+    if err := json.Unmarshal(response.MethodResponses[0][1], &result); err != nil {
+        return "", fmt.Errorf("fastmail masked email: %w", err)
+    }
+
+    if failed, ok := result.NotCreated["new"]; ok {
+        return "", fmt.Errorf("fastmail masked email: %s %s", failed.Type, failed.Description)
+    }
+    email := result.Created["new"].Email
+    if email == "" {
+        return "", fmt.Errorf("fastmail masked email: no address returned")
+    }
+
+    return email, nil
+}
+
+// SimpleLogin creates a random alias through the SimpleLogin API
+func SimpleLogin(ctx context.Context, apiKey, hostname, note string) (string, error) {
+    endpoint := strings.TrimSuffix(SimpleLoginURL, "/") + "/api/alias/random/new"
+    if hostname != "" {
+        endpoint += "?hostname=" + url.QueryEscape(hostname)
+    }
+
+    var result struct {
+        Alias string `json:"alias"`
+    }
+    if err := call(ctx, http.MethodPost, endpoint, apiKey, map[string]any{"note": note}, &result); err != nil {
+        return "", fmt.Errorf("simplelogin alias: %w", err)
+    }
+    if result.Alias == "" {
+        return "", fmt.Errorf("simplelogin alias: no address returned")
+    }
+
+    return result.Alias, nil
+}
+
+// call sends a JSON request and decodes the JSON response. Fastmail takes
+// a bearer token in Authorization, SimpleLogin a bare key in Authentication.
+func call(ctx context.Context, method, endpoint, auth string, body, out any) error {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+    if err != nil {
+        return err
+    }
+    if strings.HasPrefix(auth, "Bearer ") {
+        req.Header.Set("Authorization", auth)
+    } else {
+        req.Header.Set("Authentication", auth)
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return err
+    }
+
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+    }
+
+    return json.Unmarshal(data, out)
+}
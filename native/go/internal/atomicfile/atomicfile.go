@@ -0,0 +1,55 @@
+// Package atomicfile replaces files so that a crash leaves either the old
+// contents or the new, never a mix or nothing
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Write replaces path with data through a temporary file in the same
+// directory. The file is synced before the rename and the directory after
+// it, so the rename is on disk too when Write returns. New files get mode
+// 0600.
+func Write(path string, data []byte) error {
+    dir := filepath.Dir(path)
+    tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+
+    return syncDir(dir)
+}
+
+// syncDir flushes a directory's entries. Windows can't open a directory
+// for syncing, and makes renames durable without it.
+func syncDir(dir string) error {
+    if runtime.GOOS == "windows" {
+        return nil
+    }
+
+    d, err := os.Open(dir)
+    if err != nil {
+        return err
+    }
+    defer d.Close()
+
+    return d.Sync()
+}
@@ -0,0 +1,223 @@
+package authfail
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Kind classifies why a server rejected a login
+type Kind string
+
+const (
+    InvalidCredentials  Kind = "invalid_credentials"   // Wrong user name or password
+    AppPasswordRequired Kind = "app_password_required" // Account password refused, app password needed
+    OAuthRequired       Kind = "oauth_required"        // Password logins disabled, OAuth2 needed
+    WebLoginRequired    Kind = "web_login_required"    // Provider wants an interactive browser sign-in
+    AccountLocked       Kind = "account_locked"        // Disabled, suspended or locked by the provider
+    TooManyAttempts     Kind = "too_many_attempts"     // Throttled; retrying now prolongs the lock
+    Temporary           Kind = "temporary"             // Server-side problem, safe to retry later
+    Unknown             Kind = "unknown"
+)
+
+// Error is a classified authentication failure
+type Error struct {
+    Kind     Kind
+    Protocol string // "imap" or "smtp"
+    Response string // Server response text
+    Provider string // Known provider, if any
+    HelpURL  string // Where the user can fix the problem
+}
+
+func (e *Error) Error() string {
+    msg := fmt.Sprintf("%s login failed (%s): %s", e.Protocol, e.Kind, e.Response)
+    if e.HelpURL != "" {
+        msg += " (see " + e.HelpURL + ")"
+    }
+    return msg
+}
+
+// ErrorCode implements the protocol's error coding. Codes for failures with a
+// known remedy name the remedy.
+func (e *Error) ErrorCode() string {
+    switch e.Kind {
+    case AppPasswordRequired:
+        return protocol.CodeAuthNeedsAppPassword
+    case OAuthRequired:
+        return protocol.CodeAuthNeedsOAuth
+    case WebLoginRequired:
+        return protocol.CodeAuthWebLogin
+    case AccountLocked:
+        return protocol.CodeAuthAccountLocked
+    case TooManyAttempts:
+        return protocol.CodeAuthThrottled
+    case Temporary:
+        return protocol.CodeAuthTemporary
+    default:
+        return protocol.CodeAuthFailed
+    }
+}
+
+// ErrorDetails implements the protocol's structured error details
+func (e *Error) ErrorDetails() any {
+    details := map[string]any{
+        "kind":     e.Kind,
+        "protocol": e.Protocol,
+        "response": e.Response,
+    }
+    if e.Provider != "" {
+        details["provider"] = e.Provider
+    }
+    if e.HelpURL != "" {
+        details["help_url"] = e.HelpURL
+    }
+    return details
+}
+
+// Credential reports whether retrying with the same credentials is pointless
+// and risks an account lockout
+func (e *Error) Credential() bool {
+    switch e.Kind {
+    case TooManyAttempts, Temporary:
+        return false
+    default:
+        return true
+    }
+}
+
+// phrases maps provider response fragments to a failure kind, most specific
+// first; matching is case-insensitive
+var phrases = []struct {
+    fragment string
+    kind     Kind
+}{
+    {"basic authentication is disabled", OAuthRequired},
+    {"basicauthblocked", OAuthRequired},
+    {"smtpclientauthentication is disabled", OAuthRequired},
+    {"application-specific password", AppPasswordRequired},
+    {"app password", AppPasswordRequired},
+    {"web browser", WebLoginRequired},
+    {"web login required", WebLoginRequired},
+    {"weblogin", WebLoginRequired},
+    {"too many", TooManyAttempts},
+    {"rate limit", TooManyAttempts},
+    {"try again later", TooManyAttempts},
+    {"locked", AccountLocked},
+    {"suspended", AccountLocked},
+    {"disabled", AccountLocked},
+    {"temporar", Temporary},
+    {"unavailable", Temporary},
+    {"invalid credentials", InvalidCredentials},
+    {"authentication failed", InvalidCredentials},
+    {"login failed", InvalidCredentials},
+    {"incorrect", InvalidCredentials},
+    {"username and password not accepted", InvalidCredentials},
+}
+
+func matchPhrase(text string) Kind {
+    lower := strings.ToLower(text)
+    for _, p := range phrases {
+        if strings.Contains(lower, p.fragment) {
+            return p.kind
+        }
+    }
+    return Unknown
+}
+
+// ClassifyIMAP classifies a tagged NO response to LOGIN or AUTHENTICATE,
+// using its RFC 5530 response code when present
+func ClassifyIMAP(code, text string) *Error {
+    kind := matchPhrase(text)
+
+    if kind == Unknown {
+        switch strings.ToUpper(code) {
+        case "AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED":
+            kind = InvalidCredentials
+        case "EXPIRED", "CONTACTADMIN", "PRIVACYREQUIRED":
+            kind = AccountLocked
+        case "UNAVAILABLE":
+            kind = Temporary
+        case "LIMIT":
+            kind = TooManyAttempts
+        default:
+            kind = InvalidCredentials
+        }
+    }
+
+    return &Error{Kind: kind, Protocol: "imap", Response: text}
+}
+
+// ClassifySMTP classifies an SMTP AUTH rejection by reply code, enhanced
+// status code (RFC 3463) and text
+func ClassifySMTP(code int, text string) *Error {
+    kind := matchPhrase(text)
+
+    if kind == Unknown {
+        switch {
+        case strings.Contains(text, "5.7.9"):
+            kind = AppPasswordRequired
+        case strings.Contains(text, "5.7.14"):
+            kind = WebLoginRequired
+        case code == 454 || code == 421:
+            kind = TooManyAttempts
+        case code >= 400 && code < 500:
+            kind = Temporary
+        default:
+            kind = InvalidCredentials
+        }
+    }
+
+    return &Error{Kind: kind, Protocol: "smtp", Response: text}
+}
+
+// Guard remembers credentials a server has rejected, so the same secret is
+// never retried automatically until the user supplies a new one
+type Guard struct {
+    mu       sync.Mutex
+    rejected map[string]rejection
+}
+
+type rejection struct {
+    secret [sha256.Size]byte
+    err    *Error
+}
+
+// NewGuard creates an empty guard
+func NewGuard() *Guard {
+    return &Guard{
+        rejected: make(map[string]rejection),
+    }
+}
+
+// Check returns the earlier failure if this exact secret was rejected for
+// account, or nil if an attempt may be made
+func (g *Guard) Check(account, secret string) *Error {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    r, ok := g.rejected[account]
+    if !ok || r.secret != sha256.Sum256([]byte(secret)) {
+        return nil
+    }
+    return r.err
+}
+
+// Record notes the outcome of a login attempt. Credential failures are
+// remembered; a success or a new secret clears them.
+func (g *Guard) Record(account, secret string, err *Error) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if err == nil || !err.Credential() {
+        delete(g.rejected, account)
+        return
+    }
+
+    g.rejected[account] = rejection{
+        secret: sha256.Sum256([]byte(secret)),
+        err:    err,
+    }
+}
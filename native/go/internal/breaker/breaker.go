@@ -0,0 +1,164 @@
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Config tunes backoff and the circuit breaker
+type Config struct {
+    BaseDelay time.Duration // Delay after the first failure, doubled per failure
+    MaxDelay  time.Duration // Upper bound for the backoff delay
+    Threshold int           // Consecutive failures that open the circuit
+    OpenFor   time.Duration // Initial time the circuit stays open
+    MaxOpen   time.Duration // Upper bound for the open period
+}
+
+// DefaultConfig keeps login attempts well below typical provider lockout rates
+var DefaultConfig = Config{
+    BaseDelay: time.Second,
+    MaxDelay:  30 * time.Second,
+    Threshold: 5,
+    OpenFor:   time.Minute,
+    MaxOpen:   15 * time.Minute,
+}
+
+// OpenError is returned while a host's circuit is open
+type OpenError struct {
+    Host       string
+    RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+    return fmt.Sprintf("server %s unavailable after repeated failures, retry in %s",
+        e.Host, e.RetryAfter.Round(time.Second))
+}
+
+// ErrorCode implements the protocol's error coding
+func (e *OpenError) ErrorCode() string {
+    return protocol.CodeServerUnavailable
+}
+
+type hostState struct {
+    failures int
+    next     time.Time // No attempt before this time
+    open     bool
+    trial    bool // A half-open trial attempt is in flight
+    opened   int  // Times the circuit opened in a row
+}
+
+// Breaker tracks connection failures per host
+type Breaker struct {
+    mu     sync.Mutex
+    config Config
+    hosts  map[string]*hostState
+}
+
+// New creates a breaker with the given configuration
+func New(config Config) *Breaker {
+    return &Breaker{
+        config: config,
+        hosts:  make(map[string]*hostState),
+    }
+}
+
+// Acquire admits a connection attempt to host. While backing off it waits
+// for the remaining delay, or until ctx is done; while the circuit is open
+// it fails fast with an *OpenError. Once the open period has elapsed a
+// single trial attempt is let through.
+func (b *Breaker) Acquire(ctx context.Context, host string) error {
+    b.mu.Lock()
+    state, ok := b.hosts[host]
+    if !ok {
+        b.mu.Unlock()
+        return nil
+    }
+
+    wait := time.Until(state.next)
+    if state.open {
+        if wait > 0 || state.trial {
+            b.mu.Unlock()
+            if wait < 0 {
+                wait = 0
+            }
+            return &OpenError{Host: host, RetryAfter: wait}
+        }
+        state.trial = true
+        b.mu.Unlock()
+        return nil
+    }
+    b.mu.Unlock()
+
+    if wait <= 0 {
+        return nil
+    }
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Success resets the host's failure state
+func (b *Breaker) Success(host string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    delete(b.hosts, host)
+}
+
+// Failure records a failed attempt, extending the backoff and opening the
+// circuit once the threshold is reached
+func (b *Breaker) Failure(host string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    state, ok := b.hosts[host]
+    if !ok {
+        state = &hostState{}
+        b.hosts[host] = state
+    }
+
+    state.failures++
+    state.trial = false
+
+    if state.failures >= b.config.Threshold {
+        state.open = true
+        state.opened++
+        state.next = time.Now().Add(b.scaled(b.config.OpenFor, state.opened-1, b.config.MaxOpen))
+        return
+    }
+
+    state.next = time.Now().Add(b.scaled(b.config.BaseDelay, state.failures-1, b.config.MaxDelay))
+}
+
+// Report records the outcome of an attempt
+func (b *Breaker) Report(host string, err error) {
+    if err != nil {
+        b.Failure(host)
+        return
+    }
+    b.Success(host)
+}
+
+// scaled doubles base n times, caps it and adds up to 20% jitter so many
+// handles to one host don't retry in lockstep
+func (b *Breaker) scaled(base time.Duration, n int, max time.Duration) time.Duration {
+    d := base
+    for i := 0; i < n && d < max; i++ {
+        d *= 2
+    }
+    if d > max {
+        d = max
+    }
+    return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
@@ -0,0 +1,77 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is an unsolicited notification raised by a module
+type Event struct {
+    Type   string    `json:"type"` // e.g. "network.changed", "connection.lost"
+    Module string    `json:"module,omitempty"`
+    Handle int       `json:"handle,omitempty"`
+    Data   any       `json:"data,omitempty"`
+    Time   time.Time `json:"time"`
+
+    // TraceID is the trace ID of the request that raised the event, if any
+    TraceID string `json:"trace_id,omitempty"`
+}
+
+// Bus fans events out to subscribers
+type Bus struct {
+    mu     sync.RWMutex
+    subs   map[int]chan Event
+    nextID int
+}
+
+// NewBus creates an event bus without subscribers
+func NewBus() *Bus {
+    return &Bus{
+        subs: make(map[int]chan Event),
+    }
+}
+
+// Publish delivers an event to every subscriber. Subscribers that are not
+// keeping up miss the event rather than blocking the publisher.
+func (b *Bus) Publish(e Event) {
+    if b == nil {
+        return
+    }
+    if e.Time.IsZero() {
+        e.Time = time.Now().UTC()
+    }
+
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+
+    for _, ch := range b.subs {
+        select {
+        case ch <- e:
+        default:
+        }
+    }
+}
+
+// Subscribe registers a subscriber with the given buffer size, returning its
+// channel and a function that unsubscribes and closes it
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+    ch := make(chan Event, buffer)
+
+    b.mu.Lock()
+    id := b.nextID
+    b.nextID++
+    b.subs[id] = ch
+    b.mu.Unlock()
+
+    var once sync.Once
+    cancel := func() {
+        once.Do(func() {
+            b.mu.Lock()
+            delete(b.subs, id)
+            b.mu.Unlock()
+            close(ch)
+        })
+    }
+
+    return ch, cancel
+}
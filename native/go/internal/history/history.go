@@ -0,0 +1,157 @@
+package history
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event kinds
+const (
+    Connect   = "connect"
+    TLS       = "tls"
+    Command   = "command"
+    Error     = "error"
+    Reconnect = "reconnect"
+    Close     = "close"
+)
+
+// DefaultSize is how many events are kept per handle
+const DefaultSize = 200
+
+// maxClosed is how many closed handles keep their history, so a timeline
+// survives the frontend closing a connection and opening another
+const maxClosed = 32
+
+// Event is one entry in a handle's timeline
+type Event struct {
+    Time       time.Time `json:"time"`
+    Kind       string    `json:"kind"`
+    Detail     string    `json:"detail,omitempty"`
+    Error      string    `json:"error,omitempty"`
+    DurationMs float64   `json:"duration_ms,omitempty"`
+}
+
+// timeline is a ring of a handle's most recent events
+type timeline struct {
+    events  []Event
+    next    int // Where the next event goes once the ring is full
+    dropped int // Events overwritten so far
+    closed  bool
+}
+
+// Recorder keeps a bounded event history per connection handle, for
+// diagnosing accounts that keep disconnecting
+type Recorder struct {
+    mu      sync.Mutex
+    size    int
+    handles map[int]*timeline
+    closed  []int // Closed handles, oldest first
+}
+
+// New creates a recorder keeping size events per handle
+func New(size int) *Recorder {
+    if size < 1 {
+        size = DefaultSize
+    }
+    return &Recorder{size: size, handles: make(map[int]*timeline)}
+}
+
+// Record appends an event to a handle's timeline, stamping it if need be.
+// Handle 0 is ignored.
+func (r *Recorder) Record(handle int, event Event) {
+    if handle == 0 {
+        return
+    }
+    if event.Time.IsZero() {
+        event.Time = time.Now().UTC()
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    t, ok := r.handles[handle]
+    if !ok {
+        t = &timeline{}
+        r.handles[handle] = t
+    }
+
+    if len(t.events) < r.size {
+        t.events = append(t.events, event)
+        return
+    }
+    t.events[t.next] = event
+    t.next = (t.next + 1) % r.size
+    t.dropped++
+}
+
+// Fail records a failed step, or nothing if err is nil
+func (r *Recorder) Fail(handle int, detail string, err error) {
+    if err == nil {
+        return
+    }
+    r.Record(handle, Event{Kind: Error, Detail: detail, Error: err.Error()})
+}
+
+// Closed records that a handle was closed. Its history is kept for the
+// most recent closed handles only.
+func (r *Recorder) Closed(handle int) {
+    r.Record(handle, Event{Kind: Close})
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    t, ok := r.handles[handle]
+    if !ok || t.closed {
+        return
+    }
+    t.closed = true
+    r.closed = append(r.closed, handle)
+
+    for len(r.closed) > maxClosed {
+        delete(r.handles, r.closed[0])
+        r.closed = r.closed[1:]
+    }
+}
+
+// Events returns a handle's timeline, oldest first, with how many older
+// events were dropped. ok is false for a handle never seen or long closed.
+func (r *Recorder) Events(handle int) (events []Event, dropped int, closed, ok bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    t, ok := r.handles[handle]
+    if !ok {
+        return nil, 0, false, false
+    }
+
+    events = make([]Event, 0, len(t.events))
+    events = append(events, t.events[t.next:]...)
+    events = append(events, t.events[:t.next]...)
+    return events, t.dropped, t.closed, true
+}
+
+// TLSEvent describes a negotiated TLS session
+func TLSEvent(state tls.ConnectionState) Event {
+    parts := []string{
+        tls.VersionName(state.Version),
+        tls.CipherSuiteName(state.CipherSuite),
+    }
+    if state.NegotiatedProtocol != "" {
+        parts = append(parts, "alpn "+state.NegotiatedProtocol)
+    }
+    if state.DidResume {
+        parts = append(parts, "resumed")
+    }
+    if len(state.PeerCertificates) > 0 {
+        cert := state.PeerCertificates[0]
+        parts = append(parts,
+            fmt.Sprintf("certificate %q", cert.Subject.CommonName),
+            "issued by "+cert.Issuer.CommonName,
+            "expires "+cert.NotAfter.UTC().Format(time.RFC3339),
+        )
+    }
+    return Event{Kind: TLS, Detail: strings.Join(parts, ", ")}
+}
@@ -0,0 +1,103 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// DefaultWindow is how long a response is kept for replay
+const DefaultWindow = 10 * time.Minute
+
+// maxEntries bounds how many keys are remembered at once
+const maxEntries = 10000
+
+// Cache replays the response of a request retried with the same idempotency
+// key, so a client that lost a response can retry a side effect, such as a
+// send, without repeating it
+type Cache struct {
+    mu      sync.Mutex
+    window  time.Duration
+    entries map[string]*entry
+}
+
+// entry is one key's request and, once done, its response
+type entry struct {
+    request string // What the key was first used for, as module.action
+    done    chan struct{}
+    resp    protocol.Response
+    expires time.Time // Zero while running
+}
+
+// New creates a cache keeping responses for window
+func New(window time.Duration) *Cache {
+    return &Cache{
+        window:  window,
+        entries: make(map[string]*entry),
+    }
+}
+
+// Do runs fn unless key was used within the window, returning the first
+// run's response instead, after waiting for it if it is still running.
+// replayed is set when the response came from an earlier run.
+//
+// fn runs to completion even if ctx ends first, so that its outcome is
+// there for the retry; fn must bound itself. Failed responses are not kept,
+// so a retry after a failure runs again.
+func (c *Cache) Do(ctx context.Context, key, request string, fn func() protocol.Response) (resp protocol.Response, replayed bool) {
+    c.mu.Lock()
+    c.prune(time.Now())
+
+    e, ok := c.entries[key]
+    if !ok {
+        if len(c.entries) >= maxEntries {
+            c.mu.Unlock()
+            return protocol.ErrorResponse(errors.New("too many idempotency keys in use")), false
+        }
+
+        e = &entry{request: request, done: make(chan struct{})}
+        c.entries[key] = e
+        go c.run(key, e, fn)
+    }
+    c.mu.Unlock()
+
+    if e.request != request {
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest,
+            fmt.Errorf("idempotency key was already used for %s", e.request))), false
+    }
+
+    select {
+    case <-e.done:
+        return e.resp, ok
+    case <-ctx.Done():
+        return protocol.ErrorResponse(ctx.Err()), false
+    }
+}
+
+// run runs a key's request and records its response
+func (c *Cache) run(key string, e *entry, fn func() protocol.Response) {
+    resp := fn()
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    e.resp = resp
+    e.expires = time.Now().Add(c.window)
+    if !resp.Success {
+        delete(c.entries, key)
+    }
+    close(e.done)
+}
+
+// prune forgets finished entries past their window
+func (c *Cache) prune(now time.Time) {
+    for key, e := range c.entries {
+        if !e.expires.IsZero() && now.After(e.expires) {
+            delete(c.entries, key)
+        }
+    }
+}
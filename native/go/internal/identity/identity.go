@@ -0,0 +1,201 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// ErrNotFound is returned for unknown identity IDs
+var ErrNotFound = errors.New("identity not found")
+
+// Identity is an address a user may send as
+type Identity struct {
+    ID          string `json:"id"`
+    DisplayName string `json:"display_name,omitempty"`
+    Address     string `json:"address"`
+    Signature   string `json:"signature,omitempty"`
+    ReplyTo     string `json:"reply_to,omitempty"`
+
+    // Account is the SMTP account ("user@host") allowed to send as this
+    // identity
+    Account string `json:"account"`
+}
+
+// MismatchError reports a From address no identity allows on an account
+type MismatchError struct {
+    From    string
+    Account string
+    Reason  string
+}
+
+func (e *MismatchError) Error() string {
+    return fmt.Sprintf("cannot send as %s from %s: %s", e.From, e.Account, e.Reason)
+}
+
+func (e *MismatchError) ErrorCode() string {
+    return protocol.CodeIdentityMismatch
+}
+
+func (e *MismatchError) ErrorDetails() any {
+    return map[string]any{"from": e.From, "account": e.Account}
+}
+
+// Store persists identities in a single JSON file
+type Store struct {
+    mu   sync.Mutex
+    path string
+}
+
+// Open opens (creating the directory if needed) an identity store at path
+func Open(path string) (*Store, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, fmt.Errorf("failed to create identity store: %w", err)
+    }
+
+    return &Store{path: path}, nil
+}
+
+// List returns all identities
+func (s *Store) List() ([]Identity, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.read()
+}
+
+// Put adds an identity or replaces the one with the same ID
+func (s *Store) Put(id Identity) error {
+    if id.ID == "" || id.Address == "" || id.Account == "" {
+        return fmt.Errorf("identity needs an id, address and account")
+    }
+    if _, err := mail.ParseAddress(id.Address); err != nil {
+        return fmt.Errorf("invalid identity address %q: %w", id.Address, err)
+    }
+    if id.ReplyTo != "" {
+        if _, err := mail.ParseAddress(id.ReplyTo); err != nil {
+            return fmt.Errorf("invalid reply-to address %q: %w", id.ReplyTo, err)
+        }
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids, err := s.read()
+    if err != nil {
+        return err
+    }
+
+    replaced := false
+    for i := range ids {
+        if ids[i].ID == id.ID {
+            ids[i] = id
+            replaced = true
+        }
+    }
+    if !replaced {
+        ids = append(ids, id)
+    }
+
+    return s.write(ids)
+}
+
+// Remove deletes an identity
+func (s *Store) Remove(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids, err := s.read()
+    if err != nil {
+        return err
+    }
+
+    kept := ids[:0]
+    for _, identity := range ids {
+        if identity.ID != id {
+            kept = append(kept, identity)
+        }
+    }
+    if len(kept) == len(ids) {
+        return ErrNotFound
+    }
+
+    return s.write(kept)
+}
+
+// Check validates sending from envelope address from with the given raw
+// header From on account. Accounts without identities are unrestricted; otherwise
+// both addresses must belong to one of the account's identities. It returns
+// the matching identity, if any.
+func (s *Store) Check(account, from, headerFrom string) (*Identity, error) {
+    ids, err := s.List()
+    if err != nil {
+        return nil, err
+    }
+
+    var allowed []Identity
+    for _, id := range ids {
+        if strings.EqualFold(id.Account, account) {
+            allowed = append(allowed, id)
+        }
+    }
+    if len(allowed) == 0 {
+        return nil, nil
+    }
+
+    // A From header that can't be parsed could name anyone to the reader
+    if headerFrom != "" {
+        addr, err := mail.ParseAddress(headerFrom)
+        if err != nil {
+            return nil, &MismatchError{From: headerFrom, Account: account, Reason: "header From is not a single valid address"}
+        }
+        if !strings.EqualFold(addr.Address, from) {
+            return nil, &MismatchError{From: addr.Address, Account: account, Reason: "header From differs from envelope sender " + from}
+        }
+    }
+
+    for i := range allowed {
+        if strings.EqualFold(allowed[i].Address, from) {
+            return &allowed[i], nil
+        }
+    }
+
+    return nil, &MismatchError{From: from, Account: account, Reason: "no identity on this account uses that address"}
+}
+
+func (s *Store) read() ([]Identity, error) {
+    data, err := os.ReadFile(s.path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    var ids []Identity
+    if err := json.Unmarshal(data, &ids); err != nil {
+        return nil, fmt.Errorf("corrupt identity store: %w", err)
+    }
+    return ids, nil
+}
+
+// write stores identities atomically
+func (s *Store) write(ids []Identity) error {
+    data, err := json.MarshalIndent(ids, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := atomicfile.Write(s.path, data); err != nil {
+        return fmt.Errorf("failed to write identity store: %w", err)
+    }
+    return nil
+}
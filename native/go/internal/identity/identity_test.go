@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+    s, err := Open(filepath.Join(t.TempDir(), "identities.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Put(Identity{ID: "work", Address: "me@example.com", Account: "me@example.com"}); err != nil {
+        t.Fatalf("Put: %v", err)
+    }
+
+    tests := []struct {
+        name       string
+        account    string
+        from       string
+        headerFrom string
+        allowed    bool
+    }{
+        {"identity", "me@example.com", "me@example.com", "Me <me@example.com>", true},
+        {"no header From", "me@example.com", "me@example.com", "", true},
+        {"unrestricted account", "other@example.com", "anyone@example.com", "anyone@example.com", true},
+        {"unknown sender", "me@example.com", "boss@example.com", "boss@example.com", false},
+        {"header differs", "me@example.com", "me@example.com", "Boss <boss@example.com>", false},
+        {"malformed header", "me@example.com", "me@example.com", "Boss <boss@example.com", false},
+        {"several addresses", "me@example.com", "me@example.com", "me@example.com, boss@example.com", false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := s.Check(tt.account, tt.from, tt.headerFrom)
+            if tt.allowed && err != nil {
+                t.Errorf("Check: %v", err)
+            }
+
+            var mismatch *MismatchError
+            if !tt.allowed && !errors.As(err, &mismatch) {
+                t.Errorf("Check gave %v, want a mismatch", err)
+            }
+        })
+    }
+}
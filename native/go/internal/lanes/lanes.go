@@ -0,0 +1,141 @@
+package lanes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lanes a request may run in. Interactive is the default, for anything the
+// user is waiting on; bulk is for background syncs, which give way to it.
+const (
+    Interactive = "interactive"
+    Bulk        = "bulk"
+)
+
+// ErrUnknownLane rejects a priority other than Interactive or Bulk
+var ErrUnknownLane = errors.New("unknown priority")
+
+// DefaultMaxBulk is how many bulk requests run at once
+const DefaultMaxBulk = 2
+
+// maxYield bounds how long bulk work waits for interactive requests at a
+// time, so a slow interactive request can't stall a sync outright
+const maxYield = 2 * time.Second
+
+type laneKey struct{}
+
+// entered is what a request's context records about its lane
+type entered struct {
+    d    *Dispatcher
+    lane string
+}
+
+// Dispatcher runs requests in two lanes. Interactive requests start at once;
+// bulk requests are limited in number and pause between batches while any
+// interactive request is running, so a UI action waits for at most one
+// batch of a sync instead of all of it.
+type Dispatcher struct {
+    mu          sync.Mutex
+    interactive int
+    idle        chan struct{} // Closed while no interactive request runs
+
+    bulk chan struct{} // Slots for running bulk requests
+}
+
+// New creates a dispatcher running up to maxBulk bulk requests at once
+func New(maxBulk int) *Dispatcher {
+    idle := make(chan struct{})
+    close(idle)
+
+    return &Dispatcher{
+        idle: idle,
+        bulk: make(chan struct{}, maxBulk),
+    }
+}
+
+// Enter admits a request to its lane, waiting for a bulk slot if need be.
+// The returned context carries the lane for Yield; leave must be called
+// when the request finishes.
+func (d *Dispatcher) Enter(ctx context.Context, lane string) (context.Context, func(), error) {
+    switch lane {
+    case "", Interactive:
+        d.mu.Lock()
+        if d.interactive == 0 {
+            d.idle = make(chan struct{})
+        }
+        d.interactive++
+        d.mu.Unlock()
+
+        var once sync.Once
+        leave := func() {
+            once.Do(func() {
+                d.mu.Lock()
+                d.interactive--
+                if d.interactive == 0 {
+                    close(d.idle)
+                }
+                d.mu.Unlock()
+            })
+        }
+        return context.WithValue(ctx, laneKey{}, entered{d: d, lane: Interactive}), leave, nil
+
+    case Bulk:
+        select {
+        case d.bulk <- struct{}{}:
+        case <-ctx.Done():
+            return nil, nil, ctx.Err()
+        }
+
+        ctx = context.WithValue(ctx, laneKey{}, entered{d: d, lane: Bulk})
+        var once sync.Once
+        leave := func() {
+            once.Do(func() { <-d.bulk })
+        }
+
+        // Don't start in the middle of interactive work either
+        if err := Yield(ctx); err != nil {
+            leave()
+            return nil, nil, err
+        }
+        return ctx, leave, nil
+
+    default:
+        return nil, nil, fmt.Errorf("%w: %s", ErrUnknownLane, lane)
+    }
+}
+
+// Running returns how many interactive and bulk requests are running
+func (d *Dispatcher) Running() (interactive, bulk int) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    return d.interactive, len(d.bulk)
+}
+
+// Yield is called by bulk work between batches. In the bulk lane it waits
+// while interactive requests are running, up to maxYield; otherwise it
+// returns at once. Either way it returns ctx's error, if any, so it can
+// stand in for a ctx.Err check.
+func Yield(ctx context.Context) error {
+    e, ok := ctx.Value(laneKey{}).(entered)
+    if !ok || e.lane != Bulk {
+        return ctx.Err()
+    }
+
+    e.d.mu.Lock()
+    idle := e.d.idle
+    e.d.mu.Unlock()
+
+    timer := time.NewTimer(maxYield)
+    defer timer.Stop()
+
+    select {
+    case <-idle:
+    case <-timer.C:
+    case <-ctx.Done():
+    }
+    return ctx.Err()
+}
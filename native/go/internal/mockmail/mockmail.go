@@ -0,0 +1,152 @@
+package mockmail
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// Credentials both servers accept. The INBOX starts with one message.
+const (
+    Username = "username"
+    Password = "password"
+)
+
+// Server is a mock IMAP server, with an SMTP server that delivers every
+// message it accepts to the IMAP INBOX. Both listen on localhost only.
+type Server struct {
+    IMAPPort int
+    SMTPPort int
+    CertPEM  []byte // Self-signed certificate for localhost, to be trusted
+
+    backend *updatingBackend
+    imap    *server.Server
+    smtp    net.Listener
+}
+
+// Start runs both servers on free ports
+func Start() (*Server, error) {
+    cert, certPEM, err := selfSigned()
+    if err != nil {
+        return nil, fmt.Errorf("failed to create certificate: %w", err)
+    }
+
+    be := &updatingBackend{Backend: memory.New(), updates: make(chan backend.Update, 16)}
+    imapListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen for IMAP: %w", err)
+    }
+    smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        imapListener.Close()
+        return nil, fmt.Errorf("failed to listen for SMTP: %w", err)
+    }
+
+    imapServer := server.New(be)
+    imapServer.ErrorLog = log.New(io.Discard, "", 0)
+    go imapServer.Serve(imapListener)
+
+    s := &Server{
+        IMAPPort: imapListener.Addr().(*net.TCPAddr).Port,
+        SMTPPort: smtpListener.Addr().(*net.TCPAddr).Port,
+        CertPEM:  certPEM,
+        backend:  be,
+        imap:     imapServer,
+        smtp:     smtpListener,
+    }
+    go s.serveSMTP()
+    return s, nil
+}
+
+// Close stops both servers
+func (s *Server) Close() {
+    s.smtp.Close()
+    s.imap.Close()
+}
+
+// updatingBackend tells IDLE clients about delivered messages, which the
+// memory backend alone doesn't
+type updatingBackend struct {
+    *memory.Backend
+    mu      sync.Mutex // Serialises deliveries
+    updates chan backend.Update
+}
+
+func (b *updatingBackend) Updates() <-chan backend.Update {
+    return b.updates
+}
+
+// deliver appends a message to the INBOX and announces it
+func (b *updatingBackend) deliver(raw []byte) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    user, err := b.Login(nil, Username, Password)
+    if err != nil {
+        return err
+    }
+    mbox, err := user.GetMailbox("INBOX")
+    if err != nil {
+        return err
+    }
+    if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBuffer(raw)); err != nil {
+        return err
+    }
+
+    status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+    if err != nil {
+        return err
+    }
+    update := &backend.MailboxUpdate{Update: backend.NewUpdate(Username, "INBOX"), MailboxStatus: status}
+    select {
+    case b.updates <- update:
+    default:
+    }
+    return nil
+}
+
+// selfSigned creates a short-lived certificate for localhost that is its
+// own root
+func selfSigned() (tls.Certificate, []byte, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{CommonName: "localhost"},
+        DNSNames:              []string{"localhost"},
+        IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+        NotBefore:             time.Now().Add(-time.Minute),
+        NotAfter:              time.Now().Add(24 * time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return tls.Certificate{}, nil, err
+    }
+
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM, nil
+}
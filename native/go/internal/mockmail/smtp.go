@@ -0,0 +1,121 @@
+package mockmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+	"time"
+)
+
+// smtpTimeout drops a client that stops talking
+const smtpTimeout = 30 * time.Second
+
+// serveSMTP accepts SMTP clients until the listener closes
+func (s *Server) serveSMTP() {
+    for {
+        conn, err := s.smtp.Accept()
+        if err != nil {
+            return
+        }
+        go s.smtpSession(conn)
+    }
+}
+
+// smtpSession speaks just enough SMTP for a client that authenticates with
+// PLAIN and sends. There is no STARTTLS; clients allow PLAIN without TLS
+// on localhost.
+func (s *Server) smtpSession(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    reply := func(lines ...string) {
+        conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+    }
+    readLine := func() (string, bool) {
+        conn.SetDeadline(time.Now().Add(smtpTimeout))
+        line, err := r.ReadString('\n')
+        return strings.TrimRight(line, "\r\n"), err == nil
+    }
+
+    reply("220 localhost mock ESMTP")
+    authenticated := false
+    for {
+        line, ok := readLine()
+        if !ok {
+            return
+        }
+        verb, arg, _ := strings.Cut(line, " ")
+
+        switch strings.ToUpper(verb) {
+        case "EHLO":
+            reply("250-localhost", "250-AUTH PLAIN", "250 8BITMIME")
+        case "HELO":
+            reply("250 localhost")
+        case "AUTH":
+            mech, initial, _ := strings.Cut(arg, " ")
+            if !strings.EqualFold(mech, "PLAIN") {
+                reply("504 unsupported mechanism")
+                continue
+            }
+            if initial == "" {
+                reply("334 ")
+                if initial, ok = readLine(); !ok {
+                    return
+                }
+            }
+            if validPlain(initial) {
+                authenticated = true
+                reply("235 authenticated")
+            } else {
+                reply("535 authentication failed")
+            }
+        case "MAIL", "RCPT":
+            if !authenticated {
+                reply("530 authentication required")
+                continue
+            }
+            reply("250 ok")
+        case "DATA":
+            if !authenticated {
+                reply("530 authentication required")
+                continue
+            }
+            reply("354 end with .")
+            var msg bytes.Buffer
+            for {
+                line, ok := readLine()
+                if !ok {
+                    return
+                }
+                if line == "." {
+                    break
+                }
+                msg.WriteString(strings.TrimPrefix(line, "."))
+                msg.WriteString("\r\n")
+            }
+            if err := s.backend.deliver(msg.Bytes()); err != nil {
+                reply("451 " + err.Error())
+                continue
+            }
+            reply("250 delivered")
+        case "RSET", "NOOP":
+            reply("250 ok")
+        case "QUIT":
+            reply("221 bye")
+            return
+        default:
+            reply("502 not implemented")
+        }
+    }
+}
+
+// validPlain checks a base64 PLAIN response against the credentials
+func validPlain(encoded string) bool {
+    decoded, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return false
+    }
+    parts := strings.Split(string(decoded), "\x00")
+    return len(parts) == 3 && parts[1] == Username && parts[2] == Password
+}
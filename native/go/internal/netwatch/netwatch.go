@@ -0,0 +1,122 @@
+package netwatch
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Watcher reports changes to the host's network configuration: interfaces
+// or addresses appearing and disappearing, route changes where the platform
+// can report them, and wake-ups after sleep
+type Watcher struct {
+    interval time.Duration
+    debounce time.Duration
+    changes  chan string
+}
+
+// New creates a watcher that polls every interval in addition to any
+// platform notifications
+func New(interval time.Duration) *Watcher {
+    return &Watcher{
+        interval: interval,
+        debounce: time.Second,
+        changes:  make(chan string, 1),
+    }
+}
+
+// Changes delivers the reason for each detected change; bursts of platform
+// notifications are coalesced
+func (w *Watcher) Changes() <-chan string {
+    return w.changes
+}
+
+// Run watches until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+    notify := make(chan struct{}, 1)
+    subscribe(ctx, func() {
+        select {
+        case notify <- struct{}{}:
+        default:
+        }
+    })
+
+    ticker := time.NewTicker(w.interval)
+    defer ticker.Stop()
+
+    last := fingerprint()
+    lastTick := time.Now().Round(0)
+    var pending *time.Timer
+    var pendingC <-chan time.Time
+
+    for {
+        select {
+        case <-ctx.Done():
+            if pending != nil {
+                pending.Stop()
+            }
+            return
+        case now := <-ticker.C:
+            // The monotonic clock stops while suspended on Linux and macOS,
+            // but the wall clock doesn't, so a tick far too late by the wall
+            // clock means the machine slept. Round(0) strips the monotonic
+            // reading that Sub would otherwise use.
+            now = now.Round(0)
+            slept := now.Sub(lastTick) > 3*w.interval
+            lastTick = now
+
+            current := fingerprint()
+            if slept {
+                last = current
+                w.emit("wake")
+            } else if current != last {
+                last = current
+                w.emit("interfaces")
+            }
+        case <-notify:
+            if pending == nil {
+                pending = time.NewTimer(w.debounce)
+                pendingC = pending.C
+            }
+        case <-pendingC:
+            pending = nil
+            pendingC = nil
+            last = fingerprint()
+            w.emit("route")
+        }
+    }
+}
+
+func (w *Watcher) emit(reason string) {
+    select {
+    case w.changes <- reason:
+    default:
+    }
+}
+
+// fingerprint summarises the addresses of all interfaces that are up
+func fingerprint() string {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return ""
+    }
+
+    var parts []string
+    for _, iface := range ifaces {
+        if iface.Flags&net.FlagUp == 0 {
+            continue
+        }
+        addrs, err := iface.Addrs()
+        if err != nil {
+            continue
+        }
+        for _, addr := range addrs {
+            parts = append(parts, iface.Name+"="+addr.String())
+        }
+    }
+
+    sort.Strings(parts)
+    return strings.Join(parts, ",")
+}
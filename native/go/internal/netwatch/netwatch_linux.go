@@ -0,0 +1,61 @@
+//go:build linux
+
+package netwatch
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+)
+
+// rtnetlink multicast groups (linux/rtnetlink.h)
+const (
+    rtmgrpLink       = 0x1
+    rtmgrpIPv4IfAddr = 0x10
+    rtmgrpIPv4Route  = 0x40
+    rtmgrpIPv6IfAddr = 0x100
+    rtmgrpIPv6Route  = 0x400
+)
+
+// subscribe listens for link, address and route changes on a netlink socket
+func subscribe(ctx context.Context, notify func()) {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        log.Printf("netwatch: netlink unavailable, polling only: %v", err)
+        return
+    }
+
+    addr := &syscall.SockaddrNetlink{
+        Family: syscall.AF_NETLINK,
+        Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv4Route | rtmgrpIPv6IfAddr | rtmgrpIPv6Route,
+    }
+    if err := syscall.Bind(fd, addr); err != nil {
+        syscall.Close(fd)
+        log.Printf("netwatch: netlink bind failed, polling only: %v", err)
+        return
+    }
+
+    // A non-blocking descriptor lets the runtime poller interrupt Read on Close
+    if err := syscall.SetNonblock(fd, true); err != nil {
+        syscall.Close(fd)
+        log.Printf("netwatch: netlink setup failed, polling only: %v", err)
+        return
+    }
+    sock := os.NewFile(uintptr(fd), "netlink")
+
+    go func() {
+        <-ctx.Done()
+        sock.Close()
+    }()
+
+    go func() {
+        buf := make([]byte, 8192)
+        for {
+            if _, err := sock.Read(buf); err != nil {
+                return
+            }
+            notify()
+        }
+    }()
+}
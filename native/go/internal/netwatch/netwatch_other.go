@@ -0,0 +1,9 @@
+//go:build !linux
+
+package netwatch
+
+import "context"
+
+// subscribe has no platform notification source here; changes are picked up
+// by interface polling and sleep detection alone
+func subscribe(ctx context.Context, notify func()) {}
@@ -0,0 +1,280 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+	"github.com/rdawebb/kernel/native/internal/events"
+)
+
+// flushInterval is how often the end of quiet hours is checked for
+const flushInterval = time.Minute
+
+// weekdays names days as windows list them
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a daily quiet period in local time. End may be before Start for
+// a window running past midnight, which belongs to the day it starts on.
+type Window struct {
+    Start string   `json:"start"`          // "22:00"
+    End   string   `json:"end"`            // "07:00"
+    Days  []string `json:"days,omitempty"` // "mon" to "sun"; every day if empty
+}
+
+// Policy is how new-mail notifications are delivered
+type Policy struct {
+    Quiet []Window `json:"quiet"`
+
+    // Digest summarises the mail held back in quiet hours in one
+    // mail.digest event once they end; otherwise it is dropped
+    Digest bool `json:"digest"`
+}
+
+// FolderDigest is the mail held back for one folder
+type FolderDigest struct {
+    Module string   `json:"module"`
+    Handle int      `json:"handle"`
+    Folder string   `json:"folder"`
+    UIDs   []uint32 `json:"uids"`
+}
+
+// Digest is the payload of mail.digest events
+type Digest struct {
+    Since   time.Time      `json:"since"`
+    Until   time.Time      `json:"until"`
+    Total   int            `json:"total"`
+    Folders []FolderDigest `json:"folders"`
+}
+
+// Notifier publishes new-mail events, holding them back in quiet hours.
+// The policy is saved, so it applies even while the frontend is asleep.
+type Notifier struct {
+    mu     sync.Mutex
+    path   string
+    policy Policy
+    bus    *events.Bus
+
+    since   time.Time // When the first held-back mail arrived
+    pending map[string]*FolderDigest
+}
+
+// Open loads the policy saved at path, if any
+func Open(path string, bus *events.Bus) (*Notifier, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, fmt.Errorf("failed to create notification settings: %w", err)
+    }
+
+    n := &Notifier{path: path, bus: bus, pending: make(map[string]*FolderDigest)}
+
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(data, &n.policy); err != nil {
+            return nil, fmt.Errorf("corrupt notification settings: %w", err)
+        }
+    }
+
+    return n, nil
+}
+
+// Policy returns the current policy
+func (n *Notifier) Policy() Policy {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+
+    return n.policy
+}
+
+// SetPolicy validates, saves and applies a policy
+func (n *Notifier) SetPolicy(policy Policy) error {
+    for i, w := range policy.Quiet {
+        if _, err := parseClock(w.Start); err != nil {
+            return fmt.Errorf("quiet window %d: %w", i, err)
+        }
+        if _, err := parseClock(w.End); err != nil {
+            return fmt.Errorf("quiet window %d: %w", i, err)
+        }
+        for _, day := range w.Days {
+            if weekday(day) < 0 {
+                return fmt.Errorf("quiet window %d: unknown day %q", i, day)
+            }
+        }
+    }
+    if policy.Quiet == nil {
+        policy.Quiet = []Window{}
+    }
+
+    data, err := json.MarshalIndent(policy, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := atomicfile.Write(n.path, data); err != nil {
+        return fmt.Errorf("failed to write notification settings: %w", err)
+    }
+
+    n.mu.Lock()
+    n.policy = policy
+    n.mu.Unlock()
+
+    // Mail held back under the old policy may no longer be in quiet hours
+    n.flush(time.Now())
+    return nil
+}
+
+// NewMail announces new messages with a mail.new event, or holds them for
+// the digest in quiet hours
+func (n *Notifier) NewMail(module string, handle int, folder string, uids []uint32) {
+    if len(uids) == 0 {
+        return
+    }
+
+    now := time.Now()
+
+    n.mu.Lock()
+    if !n.policy.quiet(now) {
+        n.mu.Unlock()
+        n.bus.Publish(events.Event{
+            Type:   "mail.new",
+            Module: module,
+            Handle: handle,
+            Data:   map[string]any{"folder": folder, "uids": uids},
+        })
+        return
+    }
+    defer n.mu.Unlock()
+
+    if !n.policy.Digest {
+        return
+    }
+    if len(n.pending) == 0 {
+        n.since = now
+    }
+
+    key := fmt.Sprintf("%s/%d/%s", module, handle, folder)
+    fd, ok := n.pending[key]
+    if !ok {
+        fd = &FolderDigest{Module: module, Handle: handle, Folder: folder}
+        n.pending[key] = fd
+    }
+    fd.UIDs = append(fd.UIDs, uids...)
+}
+
+// Run publishes the digest when quiet hours end, until ctx is cancelled
+func (n *Notifier) Run(ctx context.Context) {
+    ticker := time.NewTicker(flushInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            n.flush(now)
+        }
+    }
+}
+
+// flush publishes held-back mail as a mail.digest event once quiet hours
+// are over
+func (n *Notifier) flush(now time.Time) {
+    n.mu.Lock()
+    if len(n.pending) == 0 || n.policy.quiet(now) {
+        n.mu.Unlock()
+        return
+    }
+
+    digest := Digest{Since: n.since, Until: now, Folders: make([]FolderDigest, 0, len(n.pending))}
+    for _, fd := range n.pending {
+        digest.Total += len(fd.UIDs)
+        digest.Folders = append(digest.Folders, *fd)
+    }
+    n.pending = make(map[string]*FolderDigest)
+    n.mu.Unlock()
+
+    sort.Slice(digest.Folders, func(i, j int) bool {
+        return len(digest.Folders[i].UIDs) > len(digest.Folders[j].UIDs)
+    })
+
+    n.bus.Publish(events.Event{Type: "mail.digest", Data: digest})
+}
+
+// quiet reports whether t falls in any quiet window
+func (p Policy) quiet(t time.Time) bool {
+    for _, w := range p.Quiet {
+        if w.contains(t) {
+            return true
+        }
+    }
+    return false
+}
+
+// contains reports whether t falls in the window, on one of its days
+func (w Window) contains(t time.Time) bool {
+    start, err := parseClock(w.Start)
+    if err != nil {
+        return false
+    }
+    end, err := parseClock(w.End)
+    if err != nil {
+        return false
+    }
+
+    now := t.Hour()*60 + t.Minute()
+    day := t.Weekday()
+
+    switch {
+    case start == end:
+        return false
+    case start < end:
+        return now >= start && now < end && w.onDay(day)
+    case now >= start:
+        return w.onDay(day)
+    case now < end:
+        // Past midnight, so the window started yesterday
+        return w.onDay((day + 6) % 7)
+    }
+    return false
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+    if len(w.Days) == 0 {
+        return true
+    }
+    for _, d := range w.Days {
+        if weekday(d) == int(day) {
+            return true
+        }
+    }
+    return false
+}
+
+// parseClock parses "HH:MM" into minutes after midnight
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// weekday returns a day name's index, or -1
+func weekday(name string) int {
+    name = strings.ToLower(name)
+    for i, d := range weekdays {
+        if name == d {
+            return i
+        }
+    }
+    return -1
+}
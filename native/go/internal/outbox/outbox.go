@@ -0,0 +1,326 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+)
+
+// Entry states
+const (
+    StatePending     = "pending"     // Not yet accepted by the SMTP server
+    StateTransmitted = "transmitted" // Sent, but the Sent-folder copy is missing
+)
+
+// ErrNotFound is returned for unknown entry IDs
+var ErrNotFound = errors.New("outbox entry not found")
+
+// Entry is a composed message waiting to be sent and filed
+type Entry struct {
+    ID         string    `json:"id"`
+    From       string    `json:"from"`
+    To         []string  `json:"to"`
+    Delivered  []string  `json:"delivered,omitempty"` // Recipients that already accepted the message
+    Message    []byte    `json:"message,omitempty"`
+    SentFolder string    `json:"sent_folder,omitempty"`
+    SaveSent   bool      `json:"save_sent,omitempty"`
+    State      string    `json:"state"`
+    Attempts   int       `json:"attempts"`
+    LastError  string    `json:"last_error,omitempty"`
+    SendAt     time.Time `json:"send_at,omitempty"` // Held until then (undo window or send-later)
+    CreatedAt  time.Time `json:"created_at"`
+    UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Due reports whether an entry may be sent at now
+func (e *Entry) Due(now time.Time) bool {
+    return e.SendAt.IsZero() || !now.Before(e.SendAt)
+}
+
+// Remaining returns the recipients the message still has to reach
+func (e *Entry) Remaining() []string {
+    if len(e.Delivered) == 0 {
+        return e.To
+    }
+
+    delivered := make(map[string]bool, len(e.Delivered))
+    for _, address := range e.Delivered {
+        delivered[strings.ToLower(address)] = true
+    }
+
+    var remaining []string
+    for _, address := range e.To {
+        if !delivered[strings.ToLower(address)] {
+            remaining = append(remaining, address)
+        }
+    }
+    return remaining
+}
+
+// Outbox persists entries as one JSON file each, so a message survives a
+// crash at any point between compose and the Sent-folder append
+type Outbox struct {
+    mu  sync.Mutex
+    dir string
+}
+
+// Open opens (creating if needed) an outbox stored in dir
+func Open(dir string) (*Outbox, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create outbox: %w", err)
+    }
+
+    return &Outbox{dir: dir}, nil
+}
+
+// Dir returns the directory backing the outbox
+func (o *Outbox) Dir() string {
+    return o.dir
+}
+
+// Add persists a new pending entry, assigning its ID
+func (o *Outbox) Add(entry *Entry) error {
+    id, err := newID()
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    entry.ID = id
+    entry.State = StatePending
+    entry.CreatedAt = now
+    entry.UpdatedAt = now
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    return o.write(entry)
+}
+
+// Update persists changes to an existing entry
+func (o *Outbox) Update(entry *Entry) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if !validID(entry.ID) {
+        return ErrNotFound
+    }
+    if _, err := os.Stat(o.path(entry.ID)); err != nil {
+        return ErrNotFound
+    }
+
+    entry.UpdatedAt = time.Now().UTC()
+    return o.write(entry)
+}
+
+// Get loads an entry by ID
+func (o *Outbox) Get(id string) (*Entry, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    return o.read(id)
+}
+
+// Remove deletes an entry
+func (o *Outbox) Remove(id string) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if !validID(id) {
+        return ErrNotFound
+    }
+    if err := os.Remove(o.path(id)); err != nil {
+        if os.IsNotExist(err) {
+            return ErrNotFound
+        }
+        return err
+    }
+    return nil
+}
+
+// List returns all entries, oldest first
+func (o *Outbox) List() ([]*Entry, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    files, err := os.ReadDir(o.dir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read outbox: %w", err)
+    }
+
+    var entries []*Entry
+    for _, f := range files {
+        name := f.Name()
+        if f.IsDir() || !strings.HasSuffix(name, ".json") {
+            continue
+        }
+
+        entry, err := o.read(strings.TrimSuffix(name, ".json"))
+        if err != nil {
+            continue
+        }
+        entries = append(entries, entry)
+    }
+
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+    })
+
+    return entries, nil
+}
+
+func (o *Outbox) path(id string) string {
+    return filepath.Join(o.dir, id+".json")
+}
+
+func (o *Outbox) read(id string) (*Entry, error) {
+    if !validID(id) {
+        return nil, ErrNotFound
+    }
+
+    data, err := os.ReadFile(o.path(id))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, ErrNotFound
+        }
+        return nil, err
+    }
+
+    var entry Entry
+    if err := json.Unmarshal(data, &entry); err != nil {
+        return nil, fmt.Errorf("corrupt outbox entry %s: %w", id, err)
+    }
+
+    return &entry, nil
+}
+
+// write stores an entry atomically
+func (o *Outbox) write(entry *Entry) error {
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+
+    if err := atomicfile.Write(o.path(entry.ID), data); err != nil {
+        return fmt.Errorf("failed to write outbox entry: %w", err)
+    }
+    return nil
+}
+
+// Recovery is what Recover found
+type Recovery struct {
+    Removed     []string `json:"removed,omitempty"`     // Partly written files deleted
+    Repaired    []string `json:"repaired,omitempty"`    // Entries fixed in place
+    Quarantined []string `json:"quarantined,omitempty"` // Entries moved to quarantine/
+}
+
+// Empty reports whether recovery found nothing to do
+func (r *Recovery) Empty() bool {
+    return len(r.Removed)+len(r.Repaired)+len(r.Quarantined) == 0
+}
+
+// Recover cleans up after a crash, before anything is sent: temporary files
+// of interrupted writes are deleted, and entries that can't be read or
+// could never be sent are moved to quarantine/ for inspection rather than
+// failing every flush. An entry whose ID doesn't match its file is
+// repaired.
+func (o *Outbox) Recover() (Recovery, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    var r Recovery
+    files, err := os.ReadDir(o.dir)
+    if err != nil {
+        return r, fmt.Errorf("failed to read outbox: %w", err)
+    }
+
+    for _, f := range files {
+        name := f.Name()
+        if f.IsDir() {
+            continue
+        }
+
+        // The entry itself is intact, as writes only ever rename over it
+        if strings.HasSuffix(name, ".tmp") {
+            if err := os.Remove(filepath.Join(o.dir, name)); err != nil {
+                return r, fmt.Errorf("failed to remove %s: %w", name, err)
+            }
+            r.Removed = append(r.Removed, name)
+            continue
+        }
+        if !strings.HasSuffix(name, ".json") {
+            continue
+        }
+
+        id := strings.TrimSuffix(name, ".json")
+        entry, err := o.read(id)
+        if err == nil {
+            err = entry.check()
+        }
+        if err != nil {
+            if err := o.quarantine(name); err != nil {
+                return r, err
+            }
+            r.Quarantined = append(r.Quarantined, name)
+            continue
+        }
+
+        if entry.ID != id {
+            entry.ID = id
+            if err := o.write(entry); err != nil {
+                return r, err
+            }
+            r.Repaired = append(r.Repaired, name)
+        }
+    }
+
+    return r, nil
+}
+
+// check rejects an entry that could never be sent
+func (e *Entry) check() error {
+    switch {
+    case e.State != StatePending && e.State != StateTransmitted:
+        return fmt.Errorf("unknown state %q", e.State)
+    case len(e.Message) == 0:
+        return errors.New("no message")
+    case e.From == "" || len(e.To) == 0:
+        return errors.New("no sender or recipients")
+    }
+    return nil
+}
+
+// quarantine moves an entry file out of the queue
+func (o *Outbox) quarantine(name string) error {
+    dir := filepath.Join(o.dir, "quarantine")
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create quarantine: %w", err)
+    }
+    if err := os.Rename(filepath.Join(o.dir, name), filepath.Join(dir, name)); err != nil {
+        return fmt.Errorf("failed to quarantine %s: %w", name, err)
+    }
+    return nil
+}
+
+func newID() (string, error) {
+    buf := make([]byte, 8)
+    if _, err := rand.Read(buf); err != nil {
+        return "", fmt.Errorf("failed to generate outbox ID: %w", err)
+    }
+    return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(buf)), nil
+}
+
+// validID rejects IDs that could escape the outbox directory
+func validID(id string) bool {
+    return id != "" && !strings.ContainsAny(id, `/\.`)
+}
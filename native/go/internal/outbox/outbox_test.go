@@ -0,0 +1,191 @@
+package outbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newEntry() *Entry {
+    return &Entry{From: "a@example.com", To: []string{"b@example.com"}, Message: []byte("Subject: hi\r\n\r\nhi"), SaveSent: true}
+}
+
+func TestRoundTrip(t *testing.T) {
+    o, err := Open(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    first, second := newEntry(), newEntry()
+    second.SendAt = time.Now().Add(time.Minute).UTC().Round(0)
+    for _, e := range []*Entry{first, second} {
+        if err := o.Add(e); err != nil {
+            t.Fatalf("Add: %v", err)
+        }
+    }
+    if first.ID == "" || first.ID == second.ID || first.State != StatePending {
+        t.Fatalf("Add gave entries %+v and %+v", first, second)
+    }
+
+    got, err := o.Get(second.ID)
+    if err != nil {
+        t.Fatalf("Get: %v", err)
+    }
+    if !reflect.DeepEqual(got, second) {
+        t.Errorf("Get gave %+v, want %+v", got, second)
+    }
+
+    second.State = StateTransmitted
+    second.Attempts = 1
+    if err := o.Update(second); err != nil {
+        t.Fatalf("Update: %v", err)
+    }
+    if got, _ := o.Get(second.ID); got.State != StateTransmitted || got.Attempts != 1 {
+        t.Errorf("Update left %+v", got)
+    }
+
+    list, err := o.List()
+    if err != nil {
+        t.Fatalf("List: %v", err)
+    }
+    if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+        t.Errorf("List gave %d entries, want the two oldest first", len(list))
+    }
+
+    if err := o.Remove(first.ID); err != nil {
+        t.Fatalf("Remove: %v", err)
+    }
+    if _, err := o.Get(first.ID); !errors.Is(err, ErrNotFound) {
+        t.Errorf("Get after Remove gave %v, want ErrNotFound", err)
+    }
+}
+
+func TestRemaining(t *testing.T) {
+    e := newEntry()
+    e.To = []string{"b@example.com", "c@example.com", "d@example.com"}
+    if got := e.Remaining(); !reflect.DeepEqual(got, e.To) {
+        t.Errorf("Remaining gave %v before any delivery, want %v", got, e.To)
+    }
+
+    e.Delivered = []string{"C@example.com"}
+    if got, want := e.Remaining(), []string{"b@example.com", "d@example.com"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("Remaining gave %v, want %v", got, want)
+    }
+
+    e.Delivered = append(e.Delivered, "b@example.com", "d@example.com")
+    if got := e.Remaining(); len(got) != 0 {
+        t.Errorf("Remaining gave %v once all were delivered", got)
+    }
+}
+
+func TestInvalidIDs(t *testing.T) {
+    dir := t.TempDir()
+    o, err := Open(filepath.Join(dir, "outbox"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A file outside the outbox that a path in an ID could reach
+    if err := os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []string{"", "missing", "../secret", `..\secret`, "a/b", "a.b"}
+
+    for _, id := range tests {
+        t.Run(id, func(t *testing.T) {
+            if _, err := o.Get(id); !errors.Is(err, ErrNotFound) {
+                t.Errorf("Get gave %v, want ErrNotFound", err)
+            }
+            if err := o.Remove(id); !errors.Is(err, ErrNotFound) {
+                t.Errorf("Remove gave %v, want ErrNotFound", err)
+            }
+            entry := newEntry()
+            entry.ID = id
+            if err := o.Update(entry); !errors.Is(err, ErrNotFound) {
+                t.Errorf("Update gave %v, want ErrNotFound", err)
+            }
+        })
+    }
+
+    if _, err := os.Stat(filepath.Join(dir, "secret.json")); err != nil {
+        t.Errorf("file outside the outbox touched: %v", err)
+    }
+}
+
+func TestCorruptEntries(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        data    string
+        corrupt bool   // Whether the entry can't be read at all
+        outcome string // What Recover does with the file
+    }{
+        {"truncated", "1-a.json", `{"id":"1-a","from":`, true, "quarantined"},
+        {"not an entry", "1-a.json", `[1,2]`, true, "quarantined"},
+        {"unknown state", "1-a.json", `{"id":"1-a","from":"a","to":["b"],"message":"aGk=","state":"lost"}`, false, "quarantined"},
+        {"no message", "1-a.json", `{"id":"1-a","from":"a","to":["b"],"state":"pending"}`, false, "quarantined"},
+        {"no recipients", "1-a.json", `{"id":"1-a","from":"a","message":"aGk=","state":"pending"}`, false, "quarantined"},
+        {"interrupted write", "1-a.json.123.tmp", `{"id":`, false, "removed"},
+        {"mismatched ID", "1-a.json", `{"id":"2-b","from":"a","to":["b"],"message":"aGk=","state":"pending"}`, false, "repaired"},
+        {"intact", "1-a.json", `{"id":"1-a","from":"a","to":["b"],"message":"aGk=","state":"transmitted"}`, false, ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            o, err := Open(dir)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.data), 0600); err != nil {
+                t.Fatal(err)
+            }
+
+            // A corrupt entry fails alone, without hiding the others
+            if tt.corrupt {
+                if _, err := o.Get("1-a"); err == nil || errors.Is(err, ErrNotFound) {
+                    t.Errorf("Get of a corrupt entry gave %v, want a corrupt error", err)
+                }
+                if list, err := o.List(); err != nil || len(list) != 0 {
+                    t.Errorf("List gave %d entries, %v, want the corrupt one skipped", len(list), err)
+                }
+            }
+
+            r, err := o.Recover()
+            if err != nil {
+                t.Fatalf("Recover: %v", err)
+            }
+            got := map[string][]string{"quarantined": r.Quarantined, "removed": r.Removed, "repaired": r.Repaired}
+            for outcome, files := range got {
+                want := []string(nil)
+                if outcome == tt.outcome {
+                    want = []string{tt.file}
+                }
+                if !reflect.DeepEqual(files, want) {
+                    t.Errorf("Recover %s %v, want %v", outcome, files, want)
+                }
+            }
+            if r.Empty() != (tt.outcome == "") {
+                t.Errorf("Empty() = %v for %+v", r.Empty(), r)
+            }
+            if tt.outcome == "quarantined" {
+                if _, err := os.Stat(filepath.Join(dir, "quarantine", tt.file)); err != nil {
+                    t.Errorf("quarantined file missing: %v", err)
+                }
+            }
+
+            // Whatever is left in the queue can be read, under its file's ID
+            list, err := o.List()
+            if err != nil {
+                t.Fatalf("List: %v", err)
+            }
+            kept := tt.outcome == "" || tt.outcome == "repaired"
+            if (len(list) == 1 && list[0].ID == "1-a") != kept || (!kept && len(list) != 0) {
+                t.Errorf("List after Recover gave %d entries, want kept %v", len(list), kept)
+            }
+        })
+    }
+}
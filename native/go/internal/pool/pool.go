@@ -1,15 +1,34 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
 )
 
+// ownerKey carries the client making a request
+type ownerKey struct{}
+
+// WithOwner tags ctx with the client making a request, so connections it
+// opens are scoped to that client
+func WithOwner(ctx context.Context, owner string) context.Context {
+    return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// OwnerOf returns the client ctx was tagged with, or ""
+func OwnerOf(ctx context.Context) string {
+    owner, _ := ctx.Value(ownerKey{}).(string)
+    return owner
+}
+
 // ConnectionPool manages connection lifecycle
 type ConnectionPool struct {
     mu          sync.RWMutex
     connections map[int]any
+    owners      map[int]string
     nextID      uint64
 }
 
@@ -17,12 +36,13 @@ type ConnectionPool struct {
 func NewConnectionPool() *ConnectionPool {
     return &ConnectionPool{
         connections: make(map[int]any),
+        owners:      make(map[int]string),
         nextID:      1,
     }
 }
 
-// Add adds a connection and returns its handle
-func (p *ConnectionPool) Add(conn any) (int, error) {
+// Add adds a connection owned by the client in ctx and returns its handle
+func (p *ConnectionPool) Add(ctx context.Context, conn any) (int, error) {
     p.mu.Lock()
     defer p.mu.Unlock()
 
@@ -33,6 +53,9 @@ func (p *ConnectionPool) Add(conn any) (int, error) {
     handle := int(p.nextID)
     p.nextID++
     p.connections[handle] = conn
+    if owner := OwnerOf(ctx); owner != "" {
+        p.owners[handle] = owner
+    }
 
     return handle, nil
 }
@@ -44,7 +67,7 @@ func (p *ConnectionPool) Get(handle int) (any, error) {
 
     conn, ok := p.connections[handle]
     if !ok {
-        return nil, errors.New("invalid connection handle")
+        return nil, protocol.WithCode(protocol.CodeInvalidHandle, errors.New("invalid connection handle"))
     }
 
     return conn, nil
@@ -56,6 +79,47 @@ func (p *ConnectionPool) Remove(handle int) {
     defer p.mu.Unlock()
 
     delete(p.connections, handle)
+    delete(p.owners, handle)
+}
+
+// Owner returns the client that opened a connection, or "" if it was
+// opened outside any client, and whether the handle is in the pool
+func (p *ConnectionPool) Owner(handle int) (string, bool) {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    _, ok := p.connections[handle]
+    return p.owners[handle], ok
+}
+
+// Owned lists the handles of the connections owner opened
+func (p *ConnectionPool) Owned(owner string) []int {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    var handles []int
+    for handle, o := range p.owners {
+        if o == owner {
+            handles = append(handles, handle)
+        }
+    }
+    return handles
+}
+
+// Transfer gives every connection from owns to another client, returning
+// their handles
+func (p *ConnectionPool) Transfer(from, to string) []int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    var handles []int
+    for handle, o := range p.owners {
+        if o == from {
+            p.owners[handle] = to
+            handles = append(handles, handle)
+        }
+    }
+    return handles
 }
 
 // Count returns the number of active connections
@@ -65,3 +129,18 @@ func (p *ConnectionPool) Count() int {
 
     return len(p.connections)
 }
+
+// Range calls fn for each connection. It iterates over a snapshot, so fn may
+// safely add or remove connections.
+func (p *ConnectionPool) Range(fn func(handle int, conn any)) {
+    p.mu.RLock()
+    snapshot := make(map[int]any, len(p.connections))
+    for handle, conn := range p.connections {
+        snapshot[handle] = conn
+    }
+    p.mu.RUnlock()
+
+    for handle, conn := range snapshot {
+        fn(handle, conn)
+    }
+}
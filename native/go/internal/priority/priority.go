@@ -0,0 +1,225 @@
+package priority
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+)
+
+// Priority levels, highest first. Ordinary mail has none.
+const (
+    VIP       = "vip"       // The sender is on the VIP list
+    Important = "important" // The user has replied to the sender before
+)
+
+// Settings is how senders are classified
+type Settings struct {
+    // VIPs are addresses, or "@domain" for everyone at a domain
+    VIPs []string `json:"vips"`
+
+    // Learn marks senders the user has replied to as important
+    Learn bool `json:"learn"`
+}
+
+// saved is the file the classifier is kept in
+type saved struct {
+    Settings Settings             `json:"settings"`
+    Learned  map[string]time.Time `json:"learned"` // Address to when it was learned
+}
+
+// Classifier ranks messages by sender for an important-first inbox
+type Classifier struct {
+    mu    sync.Mutex
+    path  string
+    state saved
+}
+
+// Open loads the classifier saved at path, if any. Learning is on until
+// turned off.
+func Open(path string) (*Classifier, error) {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return nil, fmt.Errorf("failed to create priority settings: %w", err)
+    }
+
+    c := &Classifier{
+        path: path,
+        state: saved{
+            Settings: Settings{VIPs: []string{}, Learn: true},
+            Learned:  make(map[string]time.Time),
+        },
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if err == nil {
+        if err := json.Unmarshal(data, &c.state); err != nil {
+            return nil, fmt.Errorf("corrupt priority settings: %w", err)
+        }
+        if c.state.Learned == nil {
+            c.state.Learned = make(map[string]time.Time)
+        }
+    }
+
+    return c, nil
+}
+
+// Settings returns the current settings
+func (c *Classifier) Settings() Settings {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return c.state.Settings
+}
+
+// SetSettings validates, normalises and saves settings
+func (c *Classifier) SetSettings(settings Settings) error {
+    vips := make([]string, 0, len(settings.VIPs))
+    seen := make(map[string]bool)
+    for _, vip := range settings.VIPs {
+        vip = normalise(vip)
+        if vip == "" || vip == "@" || (!strings.HasPrefix(vip, "@") && !strings.Contains(vip, "@")) {
+            return fmt.Errorf("invalid VIP %q, want an address or @domain", vip)
+        }
+        if !seen[vip] {
+            seen[vip] = true
+            vips = append(vips, vip)
+        }
+    }
+    sort.Strings(vips)
+    settings.VIPs = vips
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    next := c.state
+    next.Settings = settings
+    if err := c.save(next); err != nil {
+        return err
+    }
+    c.state = next
+    return nil
+}
+
+// Learned returns the senders learned as important, sorted
+func (c *Classifier) Learned() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    learned := make([]string, 0, len(c.state.Learned))
+    for address := range c.state.Learned {
+        learned = append(learned, address)
+    }
+    sort.Strings(learned)
+    return learned
+}
+
+// Learn records senders the user has replied to, if learning is on
+func (c *Classifier) Learn(addresses []string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if !c.state.Settings.Learn {
+        return nil
+    }
+
+    var added []string
+    for _, address := range addresses {
+        address = normalise(address)
+        if _, ok := c.state.Learned[address]; address != "" && !ok {
+            added = append(added, address)
+        }
+    }
+    if len(added) == 0 {
+        return nil
+    }
+
+    next := c.state
+    next.Learned = make(map[string]time.Time, len(c.state.Learned)+len(added))
+    for address, at := range c.state.Learned {
+        next.Learned[address] = at
+    }
+    now := time.Now().UTC()
+    for _, address := range added {
+        next.Learned[address] = now
+    }
+
+    if err := c.save(next); err != nil {
+        return err
+    }
+    c.state = next
+    return nil
+}
+
+// Forget drops learned senders, so they are ordinary again until the user
+// next replies to them
+func (c *Classifier) Forget(addresses []string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    next := c.state
+    next.Learned = make(map[string]time.Time, len(c.state.Learned))
+    for address, at := range c.state.Learned {
+        next.Learned[address] = at
+    }
+    for _, address := range addresses {
+        delete(next.Learned, normalise(address))
+    }
+
+    if err := c.save(next); err != nil {
+        return err
+    }
+    c.state = next
+    return nil
+}
+
+// Classify returns the priority of mail from address, or "" for none
+func (c *Classifier) Classify(address string) string {
+    address = normalise(address)
+    if address == "" {
+        return ""
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    domain := ""
+    if at := strings.LastIndex(address, "@"); at >= 0 {
+        domain = address[at:]
+    }
+    for _, vip := range c.state.Settings.VIPs {
+        if vip == address || vip == domain {
+            return VIP
+        }
+    }
+
+    if _, ok := c.state.Learned[address]; ok && c.state.Settings.Learn {
+        return Important
+    }
+    return ""
+}
+
+// save writes state atomically; the caller holds mu
+func (c *Classifier) save(state saved) error {
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := atomicfile.Write(c.path, data); err != nil {
+        return fmt.Errorf("failed to write priority settings: %w", err)
+    }
+    return nil
+}
+
+func normalise(address string) string {
+    return strings.ToLower(strings.TrimSpace(address))
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Response compressions. A client lists those it can decode in hello;
+// responses whose data is larger than CompressThreshold are then sent with
+// Data replaced by the compressed encoding of the original data.
+const (
+    CompressionZstd = "zstd"
+)
+
+// Compressions lists the supported response compressions
+var Compressions = []string{CompressionZstd}
+
+// CompressThreshold is the encoded data size, in bytes, above which a
+// response is compressed. Smaller payloads gain too little to be worth it.
+const CompressThreshold = 8 << 10
+
+// zstdEncoder is shared; EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+    enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+    return enc
+})
+
+// NegotiateCompression picks the compression to use from those a client
+// offered, or "" for none
+func NegotiateCompression(offered []string) string {
+    for _, name := range offered {
+        if name == CompressionZstd {
+            return name
+        }
+    }
+    return ""
+}
+
+// Compress replaces a response's data with its compressed encoding when
+// that is large enough to be worth it. The data is encoded in the wire
+// encoding first, so a client decompresses then decodes as it would any
+// other data. Responses are returned unchanged when compression is empty.
+func Compress(resp Response, encoding, compression string) (Response, error) {
+    if compression != CompressionZstd || resp.Data == nil {
+        return resp, nil
+    }
+
+    data, err := Encode(encoding, resp.Data)
+    if err != nil {
+        return resp, err
+    }
+    if len(data) <= CompressThreshold {
+        return resp, nil
+    }
+
+    compressed := zstdEncoder().EncodeAll(data, make([]byte, 0, len(data)/4))
+    if len(compressed) >= len(data) {
+        return resp, nil
+    }
+
+    // Bytes are base64 in JSON and raw in MessagePack
+    resp.Data = compressed
+    resp.ContentEncoding = compression
+    return resp, nil
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire encodings. JSON is the default; MessagePack carries binary values
+// (message bodies) as raw bytes instead of base64.
+const (
+    EncodingJSON    = "json"
+    EncodingMsgPack = "msgpack"
+)
+
+// Encodings lists the supported wire encodings
+var Encodings = []string{EncodingJSON, EncodingMsgPack}
+
+// Encode marshals a response or event in the given encoding. Struct fields
+// use their json names in either encoding.
+func Encode(encoding string, v any) ([]byte, error) {
+    if encoding != EncodingMsgPack {
+        return json.Marshal(v)
+    }
+
+    var buf bytes.Buffer
+    enc := msgpack.NewEncoder(&buf)
+    enc.SetCustomStructTag("json")
+    if err := enc.Encode(v); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// DecodeRequest unmarshals a request in the given encoding. MessagePack
+// params are converted to JSON for the handlers, so binary values arrive
+// as base64 strings, which []byte fields decode transparently and *_b64
+// params accept unchanged.
+func DecodeRequest(encoding string, data []byte) (Request, error) {
+    var req Request
+    if encoding != EncodingMsgPack {
+        err := json.Unmarshal(data, &req)
+        return req, err
+    }
+
+    // Converted through JSON, so every Request field is decoded by its
+    // json name and params are handed on as JSON
+    var raw map[string]any
+    if err := msgpack.Unmarshal(data, &raw); err != nil {
+        return req, fmt.Errorf("invalid msgpack request: %w", err)
+    }
+
+    converted, err := json.Marshal(raw)
+    if err != nil {
+        return req, fmt.Errorf("invalid msgpack request: %w", err)
+    }
+    if err := json.Unmarshal(converted, &req); err != nil {
+        return req, fmt.Errorf("invalid msgpack request: %w", err)
+    }
+    return req, nil
+}
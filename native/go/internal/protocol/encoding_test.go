@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// fullRequest sets every encoded Request field, so a field added later is
+// covered without touching the test
+func fullRequest(t *testing.T) Request {
+    t.Helper()
+
+    var req Request
+    v := reflect.ValueOf(&req).Elem()
+    for i := 0; i < v.NumField(); i++ {
+        field := v.Type().Field(i)
+        if field.Tag.Get("json") == "-" {
+            continue
+        }
+        switch f := v.Field(i); f.Kind() {
+        case reflect.String:
+            f.SetString(field.Name + "-value")
+        case reflect.Int:
+            f.SetInt(int64(1000 + i))
+        case reflect.Bool:
+            f.SetBool(true)
+        case reflect.Slice:
+            if field.Type != reflect.TypeOf(json.RawMessage{}) {
+                t.Fatalf("no test value for field %s", field.Name)
+            }
+            f.SetBytes([]byte(`{"handle":3,"folder":"INBOX"}`))
+        default:
+            t.Fatalf("no test value for field %s", field.Name)
+        }
+    }
+    return req
+}
+
+func TestDecodeRequest(t *testing.T) {
+    want := fullRequest(t)
+
+    // As a client would send it: the request's fields by their json
+    // names, with params as an object
+    data, err := json.Marshal(want)
+    if err != nil {
+        t.Fatal(err)
+    }
+    object := make(map[string]any)
+    v := reflect.ValueOf(want)
+    for i := 0; i < v.NumField(); i++ {
+        name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+        if name != "-" {
+            object[name] = v.Field(i).Interface()
+        }
+    }
+    var params map[string]any
+    if err := json.Unmarshal(want.Params, &params); err != nil {
+        t.Fatal(err)
+    }
+    object["params"] = params
+    packed, err := msgpack.Marshal(object)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        encoding string
+        data     []byte
+    }{
+        {EncodingJSON, data},
+        {EncodingMsgPack, packed},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.encoding, func(t *testing.T) {
+            got, err := DecodeRequest(tt.encoding, tt.data)
+            if err != nil {
+                t.Fatalf("DecodeRequest: %v", err)
+            }
+
+            // Params are compared as values, since msgpack reorders keys
+            var gotParams, wantParams any
+            json.Unmarshal(got.Params, &gotParams)
+            json.Unmarshal(want.Params, &wantParams)
+            if !reflect.DeepEqual(gotParams, wantParams) {
+                t.Errorf("params = %s, want %s", got.Params, want.Params)
+            }
+
+            got.Params, got.Partial = want.Params, nil
+            if !reflect.DeepEqual(got, want) {
+                t.Errorf("DecodeRequest gave %+v, want %+v", got, want)
+            }
+        })
+    }
+}
+
+func TestDecodeRequestMalformed(t *testing.T) {
+    tests := []struct {
+        encoding string
+        data     []byte
+    }{
+        {EncodingJSON, []byte(`{"module":`)},
+        {EncodingMsgPack, []byte{0xc1}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.encoding, func(t *testing.T) {
+            if _, err := DecodeRequest(tt.encoding, tt.data); err == nil {
+                t.Error("DecodeRequest accepted a malformed request")
+            }
+        })
+    }
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Error codes carried in Response.ErrorCode. Errors implementing Coder may
+// refine these (e.g. AUTH_NEEDS_APP_PASSWORD), but every failed response
+// carries a code, and Codes describes each one.
+const (
+    CodeAuthFailed     = "AUTH_FAILED"
+    CodeNetwork        = "NETWORK"
+    CodeNotConnected   = "NOT_CONNECTED"
+    CodeInvalidHandle  = "INVALID_HANDLE"
+    CodeTimeout        = "TIMEOUT"
+    CodeServerError    = "SERVER_ERROR"
+    CodeInvalidRequest = "INVALID_REQUEST"
+    CodeCancelled      = "CANCELLED"
+    CodeReadOnly       = "READ_ONLY"
+
+    CodeRequestTooLarge    = "REQUEST_TOO_LARGE"
+    CodeBusy               = "BUSY"
+    CodeUnauthenticated    = "UNAUTHENTICATED"
+    CodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+    CodeServerUnavailable  = "SERVER_UNAVAILABLE"
+    CodeIdentityMismatch   = "IDENTITY_MISMATCH"
+
+    // Refinements of AUTH_FAILED naming the remedy
+    CodeAuthNeedsAppPassword = "AUTH_NEEDS_APP_PASSWORD"
+    CodeAuthNeedsOAuth       = "AUTH_NEEDS_OAUTH"
+    CodeAuthWebLogin         = "AUTH_WEB_LOGIN_REQUIRED"
+    CodeAuthAccountLocked    = "AUTH_ACCOUNT_LOCKED"
+    CodeAuthThrottled        = "AUTH_THROTTLED"
+    CodeAuthTemporary        = "AUTH_TEMPORARY"
+)
+
+// Codes describes every error code, for describe and generated clients
+var Codes = map[string]string{
+    CodeAuthFailed:     "Credentials rejected; see error_details",
+    CodeNetwork:        "Connection refused, reset or lost",
+    CodeNotConnected:   "The handle's connection is closed",
+    CodeInvalidHandle:  "No connection has this handle",
+    CodeTimeout:        "Deadline or timeout_ms exceeded",
+    CodeServerError:    "Anything else, usually a mail server rejection",
+    CodeInvalidRequest: "Malformed params or unknown action",
+    CodeCancelled:      "Cancelled by the client",
+    CodeReadOnly:       "Mutating action refused in read-only mode",
+
+    CodeRequestTooLarge:    "Request exceeds the server's size limit",
+    CodeBusy:               "Client over its rate or in-flight limit; retry after error_details.retry_after_ms",
+    CodeUnauthenticated:    "The client's secret or tenant token was not accepted",
+    CodeUnsupportedVersion: "The client's protocol version is older than the server supports",
+    CodeServerUnavailable:  "The mail server kept failing and is not retried until it recovers",
+    CodeIdentityMismatch:   "The From address is not one the account may send as",
+
+    CodeAuthNeedsAppPassword: "The provider refuses account passwords; use an app password",
+    CodeAuthNeedsOAuth:       "The provider only accepts OAuth2 logins",
+    CodeAuthWebLogin:         "The provider wants an interactive sign-in in a browser first",
+    CodeAuthAccountLocked:    "The account is disabled, suspended or locked",
+    CodeAuthThrottled:        "Too many login attempts; retrying now prolongs the lock",
+    CodeAuthTemporary:        "A server-side problem with the login, safe to retry later",
+}
+
+// codedError attaches an error code to an error
+type codedError struct {
+    code string
+    err  error
+}
+
+// WithCode attaches an error code to err
+func WithCode(code string, err error) error {
+    return &codedError{code: code, err: err}
+}
+
+func (e *codedError) Error() string {
+    return e.err.Error()
+}
+
+func (e *codedError) ErrorCode() string {
+    return e.code
+}
+
+func (e *codedError) Unwrap() error {
+    return e.err
+}
+
+// classify picks the error code for err
+func classify(err error) string {
+    var coder Coder
+    if errors.As(err, &coder) {
+        return coder.ErrorCode()
+    }
+
+    switch {
+    case errors.Is(err, context.Canceled):
+        return CodeCancelled
+    case errors.Is(err, context.DeadlineExceeded):
+        return CodeTimeout
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) {
+        if netErr.Timeout() {
+            return CodeTimeout
+        }
+        return CodeNetwork
+    }
+    if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+        errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+        return CodeNetwork
+    }
+
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+        return CodeInvalidRequest
+    }
+
+    return CodeServerError
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidCursor rejects a cursor this server didn't hand out
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page is the pagination convention for list-style actions. Their params
+// embed it, and their results carry next_cursor, empty on the last page.
+// Without page_size the whole list comes back at once, as before.
+type Page struct {
+    Cursor   string `json:"cursor,omitempty"`                   // A previous result's next_cursor
+    PageSize int    `json:"page_size,omitempty" validate:"min=0"` // Items per page; 0 for all
+}
+
+// cursor is what a next_cursor encodes: where the page ended and the key
+// of the last item on it, so a page resumes after that item even if items
+// before it were added or removed meanwhile
+type cursor struct {
+    Offset int    `json:"o"`
+    Key    string `json:"k"`
+}
+
+// Slice picks the current page from a list of n items in a stable order,
+// identified by key. It returns the bounds of the page and the cursor of
+// the next one, or "" when this page is the last.
+func (p Page) Slice(n int, key func(i int) string) (start, end int, next string, err error) {
+    if p.PageSize < 0 {
+        return 0, 0, "", WithCode(CodeInvalidRequest, errors.New("page_size must not be negative"))
+    }
+
+    if p.Cursor != "" {
+        if start, err = p.resume(n, key); err != nil {
+            return 0, 0, "", err
+        }
+    }
+
+    end = n
+    if p.PageSize > 0 && n-start > p.PageSize {
+        end = start + p.PageSize
+    }
+    if end < n {
+        data, _ := json.Marshal(cursor{Offset: end, Key: key(end - 1)})
+        next = base64.RawURLEncoding.EncodeToString(data)
+    }
+
+    return start, end, next, nil
+}
+
+// resume finds where the page after the cursor starts
+func (p Page) resume(n int, key func(i int) string) (int, error) {
+    data, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+    if err != nil {
+        return 0, WithCode(CodeInvalidRequest, ErrInvalidCursor)
+    }
+    var c cursor
+    if err := json.Unmarshal(data, &c); err != nil || c.Offset < 1 {
+        return 0, WithCode(CodeInvalidRequest, ErrInvalidCursor)
+    }
+
+    // Usually nothing moved
+    if c.Offset <= n && key(c.Offset-1) == c.Key {
+        return c.Offset, nil
+    }
+    for i := 0; i < n; i++ {
+        if key(i) == c.Key {
+            return i + 1, nil
+        }
+    }
+
+    // The last item is gone; carry on from the same position
+    if c.Offset > n {
+        return n, nil
+    }
+    return c.Offset, nil
+}
@@ -1,27 +1,189 @@
 package protocol
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
 
 // Request from Python
 type Request struct {
-    Module string          `json:"module"` // "imap" or "smtp"
-    Action string          `json:"action"` // "connect", "fetch", "send", etc.
+    ID     string          `json:"id,omitempty"` // Echoed in the response for correlation
+    Module string          `json:"module"`       // "imap" or "smtp"
+    Action string          `json:"action"`       // "connect", "fetch", "send", etc.
     Params json.RawMessage `json:"params"`
+
+    // TraceID correlates frontend and native logs for one request
+    TraceID string `json:"trace_id,omitempty"`
+
+    // TimeoutMS bounds how long the request may run; 0 means no limit
+    TimeoutMS int `json:"timeout_ms,omitempty"`
+
+    // Stream asks streaming actions to send results as partial responses
+    Stream bool `json:"stream,omitempty"`
+
+    // IdempotencyKey makes a retry with the same key replay the first
+    // response instead of running again
+    IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+    // Priority is "interactive" (the default) or "bulk"; bulk requests
+    // give way to interactive ones between batches
+    Priority string `json:"priority,omitempty"`
+
+    // Partial sends one partial response; nil unless the client asked to stream
+    Partial func(data any) error `json:"-"`
 }
 
 // Response to Python
 type Response struct {
+    ID      string      `json:"id,omitempty"`
     Success bool        `json:"success"`
     Data    any         `json:"data,omitempty"`
     Error   string      `json:"error,omitempty"`
+
+    // ErrorCode classifies the error for programmatic handling
+    ErrorCode string `json:"error_code,omitempty"`
+
+    // ErrorDetails carries structured context for the error, if any
+    ErrorDetails any `json:"error_details,omitempty"`
+
+    TraceID string `json:"trace_id,omitempty"`
+
+    // Partial marks an intermediate response of a stream; the final response
+    // for the request has it unset
+    Partial bool `json:"partial,omitempty"`
+
+    // Replayed marks a response replayed for a repeated idempotency key
+    Replayed bool `json:"replayed,omitempty"`
+
+    // ContentEncoding names the compression applied to Data, if any; Data
+    // is then the compressed bytes of its usual encoding
+    ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// Event is an unsolicited notification pushed to clients that subscribed to
+// events. It carries no ID; clients tell it apart from responses by the
+// event field.
+type Event struct {
+    Event  string    `json:"event"` // e.g. "folder.changed", "connection.lost"
+    Module string    `json:"module,omitempty"`
+    Handle int       `json:"handle,omitempty"`
+    Data   any       `json:"data,omitempty"`
+    Time   time.Time `json:"time"`
+
+    // TraceID is the trace ID of the request that raised the event, if any
+    TraceID string `json:"trace_id,omitempty"`
+}
+
+// Coder is implemented by errors that carry a machine-readable code
+type Coder interface {
+    ErrorCode() string
+}
+
+// Detailer is implemented by errors that carry structured details
+type Detailer interface {
+    ErrorDetails() any
+}
+
+// TimeoutError is returned when a request exceeds its timeout_ms
+type TimeoutError struct {
+    Module  string
+    Action  string
+    Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+    return fmt.Sprintf("%s.%s timed out after %s", e.Module, e.Action, e.Timeout)
+}
+
+func (e *TimeoutError) ErrorCode() string {
+    return CodeTimeout
+}
+
+func (e *TimeoutError) ErrorDetails() any {
+    return map[string]any{"timeout_ms": e.Timeout.Milliseconds()}
+}
+
+// Unwrap lets callers match the error with context.DeadlineExceeded
+func (e *TimeoutError) Unwrap() error {
+    return context.DeadlineExceeded
+}
+
+// BusyError refuses a request from a client over its rate or concurrency
+// limit. Nothing was run, so it is always safe to retry.
+type BusyError struct {
+    Reason     string
+    RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+    return fmt.Sprintf("too many requests: %s", e.Reason)
+}
+
+func (e *BusyError) ErrorCode() string {
+    return CodeBusy
+}
+
+func (e *BusyError) ErrorDetails() any {
+    return map[string]any{"retry_after_ms": e.RetryAfter.Milliseconds()}
+}
+
+// Logf logs a message tagged with the request's trace ID
+func (r Request) Logf(format string, args ...any) {
+    logTraced(r.TraceID, fmt.Sprintf(format, args...))
+}
+
+// traceKey carries a request's trace ID in its context
+type traceKey struct{}
+
+// WithTraceID returns a context for work done on behalf of the request
+// traced by id
+func WithTraceID(ctx context.Context, id string) context.Context {
+    if id == "" {
+        return ctx
+    }
+    return context.WithValue(ctx, traceKey{}, id)
+}
+
+// TraceID returns the trace ID of the request ctx serves, or ""
+func TraceID(ctx context.Context) string {
+    id, _ := ctx.Value(traceKey{}).(string)
+    return id
 }
 
-// ErrorResponse creates an error response
+// Logf logs a message tagged with the trace ID of the request ctx serves
+func Logf(ctx context.Context, format string, args ...any) {
+    logTraced(TraceID(ctx), fmt.Sprintf(format, args...))
+}
+
+func logTraced(traceID, msg string) {
+    if traceID != "" {
+        log.Printf("[trace=%s] %s", traceID, msg)
+        return
+    }
+    log.Print(msg)
+}
+
+// ErrorResponse creates an error response, picking up the code and details of
+// the first errors in the chain that carry them, and otherwise classifying
+// the error by type
 func ErrorResponse(err error) Response {
-    return Response{
+    resp := Response{
         Success: false,
         Error:   err.Error(),
     }
+
+    resp.ErrorCode = classify(err)
+
+    var detailer Detailer
+    if errors.As(err, &detailer) {
+        resp.ErrorDetails = detailer.ErrorDetails()
+    }
+
+    return resp
 }
 
 // SuccessResponse creates a success response
@@ -31,3 +193,16 @@ func SuccessResponse(data any) Response {
         Data:    data,
     }
 }
+
+// HandleParam extracts the connection handle from request params, returning
+// 0 when the action is not scoped to a handle
+func HandleParam(params json.RawMessage) int {
+    var p struct {
+        Handle int `json:"handle"`
+    }
+
+    if err := json.Unmarshal(params, &p); err != nil {
+        return 0
+    }
+    return p.Handle
+}
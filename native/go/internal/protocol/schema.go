@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// describeKey marks a context used to discover an action's params
+type describeKey struct{}
+
+// paramCapture receives the params type a handler decodes into
+type paramCapture struct {
+    typ reflect.Type
+}
+
+// errDescribed stops a handler once its params type has been captured
+var errDescribed = errors.New("describe: params captured")
+
+// DecodeParams unmarshals request params into v and checks its validate
+// tags. Handlers decode through it so describe can learn each action's
+// params type without running it.
+func DecodeParams(ctx context.Context, params json.RawMessage, v any) error {
+    if capture, ok := ctx.Value(describeKey{}).(*paramCapture); ok {
+        if capture.typ == nil {
+            capture.typ = reflect.TypeOf(v).Elem()
+        }
+        return errDescribed
+    }
+
+    if len(params) == 0 {
+        params = json.RawMessage("{}")
+    }
+    if err := json.Unmarshal(params, v); err != nil {
+        return decodeError(err)
+    }
+    return Validate(v)
+}
+
+// DescribeParams returns the JSON schema of the params run decodes, by
+// calling it under a cancelled context that aborts at the decode. Actions
+// that take no params are described as an empty object.
+func DescribeParams(run func(ctx context.Context)) map[string]any {
+    capture := &paramCapture{}
+    ctx, cancel := context.WithCancel(context.WithValue(context.Background(), describeKey{}, capture))
+    cancel()
+
+    run(ctx)
+    if capture.typ == nil {
+        return map[string]any{"type": "object"}
+    }
+    return Schema(capture.typ)
+}
+
+var (
+    timeType = reflect.TypeOf(time.Time{})
+    rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// Schema generates a JSON schema for a type from its json struct tags
+func Schema(t reflect.Type) map[string]any {
+    switch {
+    case t == timeType:
+        return map[string]any{"type": "string", "format": "date-time"}
+    case t == rawType:
+        return map[string]any{}
+    }
+
+    switch t.Kind() {
+    case reflect.Pointer:
+        return Schema(t.Elem())
+    case reflect.Bool:
+        return map[string]any{"type": "boolean"}
+    case reflect.String:
+        return map[string]any{"type": "string"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]any{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]any{"type": "number"}
+    case reflect.Slice, reflect.Array:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return map[string]any{"type": "string", "contentEncoding": "base64"}
+        }
+        return map[string]any{"type": "array", "items": Schema(t.Elem())}
+    case reflect.Map:
+        return map[string]any{"type": "object", "additionalProperties": Schema(t.Elem())}
+    case reflect.Struct:
+        properties := map[string]any{}
+        var required []string
+        addFields(t, properties, &required)
+        schema := map[string]any{"type": "object", "properties": properties}
+        if len(required) > 0 {
+            schema["required"] = required
+        }
+        return schema
+    default:
+        return map[string]any{}
+    }
+}
+
+// addFields adds the JSON properties of a struct, including those promoted
+// from embedded structs, and collects the required ones
+func addFields(t reflect.Type, properties map[string]any, required *[]string) {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == "-" || (!field.IsExported() && !field.Anonymous) {
+            continue
+        }
+
+        if field.Anonymous && name == "" {
+            embedded := field.Type
+            if embedded.Kind() == reflect.Pointer {
+                embedded = embedded.Elem()
+            }
+            if embedded.Kind() == reflect.Struct {
+                addFields(embedded, properties, required)
+                continue
+            }
+        }
+
+        if name == "" {
+            name = field.Name
+        }
+        schema := Schema(field.Type)
+        if tag, ok := field.Tag.Lookup("validate"); ok && parseRules(tag).describe(schema) {
+            *required = append(*required, name)
+        }
+        properties[name] = schema
+    }
+}
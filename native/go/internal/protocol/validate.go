@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Params fields declare their constraints in a validate tag, checked after
+// decoding and published in describe's schemas:
+//
+//	required        the field must be present and not zero, "" or empty
+//	min=N, max=N    bounds on a number, or on the length of a string or list
+//	oneof=a b c     the string must be one of the listed values
+//
+// Bounds and oneof only apply to fields that were given, since the zero
+// value conventionally means "use the default".
+
+// ValidationError rejects one params field
+type ValidationError struct {
+    Field  string // Path from params, such as params.accounts[0].port
+    Reason string
+}
+
+func (e *ValidationError) Error() string {
+    return e.Field + ": " + e.Reason
+}
+
+func (e *ValidationError) ErrorCode() string {
+    return CodeInvalidRequest
+}
+
+func (e *ValidationError) ErrorDetails() any {
+    return map[string]string{"field": e.Field, "reason": e.Reason}
+}
+
+// rules are the parsed constraints of one field
+type rules struct {
+    required bool
+    min, max *float64
+    oneof    []string
+}
+
+// parseRules reads a validate tag
+func parseRules(tag string) rules {
+    var r rules
+    for _, rule := range strings.Split(tag, ",") {
+        name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+        switch name {
+        case "required":
+            r.required = true
+        case "min", "max":
+            n, err := strconv.ParseFloat(arg, 64)
+            if err != nil {
+                panic(fmt.Sprintf("protocol: invalid validate rule %q", rule))
+            }
+            if name == "min" {
+                r.min = &n
+            } else {
+                r.max = &n
+            }
+        case "oneof":
+            r.oneof = strings.Fields(arg)
+        case "":
+        default:
+            panic(fmt.Sprintf("protocol: unknown validate rule %q", rule))
+        }
+    }
+    return r
+}
+
+// decodeError turns a JSON type mismatch into a ValidationError naming the
+// field, leaving other errors alone
+func decodeError(err error) error {
+    var typeErr *json.UnmarshalTypeError
+    if !errors.As(err, &typeErr) {
+        return err
+    }
+
+    field := "params"
+    if typeErr.Field != "" {
+        field += "." + typeErr.Field
+    }
+    want, _ := Schema(typeErr.Type)["type"].(string)
+    if want == "" {
+        want = typeErr.Type.String()
+    }
+    return &ValidationError{Field: field, Reason: fmt.Sprintf("must be %s, not %s", article(want), typeErr.Value)}
+}
+
+// article prefixes a JSON type name with "a" or "an"
+func article(word string) string {
+    if strings.ContainsRune("aeiou", rune(word[0])) {
+        return "an " + word
+    }
+    return "a " + word
+}
+
+// Validate checks the validate tags of a decoded params struct
+func Validate(v any) error {
+    return validateValue(reflect.ValueOf(v), "params")
+}
+
+// validateValue checks the fields of structs within v, however nested
+func validateValue(v reflect.Value, path string) error {
+    switch v.Kind() {
+    case reflect.Pointer, reflect.Interface:
+        if v.IsNil() {
+            return nil
+        }
+        return validateValue(v.Elem(), path)
+    case reflect.Slice, reflect.Array:
+        for i := 0; i < v.Len(); i++ {
+            if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+                return err
+            }
+        }
+        return nil
+    case reflect.Struct:
+        if v.Type() == timeType {
+            return nil
+        }
+    default:
+        return nil
+    }
+
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+        if name == "-" || (!field.IsExported() && !field.Anonymous) {
+            continue
+        }
+
+        // Embedded structs' fields are promoted to this level
+        if field.Anonymous && name == "" {
+            if err := validateValue(v.Field(i), path); err != nil {
+                return err
+            }
+            continue
+        }
+
+        if name == "" {
+            name = field.Name
+        }
+        fieldPath := path + "." + name
+        value := v.Field(i)
+
+        if tag, ok := field.Tag.Lookup("validate"); ok {
+            if reason := parseRules(tag).check(value); reason != "" {
+                return &ValidationError{Field: fieldPath, Reason: reason}
+            }
+        }
+        if err := validateValue(value, fieldPath); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// check returns why value breaks the rules, or ""
+func (r rules) check(value reflect.Value) string {
+    if value.IsZero() {
+        if r.required {
+            return "required"
+        }
+        return ""
+    }
+    for value.Kind() == reflect.Pointer {
+        value = value.Elem()
+    }
+
+    var n float64
+    unit := ""
+    switch value.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n = float64(value.Int())
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        n = float64(value.Uint())
+    case reflect.Float32, reflect.Float64:
+        n = value.Float()
+    case reflect.String:
+        n, unit = float64(len(value.String())), " characters"
+    case reflect.Slice, reflect.Array, reflect.Map:
+        n, unit = float64(value.Len()), " items"
+    }
+
+    if r.min != nil && n < *r.min {
+        return fmt.Sprintf("must be at least %s%s", strconv.FormatFloat(*r.min, 'f', -1, 64), unit)
+    }
+    if r.max != nil && n > *r.max {
+        return fmt.Sprintf("must be at most %s%s", strconv.FormatFloat(*r.max, 'f', -1, 64), unit)
+    }
+
+    if len(r.oneof) > 0 && value.Kind() == reflect.String {
+        for _, allowed := range r.oneof {
+            if value.String() == allowed {
+                return ""
+            }
+        }
+        return "must be one of " + strings.Join(r.oneof, ", ")
+    }
+    return ""
+}
+
+// describe adds the rules to a field's schema, returning whether the field
+// is required
+func (r rules) describe(schema map[string]any) bool {
+    minKey, maxKey := "minimum", "maximum"
+    switch schema["type"] {
+    case "string":
+        minKey, maxKey = "minLength", "maxLength"
+    case "array":
+        minKey, maxKey = "minItems", "maxItems"
+    }
+
+    if r.min != nil {
+        schema[minKey] = *r.min
+    }
+    if r.max != nil {
+        schema[maxKey] = *r.max
+    }
+    if len(r.oneof) > 0 {
+        schema["enum"] = r.oneof
+    }
+    return r.required
+}
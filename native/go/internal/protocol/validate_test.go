@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type testAccount struct {
+    Host string `json:"host" validate:"required"`
+    Port int    `json:"port" validate:"min=1,max=65535"`
+}
+
+type testParams struct {
+    Handle   int           `json:"handle" validate:"required"`
+    Folder   string        `json:"folder" validate:"max=10"`
+    Sort     string        `json:"sort" validate:"oneof=date size"`
+    UIDs     []uint32      `json:"uids" validate:"max=3"`
+    Accounts []testAccount `json:"accounts"`
+    Primary  *testAccount  `json:"primary"`
+    Page
+}
+
+func TestDecodeParams(t *testing.T) {
+    tests := []struct {
+        name   string
+        params string
+        field  string // The field rejected, or "" when the params are valid
+        reason string
+    }{
+        {"valid", `{"handle":1,"folder":"INBOX","sort":"size","uids":[1,2,3]}`, "", ""},
+        {"defaults left alone", `{"handle":1,"sort":"","page_size":0}`, "", ""},
+        {"missing required", `{}`, "params.handle", "required"},
+        {"zero required", `{"handle":0}`, "params.handle", "required"},
+        {"no params", ``, "params.handle", "required"},
+        {"string too long", `{"handle":1,"folder":"Archive/2024"}`, "params.folder", "must be at most 10 characters"},
+        {"too many items", `{"handle":1,"uids":[1,2,3,4]}`, "params.uids", "must be at most 3 items"},
+        {"not one of", `{"handle":1,"sort":"from"}`, "params.sort", "must be one of date, size"},
+        {"nested in list", `{"handle":1,"accounts":[{"host":"a","port":993},{"port":993}]}`, "params.accounts[1].host", "required"},
+        {"nested bound", `{"handle":1,"accounts":[{"host":"a","port":70000}]}`, "params.accounts[0].port", "must be at most 65535"},
+        {"nested pointer", `{"handle":1,"primary":{"host":""}}`, "params.primary.host", "required"},
+        {"embedded", `{"handle":1,"page_size":-1}`, "params.page_size", "must be at least 0"},
+        {"wrong type", `{"handle":"1"}`, "params.handle", "must be an integer, not string"},
+        {"wrong nested type", `{"handle":1,"uids":["a"]}`, "params.uids.0", "must be an integer, not string"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var p testParams
+            err := DecodeParams(context.Background(), json.RawMessage(tt.params), &p)
+            if tt.field == "" {
+                if err != nil {
+                    t.Fatalf("DecodeParams: %v", err)
+                }
+                return
+            }
+
+            var verr *ValidationError
+            if !errors.As(err, &verr) {
+                t.Fatalf("DecodeParams error %v, want a validation error", err)
+            }
+            if verr.Field != tt.field || verr.Reason != tt.reason {
+                t.Errorf("DecodeParams rejected %s: %s, want %s: %s", verr.Field, verr.Reason, tt.field, tt.reason)
+            }
+            if verr.ErrorCode() != CodeInvalidRequest {
+                t.Errorf("ErrorCode() = %s, want %s", verr.ErrorCode(), CodeInvalidRequest)
+            }
+        })
+    }
+}
+
+func TestDecodeParamsMalformed(t *testing.T) {
+    var p testParams
+    err := DecodeParams(context.Background(), json.RawMessage(`{"handle":`), &p)
+    var verr *ValidationError
+    if err == nil || errors.As(err, &verr) {
+        t.Errorf("DecodeParams error %v, want a JSON syntax error", err)
+    }
+}
+
+func TestParseRulesPanics(t *testing.T) {
+    tests := []string{"min=lots", "maximum=3"}
+
+    for _, tag := range tests {
+        t.Run(tag, func(t *testing.T) {
+            defer func() {
+                if recover() == nil {
+                    t.Errorf("parseRules(%q) didn't panic", tag)
+                }
+            }()
+            parseRules(tag)
+        })
+    }
+}
@@ -0,0 +1,115 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/rdawebb/kernel/native/internal/authfail"
+)
+
+// AuthPolicy describes which credentials a provider accepts over IMAP/SMTP
+type AuthPolicy int
+
+const (
+    AuthPassword    AuthPolicy = iota // The account password works
+    AuthAppPassword                   // Only app-specific passwords or OAuth2
+    AuthOAuthOnly                     // Password logins are disabled entirely
+)
+
+// Provider describes known behaviour of a mail provider
+type Provider struct {
+    Name    string
+    Domains []string // Server host suffixes
+
+    // SavesSent is set when the provider files messages submitted over SMTP
+    // into the Sent folder itself, so clients must not append a second copy
+    SavesSent bool
+
+    // MaxRecipients is the most RCPT TO a single SMTP transaction may
+    // carry, or 0 if unknown
+    MaxRecipients int
+
+    Auth    AuthPolicy
+    HelpURL string // How to create an app password or enable OAuth
+}
+
+// known is the provider knowledge base
+var known = []Provider{
+    {
+        Name:          "gmail",
+        Domains:       []string{"gmail.com", "googlemail.com"},
+        SavesSent:     true,
+        MaxRecipients: 100,
+        Auth:          AuthAppPassword,
+        HelpURL:       "https://support.google.com/accounts/answer/185833",
+    },
+    {
+        Name:          "yahoo",
+        Domains:       []string{"yahoo.com", "yahoo.co.uk", "yahoo.co.jp"},
+        MaxRecipients: 100,
+        Auth:          AuthAppPassword,
+        HelpURL:       "https://help.yahoo.com/kb/SLN15241.html",
+    },
+    {
+        Name:    "aol",
+        Domains: []string{"aol.com"},
+        Auth:    AuthAppPassword,
+        HelpURL: "https://help.aol.com/articles/Create-and-manage-app-password",
+    },
+    {
+        Name:          "icloud",
+        Domains:       []string{"mail.me.com", "icloud.com"},
+        MaxRecipients: 500,
+        Auth:          AuthAppPassword,
+        HelpURL:       "https://support.apple.com/en-us/102654",
+    },
+    {
+        Name:          "office365",
+        Domains:       []string{"office365.com", "outlook.com", "hotmail.com", "live.com"},
+        MaxRecipients: 500,
+        Auth:          AuthOAuthOnly,
+        HelpURL:       "https://learn.microsoft.com/en-us/exchange/clients-and-mobile-in-exchange-online/deprecation-of-basic-authentication-exchange-online",
+    },
+}
+
+// Lookup returns the provider serving host, or nil if it is not known
+func Lookup(host string) *Provider {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+    for i := range known {
+        for _, domain := range known[i].Domains {
+            if host == domain || strings.HasSuffix(host, "."+domain) {
+                return &known[i]
+            }
+        }
+    }
+
+    return nil
+}
+
+// Advise refines a failed password login with what the provider serving
+// host is known to require. A plain credential rejection from a provider that
+// never accepts account passwords is reported as needing an app password or
+// OAuth instead, so the user is told the remedy rather than to retype it.
+func Advise(host string, err *authfail.Error) *authfail.Error {
+    p := Lookup(host)
+    if p == nil {
+        return err
+    }
+
+    err.Provider = p.Name
+    if err.Kind == authfail.InvalidCredentials || err.Kind == authfail.Unknown {
+        switch p.Auth {
+        case AuthAppPassword:
+            err.Kind = authfail.AppPasswordRequired
+        case AuthOAuthOnly:
+            err.Kind = authfail.OAuthRequired
+        }
+    }
+
+    switch err.Kind {
+    case authfail.AppPasswordRequired, authfail.OAuthRequired, authfail.WebLoginRequired:
+        err.HelpURL = p.HelpURL
+    }
+
+    return err
+}
@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Limits bound one client. Zero disables a limit.
+type Limits struct {
+    MaxInFlight int     // Requests running at once
+    Rate        float64 // Requests per second, sustained
+    Burst       int     // Requests allowed at once above Rate; at least 1
+}
+
+// DefaultLimits are generous enough for any well-behaved frontend
+var DefaultLimits = Limits{MaxInFlight: 128, Rate: 200, Burst: 400}
+
+// Limiter applies Limits to one client with a token bucket for the rate
+type Limiter struct {
+    limits Limits
+
+    mu       sync.Mutex
+    inFlight int
+    tokens   float64
+    last     time.Time
+}
+
+// New creates a limiter starting with a full bucket
+func New(limits Limits) *Limiter {
+    if limits.Burst < 1 {
+        limits.Burst = 1
+    }
+    return &Limiter{limits: limits, tokens: float64(limits.Burst), last: time.Now()}
+}
+
+// Acquire admits one request, or refuses it with a *protocol.BusyError
+// saying when to retry. done must be called when an admitted request
+// finishes.
+func (l *Limiter) Acquire() (done func(), err error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if max := l.limits.MaxInFlight; max > 0 && l.inFlight >= max {
+        // Requests usually take tens of milliseconds; a short wait is enough
+        // for one to finish
+        return nil, &protocol.BusyError{
+            Reason:     fmt.Sprintf("%d requests already in flight", l.inFlight),
+            RetryAfter: 50 * time.Millisecond,
+        }
+    }
+
+    if err := l.take(); err != nil {
+        return nil, err
+    }
+
+    l.inFlight++
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            l.mu.Lock()
+            l.inFlight--
+            l.mu.Unlock()
+        })
+    }, nil
+}
+
+// Charge counts a request against the rate without taking an in-flight
+// slot, for a request run under a slot its caller already holds
+func (l *Limiter) Charge() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return l.take()
+}
+
+// take spends a token from the bucket; the caller holds l.mu
+func (l *Limiter) take() error {
+    rate := l.limits.Rate
+    if rate <= 0 {
+        return nil
+    }
+
+    now := time.Now()
+    l.tokens += now.Sub(l.last).Seconds() * rate
+    if burst := float64(l.limits.Burst); l.tokens > burst {
+        l.tokens = burst
+    }
+    l.last = now
+
+    if l.tokens < 1 {
+        wait := time.Duration((1 - l.tokens) / rate * float64(time.Second))
+        return &protocol.BusyError{
+            Reason:     fmt.Sprintf("more than %g requests per second", rate),
+            RetryAfter: wait.Round(time.Millisecond) + time.Millisecond,
+        }
+    }
+    l.tokens--
+    return nil
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+func TestAcquire(t *testing.T) {
+    l := New(Limits{MaxInFlight: 1})
+
+    done, err := l.Acquire()
+    if err != nil {
+        t.Fatalf("Acquire: %v", err)
+    }
+
+    var busy *protocol.BusyError
+    if _, err := l.Acquire(); !errors.As(err, &busy) {
+        t.Fatalf("Acquire past the limit gave %v, want BUSY", err)
+    }
+
+    // Charge only spends rate, so it runs under the slot already held
+    if err := l.Charge(); err != nil {
+        t.Errorf("Charge under a held slot: %v", err)
+    }
+
+    done()
+    done()
+    if _, err := l.Acquire(); err != nil {
+        t.Errorf("Acquire after done: %v", err)
+    }
+}
+
+func TestRate(t *testing.T) {
+    l := New(Limits{Rate: 0.001, Burst: 2})
+
+    if _, err := l.Acquire(); err != nil {
+        t.Fatalf("Acquire: %v", err)
+    }
+    if err := l.Charge(); err != nil {
+        t.Fatalf("Charge: %v", err)
+    }
+
+    var busy *protocol.BusyError
+    if err := l.Charge(); !errors.As(err, &busy) || busy.RetryAfter <= 0 {
+        t.Errorf("Charge past the burst gave %v, want BUSY with a retry time", err)
+    }
+}
@@ -0,0 +1,137 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Class groups actions that are equally safe to repeat
+type Class string
+
+const (
+    Read     Class = "read"     // Idempotent; repeating has no further effect
+    Mutation Class = "mutation" // May have taken effect even when it failed
+)
+
+// Policy says how often and on which error codes a class is retried
+type Policy struct {
+    Attempts    int      `json:"attempts"`      // Including the first; 1 disables retries
+    BaseDelayMS int      `json:"base_delay_ms"` // Before the first retry, doubled per retry
+    MaxDelayMS  int      `json:"max_delay_ms"`
+    RetryOn     []string `json:"retry_on"` // Error codes worth retrying
+}
+
+// DefaultPolicies retry reads through transient network trouble. Mutations
+// are not retried by default, since a lost reply doesn't prove the server
+// didn't act.
+var DefaultPolicies = map[Class]Policy{
+    Read: {
+        Attempts:    3,
+        BaseDelayMS: 250,
+        MaxDelayMS:  2000,
+        RetryOn:     []string{protocol.CodeNetwork, protocol.CodeTimeout, "AUTH_TEMPORARY"},
+    },
+    Mutation: {
+        Attempts:    1,
+        BaseDelayMS: 250,
+        MaxDelayMS:  2000,
+    },
+}
+
+// Policies holds the retry policy of each class
+type Policies struct {
+    mu      sync.RWMutex
+    byClass map[Class]Policy
+}
+
+// New creates policies starting from DefaultPolicies
+func New() *Policies {
+    p := &Policies{byClass: make(map[Class]Policy, len(DefaultPolicies))}
+    for class, policy := range DefaultPolicies {
+        p.byClass[class] = policy
+    }
+    return p
+}
+
+// Get returns a class's policy
+func (p *Policies) Get(class Class) Policy {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    return p.byClass[class]
+}
+
+// All returns every class's policy
+func (p *Policies) All() map[Class]Policy {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    all := make(map[Class]Policy, len(p.byClass))
+    for class, policy := range p.byClass {
+        all[class] = policy
+    }
+    return all
+}
+
+// Set replaces a class's policy
+func (p *Policies) Set(class Class, policy Policy) error {
+    if class != Read && class != Mutation {
+        return fmt.Errorf("unknown action class: %s", class)
+    }
+    if policy.Attempts < 1 {
+        return fmt.Errorf("attempts must be at least 1")
+    }
+    if policy.MaxDelayMS < policy.BaseDelayMS {
+        policy.MaxDelayMS = policy.BaseDelayMS
+    }
+
+    p.mu.Lock()
+    p.byClass[class] = policy
+    p.mu.Unlock()
+    return nil
+}
+
+// Do runs fn, retrying failures whose error code the class's policy lists,
+// with jittered exponential backoff. It stops early when ctx ends.
+func (p *Policies) Do(ctx context.Context, class Class, fn func() protocol.Response) protocol.Response {
+    policy := p.Get(class)
+
+    delay := time.Duration(policy.BaseDelayMS) * time.Millisecond
+    maxDelay := time.Duration(policy.MaxDelayMS) * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        resp := fn()
+        if resp.Success || attempt >= policy.Attempts || !retryable(policy, resp.ErrorCode) {
+            return resp
+        }
+
+        // Up to half the delay again, so clients retrying together spread out
+        wait := delay
+        if delay > 0 {
+            wait += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+        }
+
+        select {
+        case <-ctx.Done():
+            return resp
+        case <-time.After(wait):
+        }
+
+        delay *= 2
+        if delay > maxDelay {
+            delay = maxDelay
+        }
+    }
+}
+
+func retryable(policy Policy, code string) bool {
+    for _, c := range policy.RetryOn {
+        if c == code {
+            return true
+        }
+    }
+    return false
+}
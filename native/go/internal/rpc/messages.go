@@ -0,0 +1,243 @@
+package rpc
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of native.proto, encoded by hand with protowire so the build
+// needs no protoc. Field numbers must match native.proto.
+
+// Request runs one action
+type Request struct {
+    ID        string
+    Module    string
+    Action    string
+    Params    []byte // JSON
+    TraceID   string
+    TimeoutMS int32
+    Priority  string
+}
+
+// Response is the result, or one partial result, of a request
+type Response struct {
+    ID           string
+    Success      bool
+    Data         []byte // JSON
+    Error        string
+    ErrorCode    string
+    ErrorDetails []byte // JSON
+    TraceID      string
+    Partial      bool
+}
+
+// Subscription selects events by type prefix
+type Subscription struct {
+    Types []string
+}
+
+// Event is a pushed notification
+type Event struct {
+    Event      string
+    Module     string
+    Handle     int32
+    Data       []byte // JSON
+    TimeUnixMS int64
+    TraceID    string // Of the request that raised the event
+}
+
+func (m *Request) Marshal() ([]byte, error) {
+    var b []byte
+    b = appendString(b, 1, m.ID)
+    b = appendString(b, 2, m.Module)
+    b = appendString(b, 3, m.Action)
+    b = appendBytes(b, 4, m.Params)
+    b = appendString(b, 5, m.TraceID)
+    b = appendVarint(b, 6, uint64(m.TimeoutMS))
+    b = appendString(b, 7, m.Priority)
+    return b, nil
+}
+
+func (m *Request) Unmarshal(b []byte) error {
+    return walk(b, func(num protowire.Number, v field) {
+        switch num {
+        case 1:
+            m.ID = v.str()
+        case 2:
+            m.Module = v.str()
+        case 3:
+            m.Action = v.str()
+        case 4:
+            m.Params = v.bytes
+        case 5:
+            m.TraceID = v.str()
+        case 6:
+            m.TimeoutMS = int32(v.varint)
+        case 7:
+            m.Priority = v.str()
+        }
+    })
+}
+
+func (m *Response) Marshal() ([]byte, error) {
+    var b []byte
+    b = appendString(b, 1, m.ID)
+    b = appendBool(b, 2, m.Success)
+    b = appendBytes(b, 3, m.Data)
+    b = appendString(b, 4, m.Error)
+    b = appendString(b, 5, m.ErrorCode)
+    b = appendBytes(b, 6, m.ErrorDetails)
+    b = appendString(b, 7, m.TraceID)
+    b = appendBool(b, 8, m.Partial)
+    return b, nil
+}
+
+func (m *Response) Unmarshal(b []byte) error {
+    return walk(b, func(num protowire.Number, v field) {
+        switch num {
+        case 1:
+            m.ID = v.str()
+        case 2:
+            m.Success = v.varint != 0
+        case 3:
+            m.Data = v.bytes
+        case 4:
+            m.Error = v.str()
+        case 5:
+            m.ErrorCode = v.str()
+        case 6:
+            m.ErrorDetails = v.bytes
+        case 7:
+            m.TraceID = v.str()
+        case 8:
+            m.Partial = v.varint != 0
+        }
+    })
+}
+
+func (m *Subscription) Marshal() ([]byte, error) {
+    var b []byte
+    for _, t := range m.Types {
+        b = protowire.AppendTag(b, 1, protowire.BytesType)
+        b = protowire.AppendString(b, t)
+    }
+    return b, nil
+}
+
+func (m *Subscription) Unmarshal(b []byte) error {
+    return walk(b, func(num protowire.Number, v field) {
+        if num == 1 {
+            m.Types = append(m.Types, v.str())
+        }
+    })
+}
+
+func (m *Event) Marshal() ([]byte, error) {
+    var b []byte
+    b = appendString(b, 1, m.Event)
+    b = appendString(b, 2, m.Module)
+    b = appendVarint(b, 3, uint64(m.Handle))
+    b = appendBytes(b, 4, m.Data)
+    b = appendVarint(b, 5, uint64(m.TimeUnixMS))
+    b = appendString(b, 6, m.TraceID)
+    return b, nil
+}
+
+func (m *Event) Unmarshal(b []byte) error {
+    return walk(b, func(num protowire.Number, v field) {
+        switch num {
+        case 1:
+            m.Event = v.str()
+        case 2:
+            m.Module = v.str()
+        case 3:
+            m.Handle = int32(v.varint)
+        case 4:
+            m.Data = v.bytes
+        case 5:
+            m.TimeUnixMS = int64(v.varint)
+        case 6:
+            m.TraceID = v.str()
+        }
+    })
+}
+
+// Proto3 omits fields holding their zero value
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+    if s == "" {
+        return b
+    }
+    b = protowire.AppendTag(b, num, protowire.BytesType)
+    return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+    if len(v) == 0 {
+        return b
+    }
+    b = protowire.AppendTag(b, num, protowire.BytesType)
+    return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+    if v == 0 {
+        return b
+    }
+    b = protowire.AppendTag(b, num, protowire.VarintType)
+    return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+    if !v {
+        return b
+    }
+    return appendVarint(b, num, 1)
+}
+
+// field is a decoded field value of either wire type we use
+type field struct {
+    varint uint64
+    bytes  []byte
+}
+
+func (f field) str() string {
+    return string(f.bytes)
+}
+
+// walk decodes a message, calling fn for each varint or length-delimited
+// field and skipping any other (unknown) fields
+func walk(b []byte, fn func(protowire.Number, field)) error {
+    for len(b) > 0 {
+        num, typ, n := protowire.ConsumeTag(b)
+        if n < 0 {
+            return fmt.Errorf("invalid tag: %w", protowire.ParseError(n))
+        }
+        b = b[n:]
+
+        switch typ {
+        case protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            if n < 0 {
+                return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+            }
+            fn(num, field{varint: v})
+            b = b[n:]
+        case protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+            }
+            fn(num, field{bytes: append([]byte(nil), v...)})
+            b = b[n:]
+        default:
+            n := protowire.ConsumeFieldValue(num, typ, b)
+            if n < 0 {
+                return fmt.Errorf("invalid field %d: %w", num, protowire.ParseError(n))
+            }
+            b = b[n:]
+        }
+    }
+    return nil
+}
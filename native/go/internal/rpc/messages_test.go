@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Vectors shared with tests/test_native_grpc.py, so the Go and Python
+// encoders are held to the same bytes
+const (
+    goldenRequest  = "0a01311204696d61701a0b7365617263685f75696473220c7b2268616e646c65223a317d2a017430f4033a0462756c6b"
+    goldenResponse = "0a013110011a0c7b2275696473223a5b365d7d3a01744001"
+)
+
+type message interface {
+    Marshal() ([]byte, error)
+    Unmarshal([]byte) error
+}
+
+func TestRoundTrip(t *testing.T) {
+    tests := []struct {
+        name  string
+        in    message
+        empty message
+    }{
+        {"request", &Request{ID: "1", Module: "imap", Action: "noop", Params: []byte(`{}`), TraceID: "t", TimeoutMS: 500, Priority: "bulk"}, &Request{}},
+        {"negative timeout", &Request{Module: "imap", Action: "noop", TimeoutMS: -1}, &Request{}},
+        {"response", &Response{ID: "1", Success: true, Data: []byte(`[1]`), Error: "e", ErrorCode: "C", ErrorDetails: []byte(`{}`), TraceID: "t", Partial: true}, &Response{}},
+        {"subscription", &Subscription{Types: []string{"imap.", "smtp."}}, &Subscription{}},
+        {"event", &Event{Event: "folder.changed", Module: "imap", Handle: 4, Data: []byte(`{}`), TimeUnixMS: 1700000000000, TraceID: "t-1"}, &Event{}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b, err := tt.in.Marshal()
+            if err != nil {
+                t.Fatalf("Marshal: %v", err)
+            }
+            if err := tt.empty.Unmarshal(b); err != nil {
+                t.Fatalf("Unmarshal: %v", err)
+            }
+            if !reflect.DeepEqual(tt.in, tt.empty) {
+                t.Errorf("round trip gave %+v, want %+v", tt.empty, tt.in)
+            }
+        })
+    }
+}
+
+func TestGolden(t *testing.T) {
+    tests := []struct {
+        name   string
+        in     message
+        golden string
+    }{
+        {"request", &Request{ID: "1", Module: "imap", Action: "search_uids", Params: []byte(`{"handle":1}`), TraceID: "t", TimeoutMS: 500, Priority: "bulk"}, goldenRequest},
+        {"response", &Response{ID: "1", Success: true, Data: []byte(`{"uids":[6]}`), TraceID: "t", Partial: true}, goldenResponse},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            want, _ := hex.DecodeString(tt.golden)
+            got, err := tt.in.Marshal()
+            if err != nil {
+                t.Fatalf("Marshal: %v", err)
+            }
+            if !bytes.Equal(got, want) {
+                t.Errorf("Marshal = %x, want %s", got, tt.golden)
+            }
+        })
+    }
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        in   []byte
+    }{
+        {"truncated tag", []byte{0x80}},
+        {"truncated length", []byte{0x0a}},
+        {"length past end", []byte{0x0a, 0x05, 'a'}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if err := (&Request{}).Unmarshal(tt.in); err == nil {
+                t.Error("Unmarshal succeeded, want an error")
+            }
+        })
+    }
+}
+
+func TestUnknownFieldsSkipped(t *testing.T) {
+    b, _ := (&Response{ID: "1"}).Marshal()
+    b = append(b, 0xca, 0x01, 0x01, 'x') // field 25, bytes
+    b = append(b, 0x10, 0x01)             // success
+
+    var got Response
+    if err := got.Unmarshal(b); err != nil {
+        t.Fatalf("Unmarshal: %v", err)
+    }
+    if got.ID != "1" || !got.Success {
+        t.Errorf("got %+v, want ID 1 and success", got)
+    }
+}
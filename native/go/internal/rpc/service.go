@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified gRPC service name from native.proto
+const ServiceName = "kernel.native.Native"
+
+// Server is implemented by the native helper to serve the Native service
+type Server interface {
+    Call(ctx context.Context, req *Request) (*Response, error)
+    CallStream(ctx context.Context, req *Request, send func(*Response) error) error
+    Events(ctx context.Context, sub *Subscription, send func(*Event) error) error
+}
+
+// Register adds the Native service, backed by srv, to a gRPC server
+func Register(s *grpc.Server, srv Server) {
+    s.RegisterService(&serviceDesc, srv)
+}
+
+// Codec encodes the hand-written messages. It is registered under the name
+// "proto" so standard gRPC clients, which send application/grpc+proto,
+// interoperate; use it with grpc.ForceServerCodec.
+type Codec struct{}
+
+type wireMessage interface {
+    Marshal() ([]byte, error)
+    Unmarshal([]byte) error
+}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+    m, ok := v.(wireMessage)
+    if !ok {
+        return nil, fmt.Errorf("rpc: cannot encode %T", v)
+    }
+    return m.Marshal()
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+    m, ok := v.(wireMessage)
+    if !ok {
+        return fmt.Errorf("rpc: cannot decode into %T", v)
+    }
+    return m.Unmarshal(data)
+}
+
+func (Codec) Name() string {
+    return "proto"
+}
+
+var serviceDesc = grpc.ServiceDesc{
+    ServiceName: ServiceName,
+    HandlerType: (*Server)(nil),
+    Methods: []grpc.MethodDesc{
+        {MethodName: "Call", Handler: callHandler},
+    },
+    Streams: []grpc.StreamDesc{
+        {StreamName: "CallStream", Handler: callStreamHandler, ServerStreams: true},
+        {StreamName: "Events", Handler: eventsHandler, ServerStreams: true},
+    },
+    Metadata: "native.proto",
+}
+
+func callHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+    req := new(Request)
+    if err := dec(req); err != nil {
+        return nil, err
+    }
+
+    if interceptor == nil {
+        return srv.(Server).Call(ctx, req)
+    }
+
+    info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/Call"}
+    return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+        return srv.(Server).Call(ctx, req.(*Request))
+    })
+}
+
+func callStreamHandler(srv any, stream grpc.ServerStream) error {
+    req := new(Request)
+    if err := stream.RecvMsg(req); err != nil {
+        return err
+    }
+
+    send := func(resp *Response) error {
+        return stream.SendMsg(resp)
+    }
+    return srv.(Server).CallStream(stream.Context(), req, send)
+}
+
+func eventsHandler(srv any, stream grpc.ServerStream) error {
+    sub := new(Subscription)
+    if err := stream.RecvMsg(sub); err != nil {
+        return err
+    }
+
+    send := func(e *Event) error {
+        return stream.SendMsg(e)
+    }
+    return srv.(Server).Events(stream.Context(), sub, send)
+}
@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// bucketBounds are the upper bounds of the latency histogram in milliseconds;
+// a final overflow bucket catches everything slower
+var bucketBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// OpStats aggregates one operation's count and latency
+type OpStats struct {
+    Count   int64   `json:"count"`
+    Errors  int64   `json:"errors"`
+    TotalMs float64 `json:"total_ms"`
+    MaxMs   float64 `json:"max_ms"`
+    Buckets []int64 `json:"buckets"` // Counts per bucketBounds entry, plus overflow
+}
+
+func (s *OpStats) add(ms float64, failed bool) {
+    if s.Buckets == nil {
+        s.Buckets = make([]int64, len(bucketBounds)+1)
+    }
+
+    s.Count++
+    if failed {
+        s.Errors++
+    }
+    s.TotalMs += ms
+    if ms > s.MaxMs {
+        s.MaxMs = ms
+    }
+
+    i := 0
+    for i < len(bucketBounds) && ms > bucketBounds[i] {
+        i++
+    }
+    s.Buckets[i]++
+}
+
+func (s *OpStats) clone() *OpStats {
+    c := *s
+    c.Buckets = append([]int64(nil), s.Buckets...)
+    return &c
+}
+
+// Snapshot is a point-in-time copy of recorded statistics
+type Snapshot struct {
+    Since        time.Time           `json:"since"`
+    BucketBounds []float64           `json:"bucket_bounds_ms"`
+    Operations   map[string]*OpStats `json:"operations"`
+}
+
+// Recorder collects operation statistics globally and per handle
+type Recorder struct {
+    mu      sync.Mutex
+    started time.Time
+    global  map[string]*OpStats
+    handles map[int]map[string]*OpStats
+}
+
+// NewRecorder creates an empty recorder
+func NewRecorder() *Recorder {
+    return &Recorder{
+        started: time.Now(),
+        global:  make(map[string]*OpStats),
+        handles: make(map[int]map[string]*OpStats),
+    }
+}
+
+// Record adds one completed operation; handle 0 records it globally only
+func (r *Recorder) Record(op string, handle int, elapsed time.Duration, failed bool) {
+    ms := float64(elapsed.Microseconds()) / 1000
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    entry, ok := r.global[op]
+    if !ok {
+        entry = &OpStats{}
+        r.global[op] = entry
+    }
+    entry.add(ms, failed)
+
+    if handle == 0 {
+        return
+    }
+
+    ops, ok := r.handles[handle]
+    if !ok {
+        ops = make(map[string]*OpStats)
+        r.handles[handle] = ops
+    }
+    entry, ok = ops[op]
+    if !ok {
+        entry = &OpStats{}
+        ops[op] = entry
+    }
+    entry.add(ms, failed)
+}
+
+// Global returns statistics across all handles since startup
+func (r *Recorder) Global() Snapshot {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    return r.snapshot(r.global)
+}
+
+// Handle returns statistics for a single handle
+func (r *Recorder) Handle(handle int) Snapshot {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    return r.snapshot(r.handles[handle])
+}
+
+// Forget drops the statistics of a closed handle
+func (r *Recorder) Forget(handle int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    delete(r.handles, handle)
+}
+
+func (r *Recorder) snapshot(ops map[string]*OpStats) Snapshot {
+    snap := Snapshot{
+        Since:        r.started,
+        BucketBounds: bucketBounds,
+        Operations:   make(map[string]*OpStats, len(ops)),
+    }
+    for op, s := range ops {
+        snap.Operations[op] = s.clone()
+    }
+    return snap
+}
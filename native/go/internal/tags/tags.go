@@ -0,0 +1,192 @@
+package tags
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/rdawebb/kernel/native/internal/atomicfile"
+)
+
+// folderTags holds the local labels of one folder. Labels are keyed by UID
+// and only valid for the UIDVALIDITY they were recorded under.
+type folderTags struct {
+    UIDValidity uint32              `json:"uid_validity"`
+    Labels      map[uint32][]string `json:"labels"`
+}
+
+// accountTags holds the local labels of one account, keyed by folder
+type accountTags map[string]*folderTags
+
+// Store keeps labels for servers that support neither Gmail labels nor
+// custom keywords, as one JSON file per account
+type Store struct {
+    mu  sync.Mutex
+    dir string
+}
+
+// Open opens (creating if needed) a tag store in dir
+func Open(dir string) (*Store, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create tag store: %w", err)
+    }
+
+    return &Store{dir: dir}, nil
+}
+
+// Add labels messages in a folder
+func (s *Store) Add(account, folder string, uidValidity uint32, uids []uint32, label string) error {
+    return s.update(account, folder, uidValidity, func(ft *folderTags) {
+        for _, uid := range uids {
+            if !contains(ft.Labels[uid], label) {
+                ft.Labels[uid] = append(ft.Labels[uid], label)
+            }
+        }
+    })
+}
+
+// Remove unlabels messages in a folder
+func (s *Store) Remove(account, folder string, uidValidity uint32, uids []uint32, label string) error {
+    return s.update(account, folder, uidValidity, func(ft *folderTags) {
+        for _, uid := range uids {
+            kept := ft.Labels[uid][:0]
+            for _, l := range ft.Labels[uid] {
+                if l != label {
+                    kept = append(kept, l)
+                }
+            }
+            if len(kept) == 0 {
+                delete(ft.Labels, uid)
+            } else {
+                ft.Labels[uid] = kept
+            }
+        }
+    })
+}
+
+// Search returns the UIDs in a folder carrying label, in ascending order
+func (s *Store) Search(account, folder string, uidValidity uint32, label string) ([]uint32, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    tags, err := s.read(account)
+    if err != nil {
+        return nil, err
+    }
+
+    ft := tags[folder]
+    if ft == nil || ft.UIDValidity != uidValidity {
+        return nil, nil
+    }
+
+    var uids []uint32
+    for uid, labels := range ft.Labels {
+        if contains(labels, label) {
+            uids = append(uids, uid)
+        }
+    }
+    sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+    return uids, nil
+}
+
+// Remap carries a folder's labels over to a new UIDVALIDITY, moving each
+// old UID's labels to its new UID. Labels of UIDs missing from remap are
+// dropped, as are labels recorded under any other UIDVALIDITY.
+func (s *Store) Remap(account, folder string, oldValidity, newValidity uint32, remap map[uint32]uint32) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    tags, err := s.read(account)
+    if err != nil {
+        return err
+    }
+
+    ft := tags[folder]
+    if ft == nil {
+        return nil
+    }
+
+    moved := &folderTags{UIDValidity: newValidity, Labels: make(map[uint32][]string)}
+    if ft.UIDValidity == oldValidity {
+        for uid, labels := range ft.Labels {
+            if newUID, ok := remap[uid]; ok {
+                moved.Labels[newUID] = labels
+            }
+        }
+    }
+
+    tags[folder] = moved
+    return s.write(account, tags)
+}
+
+func (s *Store) update(account, folder string, uidValidity uint32, fn func(*folderTags)) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    tags, err := s.read(account)
+    if err != nil {
+        return err
+    }
+
+    // A new UIDVALIDITY means the old UIDs now name different messages
+    ft := tags[folder]
+    if ft == nil || ft.UIDValidity != uidValidity {
+        ft = &folderTags{UIDValidity: uidValidity, Labels: make(map[uint32][]string)}
+        tags[folder] = ft
+    }
+
+    fn(ft)
+    return s.write(account, tags)
+}
+
+// path names the account's file by hash, so any account string is safe
+func (s *Store) path(account string) string {
+    sum := sha256.Sum256([]byte(account))
+    return filepath.Join(s.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+func (s *Store) read(account string) (accountTags, error) {
+    data, err := os.ReadFile(s.path(account))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return make(accountTags), nil
+        }
+        return nil, err
+    }
+
+    tags := make(accountTags)
+    if err := json.Unmarshal(data, &tags); err != nil {
+        return nil, fmt.Errorf("corrupt tag store: %w", err)
+    }
+
+    return tags, nil
+}
+
+// write stores an account's tags atomically
+func (s *Store) write(account string, tags accountTags) error {
+    data, err := json.Marshal(tags)
+    if err != nil {
+        return err
+    }
+
+    path := s.path(account)
+    if err := atomicfile.Write(path, data); err != nil {
+        return fmt.Errorf("failed to write tag store: %w", err)
+    }
+    return nil
+}
+
+func contains(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,147 @@
+package tags
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+    type op struct {
+        kind     string // add, remove or remap
+        validity uint32
+        uids     []uint32
+        label    string
+        remap    map[uint32]uint32
+    }
+
+    tests := []struct {
+        name     string
+        ops      []op
+        validity uint32
+        label    string
+        want     []uint32
+    }{
+        {"add", []op{{kind: "add", validity: 1, uids: []uint32{5, 3}, label: "work"}}, 1, "work", []uint32{3, 5}},
+        {"add twice", []op{{kind: "add", validity: 1, uids: []uint32{3}, label: "work"}, {kind: "add", validity: 1, uids: []uint32{3}, label: "work"}}, 1, "work", []uint32{3}},
+        {"other label", []op{{kind: "add", validity: 1, uids: []uint32{3}, label: "work"}}, 1, "home", nil},
+        {"remove", []op{{kind: "add", validity: 1, uids: []uint32{3, 4}, label: "work"}, {kind: "remove", validity: 1, uids: []uint32{3}, label: "work"}}, 1, "work", []uint32{4}},
+        {"other validity", []op{{kind: "add", validity: 1, uids: []uint32{3}, label: "work"}}, 2, "work", nil},
+        {"new validity drops old", []op{{kind: "add", validity: 1, uids: []uint32{3}, label: "work"}, {kind: "add", validity: 2, uids: []uint32{9}, label: "home"}}, 2, "work", nil},
+        {"remap", []op{{kind: "add", validity: 1, uids: []uint32{3, 4}, label: "work"}, {kind: "remap", validity: 1, remap: map[uint32]uint32{3: 30}}}, 2, "work", []uint32{30}},
+        {"remap from stale validity", []op{{kind: "add", validity: 1, uids: []uint32{3}, label: "work"}, {kind: "remap", validity: 7, remap: map[uint32]uint32{3: 30}}}, 2, "work", nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s, err := Open(t.TempDir())
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            for _, o := range tt.ops {
+                switch o.kind {
+                case "add":
+                    err = s.Add("me@example.com", "INBOX", o.validity, o.uids, o.label)
+                case "remove":
+                    err = s.Remove("me@example.com", "INBOX", o.validity, o.uids, o.label)
+                case "remap":
+                    err = s.Remap("me@example.com", "INBOX", o.validity, 2, o.remap)
+                }
+                if err != nil {
+                    t.Fatalf("%s: %v", o.kind, err)
+                }
+            }
+
+            // Reopened, so the labels come from disk
+            s, err = Open(s.dir)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got, err := s.Search("me@example.com", "INBOX", tt.validity, tt.label)
+            if err != nil {
+                t.Fatalf("Search: %v", err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Search gave %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestAccountsAndFolders(t *testing.T) {
+    s, err := Open(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := s.Add("me@example.com", "INBOX", 1, []uint32{3}, "work"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Add("../you", "INBOX", 1, []uint32{4}, "work"); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        account, folder string
+        want            []uint32
+    }{
+        {"me@example.com", "INBOX", []uint32{3}},
+        {"../you", "INBOX", []uint32{4}},
+        {"me@example.com", "Archive", nil},
+        {"nobody", "INBOX", nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.account+"/"+tt.folder, func(t *testing.T) {
+            got, err := s.Search(tt.account, tt.folder, 1, "work")
+            if err != nil {
+                t.Fatalf("Search: %v", err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("Search gave %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCorruptFile(t *testing.T) {
+    tests := []struct {
+        name string
+        data string
+    }{
+        {"truncated", `{"INBOX":{"uid_validity":1,`},
+        {"wrong shape", `["INBOX"]`},
+        {"bad UID", `{"INBOX":{"uid_validity":1,"labels":{"x":["work"]}}}`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s, err := Open(t.TempDir())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if err := os.WriteFile(s.path("me@example.com"), []byte(tt.data), 0600); err != nil {
+                t.Fatal(err)
+            }
+
+            if _, err := s.Search("me@example.com", "INBOX", 1, "work"); err == nil {
+                t.Error("Search of a corrupt store succeeded")
+            }
+
+            // Writes refuse rather than replace what can't be read
+            if err := s.Add("me@example.com", "INBOX", 1, []uint32{3}, "work"); err == nil {
+                t.Error("Add over a corrupt store succeeded")
+            }
+            data, err := os.ReadFile(s.path("me@example.com"))
+            if err != nil || string(data) != tt.data {
+                t.Errorf("corrupt store overwritten with %q", data)
+            }
+
+            // Other accounts are unaffected
+            if err := s.Add("you@example.com", "INBOX", 1, []uint32{3}, "work"); err != nil {
+                t.Errorf("Add for another account: %v", err)
+            }
+        })
+    }
+}
@@ -0,0 +1,278 @@
+package tlscheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSP statuses
+const (
+    StatusGood        = "good"
+    StatusRevoked     = "revoked"
+    StatusUnknown     = "unknown"     // The responder doesn't know the certificate
+    StatusUnavailable = "unavailable" // No stapled response and none fetched
+)
+
+// ocspTimeout bounds a query to the CA's OCSP responder
+const ocspTimeout = 10 * time.Second
+
+// maxOCSPResponse bounds what is read from a responder
+const maxOCSPResponse = 64 << 10
+
+// sctListOID is the X.509 extension carrying embedded SCTs (RFC 6962)
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// Options choose the checks beyond reading the handshake
+type Options struct {
+    OCSP bool // Ask the CA's responder when the server stapled nothing
+}
+
+// OCSPResult is the revocation status of the server certificate
+type OCSPResult struct {
+    Status     string     `json:"status"`
+    Source     string     `json:"source,omitempty"` // "stapled" or "responder"
+    ProducedAt *time.Time `json:"produced_at,omitempty"`
+    NextUpdate *time.Time `json:"next_update,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+    Error      string     `json:"error,omitempty"`
+}
+
+// SCT is one signed certificate timestamp, a log's promise to publish the
+// certificate
+type SCT struct {
+    LogID     string    `json:"log_id"` // Hex SHA-256 of the log's key
+    Timestamp time.Time `json:"timestamp"`
+    Source    string    `json:"source"` // "embedded" or "tls"
+}
+
+// Report describes a server's TLS session and certificate
+type Report struct {
+    Version     string      `json:"version"`
+    CipherSuite string      `json:"cipher_suite"`
+    Subject     string      `json:"subject,omitempty"`
+    Issuer      string      `json:"issuer,omitempty"`
+    NotAfter    time.Time   `json:"not_after,omitempty"`
+    OCSP        *OCSPResult `json:"ocsp"`
+    SCTs        []SCT       `json:"scts"`
+    Warnings    []string    `json:"warnings"`
+}
+
+// Inspect reports on a TLS session. Chain validation already happened in
+// the handshake; this adds revocation status from OCSP and whether the
+// certificate was submitted to Certificate Transparency logs. SCT
+// signatures aren't verified, as that needs a trusted list of logs, so
+// the CT check only shows the certificate claims to be logged.
+func Inspect(ctx context.Context, state tls.ConnectionState, opts Options) *Report {
+    report := &Report{
+        Version:     tls.VersionName(state.Version),
+        CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+        OCSP:        &OCSPResult{Status: StatusUnavailable},
+        SCTs:        []SCT{},
+        Warnings:    []string{},
+    }
+    if len(state.PeerCertificates) == 0 {
+        report.Warnings = append(report.Warnings, "server presented no certificate")
+        return report
+    }
+
+    leaf := state.PeerCertificates[0]
+    report.Subject = leaf.Subject.CommonName
+    report.Issuer = leaf.Issuer.CommonName
+    report.NotAfter = leaf.NotAfter
+
+    if state.Version < tls.VersionTLS12 {
+        report.Warnings = append(report.Warnings, report.Version+" is obsolete")
+    }
+    if until := time.Until(leaf.NotAfter); until < 14*24*time.Hour {
+        report.Warnings = append(report.Warnings, fmt.Sprintf("certificate expires %s", leaf.NotAfter.UTC().Format(time.RFC3339)))
+    }
+
+    issuer := issuerOf(state)
+    report.OCSP = checkOCSP(ctx, state.OCSPResponse, leaf, issuer, opts.OCSP)
+    switch report.OCSP.Status {
+    case StatusRevoked:
+        report.Warnings = append(report.Warnings, "certificate has been revoked")
+    case StatusUnknown:
+        report.Warnings = append(report.Warnings, "OCSP responder does not know the certificate")
+    }
+
+    report.SCTs = append(report.SCTs, embeddedSCTs(leaf)...)
+    for _, raw := range state.SignedCertificateTimestamps {
+        if sct, err := parseSCT(raw, "tls"); err == nil {
+            report.SCTs = append(report.SCTs, sct)
+        }
+    }
+    if len(report.SCTs) == 0 {
+        report.Warnings = append(report.Warnings, "certificate carries no Certificate Transparency timestamps")
+    }
+
+    return report
+}
+
+// Unencrypted reports a connection that never negotiated TLS
+func Unencrypted() *Report {
+    return &Report{
+        Version:  "none",
+        OCSP:     &OCSPResult{Status: StatusUnavailable},
+        SCTs:     []SCT{},
+        Warnings: []string{"connection is not encrypted"},
+    }
+}
+
+// issuerOf returns the certificate that signed the leaf, preferring the
+// chain the handshake verified
+func issuerOf(state tls.ConnectionState) *x509.Certificate {
+    if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 1 {
+        return state.VerifiedChains[0][1]
+    }
+    if len(state.PeerCertificates) > 1 {
+        return state.PeerCertificates[1]
+    }
+    return nil
+}
+
+// checkOCSP reads a stapled response, or asks the responder if fetch is set
+func checkOCSP(ctx context.Context, stapled []byte, leaf, issuer *x509.Certificate, fetch bool) *OCSPResult {
+    source := "stapled"
+    raw := stapled
+
+    if len(raw) == 0 {
+        if !fetch {
+            return &OCSPResult{Status: StatusUnavailable}
+        }
+        if issuer == nil {
+            return &OCSPResult{Status: StatusUnavailable, Error: "issuer certificate not available"}
+        }
+        if len(leaf.OCSPServer) == 0 {
+            return &OCSPResult{Status: StatusUnavailable, Error: "certificate names no OCSP responder"}
+        }
+
+        var err error
+        source = "responder"
+        if raw, err = queryOCSP(ctx, leaf.OCSPServer[0], leaf, issuer); err != nil {
+            return &OCSPResult{Status: StatusUnavailable, Source: source, Error: err.Error()}
+        }
+    }
+
+    resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+    if err != nil {
+        return &OCSPResult{Status: StatusUnavailable, Source: source, Error: fmt.Sprintf("invalid OCSP response: %v", err)}
+    }
+
+    result := &OCSPResult{
+        Status:     StatusUnknown,
+        Source:     source,
+        ProducedAt: &resp.ProducedAt,
+    }
+    if !resp.NextUpdate.IsZero() {
+        result.NextUpdate = &resp.NextUpdate
+    }
+    switch resp.Status {
+    case ocsp.Good:
+        result.Status = StatusGood
+    case ocsp.Revoked:
+        result.Status = StatusRevoked
+        result.RevokedAt = &resp.RevokedAt
+    }
+    return result
+}
+
+// queryOCSP posts an OCSP request to a responder
+func queryOCSP(ctx context.Context, server string, leaf, issuer *x509.Certificate) ([]byte, error) {
+    body, err := ocsp.CreateRequest(leaf, issuer, nil)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, ocspTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(body))
+    if err != nil {
+        return nil, fmt.Errorf("invalid OCSP responder %q: %w", server, err)
+    }
+    req.Header.Set("Content-Type", "application/ocsp-request")
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("OCSP query failed: %w", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+    }
+    return io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+}
+
+// embeddedSCTs reads the SCT list extension of a certificate
+func embeddedSCTs(cert *x509.Certificate) []SCT {
+    var result []SCT
+    for _, ext := range cert.Extensions {
+        if !ext.Id.Equal(sctListOID) {
+            continue
+        }
+
+        var list []byte
+        if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+            return nil
+        }
+        for _, raw := range splitSCTList(list) {
+            if sct, err := parseSCT(raw, "embedded"); err == nil {
+                result = append(result, sct)
+            }
+        }
+    }
+    return result
+}
+
+// splitSCTList splits a TLS-encoded SignedCertificateTimestampList: a
+// 16-bit total length, then each SCT with a 16-bit length
+func splitSCTList(list []byte) [][]byte {
+    if len(list) < 2 {
+        return nil
+    }
+    total := int(binary.BigEndian.Uint16(list))
+    list = list[2:]
+    if total < len(list) {
+        list = list[:total]
+    }
+
+    var scts [][]byte
+    for len(list) >= 2 {
+        n := int(binary.BigEndian.Uint16(list))
+        if len(list) < 2+n {
+            break
+        }
+        scts = append(scts, list[2:2+n])
+        list = list[2+n:]
+    }
+    return scts
+}
+
+// parseSCT reads the log ID and timestamp of a version 1 SCT
+func parseSCT(raw []byte, source string) (SCT, error) {
+    // version (1) | log_id (32) | timestamp (8) | ...
+    if len(raw) < 41 || raw[0] != 0 {
+        return SCT{}, errors.New("unsupported SCT")
+    }
+
+    ms := int64(binary.BigEndian.Uint64(raw[33:41]))
+    return SCT{
+        LogID:     hex.EncodeToString(raw[1:33]),
+        Timestamp: time.UnixMilli(ms).UTC(),
+        Source:    source,
+    }, nil
+}
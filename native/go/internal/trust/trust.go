@@ -0,0 +1,44 @@
+package trust
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+)
+
+// roots are the system roots plus any certificates in NATIVE_CA_FILE, or
+// nil to use the system roots alone
+var roots = sync.OnceValue(func() *x509.CertPool {
+    path := os.Getenv("NATIVE_CA_FILE")
+    if path == "" {
+        return nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        log.Printf("Failed to read NATIVE_CA_FILE, using system roots: %v", err)
+        return nil
+    }
+
+    pool, err := x509.SystemCertPool()
+    if err != nil {
+        pool = x509.NewCertPool()
+    }
+    if !pool.AppendCertsFromPEM(data) {
+        log.Printf("No certificates in NATIVE_CA_FILE %s, using system roots", path)
+        return nil
+    }
+    return pool
+})
+
+// Config returns the TLS settings for connecting to a mail server. Servers
+// are verified against the system roots and, for self-hosted servers with
+// a private CA, any PEM certificates in the file NATIVE_CA_FILE names.
+func Config(host string) *tls.Config {
+    return &tls.Config{
+        ServerName: host,
+        RootCAs:    roots(),
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/rdawebb/kernel/native/internal/ratelimit"
+)
+
+// clientLimits returns the limits applied to each socket client, from
+// NATIVE_CLIENT_MAX_INFLIGHT, NATIVE_CLIENT_RATE (requests per second) and
+// NATIVE_CLIENT_BURST. Zero turns a limit off.
+func clientLimits() ratelimit.Limits {
+    limits := ratelimit.DefaultLimits
+
+    if value, ok := envNumber("NATIVE_CLIENT_MAX_INFLIGHT"); ok {
+        limits.MaxInFlight = int(value)
+    }
+    if value, ok := envNumber("NATIVE_CLIENT_RATE"); ok {
+        limits.Rate = value
+        // Keep the burst in proportion unless it is set too
+        limits.Burst = int(2 * value)
+    }
+    if value, ok := envNumber("NATIVE_CLIENT_BURST"); ok {
+        limits.Burst = int(value)
+    }
+    return limits
+}
+
+// envNumber reads a non-negative number from the environment
+func envNumber(name string) (float64, bool) {
+    value := os.Getenv(name)
+    if value == "" {
+        return 0, false
+    }
+
+    n, err := strconv.ParseFloat(value, 64)
+    if err != nil || n < 0 {
+        log.Printf("Invalid %s %q, using the default", name, value)
+        return 0, false
+    }
+    return n, true
+}
+
+// limiterKey carries a client's limiter in its requests' contexts
+type limiterKey struct{}
+
+// withLimiter returns a context for requests counted against l
+func withLimiter(ctx context.Context, l *ratelimit.Limiter) context.Context {
+    return context.WithValue(ctx, limiterKey{}, l)
+}
+
+// limiterOf returns the limiter of a request's client, or of the gRPC or HTTP
+// listener it came through, or nil if there is none
+func limiterOf(ctx context.Context) *ratelimit.Limiter {
+    l, _ := ctx.Value(limiterKey{}).(*ratelimit.Limiter)
+    return l
+}
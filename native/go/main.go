@@ -1,38 +1,74 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"syscall"
+	"time"
 
-	"github.com/rdawebb/kernel/native/email/imap"
-	"github.com/rdawebb/kernel/native/email/smtp"
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/netwatch"
 	"github.com/rdawebb/kernel/native/internal/protocol"
 )
 
+// The Python client is generated from the action tables, so the two can't
+// drift apart on action or field names
+//go:generate go run ./cmd/pygen -o ../../src/native_client.py
+
 func main() {
-    socketPath := os.Getenv("NATIVE_SOCKET_PATH")
-    if socketPath == "" {
-        socketPath = "/tmp/email-app.sock"
+    if len(os.Args) > 1 && os.Args[1] == "selftest" {
+        os.Exit(runSelftest(os.Args[2:]))
     }
 
-    // Remove existing socket if it exists
-    os.Remove(socketPath)
+    socketPath := resolveSocketPath()
+    access, err := socketSettings()
+    if err != nil {
+        log.Fatalf("Failed to configure socket: %v", err)
+    }
 
-    listener, err := net.Listen("unix", socketPath)
+    // Any local process can reach the socket, so clients must present the
+    // token their parent shared with us before issuing requests
+    token := os.Getenv("NATIVE_AUTH_TOKEN")
+    if token == "" {
+        log.Fatalf("NATIVE_AUTH_TOKEN must be set")
+    }
+
+    // Under systemd socket activation the socket already exists and is
+    // owned by systemd, so it is inherited rather than created
+    inherited, err := activationListeners()
     if err != nil {
-        log.Fatalf("Failed to create socket: %v", err)
+        log.Fatalf("Failed to use activated socket: %v", err)
     }
-    defer os.Remove(socketPath)
-    defer listener.Close()
 
-    log.Printf("Native server listening on %s", socketPath)
+    var listener net.Listener
+    if len(inherited) > 0 {
+        listener = inherited[0]
+        for _, extra := range inherited[1:] {
+            extra.Close()
+        }
+        log.Printf("Native server listening on %s (socket activated)", listener.Addr())
+    } else {
+        listener, err = listenUnix(socketPath, access)
+        if err != nil {
+            log.Fatalf("Failed to create socket: %v", err)
+        }
+        if !isAbstract(socketPath) {
+            defer os.Remove(socketPath)
+        }
+
+        log.Printf("Native server listening on %s", socketPath)
+    }
+    defer listener.Close()
 
     // Setup signal handling
     ctx, cancel := context.WithCancel(context.Background())
@@ -41,25 +77,138 @@ func main() {
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-    // Initialise handlers
-    imapHandler := imap.NewHandler()
-    smtpHandler := smtp.NewHandler()
+    // Clients holding the main token share the default tenant
+    defaultTenant, err := openTenant("", dataDir())
+    if err != nil {
+        log.Fatalf("Failed to start: %v", err)
+    }
+    extra, err := openTenants(token)
+    if err != nil {
+        log.Fatalf("Failed to open tenants: %v", err)
+    }
+    tenants := append([]*tenant{defaultTenant}, extra...)
+    logTenants(tenants)
+
+    if os.Getenv("NATIVE_ENABLE_RAW_COMMANDS") != "" {
+        log.Println("Raw IMAP and SMTP commands enabled")
+    }
+    if os.Getenv("NATIVE_READ_ONLY") != "" {
+        log.Println("Read-only mode: mutating actions will be refused")
+    }
+
+    peers, err := allowedPeers()
+    if err != nil {
+        log.Fatalf("Failed to configure socket: %v", err)
+    }
+
+    srv := &server{
+        tenant:  defaultTenant,
+        tenants: tenants,
+        lanes:   lanes.New(lanes.DefaultMaxBulk),
+        closing: make(chan struct{}),
 
-    go func() {
-        sig := <-sigChan
-        log.Printf("Received signal: %v", sig)
-        log.Println("Shutting down...")
+        maxRequest: maxRequestSize(),
+        limits:     clientLimits(),
+        peers:      peers,
 
-        // Close connections
+        disconnectGrace: disconnectGrace(),
+        parked:          make(map[string]*parkedClient),
+    }
 
-        cancel()
-        listener.Close()
-    }()
+    for _, t := range tenants {
+        t.run(ctx)
+    }
+    go watchNetwork(ctx, tenants)
+
+    // Optional TCP listener for clients on another host; they must present
+    // the shared secret before anything else
+    if addr := os.Getenv("NATIVE_LISTEN_TCP"); addr != "" {
+        secret := os.Getenv("NATIVE_TCP_SECRET")
+        if secret == "" {
+            log.Fatalf("NATIVE_LISTEN_TCP requires NATIVE_TCP_SECRET")
+        }
+
+        tcpListener, err := net.Listen("tcp", addr)
+        if err != nil {
+            log.Fatalf("Failed to listen on %s: %v", addr, err)
+        }
+        defer tcpListener.Close()
+
+        log.Printf("Native server listening on tcp %s", tcpListener.Addr())
+        go srv.acceptLoop(ctx, tcpListener, secret)
+        go func() {
+            <-srv.closing
+            tcpListener.Close()
+        }()
+    }
+
+    // Optional WebSocket listener for browser and Electron frontends,
+    // secured like the TCP listener
+    if addr := os.Getenv("NATIVE_LISTEN_WS"); addr != "" {
+        secret := os.Getenv("NATIVE_TCP_SECRET")
+        if secret == "" {
+            log.Fatalf("NATIVE_LISTEN_WS requires NATIVE_TCP_SECRET")
+        }
+        go func() {
+            if err := srv.serveWebSocket(ctx, addr, secret); err != nil {
+                log.Fatalf("WebSocket server failed: %v", err)
+            }
+        }()
+    }
+
+    // Optional HTTP gateway for curl and non-socket frontends
+    if addr := os.Getenv("NATIVE_LISTEN_HTTP"); addr != "" {
+        secret := os.Getenv("NATIVE_TCP_SECRET")
+        if secret == "" {
+            log.Fatalf("NATIVE_LISTEN_HTTP requires NATIVE_TCP_SECRET")
+        }
+        go func() {
+            if err := srv.serveHTTP(ctx, addr, secret); err != nil {
+                log.Fatalf("HTTP gateway failed: %v", err)
+            }
+        }()
+    }
+
+    // Optional gRPC service, an alternative to the socket protocol
+    if addr := os.Getenv("NATIVE_LISTEN_GRPC"); addr != "" {
+        secret := os.Getenv("NATIVE_TCP_SECRET")
+        if secret == "" {
+            log.Fatalf("NATIVE_LISTEN_GRPC requires NATIVE_TCP_SECRET")
+        }
+        go func() {
+            if err := srv.serveGRPC(ctx, addr, secret); err != nil {
+                log.Fatalf("gRPC server failed: %v", err)
+            }
+        }()
+    }
+
+    go srv.acceptLoop(ctx, listener, token)
+
+    sig := <-sigChan
+    grace := shutdownGrace()
+    log.Printf("Received signal: %v", sig)
+    log.Printf("Shutting down, waiting up to %s for requests to finish", grace)
+
+    // Stop taking clients, but let admitted requests run to completion
+    listener.Close()
+    if !srv.drain(grace, sigChan) {
+        log.Println("Cancelling unfinished requests")
+    }
 
-    // Accept connections
+    cancel()
+    srv.closeConnections()
+    log.Println("Shutdown complete")
+}
+
+// acceptLoop serves clients from a listener until ctx is cancelled. Clients
+// must authenticate with secret first unless it is empty.
+func (s *server) acceptLoop(ctx context.Context, listener net.Listener, secret string) {
     for {
         conn, err := listener.Accept()
         if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
             select {
             case <-ctx.Done():
                 return
@@ -69,53 +218,198 @@ func main() {
             }
         }
 
-        go handleConnection(ctx, conn, imapHandler, smtpHandler)
+        go s.handleConnection(ctx, conn, secret)
+    }
+}
+
+// Protocol versions this server speaks. Bump protocolVersion for additions
+// clients may want to detect and minProtocolVersion for breaking changes.
+const (
+    protocolVersion    = 1
+    minProtocolVersion = 1
+)
+
+// versionError rejects clients older than minProtocolVersion
+type versionError struct {
+    client int
+}
+
+func (e *versionError) Error() string {
+    return fmt.Sprintf("protocol version %d is no longer supported (minimum %d)", e.client, minProtocolVersion)
+}
+
+func (e *versionError) ErrorCode() string {
+    return protocol.CodeUnsupportedVersion
+}
+
+// hello negotiates the protocol version and advertises what the server
+// supports, so clients can detect features instead of failing on unknown
+// actions at runtime. It also returns the response compression agreed on,
+// which applies to responses after this one.
+func (s *server) hello(req protocol.Request, t *tenant, client, token string) (protocol.Response, string) {
+    var p struct {
+        Version int    `json:"version"`
+        Client  string `json:"client"` // Optional client name, for the log
+
+        // Compression lists the response compressions the client can
+        // decode, such as ["zstd"]
+        Compression []string `json:"compression"`
+    }
+
+    if err := json.Unmarshal(req.Params, &p); err != nil {
+        return protocol.ErrorResponse(err), ""
+    }
+
+    if p.Version != 0 && p.Version < minProtocolVersion {
+        return protocol.ErrorResponse(&versionError{client: p.Version}), ""
+    }
+
+    // Speak the highest version both sides understand
+    version := protocolVersion
+    if p.Version != 0 && p.Version < version {
+        version = p.Version
+    }
+
+    req.Logf("Client hello: %s (protocol %d, using %d)", p.Client, p.Version, version)
+
+    compression := protocol.NegotiateCompression(p.Compression)
+
+    return protocol.SuccessResponse(map[string]any{
+        "version":     version,
+        "min_version": minProtocolVersion,
+        "modules": map[string][]string{
+            "imap": t.imap.Actions(),
+            "smtp": t.smtp.Actions(),
+        },
+        "encodings":        protocol.Encodings,
+        "compressions":     protocol.Compressions,
+        "compression":      compression,
+        "framings":         []string{framingLine, framingLength},
+        "max_request_size": s.maxRequest,
+        "read_only":        t.imap.ReadOnly(),
+        "tenant":           t.name,
+        "client":           client, // For resume after a reconnect
+        "resume_token":     token,  // Proves the client's identity to resume
+        "features":         []string{"stream", "events", "cancel", "timeout", "batch", "describe", "idempotency", "priority", "resume"},
+    }), compression
+}
+
+// version identifies the build; set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// started is when the process started, for uptime
+var started = time.Now()
+
+// ping reports liveness for a supervisor. Answering at all shows the read
+// loop is alive; the pool counts show the handlers aren't wedged on their
+// locks. Connections are counted for the client's tenant only.
+func (s *server) ping(t *tenant) protocol.Response {
+    build := version
+    if info, ok := debug.ReadBuildInfo(); ok {
+        for _, setting := range info.Settings {
+            if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+                build += " (" + setting.Value[:12] + ")"
+            }
+        }
     }
+
+    interactive, bulk := s.lanes.Running()
+
+    return protocol.SuccessResponse(map[string]any{
+        "uptime_seconds": int(time.Since(started).Seconds()),
+        "version":        build,
+        "go_version":     runtime.Version(),
+        "goroutines":     runtime.NumGoroutine(),
+        "connections": map[string]int{
+            "imap": t.imap.Connections(),
+            "smtp": t.smtp.Connections(),
+        },
+        "recovery": t.recovery,
+        "running": map[string]int{
+            "interactive": interactive,
+            "bulk":        bulk,
+        },
+    })
+}
+
+// sessionActions are the module-less actions handled by the server itself
+var sessionActions = []string{
+    "auth", "hello", "ping", "describe", "set_framing", "set_encoding",
+    "subscribe", "unsubscribe", "cancel", "resume", "batch",
+    "retry_policies", "set_retry_policy",
+    "notification_policy", "set_notification_policy",
+    "priority_settings", "set_priority_settings", "forget_important",
 }
 
-func handleConnection(
-    ctx context.Context,
-    conn net.Conn,
-    imapHandler *imap.Handler,
-    smtpHandler *smtp.Handler,
-) {
-    defer conn.Close()
+// describe lists every module's actions with the JSON schema of their
+// params, so clients can validate requests and diagnose version skew
+func (s *server) describe() protocol.Response {
+    return protocol.SuccessResponse(map[string]any{
+        "version": protocolVersion,
+        "session": sessionActions,
+        "errors":  protocol.Codes,
+        "modules": map[string]any{
+            "imap": s.tenant.imap.Describe(),
+            "smtp": s.tenant.smtp.Describe(),
+        },
+    })
+}
 
-    scanner := bufio.NewScanner(conn)
-    encoder := json.NewEncoder(conn)
+// watchNetwork revalidates pooled connections whenever the network changes,
+// so handles recover after sleep or a Wi-Fi switch instead of timing out
+func watchNetwork(ctx context.Context, tenants []*tenant) {
+    watcher := netwatch.New(10 * time.Second)
+    go watcher.Run(ctx)
 
-    for scanner.Scan() {
+    for {
         select {
         case <-ctx.Done():
             return
-        default:
-        }
+        case reason := <-watcher.Changes():
+            log.Printf("Network change detected (%s), revalidating connections", reason)
+            for _, t := range tenants {
+                t.events.Publish(events.Event{
+                    Type: "network.changed",
+                    Data: map[string]any{"reason": reason},
+                })
 
-        var req protocol.Request
-        if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
-            log.Printf("Invalid request: %v", err)
-            encoder.Encode(protocol.ErrorResponse(err))
-            continue
+                go t.imap.Revalidate()
+                go t.smtp.Revalidate()
+            }
         }
+    }
+}
 
-        var resp protocol.Response
+// logEvents writes a tenant's published events to the log
+func logEvents(name string, ch <-chan events.Event) {
+    prefix := ""
+    if name != "" {
+        prefix = "[" + name + "] "
+    }
 
-        switch req.Module {
-        case "imap":
-            resp = imapHandler.Handle(req)
-        case "smtp":
-            resp = smtpHandler.Handle(req)
-        default:
-            resp = protocol.ErrorResponse(fmt.Errorf("unknown module: %s", req.Module))
+    for e := range ch {
+        tag := prefix
+        if e.TraceID != "" {
+            tag += "[trace=" + e.TraceID + "] "
         }
-
-        if err := encoder.Encode(resp); err != nil {
-            log.Printf("Failed to send response: %v", err)
-            return
+        if e.Handle != 0 {
+            log.Printf("%sEvent %s (%s handle %d): %v", tag, e.Type, e.Module, e.Handle, e.Data)
+        } else {
+            log.Printf("%sEvent %s: %v", tag, e.Type, e.Data)
         }
     }
+}
 
-    if err := scanner.Err(); err != nil {
-        log.Printf("Scanner error: %v", err)
+// dataDir returns the directory for persistent native state
+func dataDir() string {
+    if dir := os.Getenv("NATIVE_DATA_DIR"); dir != "" {
+        return dir
+    }
+    if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+        return filepath.Join(dir, "kernel")
+    }
+    if home, err := os.UserHomeDir(); err == nil {
+        return filepath.Join(home, ".local", "share", "kernel")
     }
+    return filepath.Join(os.TempDir(), "kernel")
 }
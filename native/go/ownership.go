@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// Connection handles are scoped to the client that opened them: a request
+// may only name its own client's handles, and a socket client's
+// connections are closed when it disconnects, or parked for a grace period
+// so it can resume them after reconnecting.
+
+// grpcClient owns the connections opened over gRPC, which has no
+// per-client session to scope them to
+const grpcClient = "grpc"
+
+// httpClient owns the connections opened through the HTTP gateway, whose
+// requests are each on their own
+const httpClient = "http"
+
+// clientIDs numbers socket clients
+var clientIDs atomic.Uint64
+
+// newClientID names a new socket client
+func newClientID() string {
+    return fmt.Sprintf("client-%d", clientIDs.Add(1))
+}
+
+// newResumeToken returns the secret a socket client presents to resume its
+// connections. Client IDs are sequential and appear in events, so they
+// can't serve as one. An empty token, if randomness fails, can't resume.
+func newResumeToken() string {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil {
+        log.Printf("Failed to generate resume token: %v", err)
+        return ""
+    }
+    return hex.EncodeToString(buf)
+}
+
+// checkHandles rejects a request naming a handle another client opened.
+// A handle opened outside any client belongs to no client either. To the
+// client it looks like any unknown handle, so other clients' handles can't
+// be probed for.
+func (s *server) checkHandles(ctx context.Context, req protocol.Request) error {
+    owner := pool.OwnerOf(ctx)
+    if owner == "" || len(req.Params) == 0 {
+        return nil
+    }
+
+    // Malformed params are left for the handler to report
+    var params any
+    if err := json.Unmarshal(req.Params, &params); err != nil {
+        return nil
+    }
+
+    var err error
+    walkHandles(req.Module, params, func(module string, handle int) {
+        if err != nil {
+            return
+        }
+        // Unknown handles are left for the handler, as closed ones still
+        // have a history
+        if o, ok := s.tenantOf(ctx).handleOwner(module, handle); ok && o != owner {
+            err = protocol.WithCode(protocol.CodeInvalidHandle, errors.New("invalid connection handle"))
+        }
+    })
+    return err
+}
+
+// walkHandles calls fn for each handle in decoded params: any "handle" or
+// "*_handle" number, at any depth. imap_handle names an IMAP connection
+// whatever the request's module.
+func walkHandles(module string, v any, fn func(module string, handle int)) {
+    switch v := v.(type) {
+    case map[string]any:
+        for key, value := range v {
+            n, ok := value.(float64)
+            if !ok {
+                walkHandles(module, value, fn)
+                continue
+            }
+
+            switch {
+            case key == "imap_handle":
+                fn("imap", int(n))
+            case key == "handle" || strings.HasSuffix(key, "_handle"):
+                fn(module, int(n))
+            }
+        }
+    case []any:
+        for _, value := range v {
+            walkHandles(module, value, fn)
+        }
+    }
+}
+
+// handleOwner returns the client that opened a module's handle, and
+// whether the handle is open
+func (t *tenant) handleOwner(module string, handle int) (string, bool) {
+    switch module {
+    case "imap":
+        return t.imap.Owner(handle)
+    case "smtp":
+        return t.smtp.Owner(handle)
+    }
+    return "", false
+}
+
+// defaultDisconnectGrace closes a disconnected client's connections at once
+const defaultDisconnectGrace = 0
+
+// disconnectGrace returns how long a disconnected client's connections are
+// parked for it to resume, set with NATIVE_DISCONNECT_GRACE (a Go duration
+// such as "2m")
+func disconnectGrace() time.Duration {
+    value := os.Getenv("NATIVE_DISCONNECT_GRACE")
+    if value == "" {
+        return defaultDisconnectGrace
+    }
+
+    grace, err := time.ParseDuration(value)
+    if err != nil || grace < 0 {
+        log.Printf("Invalid NATIVE_DISCONNECT_GRACE %q, closing connections on disconnect", value)
+        return defaultDisconnectGrace
+    }
+    return grace
+}
+
+// parkedClient is a disconnected client whose connections wait to be
+// resumed
+type parkedClient struct {
+    tenant *tenant
+    token  string // Resume token hello gave the client
+    timer  *time.Timer
+}
+
+// releaseClient deals with the connections a disconnected client left open,
+// so a crashed client doesn't leave them running until restart. They are
+// closed, or parked when a grace period is set: their IDLE watchers stop at
+// once, and they close when it runs out unless the client resumes them.
+func (s *server) releaseClient(t *tenant, owner, token string) {
+    if s.disconnectGrace == 0 {
+        s.closeClient(t, owner)
+        return
+    }
+
+    imapCount := t.imap.Park(owner)
+    smtpCount := t.smtp.Park(owner)
+    if imapCount+smtpCount == 0 {
+        return
+    }
+
+    parked := &parkedClient{tenant: t, token: token}
+    s.parkedMu.Lock()
+    s.parked[owner] = parked
+    parked.timer = time.AfterFunc(s.disconnectGrace, func() {
+        s.parkedMu.Lock()
+        current := s.parked[owner]
+        if current == parked {
+            delete(s.parked, owner)
+        }
+        s.parkedMu.Unlock()
+
+        // Resumed meanwhile
+        if current != parked {
+            return
+        }
+        s.closeClient(t, owner)
+    })
+    s.parkedMu.Unlock()
+
+    log.Printf("Client %s disconnected, parked %d IMAP and %d SMTP connections for %s", owner, imapCount, smtpCount, s.disconnectGrace)
+    t.events.Publish(events.Event{
+        Type: "client.parked",
+        Data: map[string]any{"client": owner, "imap": imapCount, "smtp": smtpCount},
+    })
+}
+
+// resumeClient gives a parked client's connections to the client that
+// reconnected for them, returning how many there were. The reconnecting
+// client proves it is the parked one with the resume token hello gave it.
+func (s *server) resumeClient(t *tenant, parkedID, token, owner string) (imapCount, smtpCount int, err error) {
+    s.parkedMu.Lock()
+    parked, ok := s.parked[parkedID]
+    ok = ok && parked.tenant == t && parked.token != "" &&
+        subtle.ConstantTimeCompare([]byte(parked.token), []byte(token)) == 1
+    if ok {
+        delete(s.parked, parkedID)
+    }
+    s.parkedMu.Unlock()
+
+    // Another tenant's clients and a wrong token are indistinguishable
+    // from unknown clients
+    if !ok {
+        return 0, 0, protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("no parked connections for %s", parkedID))
+    }
+    parked.timer.Stop()
+
+    imapCount = t.imap.Transfer(parkedID, owner)
+    smtpCount = t.smtp.Transfer(parkedID, owner)
+    log.Printf("Client %s resumed %d IMAP and %d SMTP connections of %s", owner, imapCount, smtpCount, parkedID)
+    return imapCount, smtpCount, nil
+}
+
+// closeClient closes the connections a client left open
+func (s *server) closeClient(t *tenant, owner string) {
+    imapCount := t.imap.CloseOwned(owner)
+    smtpCount := t.smtp.CloseOwned(owner)
+    if imapCount+smtpCount == 0 {
+        return
+    }
+
+    log.Printf("Client %s disconnected, closed %d IMAP and %d SMTP connections", owner, imapCount, smtpCount)
+    t.events.Publish(events.Event{
+        Type: "client.released",
+        Data: map[string]any{"client": owner, "imap": imapCount, "smtp": smtpCount},
+    })
+}
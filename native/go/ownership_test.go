@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/mockmail"
+	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+)
+
+// startIMAP runs the mock mail servers, trusted through NATIVE_CA_FILE,
+// and returns the IMAP port
+func startIMAP(t *testing.T) int {
+    t.Helper()
+
+    mock, err := mockmail.Start()
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(mock.Close)
+
+    caFile := filepath.Join(t.TempDir(), "ca.pem")
+    if err := os.WriteFile(caFile, mock.CertPEM, 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("NATIVE_CA_FILE", caFile)
+    return mock.IMAPPort
+}
+
+// connectAs opens an IMAP connection for owner, or outside any client when
+// owner is empty, and returns its handle
+func connectAs(t *testing.T, tn *tenant, owner string, port int) int {
+    t.Helper()
+
+    ctx := context.Background()
+    if owner != "" {
+        ctx = pool.WithOwner(ctx, owner)
+    }
+    params := fmt.Sprintf(`{"host":"127.0.0.1","port":%d,"username":%q,"password":%q}`, port, mockmail.Username, mockmail.Password)
+    resp := tn.imap.Handle(ctx, protocol.Request{Module: "imap", Action: "connect", Params: json.RawMessage(params)})
+    if !resp.Success {
+        t.Fatalf("connect: %s", resp.Error)
+    }
+    return resp.Data.(map[string]any)["handle"].(int)
+}
+
+func TestCheckHandles(t *testing.T) {
+    port := startIMAP(t)
+    tn, err := openTenant("", t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(tn.imap.CloseAll)
+    s := &server{tenant: tn, tenants: []*tenant{tn}, parked: make(map[string]*parkedClient), disconnectGrace: time.Minute}
+
+    owned := connectAs(t, tn, "client-a", port)
+    unowned := connectAs(t, tn, "", port)
+
+    check := func(owner, module, params string) error {
+        ctx := context.Background()
+        if owner != "" {
+            ctx = pool.WithOwner(ctx, owner)
+        }
+        return s.checkHandles(ctx, protocol.Request{Module: module, Params: json.RawMessage(params)})
+    }
+
+    tests := []struct {
+        name     string
+        owner    string
+        module   string
+        params   string
+        rejected bool
+    }{
+        {"own handle", "client-a", "imap", fmt.Sprintf(`{"handle":%d}`, owned), false},
+        {"another client's handle", "client-b", "imap", fmt.Sprintf(`{"handle":%d}`, owned), true},
+        {"nested handle", "client-b", "imap", fmt.Sprintf(`{"moves":[{"target_handle":%d}]}`, owned), true},
+        {"imap_handle from smtp", "client-b", "smtp", fmt.Sprintf(`{"imap_handle":%d}`, owned), true},
+        {"handle opened outside any client", "client-a", "imap", fmt.Sprintf(`{"handle":%d}`, unowned), true},
+        {"request outside any client", "", "imap", fmt.Sprintf(`{"handle":%d}`, owned), false},
+        {"unknown handle", "client-b", "imap", `{"handle":999}`, false},
+        {"smtp handle numbered like an imap one", "client-b", "smtp", fmt.Sprintf(`{"handle":%d}`, owned), false},
+        {"malformed params", "client-b", "imap", `{"handle":`, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := check(tt.owner, tt.module, tt.params)
+            if (err != nil) != tt.rejected {
+                t.Fatalf("checkHandles error %v, want rejected %v", err, tt.rejected)
+            }
+            if err != nil && protocol.ErrorResponse(err).ErrorCode != protocol.CodeInvalidHandle {
+                t.Errorf("checkHandles error code %s, want %s", protocol.ErrorResponse(err).ErrorCode, protocol.CodeInvalidHandle)
+            }
+        })
+    }
+
+    // A client that reconnects takes over the connections it left parked,
+    // and its old identity loses them
+    t.Run("resume", func(t *testing.T) {
+        s.releaseClient(tn, "client-a", "token-a")
+        for _, token := range []string{"", "token-b"} {
+            if _, _, err := s.resumeClient(tn, "client-a", token, "client-e"); err == nil {
+                t.Fatalf("resumed with token %q", token)
+            }
+        }
+        if _, _, err := s.resumeClient(tn, "client-a", "token-a", "client-c"); err != nil {
+            t.Fatalf("resumeClient: %v", err)
+        }
+
+        params := fmt.Sprintf(`{"handle":%d}`, owned)
+        if err := check("client-c", "imap", params); err != nil {
+            t.Errorf("resumed client rejected: %v", err)
+        }
+        if err := check("client-a", "imap", params); err == nil {
+            t.Error("previous client still allowed")
+        }
+        if _, _, err := s.resumeClient(tn, "client-a", "token-a", "client-d"); err == nil {
+            t.Error("connections resumed twice")
+        }
+    })
+}
+
+func TestWalkHandles(t *testing.T) {
+    tests := []struct {
+        name   string
+        module string
+        params string
+        want   []string
+    }{
+        {"handle", "imap", `{"handle":1}`, []string{"imap:1"}},
+        {"suffixed", "smtp", `{"source_handle":2}`, []string{"smtp:2"}},
+        {"imap_handle", "smtp", `{"imap_handle":3}`, []string{"imap:3"}},
+        {"nested", "imap", `{"ops":[{"handle":4},{"x":{"handle":5}}]}`, []string{"imap:4", "imap:5"}},
+        {"not a number", "imap", `{"handle":"6"}`, nil},
+        {"other keys", "imap", `{"handles":7,"uid":8}`, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var params any
+            if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+                t.Fatal(err)
+            }
+
+            var got []string
+            walkHandles(tt.module, params, func(module string, handle int) {
+                got = append(got, fmt.Sprintf("%s:%d", module, handle))
+            })
+            if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+                t.Errorf("walkHandles found %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+)
+
+// errPeerCredUnsupported is returned where the platform can't say who is
+// on the other end of a Unix socket
+var errPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
+
+// allowedPeers returns the user IDs allowed to connect over the Unix
+// socket: our own, plus any in NATIVE_ALLOWED_UIDS (IDs or user names,
+// comma separated), for sockets shared with a group through
+// NATIVE_SOCKET_MODE. "*" turns the check off.
+func allowedPeers() (map[int]bool, error) {
+    peers := map[int]bool{os.Getuid(): true}
+
+    value := os.Getenv("NATIVE_ALLOWED_UIDS")
+    if strings.TrimSpace(value) == "*" {
+        return nil, nil
+    }
+
+    for _, name := range strings.Split(value, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+
+        uid, err := lookupID(name, func(name string) (string, error) {
+            u, err := user.Lookup(name)
+            if err != nil {
+                return "", err
+            }
+            return u.Uid, nil
+        })
+        if err != nil {
+            return nil, fmt.Errorf("invalid NATIVE_ALLOWED_UIDS entry %q: %w", name, err)
+        }
+        peers[uid] = true
+    }
+
+    return peers, nil
+}
+
+// unsupportedOnce keeps the unsupported-platform warning to one line
+var unsupportedOnce sync.Once
+
+// checkPeer rejects a Unix socket client run by a user not in allowed, a
+// second line of defence behind the socket's file permissions (abstract
+// sockets have none). Other connections, and every connection when
+// allowed is nil, pass.
+func checkPeer(conn net.Conn, allowed map[int]bool) error {
+    unixConn, ok := conn.(*net.UnixConn)
+    if !ok || allowed == nil {
+        return nil
+    }
+
+    uid, err := peerUID(unixConn)
+    if errors.Is(err, errPeerCredUnsupported) {
+        unsupportedOnce.Do(func() {
+            log.Printf("Not verifying socket clients: %v", err)
+        })
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to read peer credentials: %w", err)
+    }
+
+    if !allowed[uid] {
+        return fmt.Errorf("connection from uid %d refused", uid)
+    }
+    return nil
+}
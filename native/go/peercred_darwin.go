@@ -0,0 +1,30 @@
+//go:build darwin
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerUID reads the connecting process's user ID with LOCAL_PEERCRED
+func peerUID(conn *net.UnixConn) (int, error) {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return -1, err
+    }
+
+    var cred *unix.Xucred
+    var credErr error
+    if err := raw.Control(func(fd uintptr) {
+        cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+    }); err != nil {
+        return -1, err
+    }
+    if credErr != nil {
+        return -1, credErr
+    }
+
+    return int(cred.Uid), nil
+}
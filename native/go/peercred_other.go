@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "net"
+
+// peerUID can't identify peers here; file permissions alone guard the socket
+func peerUID(conn *net.UnixConn) (int, error) {
+    return -1, errPeerCredUnsupported
+}
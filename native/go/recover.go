@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rdawebb/kernel/native/internal/outbox"
+)
+
+// storageRecovery is what startup recovery found in a tenant's data
+// directory, reported in ping and a storage.recovered event
+type storageRecovery struct {
+    Outbox  outbox.Recovery `json:"outbox"`
+    Partial []string        `json:"partial,omitempty"` // Interrupted writes removed from the other stores
+}
+
+// empty reports whether there was nothing to recover
+func (r *storageRecovery) empty() bool {
+    return r.Outbox.Empty() && len(r.Partial) == 0
+}
+
+// recoverStorage cleans up after a crash before anything reads the stores.
+// The outbox checks its own entries; every other store writes through a
+// temporary file renamed into place, so a leftover one is an interrupted
+// write whose target is intact and can simply go.
+func recoverStorage(dir string, ob *outbox.Outbox) (*storageRecovery, error) {
+    report := &storageRecovery{}
+
+    var err error
+    if report.Outbox, err = ob.Recover(); err != nil {
+        return nil, fmt.Errorf("failed to recover outbox: %w", err)
+    }
+
+    err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() {
+            // Other tenants recover their own directories
+            if path == ob.Dir() || path == filepath.Join(dir, "tenants") {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), ".tmp") {
+            return nil
+        }
+
+        if err := os.Remove(path); err != nil {
+            return err
+        }
+        rel, _ := filepath.Rel(dir, path)
+        report.Partial = append(report.Partial, rel)
+        return nil
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to recover %s: %w", dir, err)
+    }
+
+    return report, nil
+}
+
+// logRecovery writes what recovery found to the log
+func logRecovery(name string, r *storageRecovery) {
+    if r.empty() {
+        return
+    }
+
+    prefix := ""
+    if name != "" {
+        prefix = "[" + name + "] "
+    }
+    log.Printf("%sRecovered storage: removed %d partial writes, repaired %d and quarantined %d outbox entries",
+        prefix, len(r.Outbox.Removed)+len(r.Partial), len(r.Outbox.Repaired), len(r.Outbox.Quarantined))
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/mockmail"
+)
+
+// The selftest validates an installation end to end: it starts mock IMAP
+// and SMTP servers and a real server process, then drives a scripted
+// session through the socket protocol, as a client would.
+
+// selftestStep is the outcome of one stage of the selftest
+type selftestStep struct {
+    Name   string `json:"name"`
+    Passed bool   `json:"passed"`
+    Detail string `json:"detail,omitempty"` // What was seen, or why it failed
+    Millis int64  `json:"ms"`
+}
+
+// selftest is the state the steps build up
+type selftest struct {
+    timeout time.Duration // Bounds each step
+    dir     string
+    token   string
+    mock    *mockmail.Server
+    server  *exec.Cmd
+    client  *selftestClient
+
+    imapHandle int
+    smtpHandle int
+    uids       []uint32 // Found in the INBOX by search
+    subject    string   // Of the message the selftest sends
+}
+
+// runSelftest runs the selftest with command-line args, printing each step
+// as it finishes, and returns the exit status
+func runSelftest(args []string) int {
+    flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+    jsonOut := flags.Bool("json", false, "print the steps as JSON")
+    timeout := flags.Duration("timeout", 15*time.Second, "time allowed for each step")
+    if err := flags.Parse(args); err != nil {
+        return 2
+    }
+
+    t := &selftest{timeout: *timeout}
+    steps := []struct {
+        name string
+        run  func() (string, error)
+    }{
+        {"start mock servers", t.startMocks},
+        {"start server", t.startServer},
+        {"handshake", t.handshake},
+        {"imap connect", t.imapConnect},
+        {"search", t.search},
+        {"sync", t.sync},
+        {"watch inbox", t.watch},
+        {"smtp connect", t.smtpConnect},
+        {"send", t.send},
+        {"idle event", t.idleEvent},
+    }
+
+    var results []selftestStep
+    passed := true
+    for _, step := range steps {
+        start := time.Now()
+        detail, err := step.run()
+        result := selftestStep{Name: step.name, Passed: err == nil, Detail: detail, Millis: time.Since(start).Milliseconds()}
+        if err != nil {
+            result.Detail = err.Error()
+            passed = false
+        }
+        results = append(results, result)
+
+        if !*jsonOut {
+            status := "PASS"
+            if !result.Passed {
+                status = "FAIL"
+            }
+            fmt.Printf("%s  %-20s %6dms  %s\n", status, result.Name, result.Millis, result.Detail)
+        }
+        if !passed {
+            break
+        }
+    }
+
+    // A failed run keeps the server's log for inspection
+    logPath := t.close(passed)
+    if *jsonOut {
+        out := map[string]any{"passed": passed, "steps": results}
+        if logPath != "" {
+            out["server_log"] = logPath
+        }
+        data, _ := json.Marshal(out)
+        fmt.Println(string(data))
+    } else if logPath != "" {
+        fmt.Printf("Server log kept at %s\n", logPath)
+    }
+
+    if !passed {
+        return 1
+    }
+    return 0
+}
+
+func (t *selftest) startMocks() (string, error) {
+    dir, err := os.MkdirTemp("", "kernel-selftest-")
+    if err != nil {
+        return "", err
+    }
+    t.dir = dir
+
+    if t.mock, err = mockmail.Start(); err != nil {
+        return "", err
+    }
+    if err := os.WriteFile(filepath.Join(dir, "ca.pem"), t.mock.CertPEM, 0600); err != nil {
+        return "", err
+    }
+    return fmt.Sprintf("IMAP on port %d, SMTP on port %d", t.mock.IMAPPort, t.mock.SMTPPort), nil
+}
+
+func (t *selftest) startServer() (string, error) {
+    exe, err := os.Executable()
+    if err != nil {
+        return "", err
+    }
+    logFile, err := os.Create(filepath.Join(t.dir, "server.log"))
+    if err != nil {
+        return "", err
+    }
+    defer logFile.Close()
+
+    token := make([]byte, 16)
+    if _, err := rand.Read(token); err != nil {
+        return "", err
+    }
+    t.token = hex.EncodeToString(token)
+    socketPath := filepath.Join(t.dir, "native.sock")
+
+    // A clean environment, so the user's settings (read-only mode, extra
+    // listeners, tenants) can't change the outcome
+    t.server = exec.Command(exe)
+    t.server.Env = []string{
+        "PATH=" + os.Getenv("PATH"),
+        "HOME=" + os.Getenv("HOME"),
+        "NATIVE_SOCKET_PATH=" + socketPath,
+        "NATIVE_AUTH_TOKEN=" + t.token,
+        "NATIVE_DATA_DIR=" + filepath.Join(t.dir, "data"),
+        "NATIVE_CA_FILE=" + filepath.Join(t.dir, "ca.pem"),
+    }
+    t.server.Stdout = logFile
+    t.server.Stderr = logFile
+    if err := t.server.Start(); err != nil {
+        return "", err
+    }
+
+    deadline := time.Now().Add(t.timeout)
+    for {
+        conn, err := net.Dial("unix", socketPath)
+        if err == nil {
+            t.client = newSelftestClient(conn)
+            return fmt.Sprintf("pid %d", t.server.Process.Pid), nil
+        }
+        if time.Now().After(deadline) {
+            return "", fmt.Errorf("socket not ready: %w", err)
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
+
+func (t *selftest) handshake() (string, error) {
+    if _, err := t.client.call("", "auth", map[string]any{"secret": t.token}, t.timeout); err != nil {
+        return "", fmt.Errorf("auth: %w", err)
+    }
+
+    var hello struct {
+        Version int `json:"version"`
+    }
+    if err := t.client.decode("", "hello", map[string]any{"version": protocolVersion, "client": "selftest"}, t.timeout, &hello); err != nil {
+        return "", fmt.Errorf("hello: %w", err)
+    }
+    return fmt.Sprintf("protocol %d", hello.Version), nil
+}
+
+func (t *selftest) imapConnect() (string, error) {
+    var result struct {
+        Handle int `json:"handle"`
+    }
+    params := map[string]any{"host": "localhost", "port": t.mock.IMAPPort, "username": mockmail.Username, "password": mockmail.Password}
+    if err := t.client.decode("imap", "connect", params, t.timeout, &result); err != nil {
+        return "", err
+    }
+    t.imapHandle = result.Handle
+    return fmt.Sprintf("handle %d", result.Handle), nil
+}
+
+func (t *selftest) search() (string, error) {
+    if _, err := t.client.call("imap", "select_folder", map[string]any{"handle": t.imapHandle, "folder": "INBOX"}, t.timeout); err != nil {
+        return "", fmt.Errorf("select_folder: %w", err)
+    }
+
+    var result struct {
+        UIDs []uint32 `json:"uids"`
+    }
+    if err := t.client.decode("imap", "search_uids", map[string]any{"handle": t.imapHandle}, t.timeout, &result); err != nil {
+        return "", err
+    }
+    if len(result.UIDs) == 0 {
+        return "", errors.New("no messages found in INBOX")
+    }
+    t.uids = result.UIDs
+    return fmt.Sprintf("%d messages", len(result.UIDs)), nil
+}
+
+func (t *selftest) sync() (string, error) {
+    subjects, err := t.fetchSubjects(t.uids)
+    if err != nil {
+        return "", err
+    }
+    if len(subjects) == 0 || subjects[0] == "" {
+        return "", errors.New("no metadata returned")
+    }
+    return fmt.Sprintf("%d messages, first %q", len(subjects), subjects[0]), nil
+}
+
+// fetchSubjects returns the subjects of messages in the INBOX
+func (t *selftest) fetchSubjects(uids []uint32) ([]string, error) {
+    var result struct {
+        Messages []struct {
+            Subject string `json:"subject"`
+        } `json:"messages"`
+    }
+    params := map[string]any{"handle": t.imapHandle, "folder": "INBOX", "uids": uids}
+    if err := t.client.decode("imap", "fetch_metadata", params, t.timeout, &result); err != nil {
+        return nil, err
+    }
+
+    subjects := make([]string, len(result.Messages))
+    for i, msg := range result.Messages {
+        subjects[i] = msg.Subject
+    }
+    return subjects, nil
+}
+
+func (t *selftest) watch() (string, error) {
+    if _, err := t.client.call("", "subscribe", map[string]any{"types": []string{"folder.", "watch."}}, t.timeout); err != nil {
+        return "", fmt.Errorf("subscribe: %w", err)
+    }
+
+    var result struct {
+        IDLE bool `json:"idle"`
+    }
+    params := map[string]any{"handle": t.imapHandle, "folders": []string{"INBOX"}}
+    if err := t.client.decode("imap", "watch_folders", params, t.timeout, &result); err != nil {
+        return "", err
+    }
+    if !result.IDLE {
+        return "", errors.New("server IDLE not in use")
+    }
+    return "IDLE", nil
+}
+
+func (t *selftest) smtpConnect() (string, error) {
+    var result struct {
+        Handle int `json:"handle"`
+    }
+    params := map[string]any{"host": "localhost", "port": t.mock.SMTPPort, "username": mockmail.Username, "password": mockmail.Password}
+    if err := t.client.decode("smtp", "connect", params, t.timeout, &result); err != nil {
+        return "", err
+    }
+    t.smtpHandle = result.Handle
+    return fmt.Sprintf("handle %d", result.Handle), nil
+}
+
+func (t *selftest) send() (string, error) {
+    t.subject = fmt.Sprintf("Kernel selftest %d", time.Now().UnixNano())
+    address := mockmail.Username + "@localhost"
+    message := strings.Join([]string{
+        "From: " + address,
+        "To: " + address,
+        "Subject: " + t.subject,
+        "Date: " + time.Now().Format(time.RFC1123Z),
+        "Message-ID: <" + t.token[:16] + "@selftest.invalid>",
+        "",
+        "Sent by kernel selftest.",
+        "",
+    }, "\r\n")
+
+    params := map[string]any{
+        "handle":      t.smtpHandle,
+        "from":        address,
+        "to":          []string{address},
+        "message_b64": base64.StdEncoding.EncodeToString([]byte(message)),
+    }
+    if _, err := t.client.call("smtp", "send", params, t.timeout); err != nil {
+        return "", err
+    }
+    return t.subject, nil
+}
+
+func (t *selftest) idleEvent() (string, error) {
+    deadline := time.After(t.timeout)
+    for {
+        select {
+        case e := <-t.client.events:
+            if e.Event == "watch.error" {
+                return "", fmt.Errorf("watch failed: %s", e.Data)
+            }
+            if e.Event != "folder.changed" {
+                continue
+            }
+
+            var change struct {
+                Added []uint32 `json:"added"`
+            }
+            if err := json.Unmarshal(e.Data, &change); err != nil || len(change.Added) == 0 {
+                continue
+            }
+
+            subjects, err := t.fetchSubjects(change.Added)
+            if err != nil {
+                return "", err
+            }
+            for _, subject := range subjects {
+                if subject == t.subject {
+                    return fmt.Sprintf("new UID %d", change.Added[len(change.Added)-1]), nil
+                }
+            }
+        case <-deadline:
+            return "", errors.New("no folder.changed event for the sent message")
+        }
+    }
+}
+
+// close stops everything the selftest started. The temporary directory is
+// removed if it passed; otherwise the server log's path is returned.
+func (t *selftest) close(passed bool) string {
+    if t.client != nil {
+        t.client.conn.Close()
+    }
+    if t.server != nil && t.server.Process != nil {
+        t.server.Process.Signal(os.Interrupt)
+
+        done := make(chan struct{})
+        go func() {
+            t.server.Wait()
+            close(done)
+        }()
+        select {
+        case <-done:
+        case <-time.After(closeTimeout):
+            t.server.Process.Kill()
+            <-done
+        }
+    }
+    if t.mock != nil {
+        t.mock.Close()
+    }
+    if t.dir == "" {
+        return ""
+    }
+
+    logPath := filepath.Join(t.dir, "server.log")
+    if passed {
+        os.RemoveAll(t.dir)
+        return ""
+    }
+    if _, err := os.Stat(logPath); err != nil {
+        return ""
+    }
+    return logPath
+}
+
+// selftestMessage is a response or event read from the socket
+type selftestMessage struct {
+    ID      string          `json:"id"`
+    Success bool            `json:"success"`
+    Data    json.RawMessage `json:"data"`
+    Error   string          `json:"error"`
+    Event   string          `json:"event"`
+}
+
+// selftestClient is a minimal line-framed JSON client. Responses are
+// matched to requests by ID; events are queued as they arrive.
+type selftestClient struct {
+    conn   net.Conn
+    events chan selftestMessage
+
+    mu      sync.Mutex
+    nextID  int
+    waiting map[string]chan selftestMessage
+}
+
+func newSelftestClient(conn net.Conn) *selftestClient {
+    c := &selftestClient{
+        conn:    conn,
+        events:  make(chan selftestMessage, 64),
+        waiting: make(map[string]chan selftestMessage),
+    }
+    go c.read()
+    return c
+}
+
+// read routes incoming messages until the connection closes
+func (c *selftestClient) read() {
+    scanner := bufio.NewScanner(c.conn)
+    scanner.Buffer(make([]byte, 64<<10), 64<<20)
+    for scanner.Scan() {
+        var msg selftestMessage
+        if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+            continue
+        }
+
+        if msg.Event != "" {
+            select {
+            case c.events <- msg:
+            default:
+            }
+            continue
+        }
+
+        c.mu.Lock()
+        ch := c.waiting[msg.ID]
+        delete(c.waiting, msg.ID)
+        c.mu.Unlock()
+        if ch != nil {
+            ch <- msg
+        }
+    }
+}
+
+// call sends a request and waits for its response, returning its data
+func (c *selftestClient) call(module, action string, params any, timeout time.Duration) (json.RawMessage, error) {
+    c.mu.Lock()
+    c.nextID++
+    id := fmt.Sprintf("selftest-%d", c.nextID)
+    ch := make(chan selftestMessage, 1)
+    c.waiting[id] = ch
+    c.mu.Unlock()
+
+    req, err := json.Marshal(map[string]any{"id": id, "module": module, "action": action, "params": params})
+    if err != nil {
+        return nil, err
+    }
+    if _, err := c.conn.Write(append(req, '\n')); err != nil {
+        return nil, err
+    }
+
+    select {
+    case resp := <-ch:
+        if !resp.Success {
+            return nil, errors.New(resp.Error)
+        }
+        return resp.Data, nil
+    case <-time.After(timeout):
+        return nil, fmt.Errorf("no response to %s within %s", action, timeout)
+    }
+}
+
+// decode calls an action and decodes its data into v
+func (c *selftestClient) decode(module, action string, params any, timeout time.Duration, v any) error {
+    data, err := c.call(module, action, params, timeout)
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("unexpected %s response: %w", action, err)
+    }
+    return nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/lanes"
+	"github.com/rdawebb/kernel/native/internal/notify"
+	"github.com/rdawebb/kernel/native/internal/pool"
+	"github.com/rdawebb/kernel/native/internal/priority"
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/ratelimit"
+	"github.com/rdawebb/kernel/native/internal/retry"
+)
+
+// server holds the state shared by all socket clients
+type server struct {
+    tenant  *tenant   // Serves the main token and gRPC and HTTP clients
+    tenants []*tenant // Every tenant, the default first
+    lanes   *lanes.Dispatcher
+
+    maxRequest int              // Largest request accepted, in bytes
+    limits     ratelimit.Limits // Applied to each socket client
+    peers      map[int]bool     // UIDs allowed on the Unix socket; nil for any
+
+    // Disconnected clients' connections, parked for disconnectGrace
+    disconnectGrace time.Duration
+    parkedMu        sync.Mutex
+    parked          map[string]*parkedClient
+
+    // Shutdown drains requests admitted before closing began
+    drainMu  sync.Mutex
+    draining bool
+    active   sync.WaitGroup
+    closing  chan struct{}
+}
+
+// dispatch routes a request to its module handler
+func (s *server) dispatch(ctx context.Context, req protocol.Request) protocol.Response {
+    switch req.Module {
+    case "imap", "smtp":
+        if err := s.checkHandles(ctx, req); err != nil {
+            return protocol.ErrorResponse(err)
+        }
+
+        var leave func()
+        var err error
+        ctx, leave, err = s.lanes.Enter(ctx, req.Priority)
+        if errors.Is(err, lanes.ErrUnknownLane) {
+            return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, err))
+        }
+        if err != nil {
+            return protocol.ErrorResponse(err)
+        }
+        defer leave()
+    }
+
+    t := s.tenantOf(ctx)
+    switch req.Module {
+    case "imap":
+        return t.imap.Handle(ctx, req)
+    case "smtp":
+        return t.smtp.Handle(ctx, req)
+    case "":
+        if req.Action == "batch" {
+            return s.batch(ctx, req)
+        }
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("unknown session action: %s", req.Action)))
+    default:
+        return protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("unknown module: %s", req.Module)))
+    }
+}
+
+// class tells whether a request may be repeated safely
+func (s *server) class(req protocol.Request) retry.Class {
+    var idempotent bool
+    switch req.Module {
+    case "imap":
+        idempotent = s.tenant.imap.Idempotent(req.Action)
+    case "smtp":
+        idempotent = s.tenant.smtp.Idempotent(req.Action)
+    }
+
+    if idempotent {
+        return retry.Read
+    }
+    return retry.Mutation
+}
+
+// session is one connected socket client. Requests are served concurrently,
+// so responses may arrive out of order and are matched by request ID.
+type session struct {
+    id      string // Owner of the connections this client opens
+    token   string // Resume token, revealed only in this client's hello response
+    conn    net.Conn
+    reader  *bufio.Reader
+    writeMu sync.Mutex
+    wire    wire // Write-side framing and encoding, guarded by writeMu
+    pending sync.WaitGroup
+
+    // unsubscribe stops event delivery; only touched by the read loop
+    unsubscribe func()
+
+    // secret must be presented with an auth request before anything else;
+    // empty for trusted listeners. Only the read loop uses it.
+    secret        string
+    authenticated bool
+
+    // tenant is what the client's requests act on, chosen by the token it
+    // authenticated with. Set before the read loop starts and changed only
+    // by authentication.
+    tenant *tenant
+
+    // fixedFraming is set when the transport delimits messages itself, so
+    // set_framing can't change it
+    fixedFraming bool
+
+    // inflight cancels running requests by ID
+    inflightMu sync.Mutex
+    inflight   map[string]context.CancelFunc
+
+    // limiter refuses requests past the client's limits with BUSY, so a
+    // runaway client can't grow goroutines without bound
+    limiter *ratelimit.Limiter
+}
+
+// send writes one response; writes from concurrent requests never interleave
+func (s *session) send(resp protocol.Response) error {
+    return s.write(resp)
+}
+
+// write encodes and writes one message in the current framing and encoding,
+// compressing response data if the client negotiated it
+func (s *session) write(v any) error {
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+
+    if resp, ok := v.(protocol.Response); ok {
+        compressed, err := protocol.Compress(resp, s.wire.encoding, s.wire.compression)
+        if err != nil {
+            return err
+        }
+        v = compressed
+    }
+
+    payload, err := protocol.Encode(s.wire.encoding, v)
+    if err != nil {
+        return err
+    }
+
+    return writeMessage(s.conn, s.wire.framing, payload)
+}
+
+// wire is how messages are framed and encoded on a connection
+type wire struct {
+    framing     string
+    encoding    string
+    compression string // Applied to large response data; empty for none
+}
+
+// binary reports whether messages may contain arbitrary bytes, which only
+// length framing can carry
+func (w wire) binary() bool {
+    return w.encoding == protocol.EncodingMsgPack
+}
+
+// authError rejects a client that hasn't authenticated
+type authError struct {
+    reason string
+}
+
+func (e *authError) Error() string {
+    return e.reason
+}
+
+func (e *authError) ErrorCode() string {
+    return protocol.CodeUnauthenticated
+}
+
+// authenticate checks a client's first request against the shared secret
+// or a tenant's token, answering it either way. A client that fails is
+// disconnected.
+func (s *session) authenticate(req protocol.Request, tenantFor func(secret string) *tenant) bool {
+    var resp protocol.Response
+
+    var p struct {
+        Secret string `json:"secret"`
+    }
+    switch {
+    case req.Module != "" || req.Action != "auth":
+        resp = protocol.ErrorResponse(&authError{reason: "authentication required"})
+    case json.Unmarshal(req.Params, &p) != nil:
+        resp = protocol.ErrorResponse(&authError{reason: "invalid auth request"})
+    case subtle.ConstantTimeCompare([]byte(p.Secret), []byte(s.secret)) == 1:
+        s.authenticated = true
+        resp = protocol.SuccessResponse(nil)
+    default:
+        if t := tenantFor(p.Secret); t != nil {
+            s.tenant = t
+            s.authenticated = true
+            resp = protocol.SuccessResponse(map[string]any{"tenant": t.name})
+        } else {
+            resp = protocol.ErrorResponse(&authError{reason: "invalid secret"})
+        }
+    }
+
+    resp.ID = req.ID
+    resp.TraceID = req.TraceID
+    if err := s.send(resp); err != nil {
+        return false
+    }
+
+    if !s.authenticated {
+        log.Printf("Rejected unauthenticated client %s", s.conn.RemoteAddr())
+    }
+    return s.authenticated
+}
+
+// track registers a running request so cancel can reach it, returning the
+// context to run it under and a function to call when it finishes
+func (s *session) track(ctx context.Context, id string) (context.Context, func()) {
+    ctx, cancel := context.WithCancel(ctx)
+    if id == "" {
+        return ctx, cancel
+    }
+
+    s.inflightMu.Lock()
+    s.inflight[id] = cancel
+    s.inflightMu.Unlock()
+
+    return ctx, func() {
+        s.inflightMu.Lock()
+        delete(s.inflight, id)
+        s.inflightMu.Unlock()
+        cancel()
+    }
+}
+
+// cancel cancels a running request, reporting whether it was found
+func (s *session) cancel(id string) bool {
+    s.inflightMu.Lock()
+    defer s.inflightMu.Unlock()
+
+    cancel, ok := s.inflight[id]
+    if ok {
+        cancel()
+    }
+    return ok
+}
+
+// subscribe starts pushing bus events whose type starts with one of the
+// given prefixes (all events if none), replacing any earlier subscription
+func (s *session) subscribe(bus *events.Bus, prefixes []string) {
+    s.stopEvents()
+
+    ch, cancel := bus.Subscribe(256)
+    s.unsubscribe = cancel
+
+    go func() {
+        for e := range ch {
+            if !matchPrefix(e.Type, prefixes) {
+                continue
+            }
+
+            err := s.write(protocol.Event{
+                Event:   e.Type,
+                Module:  e.Module,
+                Handle:  e.Handle,
+                Data:    e.Data,
+                Time:    e.Time,
+                TraceID: e.TraceID,
+            })
+            if err != nil {
+                log.Printf("Failed to push event %s: %v", e.Type, err)
+            }
+        }
+    }()
+}
+
+// stopEvents ends event delivery, if any
+func (s *session) stopEvents() {
+    if s.unsubscribe != nil {
+        s.unsubscribe()
+        s.unsubscribe = nil
+    }
+}
+
+func matchPrefix(eventType string, prefixes []string) bool {
+    if len(prefixes) == 0 {
+        return true
+    }
+    for _, prefix := range prefixes {
+        if strings.HasPrefix(eventType, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+// control handles session-level requests, which carry no module. They run
+// on the read loop so they take effect before the next request is read. It
+// returns the framing and encoding to read with from now on.
+func (s *session) control(srv *server, req protocol.Request, current wire) wire {
+    var resp protocol.Response
+    next := current
+    t := s.tenant
+
+    switch req.Action {
+    case "set_framing":
+        var p struct {
+            Mode string `json:"mode"` // "line" or "length"
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if s.fixedFraming {
+            resp = protocol.ErrorResponse(fmt.Errorf("framing is fixed on this connection"))
+        } else if p.Mode != framingLine && p.Mode != framingLength {
+            resp = protocol.ErrorResponse(fmt.Errorf("unknown framing mode: %s", p.Mode))
+        } else if p.Mode == framingLine && current.binary() {
+            resp = protocol.ErrorResponse(fmt.Errorf("line framing cannot carry %s", current.encoding))
+        } else {
+            resp = protocol.SuccessResponse(map[string]any{"mode": p.Mode})
+            next.framing = p.Mode
+        }
+    case "set_encoding":
+        var p struct {
+            Encoding string `json:"encoding"` // "json" or "msgpack"
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if p.Encoding != protocol.EncodingJSON && p.Encoding != protocol.EncodingMsgPack {
+            resp = protocol.ErrorResponse(fmt.Errorf("unknown encoding: %s", p.Encoding))
+        } else if p.Encoding == protocol.EncodingMsgPack && current.framing != framingLength {
+            resp = protocol.ErrorResponse(fmt.Errorf("%s requires length framing", p.Encoding))
+        } else {
+            resp = protocol.SuccessResponse(map[string]any{"encoding": p.Encoding})
+            next.encoding = p.Encoding
+        }
+    case "hello":
+        var compression string
+        resp, compression = srv.hello(req, t, s.id, s.token)
+        if resp.Success {
+            next.compression = compression
+        }
+    case "ping":
+        resp = srv.ping(t)
+    case "describe":
+        resp = srv.describe()
+    case "retry_policies":
+        resp = protocol.SuccessResponse(t.retries.All())
+    case "set_retry_policy":
+        var p struct {
+            Class  retry.Class  `json:"class"` // "read" or "mutation"
+            Policy retry.Policy `json:"policy"`
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if err := t.retries.Set(p.Class, p.Policy); err != nil {
+            resp = protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, err))
+        } else {
+            resp = protocol.SuccessResponse(t.retries.Get(p.Class))
+        }
+    case "notification_policy":
+        resp = protocol.SuccessResponse(t.notifier.Policy())
+    case "set_notification_policy":
+        var p notify.Policy
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if err := t.notifier.SetPolicy(p); err != nil {
+            resp = protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, err))
+        } else {
+            resp = protocol.SuccessResponse(t.notifier.Policy())
+        }
+    case "priority_settings":
+        resp = protocol.SuccessResponse(map[string]any{
+            "settings": t.priority.Settings(),
+            "learned":  t.priority.Learned(),
+        })
+    case "set_priority_settings":
+        var p priority.Settings
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if err := t.priority.SetSettings(p); err != nil {
+            resp = protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, err))
+        } else {
+            resp = protocol.SuccessResponse(t.priority.Settings())
+        }
+    case "forget_important":
+        var p struct {
+            Addresses []string `json:"addresses"` // Learned senders to drop
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if err := t.priority.Forget(p.Addresses); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else {
+            resp = protocol.SuccessResponse(map[string]any{"learned": t.priority.Learned()})
+        }
+    case "subscribe":
+        var p struct {
+            Types []string `json:"types"` // Event type prefixes; empty for all
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else {
+            s.subscribe(t.events, p.Types)
+            resp = protocol.SuccessResponse(nil)
+        }
+    case "cancel":
+        var p struct {
+            ID string `json:"id"` // ID of the request to cancel
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else {
+            resp = protocol.SuccessResponse(map[string]any{"cancelled": s.cancel(p.ID)})
+        }
+    case "resume":
+        var p struct {
+            Client string `json:"client"` // ID hello gave the disconnected client
+            Token  string `json:"token"`  // Resume token hello gave it
+        }
+        if err := json.Unmarshal(req.Params, &p); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else if imapCount, smtpCount, err := srv.resumeClient(t, p.Client, p.Token, s.id); err != nil {
+            resp = protocol.ErrorResponse(err)
+        } else {
+            resp = protocol.SuccessResponse(map[string]any{"imap": imapCount, "smtp": smtpCount})
+        }
+    case "unsubscribe":
+        s.stopEvents()
+        resp = protocol.SuccessResponse(nil)
+    default:
+        resp = protocol.ErrorResponse(protocol.WithCode(protocol.CodeInvalidRequest, fmt.Errorf("unknown session action: %s", req.Action)))
+    }
+
+    resp.ID = req.ID
+    resp.TraceID = req.TraceID
+
+    // Acknowledge in the old mode, then switch, so the client knows exactly
+    // where the new framing or encoding starts
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+
+    resp, err := protocol.Compress(resp, s.wire.encoding, s.wire.compression)
+    if err != nil {
+        req.Logf("Failed to compress response: %v", err)
+        return current
+    }
+    payload, err := protocol.Encode(s.wire.encoding, resp)
+    if err != nil {
+        req.Logf("Failed to encode response: %v", err)
+        return current
+    }
+
+    if err := writeMessage(s.conn, s.wire.framing, payload); err != nil {
+        req.Logf("Failed to send response: %v", err)
+    }
+    s.wire = next
+    return next
+}
+
+func (s *server) handleConnection(ctx context.Context, conn net.Conn, secret string) {
+    if err := checkPeer(conn, s.peers); err != nil {
+        log.Printf("Rejected client: %v", err)
+        conn.Close()
+        return
+    }
+
+    s.serveSession(ctx, newSession(conn, secret, framingLine))
+}
+
+// newSession starts a client on conn in the given framing with JSON encoding
+func newSession(conn net.Conn, secret, framing string) *session {
+    return &session{
+        id:       newClientID(),
+        token:    newResumeToken(),
+        conn:     conn,
+        reader:   bufio.NewReader(conn),
+        wire:     wire{framing: framing, encoding: protocol.EncodingJSON},
+        inflight: make(map[string]context.CancelFunc),
+
+        secret:        secret,
+        authenticated: secret == "",
+    }
+}
+
+// serveSession reads and serves a client's requests until it disconnects
+func (s *server) serveSession(ctx context.Context, sess *session) {
+    defer sess.conn.Close()
+    sess.limiter = ratelimit.New(s.limits)
+    sess.tenant = s.tenant
+
+    // Connections die with the client that opened them, once its
+    // in-flight requests have finished
+    defer func() { s.releaseClient(sess.tenant, sess.id, sess.token) }()
+    defer sess.pending.Wait()
+    defer sess.stopEvents()
+
+    // Requests outlive neither the server nor their client
+    ctx, cancelAll := context.WithCancel(pool.WithOwner(ctx, sess.id))
+    defer cancelAll()
+
+    // Only the read loop changes the wire mode, so it can track it unlocked
+    mode := sess.wire
+
+    for {
+        payload, err := readMessage(sess.reader, mode.framing, s.maxRequest)
+        var tooLarge *tooLargeError
+        if errors.As(err, &tooLarge) {
+            log.Printf("Rejected request: %v", err)
+            sess.send(protocol.ErrorResponse(err))
+            continue
+        }
+        if err != nil {
+            if err != io.EOF {
+                log.Printf("Read error: %v", err)
+            }
+            return
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        default:
+        }
+
+        req, err := protocol.DecodeRequest(mode.encoding, payload)
+        if err != nil {
+            log.Printf("Invalid request: %v", err)
+            sess.send(protocol.ErrorResponse(err))
+            continue
+        }
+
+        if !sess.authenticated {
+            if !sess.authenticate(req, s.tenantFor) {
+                return
+            }
+            continue
+        }
+
+        // Batches run like any module request, off the read loop
+        if req.Module == "" && req.Action != "batch" {
+            mode = sess.control(s, req, mode)
+            continue
+        }
+
+        finish, err := s.admit(sess.limiter)
+        if err != nil {
+            resp := protocol.ErrorResponse(err)
+            resp.ID = req.ID
+            resp.TraceID = req.TraceID
+            sess.send(resp)
+            continue
+        }
+
+        // Register before reading on, so a following cancel finds it
+        reqCtx, done := sess.track(withLimiter(withTenant(ctx, sess.tenant), sess.limiter), req.ID)
+
+        sess.pending.Add(1)
+        go func() {
+            defer sess.pending.Done()
+            defer finish()
+            defer done()
+            s.serve(reqCtx, sess, req)
+        }()
+    }
+}
+
+// run dispatches a request under its timeout. A request whose context ends
+// is answered at once; the handler sees its context cancelled and is left
+// to unwind in the background so a hung server can't hold the response
+// back. wait returns once the handler has, and callers hold the request's
+// slot until then, so a timed-out handler still counts against the limits.
+func (s *server) run(ctx context.Context, req protocol.Request) (resp protocol.Response, wait func()) {
+    ctx = protocol.WithTraceID(ctx, req.TraceID)
+
+    // A keyed request runs to completion even if its client goes away, so
+    // the outcome is there when the client retries
+    if key := req.IdempotencyKey; key != "" {
+        req.IdempotencyKey = ""
+        detached := context.WithoutCancel(ctx)
+        resp, replayed := s.tenantOf(ctx).idempotent.Do(ctx, key, req.Module+"."+req.Action, func() protocol.Response {
+            // The response is recorded once the handler is done, so a retry
+            // can't overlap it
+            resp, wait := s.run(detached, req)
+            wait()
+            return resp
+        })
+        resp.Replayed = replayed
+        return resp, func() {}
+    }
+
+    var timeout time.Duration
+    if req.TimeoutMS > 0 {
+        timeout = time.Duration(req.TimeoutMS) * time.Millisecond
+
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    // Nothing may follow the final response, so a late handler's partials
+    // are refused
+    if partial := req.Partial; partial != nil {
+        req.Partial = func(data any) error {
+            if err := ctx.Err(); err != nil {
+                return err
+            }
+            return partial(data)
+        }
+    }
+
+    // Streams are never retried, as the client has seen the partials
+    class := s.class(req)
+    if req.Partial != nil {
+        class = retry.Mutation
+    }
+
+    result := make(chan protocol.Response, 1)
+    handled := make(chan struct{})
+    go func() {
+        defer close(handled)
+        result <- s.tenantOf(ctx).retries.Do(ctx, class, func() protocol.Response {
+            return s.dispatch(ctx, req)
+        })
+    }()
+    wait = func() { <-handled }
+
+    select {
+    case resp := <-result:
+        if errors.Is(ctx.Err(), context.DeadlineExceeded) && !resp.Success {
+            return protocol.ErrorResponse(&protocol.TimeoutError{Module: req.Module, Action: req.Action, Timeout: timeout}), wait
+        }
+        return resp, wait
+    case <-ctx.Done():
+        if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+            return protocol.ErrorResponse(&protocol.TimeoutError{Module: req.Module, Action: req.Action, Timeout: timeout}), wait
+        }
+        return protocol.ErrorResponse(ctx.Err()), wait
+    }
+}
+
+// serve runs one request and writes its response
+func (s *server) serve(ctx context.Context, sess *session, req protocol.Request) {
+    if req.Stream {
+        req.Partial = func(data any) error {
+            partial := protocol.SuccessResponse(data)
+            partial.ID = req.ID
+            partial.TraceID = req.TraceID
+            partial.Partial = true
+            return sess.send(partial)
+        }
+    }
+
+    resp, wait := s.run(ctx, req)
+    defer wait()
+
+    resp.ID = req.ID
+    resp.TraceID = req.TraceID
+    if !resp.Success {
+        req.Logf("%s.%s failed: %s", req.Module, req.Action, resp.Error)
+    }
+
+    if err := sess.send(resp); err != nil {
+        req.Logf("Failed to send response: %v", err)
+    }
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rdawebb/kernel/native/internal/protocol"
+	"github.com/rdawebb/kernel/native/internal/ratelimit"
+)
+
+// Shutdown timings. The grace period can be changed with
+// NATIVE_SHUTDOWN_GRACE (a Go duration such as "45s").
+const (
+    defaultShutdownGrace = 30 * time.Second
+    closeTimeout         = 10 * time.Second
+)
+
+var errShuttingDown = protocol.WithCode(protocol.CodeServerError, errors.New("server is shutting down"))
+
+// shutdownGrace returns how long in-flight requests get to finish
+func shutdownGrace() time.Duration {
+    value := os.Getenv("NATIVE_SHUTDOWN_GRACE")
+    if value == "" {
+        return defaultShutdownGrace
+    }
+
+    grace, err := time.ParseDuration(value)
+    if err != nil || grace < 0 {
+        log.Printf("Invalid NATIVE_SHUTDOWN_GRACE %q, using %s", value, defaultShutdownGrace)
+        return defaultShutdownGrace
+    }
+    return grace
+}
+
+// admit registers a request so shutdown waits for it, or refuses it once
+// shutdown has begun or when the client's limiter, if any, does. finish
+// must be called after the response is sent.
+func (s *server) admit(limiter *ratelimit.Limiter) (finish func(), err error) {
+    limited := func() {}
+    if limiter != nil {
+        if limited, err = limiter.Acquire(); err != nil {
+            return nil, err
+        }
+    }
+
+    s.drainMu.Lock()
+    defer s.drainMu.Unlock()
+
+    if s.draining {
+        limited()
+        return nil, errShuttingDown
+    }
+
+    s.active.Add(1)
+    return func() {
+        s.active.Done()
+        limited()
+    }, nil
+}
+
+// drain stops admitting requests and waits for those already running,
+// giving up after grace or when interrupt fires. It reports whether every
+// request finished.
+func (s *server) drain(grace time.Duration, interrupt <-chan os.Signal) bool {
+    s.drainMu.Lock()
+    s.draining = true
+    s.drainMu.Unlock()
+    close(s.closing)
+
+    done := make(chan struct{})
+    go func() {
+        s.active.Wait()
+        close(done)
+    }()
+
+    timer := time.NewTimer(grace)
+    defer timer.Stop()
+
+    select {
+    case <-done:
+        return true
+    case <-timer.C:
+        return false
+    case sig := <-interrupt:
+        log.Printf("Received signal: %v, not waiting for requests", sig)
+        return false
+    }
+}
+
+// closeConnections logs out of every pooled connection, bounded so a dead
+// server can't hold up exit
+func (s *server) closeConnections() {
+    var wg sync.WaitGroup
+    for _, t := range s.tenants {
+        wg.Add(2)
+        go func(t *tenant) {
+            defer wg.Done()
+            t.imap.CloseAll()
+        }(t)
+        go func(t *tenant) {
+            defer wg.Done()
+            t.smtp.CloseAll()
+        }(t)
+    }
+
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(closeTimeout):
+        log.Printf("Timed out closing connections")
+    }
+}
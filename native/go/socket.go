@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// defaultSocketName is used when NATIVE_SOCKET_PATH is unset
+const defaultSocketName = "email-app.sock"
+
+// socketAccess is who may use a socket file
+type socketAccess struct {
+    mode os.FileMode
+    uid  int // -1 leaves the owner unchanged
+    gid  int // -1 leaves the group unchanged
+}
+
+// socketSettings reads the socket's permissions from NATIVE_SOCKET_MODE
+// (octal, owner-only by default) and NATIVE_SOCKET_OWNER (user, user:group
+// or :group, by name or number)
+func socketSettings() (socketAccess, error) {
+    access := socketAccess{mode: 0600, uid: -1, gid: -1}
+
+    if value := os.Getenv("NATIVE_SOCKET_MODE"); value != "" {
+        mode, err := strconv.ParseUint(value, 8, 32)
+        if err != nil || mode > 0777 {
+            return access, fmt.Errorf("invalid NATIVE_SOCKET_MODE %q: want octal permissions such as 0660", value)
+        }
+        access.mode = os.FileMode(mode)
+    }
+
+    if value := os.Getenv("NATIVE_SOCKET_OWNER"); value != "" {
+        owner, group, _ := strings.Cut(value, ":")
+        if owner != "" {
+            uid, err := lookupID(owner, func(name string) (string, error) {
+                u, err := user.Lookup(name)
+                if err != nil {
+                    return "", err
+                }
+                return u.Uid, nil
+            })
+            if err != nil {
+                return access, fmt.Errorf("invalid NATIVE_SOCKET_OWNER user: %w", err)
+            }
+            access.uid = uid
+        }
+        if group != "" {
+            gid, err := lookupID(group, func(name string) (string, error) {
+                g, err := user.LookupGroup(name)
+                if err != nil {
+                    return "", err
+                }
+                return g.Gid, nil
+            })
+            if err != nil {
+                return access, fmt.Errorf("invalid NATIVE_SOCKET_OWNER group: %w", err)
+            }
+            access.gid = gid
+        }
+    }
+
+    return access, nil
+}
+
+// lookupID resolves a numeric ID, or a name through lookup
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+    if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+        return id, nil
+    }
+
+    id, err := lookup(name)
+    if err != nil {
+        return 0, err
+    }
+    return strconv.Atoi(id)
+}
+
+// resolveSocketPath resolves NATIVE_SOCKET_PATH. A bare file name is placed
+// in $XDG_RUNTIME_DIR, which only the user can enter, falling back to the
+// temporary directory where that isn't set.
+func resolveSocketPath() string {
+    path := os.Getenv("NATIVE_SOCKET_PATH")
+    if path == "" {
+        path = defaultSocketName
+    }
+    if isAbstract(path) || strings.ContainsRune(path, filepath.Separator) {
+        return path
+    }
+
+    dir := os.Getenv("XDG_RUNTIME_DIR")
+    if dir == "" {
+        dir = os.TempDir()
+    }
+    return filepath.Join(dir, path)
+}
+
+// isAbstract reports whether path names a socket in Linux's abstract
+// namespace, written with a leading @ as ss and netstat show them
+func isAbstract(path string) bool {
+    return strings.HasPrefix(path, "@")
+}
+
+// listenUnix listens on a Unix socket. An abstract socket has no file, so
+// there is nothing stale to remove first and no directory permissions to
+// get wrong; it vanishes when the process exits. Anyone in the network
+// namespace can connect to one, which the auth token already guards.
+//
+// A socket file is bound under a temporary name and renamed into place
+// once access is applied, so clients never find it at path with the
+// umask's looser permissions.
+func listenUnix(path string, access socketAccess) (net.Listener, error) {
+    if isAbstract(path) {
+        if runtime.GOOS != "linux" {
+            return nil, fmt.Errorf("abstract sockets (%s) are only supported on Linux", path)
+        }
+        // Go maps the leading @ to the NUL byte that marks the namespace
+        return net.Listen("unix", path)
+    }
+
+    // Remove a socket left behind by an earlier run
+    os.Remove(path)
+
+    tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+    os.Remove(tmp)
+    listener, err := net.Listen("unix", tmp)
+    if err != nil {
+        return nil, err
+    }
+    // The file is renamed away from the bound name; main removes it
+    listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+    fail := func(err error) (net.Listener, error) {
+        listener.Close()
+        os.Remove(tmp)
+        return nil, err
+    }
+
+    if err := os.Chmod(tmp, access.mode); err != nil {
+        return fail(fmt.Errorf("failed to set socket permissions: %w", err))
+    }
+    if access.uid != -1 || access.gid != -1 {
+        if err := os.Lchown(tmp, access.uid, access.gid); err != nil {
+            return fail(fmt.Errorf("failed to set socket owner: %w", err))
+        }
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return fail(fmt.Errorf("failed to move socket into place: %w", err))
+    }
+
+    return listener, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/rdawebb/kernel/native/email/imap"
+	"github.com/rdawebb/kernel/native/email/smtp"
+	"github.com/rdawebb/kernel/native/internal/events"
+	"github.com/rdawebb/kernel/native/internal/identity"
+	"github.com/rdawebb/kernel/native/internal/idempotency"
+	"github.com/rdawebb/kernel/native/internal/notify"
+	"github.com/rdawebb/kernel/native/internal/outbox"
+	"github.com/rdawebb/kernel/native/internal/priority"
+	"github.com/rdawebb/kernel/native/internal/retry"
+	"github.com/rdawebb/kernel/native/internal/tags"
+)
+
+// A tenant is everything a client's requests act on: connection pools,
+// stores, settings and events. One tenant serves every client unless
+// NATIVE_TENANTS gives profiles tokens of their own. Each of those gets a
+// tenant with its own data directory, and its clients can't see or reach
+// another tenant's connections, accounts or events.
+type tenant struct {
+    name  string // Empty for the default tenant
+    token string // Authenticates its clients; empty for the default tenant
+
+    imap       *imap.Handler
+    smtp       *smtp.Handler
+    events     *events.Bus
+    retries    *retry.Policies
+    notifier   *notify.Notifier
+    priority   *priority.Classifier
+    idempotent *idempotency.Cache // Responses kept for replay by key
+    recovery   *storageRecovery   // What startup recovery found
+}
+
+// tenantName restricts names to what is safe as a directory name
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// openTenant creates a tenant's handlers over the stores in dir
+func openTenant(name, dir string) (*tenant, error) {
+    bus := events.NewBus()
+
+    imapHandler := imap.NewHandler()
+    imapHandler.SetEventBus(bus)
+    tagStore, err := tags.Open(filepath.Join(dir, "tags"))
+    if err != nil {
+        return nil, fmt.Errorf("failed to open tag store: %w", err)
+    }
+    imapHandler.SetTagStore(tagStore)
+    if err := imapHandler.SetMigrationDir(filepath.Join(dir, "migrations")); err != nil {
+        return nil, fmt.Errorf("failed to open migrations: %w", err)
+    }
+
+    notifier, err := notify.Open(filepath.Join(dir, "notifications.json"), bus)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open notification settings: %w", err)
+    }
+    imapHandler.SetNotifier(notifier)
+
+    classifier, err := priority.Open(filepath.Join(dir, "priority.json"))
+    if err != nil {
+        return nil, fmt.Errorf("failed to open priority settings: %w", err)
+    }
+    imapHandler.SetClassifier(classifier)
+
+    smtpHandler := smtp.NewHandler()
+    smtpHandler.SetEventBus(bus)
+    smtpHandler.SetMailstore(imapHandler)
+
+    // raw_command and raw_smtp can do anything the account can, so they
+    // are opt-in
+    if os.Getenv("NATIVE_ENABLE_RAW_COMMANDS") != "" {
+        imapHandler.EnableRawCommands(true)
+        smtpHandler.EnableRawCommands(true)
+    }
+
+    // Read-only mode refuses anything that changes a mailbox or sends, for
+    // pointing a development client at a real account
+    if os.Getenv("NATIVE_READ_ONLY") != "" {
+        imapHandler.SetReadOnly(true)
+        smtpHandler.SetReadOnly(true)
+    }
+
+    ob, err := outbox.Open(filepath.Join(dir, "outbox"))
+    if err != nil {
+        return nil, fmt.Errorf("failed to open outbox: %w", err)
+    }
+    recovery, err := recoverStorage(dir, ob)
+    if err != nil {
+        return nil, err
+    }
+    smtpHandler.SetOutbox(ob)
+
+    ids, err := identity.Open(filepath.Join(dir, "identities.json"))
+    if err != nil {
+        return nil, fmt.Errorf("failed to open identities: %w", err)
+    }
+    smtpHandler.SetIdentities(ids)
+
+    return &tenant{
+        name:       name,
+        imap:       imapHandler,
+        smtp:       smtpHandler,
+        events:     bus,
+        retries:    retry.New(),
+        notifier:   notifier,
+        priority:   classifier,
+        idempotent: idempotency.New(idempotency.DefaultWindow),
+        recovery:   recovery,
+    }, nil
+}
+
+// run starts the tenant's background work
+func (t *tenant) run(ctx context.Context) {
+    // Subscribed before returning, so events published from here on are
+    // all logged
+    logged, _ := t.events.Subscribe(64)
+    go logEvents(t.name, logged)
+    go t.notifier.Run(ctx)
+
+    logRecovery(t.name, t.recovery)
+    if !t.recovery.empty() {
+        t.events.Publish(events.Event{Type: "storage.recovered", Data: t.recovery})
+    }
+}
+
+// openTenants opens the tenants listed in the JSON file NATIVE_TENANTS
+// names, an object of tenant names to tokens. Each keeps its state in
+// tenants/<name> under the data directory.
+func openTenants(mainToken string) ([]*tenant, error) {
+    path := os.Getenv("NATIVE_TENANTS")
+    if path == "" {
+        return nil, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read NATIVE_TENANTS: %w", err)
+    }
+    var tokens map[string]string
+    if err := json.Unmarshal(data, &tokens); err != nil {
+        return nil, fmt.Errorf("invalid NATIVE_TENANTS file %s: %w", path, err)
+    }
+
+    seen := map[string]string{mainToken: "the default tenant"}
+    tenants := make([]*tenant, 0, len(tokens))
+    for name, token := range tokens {
+        if !tenantName.MatchString(name) {
+            return nil, fmt.Errorf("invalid tenant name %q: use letters, digits, - and _", name)
+        }
+        if token == "" {
+            return nil, fmt.Errorf("tenant %s has no token", name)
+        }
+        if other, ok := seen[token]; ok {
+            return nil, fmt.Errorf("tenant %s has the same token as %s", name, other)
+        }
+        seen[token] = "tenant " + name
+
+        t, err := openTenant(name, filepath.Join(dataDir(), "tenants", name))
+        if err != nil {
+            return nil, fmt.Errorf("tenant %s: %w", name, err)
+        }
+        t.token = token
+        tenants = append(tenants, t)
+    }
+
+    return tenants, nil
+}
+
+// tenantFor returns the tenant whose token secret is, or nil. Every token
+// is compared, so timing doesn't tell which tenants exist.
+func (s *server) tenantFor(secret string) *tenant {
+    var match *tenant
+    for _, t := range s.tenants {
+        if t.token != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(t.token)) == 1 {
+            match = t
+        }
+    }
+    return match
+}
+
+// tenantKey carries a request's tenant in its context
+type tenantKey struct{}
+
+// withTenant returns a context for requests acting on t
+func withTenant(ctx context.Context, t *tenant) context.Context {
+    return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantOf returns the tenant a request acts on: its client's, or the
+// default tenant for gRPC and the HTTP gateway
+func (s *server) tenantOf(ctx context.Context) *tenant {
+    if t, ok := ctx.Value(tenantKey{}).(*tenant); ok {
+        return t
+    }
+    return s.tenant
+}
+
+// logTenants reports the tenants in use at startup
+func logTenants(tenants []*tenant) {
+    for _, t := range tenants {
+        if t.name != "" {
+            log.Printf("Serving tenant %s", t.name)
+        }
+    }
+}
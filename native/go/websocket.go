@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// serveWebSocket accepts WebSocket clients on addr until shutdown. Each
+// message carries one request or response, in the same protocol as the
+// socket, so a browser or Electron frontend needs no bridge process.
+func (s *server) serveWebSocket(ctx context.Context, addr, secret string) error {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+
+    ws := websocket.Server{
+        // Any page can open a WebSocket, so the secret is what keeps other
+        // origins out; file:// and null origins are normal for Electron
+        Handshake: func(*websocket.Config, *http.Request) error {
+            return nil
+        },
+        Handler: func(conn *websocket.Conn) {
+            conn.MaxPayloadBytes = s.maxRequest
+
+            sess := newSession(&wsConn{Conn: conn}, secret, framingLength)
+            sess.fixedFraming = true
+            s.serveSession(ctx, sess)
+        },
+    }
+    hs := &http.Server{Handler: ws}
+
+    go func() {
+        <-s.closing
+        hs.Close()
+    }()
+
+    log.Printf("Native server listening on websocket %s", listener.Addr())
+    if err := hs.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+// wsConn presents a WebSocket as a length-framed stream, so sessions can
+// serve it like any other connection. Each received message becomes one
+// frame and each frame written is sent as one message.
+type wsConn struct {
+    *websocket.Conn
+    in  []byte // Unread part of the current incoming frame
+    out []byte // Outgoing frame bytes not yet sent; session writes are serialised
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+    if len(c.in) == 0 {
+        var message []byte
+        err := websocket.Message.Receive(c.Conn, &message)
+        if errors.Is(err, websocket.ErrFrameTooLarge) {
+            // The rest of the message is skipped on the next Receive
+            return 0, &tooLargeError{limit: c.MaxPayloadBytes}
+        }
+        if err != nil {
+            return 0, err
+        }
+
+        c.in = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(message)), uint32(len(message)))
+        c.in = append(c.in, message...)
+    }
+
+    n := copy(p, c.in)
+    c.in = c.in[n:]
+    return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+    c.out = append(c.out, p...)
+
+    for len(c.out) >= 4 {
+        size := int(binary.BigEndian.Uint32(c.out))
+        if len(c.out) < 4+size {
+            break
+        }
+
+        // JSON goes in text messages for browsers; anything else, such as
+        // MessagePack, must be binary. Every message is an object, so JSON
+        // always starts with a brace.
+        var err error
+        payload := c.out[4 : 4+size]
+        if size > 0 && payload[0] == '{' {
+            err = websocket.Message.Send(c.Conn, string(payload))
+        } else {
+            err = websocket.Message.Send(c.Conn, payload)
+        }
+        c.out = c.out[4+size:]
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    return len(p), nil
+}
+
+// RemoteAddr reports the client's address rather than its origin
+func (c *wsConn) RemoteAddr() net.Addr {
+    if addr, err := net.ResolveTCPAddr("tcp", c.Request().RemoteAddr); err == nil {
+        return addr
+    }
+    return c.Conn.RemoteAddr()
+}
@@ -10,6 +10,7 @@ from .commands import (
     EmailOperationsCommand,
     RefreshCommand,
     SearchCommand,
+    SelftestCommand,
     create_folder_commands,
 )
 
@@ -89,7 +90,7 @@ def setup_compose_commands(subparsers) -> None:
 
 
 def setup_maintenance_commands(subparsers) -> None:
-    """Setup maintenance commands (refresh, database).
+    """Setup maintenance commands (refresh, database, selftest).
 
     Uses command pattern for both commands.
     """
@@ -111,6 +112,15 @@ def setup_maintenance_commands(subparsers) -> None:
     )
     db_cmd.add_arguments(db_parser)
 
+    # Selftest command
+    selftest_cmd = SelftestCommand()
+    selftest_parser = subparsers.add_parser(
+        selftest_cmd.name,
+        help=selftest_cmd.description,
+        description="Run a scripted session against mock mail servers",
+    )
+    selftest_cmd.add_arguments(selftest_parser)
+
 
 def setup_config_commands(subparsers) -> None:
     """Setup configuration management commands.
@@ -8,6 +8,7 @@ from .database import DatabaseCommand
 from .operations import EmailOperationsCommand
 from .refresh import RefreshCommand
 from .search import SearchCommand
+from .selftest import SelftestCommand
 from .view import FolderViewCommand, create_folder_commands
 
 __all__ = [
@@ -21,5 +22,6 @@ __all__ = [
     "AttachmentsCommand",
     "DatabaseCommand",
     "ConfigCommand",
+    "SelftestCommand",
     "create_folder_commands",
 ]
@@ -0,0 +1,99 @@
+"""Selftest command implementation."""
+
+import asyncio
+import json
+from typing import Any, Dict
+
+from rich.table import Table
+
+from src.native_bridge import find_native_binary
+
+from .base import BaseCommand
+
+
+class SelftestCommand(BaseCommand):
+    """Command for validating an installation end to end.
+
+    Runs the native binary's selftest, which drives mock IMAP and SMTP
+    servers through the real socket protocol, and reports each step.
+    """
+
+    @property
+    def name(self) -> str:
+        """Command name.
+
+        Returns:
+            str: Command name
+        """
+        return "selftest"
+
+    @property
+    def description(self) -> str:
+        """Command description.
+
+        Returns:
+            str: Command description
+        """
+        return "Check the installation against mock mail servers"
+
+    def add_arguments(self, parser) -> None:
+        """Add selftest-specific arguments.
+
+        Args:
+            parser: ArgumentParser to configure
+        """
+        parser.add_argument(
+            "--timeout",
+            type=int,
+            default=15,
+            help="Seconds allowed for each step (default: 15)",
+        )
+
+    async def execute_impl(self, args: Dict[str, Any]) -> bool:
+        """Execute selftest command.
+
+        Args:
+            args: Parsed arguments containing:
+                - timeout: Seconds allowed for each step
+
+        Returns:
+            True if every step passed
+        """
+        binary = find_native_binary()
+        if binary is None:
+            self.console.print(
+                "[red]Native binary not found. Run 'make build' in native/ directory[/red]"
+            )
+            return False
+
+        timeout = args.get("timeout") or 15
+        process = await asyncio.create_subprocess_exec(
+            str(binary),
+            "selftest",
+            "--json",
+            f"--timeout={timeout}s",
+            stdout=asyncio.subprocess.PIPE,
+            stderr=asyncio.subprocess.PIPE,
+        )
+        stdout, stderr = await process.communicate()
+
+        try:
+            report = json.loads(stdout.decode().strip().splitlines()[-1])
+        except (IndexError, json.JSONDecodeError):
+            self.console.print(f"[red]Selftest did not run: {stderr.decode().strip()}[/red]")
+            return False
+
+        table = Table(title="Kernel selftest")
+        table.add_column("Step")
+        table.add_column("Result")
+        table.add_column("Time", justify="right")
+        table.add_column("Detail")
+        for step in report.get("steps", []):
+            result = "[green]PASS[/green]" if step["passed"] else "[red]FAIL[/red]"
+            table.add_row(step["name"], result, f"{step['ms']}ms", step.get("detail", ""))
+        self.console.print(table)
+
+        if report.get("server_log"):
+            self.console.print(f"Server log kept at {report['server_log']}")
+
+        return bool(report.get("passed"))
@@ -15,6 +15,7 @@ from .commands import (
     EmailOperationsCommand,
     RefreshCommand,
     SearchCommand,
+    SelftestCommand,
     create_folder_commands,
 )
 
@@ -39,6 +40,7 @@ class CommandRouter:
         self._command_registry["search"] = SearchCommand(self.console)
         self._command_registry["compose"] = ComposeCommand(self.console)
         self._command_registry["refresh"] = RefreshCommand(self.console)
+        self._command_registry["selftest"] = SelftestCommand(self.console)
 
         # Commands with subcommands
         self._command_registry["email"] = EmailOperationsCommand(self.console)
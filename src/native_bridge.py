@@ -3,17 +3,65 @@
 import asyncio
 import json
 import os
+import secrets
 import socket
 import subprocess
+import sys
 import time
 from contextlib import asynccontextmanager
 from pathlib import Path
-from typing import Any, Dict, Optional
+from typing import Any, Dict, List, Optional
 
 from src.utils.logging import get_logger
 
 logger = get_logger(__name__)
 
+# Native protocol version this client speaks
+PROTOCOL_VERSION = 1
+
+
+class NativeError(Exception):
+    """A failed native call.
+
+    Attributes:
+        code: Error code from the native taxonomy, e.g. "AUTH_FAILED",
+            "NETWORK", "NOT_CONNECTED", "INVALID_HANDLE", "TIMEOUT",
+            "BUSY" (retry after details["retry_after_ms"]) or "SERVER_ERROR";
+            ERROR_CODES in src.native_client describes them all
+        details: Structured context for the error, if any
+        trace_id: Trace ID of the failed request, if any
+    """
+
+    def __init__(
+        self,
+        message: str,
+        code: str = "SERVER_ERROR",
+        details: Optional[Dict[str, Any]] = None,
+        trace_id: Optional[str] = None,
+    ):
+        super().__init__(message)
+        self.code = code
+        self.details = details or {}
+        self.trace_id = trace_id
+
+
+def find_native_binary() -> Optional[Path]:
+    """Find the native binary in the build tree or install location."""
+    current_file = Path(__file__)
+    project_root = current_file.parent.parent
+
+    possible_paths = [
+        project_root / "native" / "build" / "kernel-native",
+        project_root / "build" / "kernel-native",
+        Path("/usr/local/bin/kernel-native"),
+    ]
+
+    for path in possible_paths:
+        if path.exists() and path.is_file():
+            return path
+
+    return None
+
 
 class NativeBridge:
     """Manages the native Go process and communication via Unix socket."""
@@ -22,13 +70,23 @@ class NativeBridge:
         """Initialise the native bridge.
 
         Args:
-            socket_path: Path to Unix socket (auto-generated if None)
+            socket_path: Path to Unix socket, or "@name" for an abstract
+                socket on Linux (auto-generated if None: abstract on Linux,
+                so no socket file is left behind)
         """
-        self.socket_path = socket_path or f"/tmp/kernel-{os.getpid()}.sock"
+        if socket_path is None:
+            if sys.platform.startswith("linux"):
+                socket_path = f"@kernel-{os.getpid()}"
+            else:
+                socket_path = f"/tmp/kernel-{os.getpid()}.sock"
+        self.socket_path = socket_path
         self.process: Optional[subprocess.Popen] = None
         self._sock: Optional[socket.socket] = None
         self._lock = asyncio.Lock()
         self._connected = False
+        self.server_info: Dict[str, Any] = {}
+        # Shared with the native process so it only serves us
+        self._auth_token = secrets.token_urlsafe(32)
 
     async def start(self) -> None:
         """Start the native Go process."""
@@ -46,6 +104,7 @@ class NativeBridge:
         # Start the Go process
         env = os.environ.copy()
         env["NATIVE_SOCKET_PATH"] = self.socket_path
+        env["NATIVE_AUTH_TOKEN"] = self._auth_token
 
         self.process = subprocess.Popen(
             [str(native_binary)],
@@ -57,7 +116,7 @@ class NativeBridge:
         # Wait for socket to be ready (max 5 seconds)
         start_time = time.time()
         while time.time() - start_time < 5:
-            if os.path.exists(self.socket_path):
+            if self._socket_ready():
                 break
             await asyncio.sleep(0.1)
         else:
@@ -66,33 +125,104 @@ class NativeBridge:
 
         await self._connect_socket()
         self._connected = True
-        logger.info("Native bridge connected")
+
+        # The server rejects everything until the token is presented
+        await self.call("", "auth", {"secret": self._auth_token})
+        self.server_info = await self.call(
+            "", "hello", {"version": PROTOCOL_VERSION, "client": "kernel"}
+        )
+        logger.info(
+            f"Native bridge connected (protocol {self.server_info.get('version')})"
+        )
+
+    def supports(self, module: str, action: str) -> bool:
+        """Check whether the native backend supports an action.
+
+        Args:
+            module: Module name ("imap" or "smtp")
+            action: Action name
+
+        Returns:
+            True if the backend advertised the action in its hello response
+        """
+        modules = self.server_info.get("modules", {})
+        return action in modules.get(module, [])
+
+    async def ping(self) -> Dict[str, Any]:
+        """Check the native process is alive and responsive.
+
+        Returns:
+            Uptime, build version and pooled connection counts
+        """
+        return await self.call("", "ping", {})
+
+    async def warm_up(
+        self, accounts: List[Dict[str, Any]], deadline_ms: int = 5000
+    ) -> List[Dict[str, Any]]:
+        """Connect accounts and select their INBOX ahead of first use.
+
+        Args:
+            accounts: IMAP connect params per account, each with an "id"
+            deadline_ms: How long to wait before returning
+
+        Returns:
+            Per-account results with "ready" and, once connected, "handle".
+            Accounts still connecting at the deadline are marked "pending"
+            and reported later by a "warmup.finished" event.
+        """
+        data = await self.call(
+            "imap", "warm_up", {"accounts": accounts, "deadline_ms": deadline_ms}
+        )
+        return data.get("accounts", [])
+
+    async def describe(self) -> Dict[str, Any]:
+        """Fetch the native protocol description.
+
+        Returns:
+            Session actions, and for each module the JSON schema of every
+            action's params
+        """
+        return await self.call("", "describe", {})
+
+    def _socket_address(self) -> str:
+        """Address to connect to; abstract sockets start with a NUL byte."""
+        if self.socket_path.startswith("@"):
+            return "\0" + self.socket_path[1:]
+        return self.socket_path
+
+    def _socket_ready(self) -> bool:
+        """Check whether the native process is listening yet."""
+        if not self.socket_path.startswith("@"):
+            return os.path.exists(self.socket_path)
+
+        # An abstract socket has no file to look for, so try connecting
+        probe = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        try:
+            probe.connect(self._socket_address())
+            return True
+        except OSError:
+            return False
+        finally:
+            probe.close()
 
     async def _connect_socket(self) -> None:
         """Connect to the Unix socket."""
         self._sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
-        self._sock.connect(self.socket_path)
+        self._sock.connect(self._socket_address())
         self._sock.settimeout(30.0)  # 30 second timeout
 
     def _find_native_binary(self) -> Optional[Path]:
         """Find the native binary."""
-        current_file = Path(__file__)
-        project_root = current_file.parent.parent
-
-        possible_paths = [
-            project_root / "native" / "build" / "kernel-native",
-            project_root / "build" / "kernel-native",
-            Path("/usr/local/bin/kernel-native"),
-        ]
-
-        for path in possible_paths:
-            if path.exists() and path.is_file():
-                return path
-
-        return None
+        return find_native_binary()
 
     async def call(
-        self, module: str, action: str, params: Dict[str, Any]
+        self,
+        module: str,
+        action: str,
+        params: Dict[str, Any],
+        trace_id: Optional[str] = None,
+        idempotency_key: Optional[str] = None,
+        priority: Optional[str] = None,
     ) -> Dict[str, Any]:
         """Call a native function.
 
@@ -100,18 +230,30 @@ class NativeBridge:
             module: Module name ("imap" or "smtp")
             action: Action name ("connect", "fetch", etc.)
             params: Action parameters
+            trace_id: Optional ID to correlate native logs with this call
+            idempotency_key: Optional key making a retried call return the
+                first call's result instead of acting again; use it for
+                side effects such as sends
+            priority: "bulk" for background syncs, which then give way to
+                interactive calls between batches; defaults to interactive
 
         Returns:
             Response data from native backend
 
         Raises:
-            Exception: If the call fails
+            NativeError: If the call fails
         """
         if not self._connected:
             await self.start()
 
         async with self._lock:
             request = {"module": module, "action": action, "params": params}
+            if trace_id:
+                request["trace_id"] = trace_id
+            if idempotency_key:
+                request["idempotency_key"] = idempotency_key
+            if priority:
+                request["priority"] = priority
 
             request_json = json.dumps(request) + "\n"
             if self._sock is None:
@@ -132,10 +274,44 @@ class NativeBridge:
 
             if not response.get("success", False):
                 error = response.get("error", "Unknown error")
-                raise Exception(f"Native call failed: {error}")
+                trace = response.get("trace_id")
+                message = f"Native call failed: {error}"
+                if trace:
+                    message = f"Native call failed [trace={trace}]: {error}"
+                raise NativeError(
+                    message,
+                    code=response.get("error_code", "SERVER_ERROR"),
+                    details=response.get("error_details"),
+                    trace_id=trace,
+                )
 
             return response.get("data", {})
 
+    async def batch(
+        self,
+        requests: List[Dict[str, Any]],
+        parallel: bool = False,
+        trace_id: Optional[str] = None,
+    ) -> List[Dict[str, Any]]:
+        """Run several native calls in one round trip.
+
+        Args:
+            requests: Requests, each with "module", "action" and "params"
+            parallel: Run the requests concurrently instead of in order
+            trace_id: Optional ID applied to requests that carry none
+
+        Returns:
+            One response per request, in order. Each has "success" and
+            either "data" or "error"; a failed request does not raise.
+        """
+        data = await self.call(
+            "",
+            "batch",
+            {"requests": requests, "parallel": parallel},
+            trace_id=trace_id,
+        )
+        return data.get("responses", [])
+
     async def stop(self) -> None:
         """Stop the native process and clean up."""
         if self._sock:
@@ -147,7 +323,7 @@ class NativeBridge:
 
         self._kill_process()
 
-        if os.path.exists(self.socket_path):
+        if not self.socket_path.startswith("@") and os.path.exists(self.socket_path):
             try:
                 os.unlink(self.socket_path)
             except Exception:
@@ -0,0 +1,1315 @@
+# Code generated by native/go/cmd/pygen; DO NOT EDIT.
+"""Typed client for the native actions, generated from the Go handlers.
+
+Regenerate with `go generate` in native/go after changing an action's
+params. Optional params left as None are omitted, so the server applies
+its default.
+"""
+
+from typing import Any, Dict, List, Optional
+
+from src.native_bridge import NativeBridge
+
+# What each NativeError.code means
+ERROR_CODES: Dict[str, str] = {
+    "AUTH_ACCOUNT_LOCKED": "The account is disabled, suspended or locked",
+    "AUTH_FAILED": "Credentials rejected; see error_details",
+    "AUTH_NEEDS_APP_PASSWORD": "The provider refuses account passwords; use an app password",
+    "AUTH_NEEDS_OAUTH": "The provider only accepts OAuth2 logins",
+    "AUTH_TEMPORARY": "A server-side problem with the login, safe to retry later",
+    "AUTH_THROTTLED": "Too many login attempts; retrying now prolongs the lock",
+    "AUTH_WEB_LOGIN_REQUIRED": "The provider wants an interactive sign-in in a browser first",
+    "BUSY": "Client over its rate or in-flight limit; retry after error_details.retry_after_ms",
+    "CANCELLED": "Cancelled by the client",
+    "IDENTITY_MISMATCH": "The From address is not one the account may send as",
+    "INVALID_HANDLE": "No connection has this handle",
+    "INVALID_REQUEST": "Malformed params or unknown action",
+    "NETWORK": "Connection refused, reset or lost",
+    "NOT_CONNECTED": "The handle's connection is closed",
+    "READ_ONLY": "Mutating action refused in read-only mode",
+    "REQUEST_TOO_LARGE": "Request exceeds the server's size limit",
+    "SERVER_ERROR": "Anything else, usually a mail server rejection",
+    "SERVER_UNAVAILABLE": "The mail server kept failing and is not retried until it recovers",
+    "TIMEOUT": "Deadline or timeout_ms exceeded",
+    "UNAUTHENTICATED": "The client's secret or tenant token was not accepted",
+    "UNSUPPORTED_VERSION": "The client's protocol version is older than the server supports",
+}
+
+
+class ImapClient:
+    """Calls to the native imap module."""
+
+    def __init__(self, bridge: NativeBridge):
+        self._bridge = bridge
+
+    async def connect(
+        self,
+        *,
+        host: str,
+        port: int,
+        access_token: Optional[str] = None,
+        auth_type: Optional[str] = None,
+        compress: Optional[bool] = None,
+        password: Optional[str] = None,
+        username: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.connect."""
+        params: Dict[str, Any] = {
+            "host": host,
+            "port": port,
+        }
+        if access_token is not None:
+            params["access_token"] = access_token
+        if auth_type is not None:
+            params["auth_type"] = auth_type
+        if compress is not None:
+            params["compress"] = compress
+        if password is not None:
+            params["password"] = password
+        if username is not None:
+            params["username"] = username
+        return await self._bridge.call("imap", "connect", params)
+
+    async def close(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.close."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "close", params)
+
+    async def select_folder(
+        self,
+        *,
+        folder: str,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.select_folder."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "select_folder", params)
+
+    async def search_uids(
+        self,
+        *,
+        handle: int,
+        cursor: Optional[str] = None,
+        highest_uid: Optional[int] = None,
+        page_size: Optional[int] = None,
+        return_: Optional[List[str]] = None,
+        unseen: Optional[bool] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.search_uids."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if cursor is not None:
+            params["cursor"] = cursor
+        if highest_uid is not None:
+            params["highest_uid"] = highest_uid
+        if page_size is not None:
+            params["page_size"] = page_size
+        if return_ is not None:
+            params["return"] = return_
+        if unseen is not None:
+            params["unseen"] = unseen
+        return await self._bridge.call("imap", "search_uids", params)
+
+    async def sort_uids(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        cursor: Optional[str] = None,
+        page_size: Optional[int] = None,
+        reverse: Optional[bool] = None,
+        sort: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.sort_uids."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        if cursor is not None:
+            params["cursor"] = cursor
+        if page_size is not None:
+            params["page_size"] = page_size
+        if reverse is not None:
+            params["reverse"] = reverse
+        if sort is not None:
+            params["sort"] = sort
+        return await self._bridge.call("imap", "sort_uids", params)
+
+    async def fetch_messages(
+        self,
+        *,
+        handle: int,
+        peek: Optional[bool] = None,
+        uids: Optional[List[int]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_messages."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if peek is not None:
+            params["peek"] = peek
+        if uids is not None:
+            params["uids"] = uids
+        return await self._bridge.call("imap", "fetch_messages", params)
+
+    async def set_flags(
+        self,
+        *,
+        handle: int,
+        uid: int,
+        add: Optional[bool] = None,
+        flags: Optional[List[str]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.set_flags."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+            "uid": uid,
+        }
+        if add is not None:
+            params["add"] = add
+        if flags is not None:
+            params["flags"] = flags
+        return await self._bridge.call("imap", "set_flags", params)
+
+    async def copy_message(
+        self,
+        *,
+        dest_folder: str,
+        handle: int,
+        uid: int,
+    ) -> Dict[str, Any]:
+        """Call imap.copy_message."""
+        params: Dict[str, Any] = {
+            "dest_folder": dest_folder,
+            "handle": handle,
+            "uid": uid,
+        }
+        return await self._bridge.call("imap", "copy_message", params)
+
+    async def append_message(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        message_b64: str,
+        flags: Optional[List[str]] = None,
+        internal_date: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.append_message."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "message_b64": message_b64,
+        }
+        if flags is not None:
+            params["flags"] = flags
+        if internal_date is not None:
+            params["internal_date"] = internal_date
+        return await self._bridge.call("imap", "append_message", params)
+
+    async def append_messages(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        messages: List[Dict[str, Any]],
+    ) -> Dict[str, Any]:
+        """Call imap.append_messages."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "messages": messages,
+        }
+        return await self._bridge.call("imap", "append_messages", params)
+
+    async def expunge(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.expunge."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "expunge", params)
+
+    async def noop(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.noop."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "noop", params)
+
+    async def capabilities(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.capabilities."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "capabilities", params)
+
+    async def stats(
+        self,
+        *,
+        handle: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.stats."""
+        params: Dict[str, Any] = {}
+        if handle is not None:
+            params["handle"] = handle
+        return await self._bridge.call("imap", "stats", params)
+
+    async def watch_folders(
+        self,
+        *,
+        handle: int,
+        folders: Optional[List[str]] = None,
+        interval_seconds: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.watch_folders."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folders is not None:
+            params["folders"] = folders
+        if interval_seconds is not None:
+            params["interval_seconds"] = interval_seconds
+        return await self._bridge.call("imap", "watch_folders", params)
+
+    async def badge_register(
+        self,
+        *,
+        handle: int,
+        interval_seconds: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.badge_register."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if interval_seconds is not None:
+            params["interval_seconds"] = interval_seconds
+        return await self._bridge.call("imap", "badge_register", params)
+
+    async def badge_unregister(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.badge_unregister."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "badge_unregister", params)
+
+    async def badge_counts(self) -> Dict[str, Any]:
+        """Call imap.badge_counts."""
+        params: Dict[str, Any] = {}
+        return await self._bridge.call("imap", "badge_counts", params)
+
+    async def conversation_action(
+        self,
+        *,
+        handle: int,
+        thread_id: str,
+        dest_folder: Optional[str] = None,
+        folders: Optional[List[str]] = None,
+        operation: Optional[str] = None,
+        permanent: Optional[bool] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.conversation_action."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+            "thread_id": thread_id,
+        }
+        if dest_folder is not None:
+            params["dest_folder"] = dest_folder
+        if folders is not None:
+            params["folders"] = folders
+        if operation is not None:
+            params["operation"] = operation
+        if permanent is not None:
+            params["permanent"] = permanent
+        return await self._bridge.call("imap", "conversation_action", params)
+
+    async def add_label(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        label: str,
+        uids: List[int],
+    ) -> Dict[str, Any]:
+        """Call imap.add_label."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "label": label,
+            "uids": uids,
+        }
+        return await self._bridge.call("imap", "add_label", params)
+
+    async def remove_label(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        label: str,
+        uids: List[int],
+    ) -> Dict[str, Any]:
+        """Call imap.remove_label."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "label": label,
+            "uids": uids,
+        }
+        return await self._bridge.call("imap", "remove_label", params)
+
+    async def search_by_label(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        label: str,
+    ) -> Dict[str, Any]:
+        """Call imap.search_by_label."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "label": label,
+        }
+        return await self._bridge.call("imap", "search_by_label", params)
+
+    async def set_color(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uids: List[int],
+        color: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.set_color."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uids": uids,
+        }
+        if color is not None:
+            params["color"] = color
+        return await self._bridge.call("imap", "set_color", params)
+
+    async def message_markers(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uids: List[int],
+    ) -> Dict[str, Any]:
+        """Call imap.message_markers."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uids": uids,
+        }
+        return await self._bridge.call("imap", "message_markers", params)
+
+    async def replay_journal(
+        self,
+        *,
+        handle: int,
+        entries: Optional[List[Dict[str, Any]]] = None,
+        policy: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.replay_journal."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if entries is not None:
+            params["entries"] = entries
+        if policy is not None:
+            params["policy"] = policy
+        return await self._bridge.call("imap", "replay_journal", params)
+
+    async def recover_folder(
+        self,
+        *,
+        handle: int,
+        cached: Optional[List[Dict[str, Any]]] = None,
+        folder: Optional[str] = None,
+        uid_validity: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.recover_folder."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if cached is not None:
+            params["cached"] = cached
+        if folder is not None:
+            params["folder"] = folder
+        if uid_validity is not None:
+            params["uid_validity"] = uid_validity
+        return await self._bridge.call("imap", "recover_folder", params)
+
+    async def transfer_message(
+        self,
+        *,
+        dest_folder: Optional[str] = None,
+        dest_handle: Optional[int] = None,
+        move: Optional[bool] = None,
+        source_folder: Optional[str] = None,
+        source_handle: Optional[int] = None,
+        uid: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.transfer_message."""
+        params: Dict[str, Any] = {}
+        if dest_folder is not None:
+            params["dest_folder"] = dest_folder
+        if dest_handle is not None:
+            params["dest_handle"] = dest_handle
+        if move is not None:
+            params["move"] = move
+        if source_folder is not None:
+            params["source_folder"] = source_folder
+        if source_handle is not None:
+            params["source_handle"] = source_handle
+        if uid is not None:
+            params["uid"] = uid
+        return await self._bridge.call("imap", "transfer_message", params)
+
+    async def migrate_account(
+        self,
+        *,
+        dest_handle: Optional[int] = None,
+        id: Optional[str] = None,
+        source_handle: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.migrate_account."""
+        params: Dict[str, Any] = {}
+        if dest_handle is not None:
+            params["dest_handle"] = dest_handle
+        if id is not None:
+            params["id"] = id
+        if source_handle is not None:
+            params["source_handle"] = source_handle
+        return await self._bridge.call("imap", "migrate_account", params)
+
+    async def migration_status(
+        self,
+        *,
+        id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.migration_status."""
+        params: Dict[str, Any] = {}
+        if id is not None:
+            params["id"] = id
+        return await self._bridge.call("imap", "migration_status", params)
+
+    async def list_folders(
+        self,
+        *,
+        handle: int,
+        cursor: Optional[str] = None,
+        page_size: Optional[int] = None,
+        subscribed: Optional[bool] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.list_folders."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if cursor is not None:
+            params["cursor"] = cursor
+        if page_size is not None:
+            params["page_size"] = page_size
+        if subscribed is not None:
+            params["subscribed"] = subscribed
+        return await self._bridge.call("imap", "list_folders", params)
+
+    async def create_folder(
+        self,
+        *,
+        folder: str,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.create_folder."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "create_folder", params)
+
+    async def delete_folder(
+        self,
+        *,
+        folder: str,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.delete_folder."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "delete_folder", params)
+
+    async def rename_folder(
+        self,
+        *,
+        from_: str,
+        handle: int,
+        to: str,
+    ) -> Dict[str, Any]:
+        """Call imap.rename_folder."""
+        params: Dict[str, Any] = {
+            "from": from_,
+            "handle": handle,
+            "to": to,
+        }
+        return await self._bridge.call("imap", "rename_folder", params)
+
+    async def subscribe_folder(
+        self,
+        *,
+        folder: str,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.subscribe_folder."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "subscribe_folder", params)
+
+    async def unsubscribe_folder(
+        self,
+        *,
+        folder: str,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.unsubscribe_folder."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "unsubscribe_folder", params)
+
+    async def folder_roles(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.folder_roles."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "folder_roles", params)
+
+    async def folder_status(
+        self,
+        *,
+        folders: List[str],
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call imap.folder_status."""
+        params: Dict[str, Any] = {
+            "folders": folders,
+            "handle": handle,
+        }
+        return await self._bridge.call("imap", "folder_status", params)
+
+    async def object_ids(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+        uids: Optional[List[int]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.object_ids."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        if uids is not None:
+            params["uids"] = uids
+        return await self._bridge.call("imap", "object_ids", params)
+
+    async def fetch_metadata(
+        self,
+        *,
+        handle: int,
+        dates: Optional[bool] = None,
+        folder: Optional[str] = None,
+        keep_duplicates: Optional[bool] = None,
+        lists: Optional[str] = None,
+        priority_first: Optional[bool] = None,
+        uids: Optional[List[int]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_metadata."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if dates is not None:
+            params["dates"] = dates
+        if folder is not None:
+            params["folder"] = folder
+        if keep_duplicates is not None:
+            params["keep_duplicates"] = keep_duplicates
+        if lists is not None:
+            params["lists"] = lists
+        if priority_first is not None:
+            params["priority_first"] = priority_first
+        if uids is not None:
+            params["uids"] = uids
+        return await self._bridge.call("imap", "fetch_metadata", params)
+
+    async def fetch_envelopes(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uids: List[int],
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_envelopes."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uids": uids,
+        }
+        return await self._bridge.call("imap", "fetch_envelopes", params)
+
+    async def fetch_bodystructure(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uids: List[int],
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_bodystructure."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uids": uids,
+        }
+        return await self._bridge.call("imap", "fetch_bodystructure", params)
+
+    async def fetch_part(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        part: str,
+        uid: int,
+        decode: Optional[bool] = None,
+        length: Optional[int] = None,
+        offset: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_part."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "part": part,
+            "uid": uid,
+        }
+        if decode is not None:
+            params["decode"] = decode
+        if length is not None:
+            params["length"] = length
+        if offset is not None:
+            params["offset"] = offset
+        return await self._bridge.call("imap", "fetch_part", params)
+
+    async def fetch_headers(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uids: List[int],
+        fields: Optional[List[str]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.fetch_headers."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uids": uids,
+        }
+        if fields is not None:
+            params["fields"] = fields
+        return await self._bridge.call("imap", "fetch_headers", params)
+
+    async def warm_up(
+        self,
+        *,
+        accounts: Optional[List[Dict[str, Any]]] = None,
+        deadline_ms: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.warm_up."""
+        params: Dict[str, Any] = {}
+        if accounts is not None:
+            params["accounts"] = accounts
+        if deadline_ms is not None:
+            params["deadline_ms"] = deadline_ms
+        return await self._bridge.call("imap", "warm_up", params)
+
+    async def raw_command(
+        self,
+        *,
+        handle: int,
+        command: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.raw_command."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if command is not None:
+            params["command"] = command
+        return await self._bridge.call("imap", "raw_command", params)
+
+    async def verify_cache(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+        messages: Optional[List[Dict[str, Any]]] = None,
+        min_uid: Optional[int] = None,
+        uid_validity: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.verify_cache."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        if messages is not None:
+            params["messages"] = messages
+        if min_uid is not None:
+            params["min_uid"] = min_uid
+        if uid_validity is not None:
+            params["uid_validity"] = uid_validity
+        return await self._bridge.call("imap", "verify_cache", params)
+
+    async def mailing_lists(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+        list: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.mailing_lists."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        if list is not None:
+            params["list"] = list
+        return await self._bridge.call("imap", "mailing_lists", params)
+
+    async def find_messages_with_attachments(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+        limit: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.find_messages_with_attachments."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        if limit is not None:
+            params["limit"] = limit
+        return await self._bridge.call("imap", "find_messages_with_attachments", params)
+
+    async def find_messages_larger_than(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+        limit: Optional[int] = None,
+        size: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.find_messages_larger_than."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        if limit is not None:
+            params["limit"] = limit
+        if size is not None:
+            params["size"] = size
+        return await self._bridge.call("imap", "find_messages_larger_than", params)
+
+    async def handle_history(
+        self,
+        *,
+        handle: int,
+        limit: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.handle_history."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if limit is not None:
+            params["limit"] = limit
+        return await self._bridge.call("imap", "handle_history", params)
+
+    async def tls_info(
+        self,
+        *,
+        handle: int,
+        ocsp: Optional[bool] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.tls_info."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if ocsp is not None:
+            params["ocsp"] = ocsp
+        return await self._bridge.call("imap", "tls_info", params)
+
+    async def get_quota(
+        self,
+        *,
+        handle: int,
+        folder: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.get_quota."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if folder is not None:
+            params["folder"] = folder
+        return await self._bridge.call("imap", "get_quota", params)
+
+    async def delivery_route(
+        self,
+        *,
+        folder: str,
+        handle: int,
+        uid: int,
+    ) -> Dict[str, Any]:
+        """Call imap.delivery_route."""
+        params: Dict[str, Any] = {
+            "folder": folder,
+            "handle": handle,
+            "uid": uid,
+        }
+        return await self._bridge.call("imap", "delivery_route", params)
+
+    async def corpus_counts(
+        self,
+        *,
+        handle: int,
+        ham_folder: Optional[str] = None,
+        junk_folder: Optional[str] = None,
+        limit: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.corpus_counts."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if ham_folder is not None:
+            params["ham_folder"] = ham_folder
+        if junk_folder is not None:
+            params["junk_folder"] = junk_folder
+        if limit is not None:
+            params["limit"] = limit
+        return await self._bridge.call("imap", "corpus_counts", params)
+
+    async def export_corpus(
+        self,
+        *,
+        dir: str,
+        handle: int,
+        ham_folder: Optional[str] = None,
+        headers_only: Optional[bool] = None,
+        junk_folder: Optional[str] = None,
+        limit: Optional[int] = None,
+        redact: Optional[Dict[str, Any]] = None,
+    ) -> Dict[str, Any]:
+        """Call imap.export_corpus."""
+        params: Dict[str, Any] = {
+            "dir": dir,
+            "handle": handle,
+        }
+        if ham_folder is not None:
+            params["ham_folder"] = ham_folder
+        if headers_only is not None:
+            params["headers_only"] = headers_only
+        if junk_folder is not None:
+            params["junk_folder"] = junk_folder
+        if limit is not None:
+            params["limit"] = limit
+        if redact is not None:
+            params["redact"] = redact
+        return await self._bridge.call("imap", "export_corpus", params)
+
+
+class SmtpClient:
+    """Calls to the native smtp module."""
+
+    def __init__(self, bridge: NativeBridge):
+        self._bridge = bridge
+
+    async def connect(
+        self,
+        *,
+        host: str,
+        port: int,
+        max_recipients: Optional[int] = None,
+        password: Optional[str] = None,
+        username: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.connect."""
+        params: Dict[str, Any] = {
+            "host": host,
+            "port": port,
+        }
+        if max_recipients is not None:
+            params["max_recipients"] = max_recipients
+        if password is not None:
+            params["password"] = password
+        if username is not None:
+            params["username"] = username
+        return await self._bridge.call("smtp", "connect", params)
+
+    async def close(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call smtp.close."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("smtp", "close", params)
+
+    async def send(
+        self,
+        *,
+        from_: str,
+        handle: int,
+        message_b64: str,
+        to: List[str],
+        imap_handle: Optional[int] = None,
+        outbox: Optional[bool] = None,
+        priority: Optional[str] = None,
+        save_sent: Optional[bool] = None,
+        send_at: Optional[str] = None,
+        sent_folder: Optional[str] = None,
+        undo_seconds: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.send."""
+        params: Dict[str, Any] = {
+            "from": from_,
+            "handle": handle,
+            "message_b64": message_b64,
+            "to": to,
+        }
+        if imap_handle is not None:
+            params["imap_handle"] = imap_handle
+        if outbox is not None:
+            params["outbox"] = outbox
+        if priority is not None:
+            params["priority"] = priority
+        if save_sent is not None:
+            params["save_sent"] = save_sent
+        if send_at is not None:
+            params["send_at"] = send_at
+        if sent_folder is not None:
+            params["sent_folder"] = sent_folder
+        if undo_seconds is not None:
+            params["undo_seconds"] = undo_seconds
+        return await self._bridge.call("smtp", "send", params)
+
+    async def noop(
+        self,
+        *,
+        handle: int,
+    ) -> Dict[str, Any]:
+        """Call smtp.noop."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        return await self._bridge.call("smtp", "noop", params)
+
+    async def stats(
+        self,
+        *,
+        handle: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.stats."""
+        params: Dict[str, Any] = {}
+        if handle is not None:
+            params["handle"] = handle
+        return await self._bridge.call("smtp", "stats", params)
+
+    async def outbox_list(self) -> Dict[str, Any]:
+        """Call smtp.outbox_list."""
+        params: Dict[str, Any] = {}
+        return await self._bridge.call("smtp", "outbox_list", params)
+
+    async def outbox_flush(
+        self,
+        *,
+        handle: int,
+        imap_handle: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.outbox_flush."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if imap_handle is not None:
+            params["imap_handle"] = imap_handle
+        return await self._bridge.call("smtp", "outbox_flush", params)
+
+    async def outbox_get(
+        self,
+        *,
+        outbox_id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.outbox_get."""
+        params: Dict[str, Any] = {}
+        if outbox_id is not None:
+            params["outbox_id"] = outbox_id
+        return await self._bridge.call("smtp", "outbox_get", params)
+
+    async def outbox_retry(
+        self,
+        *,
+        handle: int,
+        imap_handle: Optional[int] = None,
+        outbox_id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.outbox_retry."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if imap_handle is not None:
+            params["imap_handle"] = imap_handle
+        if outbox_id is not None:
+            params["outbox_id"] = outbox_id
+        return await self._bridge.call("smtp", "outbox_retry", params)
+
+    async def outbox_resend(
+        self,
+        *,
+        handle: int,
+        from_: Optional[str] = None,
+        imap_handle: Optional[int] = None,
+        message_b64: Optional[str] = None,
+        outbox_id: Optional[str] = None,
+        to: Optional[List[str]] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.outbox_resend."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if from_ is not None:
+            params["from"] = from_
+        if imap_handle is not None:
+            params["imap_handle"] = imap_handle
+        if message_b64 is not None:
+            params["message_b64"] = message_b64
+        if outbox_id is not None:
+            params["outbox_id"] = outbox_id
+        if to is not None:
+            params["to"] = to
+        return await self._bridge.call("smtp", "outbox_resend", params)
+
+    async def outbox_abandon(
+        self,
+        *,
+        outbox_id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.outbox_abandon."""
+        params: Dict[str, Any] = {}
+        if outbox_id is not None:
+            params["outbox_id"] = outbox_id
+        return await self._bridge.call("smtp", "outbox_abandon", params)
+
+    async def cancel_send(
+        self,
+        *,
+        outbox_id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.cancel_send."""
+        params: Dict[str, Any] = {}
+        if outbox_id is not None:
+            params["outbox_id"] = outbox_id
+        return await self._bridge.call("smtp", "cancel_send", params)
+
+    async def check_attachments(
+        self,
+        *,
+        attachments: Optional[int] = None,
+        body: Optional[str] = None,
+        message_b64: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.check_attachments."""
+        params: Dict[str, Any] = {}
+        if attachments is not None:
+            params["attachments"] = attachments
+        if body is not None:
+            params["body"] = body
+        if message_b64 is not None:
+            params["message_b64"] = message_b64
+        return await self._bridge.call("smtp", "check_attachments", params)
+
+    async def set_routes(
+        self,
+        *,
+        routes: Optional[List[Dict[str, Any]]] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.set_routes."""
+        params: Dict[str, Any] = {}
+        if routes is not None:
+            params["routes"] = routes
+        return await self._bridge.call("smtp", "set_routes", params)
+
+    async def list_routes(self) -> Dict[str, Any]:
+        """Call smtp.list_routes."""
+        params: Dict[str, Any] = {}
+        return await self._bridge.call("smtp", "list_routes", params)
+
+    async def list_identities(
+        self,
+        *,
+        handle: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.list_identities."""
+        params: Dict[str, Any] = {}
+        if handle is not None:
+            params["handle"] = handle
+        return await self._bridge.call("smtp", "list_identities", params)
+
+    async def set_identity(
+        self,
+        *,
+        account: Optional[str] = None,
+        address: Optional[str] = None,
+        display_name: Optional[str] = None,
+        id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        signature: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.set_identity."""
+        params: Dict[str, Any] = {}
+        if account is not None:
+            params["account"] = account
+        if address is not None:
+            params["address"] = address
+        if display_name is not None:
+            params["display_name"] = display_name
+        if id is not None:
+            params["id"] = id
+        if reply_to is not None:
+            params["reply_to"] = reply_to
+        if signature is not None:
+            params["signature"] = signature
+        return await self._bridge.call("smtp", "set_identity", params)
+
+    async def remove_identity(
+        self,
+        *,
+        id: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.remove_identity."""
+        params: Dict[str, Any] = {}
+        if id is not None:
+            params["id"] = id
+        return await self._bridge.call("smtp", "remove_identity", params)
+
+    async def generate_alias(
+        self,
+        *,
+        address: Optional[str] = None,
+        domain: Optional[str] = None,
+        kind: Optional[str] = None,
+        note: Optional[str] = None,
+        tag: Optional[str] = None,
+        token: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.generate_alias."""
+        params: Dict[str, Any] = {}
+        if address is not None:
+            params["address"] = address
+        if domain is not None:
+            params["domain"] = domain
+        if kind is not None:
+            params["kind"] = kind
+        if note is not None:
+            params["note"] = note
+        if tag is not None:
+            params["tag"] = tag
+        if token is not None:
+            params["token"] = token
+        return await self._bridge.call("smtp", "generate_alias", params)
+
+    async def raw_smtp(
+        self,
+        *,
+        handle: int,
+        commands: Optional[List[str]] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.raw_smtp."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if commands is not None:
+            params["commands"] = commands
+        return await self._bridge.call("smtp", "raw_smtp", params)
+
+    async def handle_history(
+        self,
+        *,
+        handle: int,
+        limit: Optional[int] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.handle_history."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if limit is not None:
+            params["limit"] = limit
+        return await self._bridge.call("smtp", "handle_history", params)
+
+    async def tls_info(
+        self,
+        *,
+        handle: int,
+        ocsp: Optional[bool] = None,
+    ) -> Dict[str, Any]:
+        """Call smtp.tls_info."""
+        params: Dict[str, Any] = {
+            "handle": handle,
+        }
+        if ocsp is not None:
+            params["ocsp"] = ocsp
+        return await self._bridge.call("smtp", "tls_info", params)
+
+
+class NativeClient:
+    """Typed calls to every native module."""
+
+    def __init__(self, bridge: NativeBridge):
+        self.imap = ImapClient(bridge)
+        self.smtp = SmtpClient(bridge)
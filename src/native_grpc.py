@@ -0,0 +1,215 @@
+"""gRPC client stubs for the native backend.
+
+Mirrors native/go/internal/rpc/native.proto. The messages are small, so they
+are encoded by hand rather than generated, which keeps protoc out of the
+build; only the ``grpcio`` runtime is needed.
+"""
+
+import json
+from dataclasses import dataclass, field
+from typing import Any, AsyncIterator, Dict, List, Optional
+
+SERVICE = "/kernel.native.Native"
+
+
+def _varint(value: int) -> bytes:
+    value &= (1 << 64) - 1
+    out = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(byte | 0x80)
+        else:
+            out.append(byte)
+            return bytes(out)
+
+
+def _field(number: int, value: Any) -> bytes:
+    """Encode one field, omitting proto3 zero values."""
+    if isinstance(value, bool) or isinstance(value, int):
+        if not value:
+            return b""
+        return _varint(number << 3) + _varint(int(value))
+    if isinstance(value, str):
+        value = value.encode("utf-8")
+    if not value:
+        return b""
+    return _varint(number << 3 | 2) + _varint(len(value)) + value
+
+
+def _fields(data: bytes) -> Dict[int, List[Any]]:
+    """Decode a message into field number -> values."""
+    result: Dict[int, List[Any]] = {}
+    pos = 0
+
+    def read_varint() -> int:
+        nonlocal pos
+        shift = value = 0
+        while True:
+            byte = data[pos]
+            pos += 1
+            value |= (byte & 0x7F) << shift
+            if not byte & 0x80:
+                return value
+            shift += 7
+
+    while pos < len(data):
+        tag = read_varint()
+        number, wire_type = tag >> 3, tag & 7
+        if wire_type == 0:
+            value: Any = read_varint()
+        elif wire_type == 2:
+            length = read_varint()
+            value = data[pos : pos + length]
+            pos += length
+        elif wire_type == 1:
+            value, pos = None, pos + 8
+        elif wire_type == 5:
+            value, pos = None, pos + 4
+        else:
+            raise ValueError(f"unsupported wire type {wire_type}")
+        result.setdefault(number, []).append(value)
+    return result
+
+
+def _one(fields: Dict[int, List[Any]], number: int, default: Any) -> Any:
+    values = fields.get(number)
+    return values[-1] if values else default
+
+
+def _json(raw: bytes) -> Any:
+    return json.loads(raw) if raw else None
+
+
+@dataclass
+class Request:
+    module: str
+    action: str
+    params: Dict[str, Any] = field(default_factory=dict)
+    id: str = ""
+    trace_id: str = ""
+    timeout_ms: int = 0
+    priority: str = ""  # "interactive" (default) or "bulk"
+
+    def encode(self) -> bytes:
+        return b"".join(
+            [
+                _field(1, self.id),
+                _field(2, self.module),
+                _field(3, self.action),
+                _field(4, json.dumps(self.params, separators=(",", ":"))),
+                _field(5, self.trace_id),
+                _field(6, self.timeout_ms),
+                _field(7, self.priority),
+            ]
+        )
+
+    @classmethod
+    def decode(cls, raw: bytes) -> "Request":
+        f = _fields(raw)
+        return cls(
+            id=_one(f, 1, b"").decode(),
+            module=_one(f, 2, b"").decode(),
+            action=_one(f, 3, b"").decode(),
+            params=_json(_one(f, 4, b"")) or {},
+            trace_id=_one(f, 5, b"").decode(),
+            timeout_ms=_one(f, 6, 0),
+            priority=_one(f, 7, b"").decode(),
+        )
+
+
+@dataclass
+class Response:
+    id: str = ""
+    success: bool = False
+    data: Any = None
+    error: str = ""
+    error_code: str = ""
+    error_details: Any = None
+    trace_id: str = ""
+    partial: bool = False
+
+    @classmethod
+    def decode(cls, raw: bytes) -> "Response":
+        f = _fields(raw)
+        return cls(
+            id=_one(f, 1, b"").decode(),
+            success=bool(_one(f, 2, 0)),
+            data=_json(_one(f, 3, b"")),
+            error=_one(f, 4, b"").decode(),
+            error_code=_one(f, 5, b"").decode(),
+            error_details=_json(_one(f, 6, b"")),
+            trace_id=_one(f, 7, b"").decode(),
+            partial=bool(_one(f, 8, 0)),
+        )
+
+
+@dataclass
+class Subscription:
+    types: List[str] = field(default_factory=list)
+
+    def encode(self) -> bytes:
+        return b"".join(_field(1, t) for t in self.types)
+
+
+@dataclass
+class Event:
+    event: str = ""
+    module: str = ""
+    handle: int = 0
+    data: Any = None
+    time_unix_ms: int = 0
+    trace_id: str = ""
+
+    @classmethod
+    def decode(cls, raw: bytes) -> "Event":
+        f = _fields(raw)
+        return cls(
+            event=_one(f, 1, b"").decode(),
+            module=_one(f, 2, b"").decode(),
+            handle=_one(f, 3, 0),
+            data=_json(_one(f, 4, b"")),
+            time_unix_ms=_one(f, 5, 0),
+            trace_id=_one(f, 6, b"").decode(),
+        )
+
+
+class NativeStub:
+    """Async client for the Native gRPC service."""
+
+    def __init__(self, channel: Any, secret: Optional[str] = None):
+        """Initialise the stub.
+
+        Args:
+            channel: A ``grpc.aio`` channel
+            secret: The server's NATIVE_TCP_SECRET
+        """
+        self._metadata = (("x-native-secret", secret),) if secret else None
+        self._call = channel.unary_unary(
+            f"{SERVICE}/Call",
+            request_serializer=Request.encode,
+            response_deserializer=Response.decode,
+        )
+        self._call_stream = channel.unary_stream(
+            f"{SERVICE}/CallStream",
+            request_serializer=Request.encode,
+            response_deserializer=Response.decode,
+        )
+        self._events = channel.unary_stream(
+            f"{SERVICE}/Events",
+            request_serializer=Subscription.encode,
+            response_deserializer=Event.decode,
+        )
+
+    async def call(self, request: Request) -> Response:
+        """Run one action."""
+        return await self._call(request, metadata=self._metadata)
+
+    def call_stream(self, request: Request) -> AsyncIterator[Response]:
+        """Run a streaming action, yielding partial responses then the final one."""
+        return self._call_stream(request, metadata=self._metadata)
+
+    def events(self, *types: str) -> AsyncIterator[Event]:
+        """Subscribe to events whose type starts with one of the prefixes."""
+        return self._events(Subscription(list(types)), metadata=self._metadata)
@@ -1,9 +1,23 @@
-"""Test native IMAP/SMTP backend."""
+"""
+Tests for the native IMAP/SMTP backend and its socket bridge
+
+Tests cover:
+- Requests written to the socket, optional fields included
+- Responses read back, however they are split
+- Errors raised with their code, details and trace ID
+- Batches and capability checks
+"""
 
 import asyncio
+import json
+import socket
+import threading
+
+import pytest
 
 from src.core.email.imap.connection import IMAPConnection
 from src.core.email.imap.protocol import IMAPProtocol
+from src.native_bridge import NativeBridge, NativeError
 from src.utils.config import ConfigManager
 
 
@@ -30,5 +44,225 @@ async def test_imap():
         pass
 
 
+class FakeNative:
+    """The native end of a socket pair, answering each request with a
+    scripted reply and recording what it was sent"""
+
+    def __init__(self, replies):
+        self.requests = []
+        self._replies = list(replies)
+        self._sock, self.client = socket.socketpair()
+        self._thread = threading.Thread(target=self._serve, daemon=True)
+        self._thread.start()
+
+    def _serve(self):
+        reader = self._sock.makefile("rb")
+        for reply in self._replies:
+            line = reader.readline()
+            if not line:
+                break
+            self.requests.append(json.loads(line))
+            if reply is None:
+                break
+            # Each reply is a list of chunks, sent separately
+            for chunk in reply:
+                self._sock.sendall(chunk)
+        reader.close()
+        self._sock.close()
+
+    def join(self):
+        self._thread.join(timeout=5)
+
+
+def reply(response):
+    """Encode a response as one line, in one chunk"""
+    return [json.dumps(response).encode() + b"\n"]
+
+
+def fake_bridge(*replies):
+    """A bridge already connected to a fake native process"""
+    native = FakeNative(replies)
+    bridge = NativeBridge(socket_path="@test")
+    bridge._sock = native.client
+    bridge._connected = True
+    return bridge, native
+
+
+class TestCall:
+    """Tests for calls over the socket"""
+
+    @pytest.mark.asyncio
+    async def test_returns_data(self):
+        """Test that a call sends one JSON line and returns the data"""
+        bridge, native = fake_bridge(reply({"success": True, "data": {"uids": [6]}}))
+
+        data = await bridge.call("imap", "search_uids", {"handle": 1})
+        native.join()
+
+        assert data == {"uids": [6]}
+        assert native.requests == [
+            {"module": "imap", "action": "search_uids", "params": {"handle": 1}}
+        ]
+
+    @pytest.mark.asyncio
+    async def test_sends_trace_id(self):
+        """Test that a trace ID goes with the request"""
+        bridge, native = fake_bridge(reply({"success": True}))
+
+        await bridge.call("smtp", "send", {"handle": 2}, trace_id="t1")
+        native.join()
+
+        assert native.requests[0]["trace_id"] == "t1"
+
+    @pytest.mark.asyncio
+    async def test_sends_idempotency_key(self):
+        """Test that an idempotency key goes with the request"""
+        bridge, native = fake_bridge(reply({"success": True}))
+
+        await bridge.call("smtp", "send", {"handle": 2}, idempotency_key="k1")
+        native.join()
+
+        assert native.requests[0]["idempotency_key"] == "k1"
+
+    @pytest.mark.asyncio
+    async def test_sends_priority(self):
+        """Test that a priority goes with the request"""
+        bridge, native = fake_bridge(reply({"success": True}))
+
+        await bridge.call("smtp", "send", {"handle": 2}, priority="bulk")
+        native.join()
+
+        assert native.requests[0]["priority"] == "bulk"
+
+    @pytest.mark.asyncio
+    async def test_missing_data_is_empty(self):
+        """Test that a success without data returns an empty dict"""
+        bridge, native = fake_bridge(reply({"success": True}))
+
+        assert await bridge.call("imap", "noop", {"handle": 1}) == {}
+        native.join()
+
+    @pytest.mark.asyncio
+    async def test_split_response(self):
+        """Test that a response arriving in pieces is put back together"""
+        line = json.dumps({"success": True, "data": {"ok": True}}).encode() + b"\n"
+        bridge, native = fake_bridge([line[:5], line[5:12], line[12:]])
+
+        assert await bridge.call("imap", "noop", {"handle": 1}) == {"ok": True}
+        native.join()
+
+    @pytest.mark.asyncio
+    async def test_calls_in_turn(self):
+        """Test that concurrent calls each get their own response"""
+        bridge, native = fake_bridge(
+            reply({"success": True, "data": {"n": 1}}),
+            reply({"success": True, "data": {"n": 2}}),
+        )
+
+        first, second = await asyncio.gather(
+            bridge.call("imap", "noop", {"handle": 1}),
+            bridge.call("imap", "noop", {"handle": 2}),
+        )
+        native.join()
+
+        assert [first["n"], second["n"]] == [1, 2]
+        assert [r["params"]["handle"] for r in native.requests] == [1, 2]
+
+    @pytest.mark.asyncio
+    async def test_closed_socket(self):
+        """Test that the native process going away raises ConnectionError"""
+        bridge, native = fake_bridge(None)
+
+        with pytest.raises(ConnectionError):
+            await bridge.call("imap", "noop", {"handle": 1})
+        native.join()
+
+
+class TestErrors:
+    """Tests for failed calls"""
+
+    @pytest.mark.asyncio
+    async def test_raises_native_error(self):
+        """Test that a failure raises with its code, details and trace ID"""
+        bridge, native = fake_bridge(
+            reply(
+                {
+                    "success": False,
+                    "error": "too many requests",
+                    "error_code": "BUSY",
+                    "error_details": {"retry_after_ms": 250},
+                    "trace_id": "t1",
+                }
+            )
+        )
+
+        with pytest.raises(NativeError) as excinfo:
+            await bridge.call("imap", "noop", {"handle": 1})
+        native.join()
+
+        error = excinfo.value
+        assert error.code == "BUSY"
+        assert error.details == {"retry_after_ms": 250}
+        assert error.trace_id == "t1"
+        assert "[trace=t1]" in str(error)
+        assert "too many requests" in str(error)
+
+    @pytest.mark.asyncio
+    async def test_defaults(self):
+        """Test that a bare failure is a SERVER_ERROR without details"""
+        bridge, native = fake_bridge(reply({"success": False}))
+
+        with pytest.raises(NativeError) as excinfo:
+            await bridge.call("imap", "noop", {"handle": 1})
+        native.join()
+
+        error = excinfo.value
+        assert error.code == "SERVER_ERROR"
+        assert error.details == {}
+        assert error.trace_id is None
+        assert "Unknown error" in str(error)
+
+
+class TestBridge:
+    """Tests for the bridge's other calls and helpers"""
+
+    @pytest.mark.asyncio
+    async def test_batch(self):
+        """Test that a batch is one session call returning every response"""
+        responses = [{"success": True, "data": {}}, {"success": False, "error": "no"}]
+        bridge, native = fake_bridge(
+            reply({"success": True, "data": {"responses": responses}})
+        )
+
+        requests = [
+            {"module": "imap", "action": "noop", "params": {"handle": 1}},
+            {"module": "imap", "action": "noop", "params": {"handle": 9}},
+        ]
+        result = await bridge.batch(requests, parallel=True, trace_id="t1")
+        native.join()
+
+        assert result == responses
+        assert native.requests[0] == {
+            "module": "",
+            "action": "batch",
+            "params": {"requests": requests, "parallel": True},
+            "trace_id": "t1",
+        }
+
+    def test_supports(self):
+        """Test that support comes from the actions hello advertised"""
+        bridge = NativeBridge(socket_path="@test")
+        bridge.server_info = {"modules": {"imap": ["connect", "noop"]}}
+
+        assert bridge.supports("imap", "noop")
+        assert not bridge.supports("imap", "sort_uids")
+        assert not bridge.supports("smtp", "send")
+
+    def test_socket_address(self):
+        """Test that abstract socket names get their leading NUL byte"""
+        assert NativeBridge(socket_path="@kernel-1")._socket_address() == "\0kernel-1"
+        assert NativeBridge(socket_path="/tmp/k.sock")._socket_address() == "/tmp/k.sock"
+
+
 if __name__ == "__main__":
     asyncio.run(test_imap())